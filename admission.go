@@ -0,0 +1,122 @@
+package beehive
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// ErrOverloaded is returned when a message is emitted on a hive whose bees have
+// more queued messages than HiveConfig.MaxInflight.
+var ErrOverloaded = errors.New("hive is overloaded")
+
+// overloadedNack is the NACK returned to other hives for the messages rejected
+// because the hive is overloaded. Unlike other NACKs, the messages are retried
+// by the sender after overloadRetry.
+const overloadedNack = nackPrefix + "hive is overloaded"
+
+// overloadRetry is the delay before resending messages rejected by an
+// overloaded hive.
+const overloadRetry = 100 * time.Millisecond
+
+// isOverloaded returns whether err is the NACK of an overloaded hive.
+func isOverloaded(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), overloadedNack)
+}
+
+// overloaded returns whether the bees of the hive have more queued messages
+// than the hive's MaxInflight.
+func (h *hive) overloaded() bool {
+	max := h.cfg().MaxInflight
+	return max != 0 && uint64(atomic.LoadInt64(&h.inflight)) > max
+}
+
+// addInflight adds d to the number of messages queued on the bees of the hive.
+func (h *hive) addInflight(d int) {
+	atomic.AddInt64(&h.inflight, int64(d))
+}
+
+// enqueued counts n messages queued on the bee as inflight messages of the
+// hive, unless the bee is stopped.
+func (b *bee) enqueued(n int) {
+	b.queuedM.Lock()
+	defer b.queuedM.Unlock()
+	if b.drained {
+		return
+	}
+	b.queued += n
+	b.hive.addInflight(n)
+}
+
+// dequeued uncounts n messages dequeued by the bee.
+func (b *bee) dequeued(n int) {
+	b.queuedM.Lock()
+	defer b.queuedM.Unlock()
+	if n > b.queued {
+		n = b.queued
+	}
+	b.queued -= n
+	b.hive.addInflight(-n)
+}
+
+// drainQueued uncounts the messages left in the queue of a stopped bee, and
+// the messages queued on the bee until it is started again.
+func (b *bee) drainQueued() {
+	b.queuedM.Lock()
+	defer b.queuedM.Unlock()
+	b.hive.addInflight(-b.queued)
+	b.queued = 0
+	b.drained = true
+}
+
+// countQueued counts the messages queued on a restarted bee again.
+func (b *bee) countQueued() {
+	b.queuedM.Lock()
+	defer b.queuedM.Unlock()
+	b.drained = false
+}
+
+// deferOverloaded emits msgs after overloadRetry, since they are emitted by the
+// bee while the hive is overloaded. Best-effort messages are dropped. emitted,
+// if not nil, is called once the rest are emitted.
+func (b *bee) deferOverloaded(msgs []*msg, emitted func()) {
+	var retry []*msg
+	for _, m := range msgs {
+		if m.MsgBestEffort {
+			b.hive.countBestEffortDrop()
+			m.receipt.report(Dropped, b.ID(), nil)
+			continue
+		}
+		retry = append(retry, m)
+	}
+	if len(retry) == 0 {
+		if emitted != nil {
+			emitted()
+		}
+		return
+	}
+
+	glog.V(2).Infof("%v defers %v messages: hive is overloaded", b, len(retry))
+	go func() {
+		<-b.hive.config.Clock.After(overloadRetry)
+		b.doEmitThen(retry, emitted)
+	}()
+}
+
+// retryOverloaded resends the messages rejected by an overloaded hive after
+// overloadRetry. Best-effort messages are dropped.
+func (b *bee) retryOverloaded(mhs []msgAndHandler) {
+	glog.Warningf("%v backs off for %v: destination is overloaded", b,
+		overloadRetry)
+	for _, mh := range mhs {
+		if mh.msg.MsgBestEffort {
+			b.hive.countBestEffortDrop()
+			mh.msg.receipt.report(Dropped, b.ID(), nil)
+			continue
+		}
+		b.snooze(mh, overloadRetry)
+	}
+}
@@ -0,0 +1,134 @@
+package beehive
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type overloadTestMsg int
+
+func TestMaxInflight(t *testing.T) {
+	h := newHiveForTest(MaxInflight(10))
+	block := make(chan struct{})
+	ch := make(chan uint64, 1)
+	h.NewApp("overload").HandleFunc(overloadTestMsg(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			select {
+			case ch <- c.ID():
+			default:
+			}
+			<-block
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// The bee blocks on the first message and the rest are queued.
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; ; i++ {
+		err := h.Emit(overloadTestMsg(i))
+		if err == ErrOverloaded {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid error in emit: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hive is not overloaded after %v emits", i)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	id := <-ch
+
+	err := h.EmitBatch([]interface{}{overloadTestMsg(0)})
+	if err != ErrOverloaded {
+		t.Errorf("invalid error in emit batch: actual=%v want=%v", err,
+			ErrOverloaded)
+	}
+	if err = h.SendToBee(overloadTestMsg(0), id); err != ErrOverloaded {
+		t.Errorf("invalid error in send to bee: actual=%v want=%v", err,
+			ErrOverloaded)
+	}
+
+	c, err := newRPCClient(h.Config().Addr, h.Config().dialer())
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer c.stop()
+	err = c.sendMsg([]msg{{MsgData: overloadTestMsg(0), MsgTo: id}})
+	if !isOverloaded(err) {
+		t.Errorf("invalid error for messages of other hives: actual=%v want=%v",
+			err, overloadedNack)
+	}
+
+	close(block)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		err := h.Emit(overloadTestMsg(0))
+		if err == nil {
+			break
+		}
+		if err != ErrOverloaded {
+			t.Fatalf("invalid error in emit: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hive is overloaded after the backlog drains")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxInflightStoppedBee(t *testing.T) {
+	const queued = 100
+	h := newHiveForTest(MaxInflight(queued*2), BatchSize(1))
+	block := make(chan struct{})
+	started := make(chan struct{})
+	h.NewApp("overload").HandleFunc(overloadTestMsg(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			if m.Data().(overloadTestMsg) == 0 {
+				close(started)
+				<-block
+			}
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i <= queued; i++ {
+		if err := h.Emit(overloadTestMsg(i)); err != nil {
+			t.Fatalf("cannot emit: %v", err)
+		}
+	}
+	<-started
+	b, ok := localBee(h, "overload")
+	if !ok {
+		t.Fatal("no bee is created")
+	}
+
+	// The bee is stopped while most messages are still in its queue.
+	stopped := make(chan struct{})
+	go func() {
+		b.processCmd(cmdStop{})
+		b.qee.removeBee(b.ID())
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(block)
+	<-stopped
+
+	hv := h.(*hive)
+	for i := 0; atomic.LoadInt64(&hv.inflight) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("messages of the stopped bee are inflight: actual=%v want=0",
+				atomic.LoadInt64(&hv.inflight))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
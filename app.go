@@ -3,11 +3,17 @@ package beehive
 import (
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 	"github.com/kandoo/beehive/bucket"
 	"github.com/kandoo/beehive/state"
 )
@@ -15,8 +21,10 @@ import (
 // App represents an application in beehive. An app is a collection of stateful
 // message handlers.
 //
-// Methods in this interface are not thread-safe and must be called before the
-// Hive starts.
+// Methods in this interface are not thread-safe. They can be called before or
+// after the Hive starts. Handlers registered after the hive is started are
+// synchronized with the hive's message loop, and are used for messages emitted
+// after the registration returns.
 type App interface {
 	// Returns the app name.
 	Name() string
@@ -29,12 +37,193 @@ type App interface {
 	// msgType is an instnace of MsgType, we use it as the type. Otherwise, we use
 	// the qualified name of msgType's reflection type.
 	HandleFunc(msgType interface{}, m MapFunc, r RcvFunc) error
+	// ShardBy maps the messages of msgType using the shard key returned by key,
+	// instead of the map function of their handler. Messages with the same key,
+	// of this or any other sharded type of the app, are handled by the same
+	// bee. The map function of the handler is not called, and can be nil for
+	// HandleFunc. It must be called before the app is started.
+	ShardBy(msgType interface{}, key func(msg interface{}) string)
+
+	// Use adds a middleware that is invoked around the Rcv of every message
+	// handled by the app's bees. Middlewares are invoked in the order they are
+	// added, and must be added before the app is started.
+	Use(m Middleware)
 
 	// Regsiters the app's detached handler.
 	Detached(h DetachedHandler)
 	// Registers the detached handler using functions.
 	DetachedFunc(start StartFunc, stop StopFunc, r RcvFunc)
 
+	// Snapshot serializes the state of all local bees of this app.
+	Snapshot() ([]byte, error)
+	// DependsOn declares that this app depends on the app named other, e.g.,
+	// because it emits messages that are handled by other. When the hive stops,
+	// this app is drained and stopped before other, and other handles the
+	// messages emitted by this app before it is stopped. It returns
+	// ErrDependencyCycle if other already depends on this app.
+	DependsOn(other string) error
+
+	// Stop stops the app without stopping the hive. New messages are no longer
+	// routed to the app, and its bees are stopped after handling the messages
+	// already in their queues. Messages that arrive afterwards are dropped.
+	Stop() error
+
+	// HandlerTimeouts returns the number of messages whose handlers have not
+	// returned within the app's HandlerTimeout.
+	HandlerTimeouts() uint64
+
+	// RemoveHandler removes the handler of msgType. New messages of msgType are
+	// no longer routed to the app, and RemoveHandler blocks until the messages
+	// that are already routed to the app's local bees are handled.
+	RemoveHandler(msgType interface{}) error
+	// Handlers returns the message types handled by the app, sorted by name.
+	Handlers() []string
+
+	// SetSticky sets whether the app is sticky (see Sticky). When a running
+	// sticky app is made non-sticky, the cells that its local bees have grouped
+	// because of the sticky split are distributed among new bees, one for each
+	// key (or affinity group, see StickyBy), and the state of each key moves
+	// with it. Messages that are already queued on the old bees are still
+	// handled there. Persistent apps cannot be distributed at runtime.
+	SetSticky(sticky bool) error
+
+	// SetSchedulerHint runs the message handlers of the app's local bees on a
+	// bounded set of worker goroutines, one for each shard index returned by
+	// shard. Bees with the same shard index are serviced by the same worker,
+	// which improves cache locality at the cost of parallelism. Handlers must
+	// not block on messages handled by bees of their own worker. It must be
+	// called before the app is started.
+	SetSchedulerHint(shard func(bee uint64) int)
+
+	// SetAutoTx wraps each invocation of the app's receive functions in a
+	// transaction, if enabled. The transaction is committed when the receive
+	// function returns nil, and is aborted when it returns an error or panics.
+	// As such, the messages emitted by the receive function are dropped along
+	// with its state changes. It is the same as the Transactional option, and
+	// has no effect on persistent apps that are always transactional. It must
+	// be called before the app is started.
+	SetAutoTx(enabled bool)
+
+	// DetachedBees returns the IDs of the app's detached bees that are running
+	// on this hive, sorted by ID.
+	DetachedBees() []uint64
+
+	// SetMapCache caches the result of mapping the messages whose data
+	// implement RoutingKeyer, if enabled. Messages with a cached routing key are
+	// sent to the bee of their cells without invoking the map function. The
+	// cache is invalidated whenever a colony changes. The map function of the
+	// app must be deterministic for the routing keys. It must be called before
+	// the app is started.
+	SetMapCache(enabled bool)
+
+	// SetFairQueuing makes the bees of the app dequeue their messages of
+	// different types in a round robin, if enabled. As such, a burst of
+	// messages of one type does not starve the messages of other types. It has
+	// no effect on prioritized apps. It must be called before the app is
+	// started.
+	SetFairQueuing(enabled bool)
+
+	// SetDedupWindow drops the emitted messages whose data implement
+	// IdempotencyKeyer, if a message of the same type and idempotency key is
+	// among the last n keys seen by the app on this hive. Larger windows catch
+	// duplicates that arrive further apart, at the cost of memory. n <= 0
+	// disables deduplication. It must be called before the app is started.
+	SetDedupWindow(n int)
+
+	// SetReplicaWeights makes eventual reads from the replicas of the app (see
+	// RcvContext.ReadFromReplica) pick a replica with a probability proportional
+	// to the weight of its hive, e.g., to favor the replicas in the same rack.
+	// Hives that are not in weights have a weight of 1, and replicas with
+	// non-positive weights are never read. Followers that lag behind a leader on
+	// the reading hive are skipped. Since hive IDs are assigned when hives
+	// start, it can be called at any time.
+	SetReplicaWeights(weights map[uint64]int)
+	// SetRetry redelivers a message to its bee when the app's handler returns
+	// an error, after the delay returned by backoff (no delay if nil). Once a
+	// message is redelivered max times and the handler still fails, the message
+	// is dropped and a DeadLetter is emitted. Panics are not retried. max <= 0
+	// disables redelivery. It must be called before the app is started.
+	SetRetry(max int, backoff BackoffFunc)
+	// SetValidator validates the messages of the app before they are handled.
+	// Messages for which validate returns an error are not passed to the
+	// handler, and a DeadLetter with the error is emitted instead. Messages
+	// received from other hives are validated on the receiving hive. It must
+	// be called before the app is started.
+	SetValidator(validate func(Msg) error)
+	// SetHivePreference sets the hive on which new bees of the app prefer to
+	// live. When the cells of a message are not owned by any bee, pref is
+	// called with the first of those cells and the new bee is created on the
+	// returned hive, if that hive is alive. Otherwise, the bee is created on
+	// the local hive. It replaces the placement method of the app.
+	SetHivePreference(pref func(k CellKey) uint64)
+	// SetOptimisticTx enables optimistic concurrency control for the
+	// transactions of the app. The cells read or written in a transaction are
+	// recorded, and validated against the versions of the cells when the
+	// transaction commits. If a bee of the app on this hive has committed a
+	// transaction that wrote any of those cells since the transaction began,
+	// the transaction is aborted and CommitTx returns ErrConcurrentTx, an error
+	// in the ErrTxConflict category. Otherwise, the versions of the written
+	// cells are bumped. It must be called before the app is started.
+	SetOptimisticTx(optimistic bool)
+	// SetCausalOrdering enables causal ordering for the app. The messages sent
+	// between the bees of causally ordered apps are stamped with a matrix
+	// clock, and a bee delays a received message until it has handled the
+	// messages sent to it that happened before the received message. Only the
+	// messages sent to the bee are tracked, so the messages exchanged by other
+	// bees never delay it. A message is handled anyway if its dependencies are
+	// not handled within the causal timeout of the app (see CausalTimeout),
+	// e.g., when they are dropped. It must be called before the app is
+	// started.
+	SetCausalOrdering(causal bool)
+	// SetStateless marks the app as stateless. The handlers of a stateless app
+	// do not access the state, and the bees of the app handle each batch of
+	// messages concurrently on a pool of goroutines. Accessing the dictionaries
+	// of the bee panics with ErrStateless, and the handlers must not use the
+	// bee-local storage. Stateless apps are not transactional, and
+	// SetStateless returns an error for persistent apps. It must be called
+	// before the app is started.
+	SetStateless(stateless bool) error
+	// SetBeeIDFunc sets the function that names the bees of the app. When a
+	// bee is created for a set of cells, f is called with the first cell, and
+	// the bee is registered with the returned name (see BeeInfo.Name), which
+	// can be used to correlate the bee with external entities. Names are
+	// unique in the app: the messages of a new bee whose name is taken by
+	// another bee are rejected and emitted as DeadLetters. An empty name
+	// leaves the bee unnamed. It must be called before the app is started.
+	SetBeeIDFunc(f func(k CellKey) string)
+	// SetPollerJitter staggers the detached bees of the app over d: the Start
+	// method of each detached handler is delayed by a phase in [0, d) that is
+	// derived from the bee ID, so that pollers ticking every d do not fire
+	// simultaneously. The phase of a bee is deterministic. Zero, the default,
+	// starts detached handlers immediately.
+	SetPollerJitter(d time.Duration)
+	// SetEmitRate limits the rate of the messages emitted by the local bees of
+	// the app to msgsPerSec, using a token bucket that is shared by the bees and
+	// holds at most burst tokens. The bucket starts empty. When it is empty,
+	// the emitted messages are handled according to the emit policy of the app
+	// (see SetEmitPolicy). msgsPerSec <= 0 removes the limit. It must be called
+	// before the app is started.
+	SetEmitRate(msgsPerSec int, burst int)
+	// SetEmitPolicy sets what the bees of the app do with the messages that
+	// exceed the emit rate of the app. By default, the bees block (i.e.,
+	// BlockEmit). It must be called before the app is started.
+	SetEmitPolicy(p EmitPolicy)
+
+	// Restore loads a snapshot into this app. The bees of the snapshot are
+	// created when the app starts, before handling any message. Restore must be
+	// called before the app is started.
+	Restore(b []byte) error
+	// ReplayLog reconstructs the state of the app by replaying the transaction
+	// log written by NewTxLogWriter, e.g., to recover from a disaster. The
+	// transactions of each colony are applied in order, and ReplayLog returns
+	// an error if a transaction is missing or belongs to an older generation
+	// than its predecessor. The records of other apps are skipped. When called
+	// after Restore, the log replays the transactions committed after the
+	// snapshot on the state of the snapshot's bees. As with Restore, the bees
+	// are created when the app starts, and ReplayLog must be called before the
+	// app is started.
+	ReplayLog(r io.Reader) error
+
 	// Returns the state of this app that is used in the map function. This state
 	// is NOT thread-safe and apps must synchronize for themselves.
 	Dict(name string) state.Dict
@@ -54,6 +243,11 @@ type App interface {
 		handler func(http.ResponseWriter, *http.Request)) *mux.Route
 }
 
+// Middleware wraps the receive functions of an application. It should call
+// next to proceed to the next middleware and, eventually, to the handler.
+// A middleware that does not call next skips the handler.
+type Middleware func(ctx RcvContext, msg Msg, next func() error) error
+
 // AppOption represents an option for applications.
 type AppOption func(a *app)
 
@@ -83,6 +277,63 @@ func Sticky() AppOption {
 	}
 }
 
+// StickySplit is an application option that splits a sticky app into more
+// bees when the rate of its messages on a hive exceeds threshold messages per
+// second, and consolidates them on fewer bees when the rate drops. Cells are
+// spread among the bees by their key, or by their affinity group (see
+// StickyBy), and the cells of the local bees, with their state, are re-mapped
+// whenever the number of bees changes. Splitting has no effect on apps that
+// are not sticky, and on persistent apps.
+func StickySplit(threshold int) AppOption {
+	return func(a *app) {
+		a.stickySplit = threshold
+	}
+}
+
+// Prioritized is an application option that makes the bees of the application
+// handle messages of higher priorities first. See RcvContext.EmitWithPriority.
+func Prioritized() AppOption {
+	return func(a *app) {
+		a.flags |= appFlagPrioritized
+	}
+}
+
+// MaxDetached is an application option that limits the number of running
+// detached bees of the application on each hive to n. Once the limit is
+// reached, StartDetached fails until one of the detached bees stops. Values
+// smaller than 1 mean no limit.
+func MaxDetached(n int) AppOption {
+	return func(a *app) {
+		a.maxDetached = n
+	}
+}
+
+// PinWorkers is an application option that locks the worker goroutines of
+// the app's scheduler to their OS threads. See App.SetSchedulerHint.
+func PinWorkers() AppOption {
+	return func(a *app) {
+		a.pinWorkers = true
+	}
+}
+
+// StickyBy is an application option that co-locates cells of the same
+// affinity group on one bee. The group of each mapped cell is computed by
+// group, and cells with the same group (e.g., switches of the same rack) are
+// always mapped to the same bee.
+func StickyBy(group func(k CellKey) string) AppOption {
+	return func(a *app) {
+		a.stickyBy = group
+	}
+}
+
+// Mapper is an application option that rewrites the mapped cells of all
+// messages of the application using m (e.g., ConsistentHash).
+func Mapper(m CellMapper) AppOption {
+	return func(a *app) {
+		a.mapper = m
+	}
+}
+
 // NonTransactional is an application option that makes the application
 // non-transactional.
 func NonTransactional() AppOption {
@@ -99,6 +350,38 @@ func Placement(m PlacementMethod) AppOption {
 	}
 }
 
+// HandlerTimeout is an application option that limits the time that a bee
+// waits for the Rcv of a message. If Rcv does not return within d, the bee
+// logs the timeout, aborts the open transaction, and handles the next message.
+// The handler keeps running in the background, but its context is abandoned:
+// RcvContext.Context is cancelled, and the calls on the RcvContext return, or
+// panic with, ErrHandlerTimeout.
+func HandlerTimeout(d time.Duration) AppOption {
+	return func(a *app) {
+		a.handlerTimeout = d
+	}
+}
+
+// CausalTimeout is an application option that sets the time after which the
+// bees of a causally ordered app handle a message even if its causal
+// dependencies are not handled. It also bounds the dependencies tracked by the
+// bees: the messages sent earlier than d are forgotten. By default, it is one
+// second.
+func CausalTimeout(d time.Duration) AppOption {
+	return func(a *app) {
+		a.causalTTL = d
+	}
+}
+
+// OnPartition is an application option that sets the policy for messages
+// destined to the bees on unreachable hives. By default, such messages are
+// dropped (i.e., FailFast).
+func OnPartition(p PartitionPolicy) AppOption {
+	return func(a *app) {
+		a.partition = p
+	}
+}
+
 // InRate is an application option that limits the rate of incoming messages of
 // each bee of an application using a token bucket with the given rate and the
 // given maximum.
@@ -111,7 +394,9 @@ func InRate(rate bucket.Rate, max uint64) AppOption {
 
 // OutRate is an application option that limits the rate of outgoing messages of
 // each bee of an application using a token bucket with the given rate and the
-// given maximum.
+// given maximum (i.e., the burst size). When the bucket is empty, the messages
+// emitted by the bee are held back until enough tokens are available, which
+// applies backpressure on the bee instead of flooding the receivers.
 func OutRate(rate bucket.Rate, max uint64) AppOption {
 	return func(a *app) {
 		a.rate.outRate = rate
@@ -142,6 +427,17 @@ type Handler interface {
 	Map(m Msg, c MapContext) MappedCells
 }
 
+// Initializer is an optional interface of handlers. If a handler implements
+// Initializer, each bee calls its Init once before handling its first message,
+// e.g., to initialize caches or to open resources in the bee-local storage.
+// Init is called before a new bee is started. If Init returns an error, the
+// bee is not started, and its messages are placed on another hive or retried
+// later. Bees that are restored on a hive call Init before handling their
+// first message, and retry Init and the messages later if Init fails.
+type Initializer interface {
+	Init(ctx RcvContext) error
+}
+
 // DetachedHandler in contrast to normal Handlers with Map and Rcv, starts in
 // their own go-routine and emit messages. They do not listen on a particular
 // message and only recv replys in their receive functions.
@@ -202,16 +498,52 @@ func (c runtimeRcvContext) ID() uint64 {
 	return 0
 }
 
+func (c runtimeRcvContext) BeeName() string {
+	return ""
+}
+
+func (c runtimeRcvContext) Colony() Colony {
+	return Colony{}
+}
+
+func (c runtimeRcvContext) Generation() uint64 {
+	return 0
+}
+
+func (c runtimeRcvContext) Context() context.Context {
+	return context.Background()
+}
+
 func (c runtimeRcvContext) Printf(format string, a ...interface{}) {}
 
 func (c runtimeRcvContext) Emit(msgData interface{}) {}
 
+func (c runtimeRcvContext) EmitBatch(msgData []interface{}) {}
+
+func (c runtimeRcvContext) EmitBestEffort(msgData interface{}) {}
+
+func (c runtimeRcvContext) EmitCoalesced(msgData interface{}, key string,
+	window time.Duration) {
+}
+
+func (c runtimeRcvContext) EmitWithReceipt(msgData interface{},
+	onResult func(DeliveryResult)) {
+}
+
+func (c runtimeRcvContext) EmitWithPriority(msgData interface{}, prio int) {}
+
 func (c runtimeRcvContext) SendToCell(msgData interface{}, app string,
 	cell CellKey) {
 }
 
 func (c runtimeRcvContext) SendToBee(msgData interface{}, to uint64) {}
 
+func (c runtimeRcvContext) EmitToSelf(msgData interface{}) {}
+
+func (c runtimeRcvContext) SendToBeeErr(msgData interface{}, to uint64) error {
+	return nil
+}
+
 func (c runtimeRcvContext) Reply(msg Msg, replyData interface{}) error {
 	return nil
 }
@@ -230,10 +562,42 @@ func (c runtimeRcvContext) StartDetachedFunc(start StartFunc, stop StopFunc,
 	return 0
 }
 
+func (c runtimeRcvContext) StopDetached(id uint64) error {
+	return c.qee.stopDetached(id)
+}
+
+func (c runtimeRcvContext) SubscribeDetached(msgType interface{}) {}
+
+func (c runtimeRcvContext) RunOnBee(f func(ctx RcvContext)) {
+	f(c)
+}
+
 func (c runtimeRcvContext) LockCells(keys []CellKey) error {
 	return nil
 }
 
+func (c runtimeRcvContext) LockWithTimeout(keys []CellKey,
+	d time.Duration) error {
+
+	return nil
+}
+
+func (c runtimeRcvContext) UnlockCells(keys []CellKey) error {
+	return nil
+}
+
+func (c runtimeRcvContext) ReadFromReplica(app string, cell CellKey, dict,
+	key string, rc ReadConsistency) (ReplicaValue, error) {
+
+	return ReplicaValue{}, nil
+}
+
+func (c runtimeRcvContext) QueryApp(app string, cell CellKey, dict,
+	key string) (interface{}, error) {
+
+	return nil, nil
+}
+
 func (c runtimeRcvContext) Snooze(d time.Duration) {}
 
 func (c runtimeRcvContext) BeeLocal() interface{} {
@@ -242,6 +606,22 @@ func (c runtimeRcvContext) BeeLocal() interface{} {
 
 func (c runtimeRcvContext) SetBeeLocal(d interface{}) {}
 
+func (c runtimeRcvContext) BeeLocalGet(key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (c runtimeRcvContext) BeeLocalSet(key string, v interface{}) {}
+
+func (c runtimeRcvContext) BeeLocalGetOrInit(key string,
+	init func() interface{}) interface{} {
+
+	return init()
+}
+
+func (c runtimeRcvContext) Rand() *rand.Rand {
+	return rand.New(rand.NewSource(beeSeed(c.hive.config.Seed, 0)))
+}
+
 func (c runtimeRcvContext) Dict(name string) state.Dict {
 	return c.state.Dict(name)
 }
@@ -258,6 +638,26 @@ func (c runtimeRcvContext) CommitTx() error {
 	return c.state.CommitTx()
 }
 
+func (c runtimeRcvContext) OnPreCommit(f func() error) {}
+
+func (c runtimeRcvContext) OnPostCommit(f func()) {}
+
+func (c runtimeRcvContext) InTx() bool {
+	return c.state.TxStatus() == state.TxOpen
+}
+
+func (c runtimeRcvContext) TxSeq() uint64 {
+	return 0
+}
+
+func (c runtimeRcvContext) TxBufferedMsgs() []Msg {
+	return nil
+}
+
+func (c runtimeRcvContext) TxBufferedOps() []state.Op {
+	return c.state.TxOps()
+}
+
 // RuntimeMap generates an automatic runtime map function based on the given
 // rcv function.
 //
@@ -303,6 +703,7 @@ const (
 	appFlagSticky appFlag = 1 << iota
 	appFlagPersistent
 	appFlagTransactional
+	appFlagPrioritized
 )
 
 type appRate struct {
@@ -313,15 +714,121 @@ type appRate struct {
 }
 
 type app struct {
-	name       string
-	hive       *hive
-	qee        *qee
-	handlers   map[string]Handler
-	flags      appFlag
-	replFactor int
-	placement  PlacementMethod
-	router     *mux.Router
-	rate       appRate
+	name           string
+	hive           *hive
+	qee            *qee
+	handlers       map[string]Handler
+	flags          appFlag
+	replFactor     int
+	placement      PlacementMethod
+	partition      PartitionPolicy
+	handlerTimeout time.Duration
+	timeouts       uint64 // accessed atomically.
+	stickyBy       func(k CellKey) string
+	stickySplit    int
+	sched          *scheduler
+	mapCache       bool
+	fairQueuing    bool
+	dedup          *dedupWindow
+	retryMax       int
+	retryBackoff   BackoffFunc
+	validator      func(Msg) error
+	optimisticTx   bool
+	txVersions     txVersions // versions of the cells of optimistic txs.
+	causal         bool
+	causalTTL      time.Duration
+	stateless      bool
+	beeIDFunc      func(k CellKey) string
+	pollerJitter   time.Duration
+	shards         map[string]func(msg interface{}) string
+	latency        latencyRecorder
+	replicaWeights atomic.Value // map[uint64]int keyed by hive ID.
+	pinWorkers     bool
+	mapper         CellMapper
+	maxDetached    int
+	middlewares    []Middleware
+	deps           []string // apps that this app depends on.
+	router         *mux.Router
+	rate           appRate
+	emitBucket     *bucket.Bucket // shared by the local bees of the app.
+	emitPolicy     EmitPolicy
+	stopped        bool  // whether the app is stopped. Accessed by the hive.
+	failure        error // why the app has failed. Guarded by the hive lock.
+}
+
+// ErrAppStopped is returned when an app is stopped more than once.
+var ErrAppStopped = errors.New("app is already stopped")
+
+// ErrDependencyCycle is returned when an app dependency creates a cycle.
+var ErrDependencyCycle = errors.New("app dependency cycle")
+
+func (a *app) DependsOn(other string) error {
+	a.hive.Lock()
+	defer a.hive.Unlock()
+
+	if other == a.name || a.hive.dependsOn(other, a.name, map[string]bool{}) {
+		return ErrDependencyCycle
+	}
+	a.deps = append(a.deps, other)
+	return nil
+}
+
+func (a *app) Stop() error {
+	if !a.hive.isStarted() {
+		return a.hive.stopApp(a)
+	}
+
+	if _, err := a.hive.processCmd(cmdStopApp{App: a.Name()}); err != nil {
+		return err
+	}
+	a.drain()
+	_, err := a.qee.processCmd(cmdStop{})
+	return err
+}
+
+// drain blocks until the local bees of the app have handled the messages
+// already in their queues.
+func (a *app) drain() {
+	// Bees commit the side effects of a batch after handling all the messages
+	// in the batch. The second round makes sure that the batch containing the
+	// first drain message is committed.
+	for i := 0; i < 2; i++ {
+		d := &drainHandler{mapped: make(chan struct{})}
+		a.qee.enqueMsg(msgAndHandler{
+			msg:     &msg{MsgData: appDrain{}},
+			handler: d,
+		})
+		<-d.mapped
+		d.wg.Wait()
+	}
+}
+
+// appDrain is the message used to drain the queues of an app's bees.
+type appDrain struct{}
+
+// drainHandler broadcasts appDrain to all local bees of an app, and waits until
+// they receive it.
+type drainHandler struct {
+	mapped chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (d *drainHandler) Map(m Msg, c MapContext) MappedCells {
+	q := c.(*qee)
+	q.RLock()
+	for id, b := range q.bees {
+		if !b.detached && !b.proxy && b.colony().Leader == id {
+			d.wg.Add(1)
+		}
+	}
+	q.RUnlock()
+	close(d.mapped)
+	return MappedCells{}
+}
+
+func (d *drainHandler) Rcv(m Msg, c RcvContext) error {
+	d.wg.Done()
+	return nil
 }
 
 func (a *app) String() string {
@@ -336,6 +843,119 @@ func (a *app) DetachedFunc(start StartFunc, stop StopFunc, rcv RcvFunc) {
 	a.Detached(&funcDetached{start, stop, rcv})
 }
 
+func (a *app) ShardBy(msg interface{}, key func(msg interface{}) string) {
+	if a.shards == nil {
+		a.shards = make(map[string]func(msg interface{}) string)
+	}
+	a.shards[MsgType(msg)] = key
+}
+
+func (a *app) HandlerTimeouts() uint64 {
+	return atomic.LoadUint64(&a.timeouts)
+}
+
+func (a *app) SetSticky(sticky bool) error {
+	if !a.hive.isStarted() {
+		if sticky {
+			a.flags |= appFlagSticky
+		} else {
+			a.flags &^= appFlagSticky
+		}
+		return nil
+	}
+
+	_, err := a.qee.processCmd(cmdSetSticky{Sticky: sticky})
+	return err
+}
+
+func (a *app) SetSchedulerHint(shard func(bee uint64) int) {
+	a.sched = newScheduler(shard, a.pinWorkers)
+}
+
+func (a *app) SetAutoTx(enabled bool) {
+	if enabled {
+		a.flags |= appFlagTransactional
+		return
+	}
+	if !a.persistent() {
+		a.flags &= ^appFlagTransactional
+	}
+}
+
+func (a *app) DetachedBees() []uint64 {
+	return a.qee.detachedBees()
+}
+
+func (a *app) SetMapCache(enabled bool) {
+	a.mapCache = enabled
+}
+
+func (a *app) SetFairQueuing(enabled bool) {
+	a.fairQueuing = enabled
+}
+
+func (a *app) SetDedupWindow(n int) {
+	if n <= 0 {
+		a.dedup = nil
+		return
+	}
+	a.dedup = newDedupWindow(n)
+}
+
+func (a *app) SetReplicaWeights(weights map[uint64]int) {
+	a.replicaWeights.Store(weights)
+}
+
+// weights returns the replica weights of the app, or nil if not set.
+func (a *app) weights() map[uint64]int {
+	w, _ := a.replicaWeights.Load().(map[uint64]int)
+	return w
+}
+
+func (a *app) SetRetry(max int, backoff BackoffFunc) {
+	a.retryMax = max
+	a.retryBackoff = backoff
+}
+
+func (a *app) SetValidator(validate func(Msg) error) {
+	a.validator = validate
+}
+
+func (a *app) SetHivePreference(pref func(k CellKey) uint64) {
+	a.placement = hivePreference(pref)
+}
+
+func (a *app) SetOptimisticTx(optimistic bool) {
+	a.optimisticTx = optimistic
+}
+
+func (a *app) SetCausalOrdering(causal bool) {
+	a.causal = causal
+}
+
+func (a *app) SetStateless(stateless bool) error {
+	if stateless {
+		if a.persistent() {
+			return errors.New("persistent apps cannot be stateless")
+		}
+		a.flags &^= appFlagTransactional
+	}
+	a.stateless = stateless
+	return nil
+}
+
+func (a *app) SetBeeIDFunc(f func(k CellKey) string) {
+	a.beeIDFunc = f
+}
+
+func (a *app) SetPollerJitter(d time.Duration) {
+	a.pollerJitter = d
+}
+
+func (a *app) Use(m Middleware) {
+	a.middlewares = append(a.middlewares, m)
+}
+
 func (a *app) Handle(msg interface{}, h Handler) error {
 	if a.qee == nil {
 		glog.Fatalf("app's qee is nil!")
@@ -353,8 +973,22 @@ func (a *app) Handle(msg interface{}, h Handler) error {
 }
 
 func (a *app) registerHandler(t string, h Handler) error {
+	if a.hive.isStarted() {
+		_, err := a.hive.processCmd(cmdRegisterHandler{
+			App:     a.Name(),
+			Type:    t,
+			Handler: h,
+		})
+		return err
+	}
+	return a.setHandler(t, h)
+}
+
+func (a *app) setHandler(t string, h Handler) error {
+	a.hive.Lock()
 	_, ok := a.handlers[t]
 	a.handlers[t] = h
+	a.hive.Unlock()
 	a.hive.registerHandler(t, a.qee, h)
 
 	if ok {
@@ -363,7 +997,58 @@ func (a *app) registerHandler(t string, h Handler) error {
 	return nil
 }
 
+func (a *app) RemoveHandler(msg interface{}) error {
+	types := []string{MsgType(msg), MsgType(syncReq{Data: msg})}
+	if !a.hive.isStarted() {
+		return a.removeHandlers(types...)
+	}
+
+	_, err := a.hive.processCmd(cmdRemoveHandler{App: a.Name(), Types: types})
+	if err != nil {
+		return err
+	}
+	a.drain()
+	return nil
+}
+
+// removeHandlers removes the handlers of the given types, and returns
+// ErrNoHandler if there is no handler for the first type.
+func (a *app) removeHandlers(types ...string) error {
+	a.hive.Lock()
+	if _, ok := a.handlers[types[0]]; !ok {
+		a.hive.Unlock()
+		return ErrNoHandler
+	}
+	for _, t := range types {
+		delete(a.handlers, t)
+	}
+	a.hive.Unlock()
+
+	for _, t := range types {
+		a.hive.unregisterHandler(t, a.qee)
+	}
+	return nil
+}
+
+func (a *app) Handlers() []string {
+	a.hive.Lock()
+	defer a.hive.Unlock()
+
+	types := make([]string, 0, len(a.handlers)/2)
+	for t, h := range a.handlers {
+		// Skip the handlers registered for sync requests of each type.
+		if _, ok := h.(syncHandler); ok {
+			continue
+		}
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
 func (a *app) handler(t string) Handler {
+	a.hive.RLock()
+	defer a.hive.RUnlock()
 	return a.handlers[t]
 }
 
@@ -428,3 +1113,7 @@ func (a *app) transactional() bool {
 func (a *app) sticky() bool {
 	return a.flags&appFlagSticky != 0
 }
+
+func (a *app) prioritized() bool {
+	return a.flags&appFlagPrioritized != 0
+}
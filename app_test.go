@@ -3,8 +3,11 @@ package beehive
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 )
 
 type AppTestMsg int
@@ -146,6 +149,112 @@ func TestReplicatedAppFailure(t *testing.T) {
 	h3.Stop()
 }
 
+type replyTestStart struct{}
+type replyTestReq struct{}
+type replyTestRes struct{}
+
+func registerReplyApps(h Hive, responder func() uint64, reqCh chan struct{},
+	unblock chan struct{}, ch chan uint64) {
+
+	req := h.NewApp("requester", Persistent(3))
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	req.HandleFunc(replyTestStart{}, mf, func(msg Msg, ctx RcvContext) error {
+		// The colony recruits its followers on the first write.
+		ctx.Dict("D").Put("0", []byte{})
+		ctx.Emit(replyTestReq{})
+		return nil
+	})
+	req.HandleFunc(replyTestRes{}, mf, func(msg Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	})
+
+	res := h.NewApp("responder")
+	res.SetHivePreference(func(k CellKey) uint64 { return responder() })
+	res.HandleFunc(replyTestReq{}, mf, func(msg Msg, ctx RcvContext) error {
+		reqCh <- struct{}{}
+		<-unblock
+		return ctx.Reply(msg, replyTestRes{})
+	})
+}
+
+func TestReplyAfterFailover(t *testing.T) {
+	reqCh := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	ch := make(chan uint64, 1)
+
+	var hs []Hive
+	responder := func() uint64 { return hs[1].ID() }
+	for i := 0; i < 3; i++ {
+		var opts []HiveOption
+		if i != 0 {
+			opts = append(opts, PeerAddrs(hs[0].Config().Addr))
+		}
+		h := newHiveForTest(opts...)
+		registerReplyApps(h, responder, reqCh, unblock, ch)
+		go h.Start()
+		waitTilStareted(h)
+		hs = append(hs, h)
+	}
+	h1, h2, h3 := hs[0], hs[1], hs[2]
+	defer h3.Stop()
+	defer h2.Stop()
+
+	h1.Emit(replyTestStart{})
+	select {
+	case <-reqCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request is not received")
+	}
+
+	old := findBee("requester", h1)
+	if old == 0 {
+		t.Fatalf("cannot find the requester on %v", h1)
+	}
+	elect := h1.Config().RaftElectTimeout()
+	waitForColony(t, h2, old, func(c Colony) bool {
+		return len(c.Followers) == 2
+	})
+
+	// Fail over the requester while the request is being handled.
+	h1.Stop()
+	var leader uint64
+	waitForColony(t, h2, old, func(c Colony) bool {
+		leader = c.Leader
+		return leader != Nil && leader != old
+	})
+	time.Sleep(elect)
+	close(unblock)
+
+	select {
+	case id := <-ch:
+		if id != leader {
+			t.Errorf("invalid receiver of the reply: actual=%v want=%v", id,
+				leader)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("the reply is lost after failover")
+	}
+}
+
+// waitForColony waits until the colony of bee, as registered on h, satisfies
+// cond.
+func waitForColony(t *testing.T, h Hive, bee uint64, cond func(c Colony) bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		i, err := h.(*hive).registry.bee(bee)
+		if err == nil && cond(i.Colony) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("invalid colony for %v: %v", bee, i.Colony)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestReplicatedAppHandoff(t *testing.T) {
 	ch := make(chan hiveAndBeeID)
 
@@ -381,3 +490,717 @@ func findBee(a string, h Hive) uint64 {
 	}
 	return 0
 }
+
+type snapshotTestPut struct{ K, V string }
+type snapshotTestGet string
+
+func registerSnapshotApp(h Hive, ch chan string) App {
+	a := h.NewApp("snapshot")
+	a.HandleFunc(snapshotTestPut{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(snapshotTestPut).K}}
+	}, func(m Msg, c RcvContext) error {
+		p := m.Data().(snapshotTestPut)
+		c.Dict("D").Put(p.K, p.V)
+		ch <- p.V
+		return nil
+	})
+	a.HandleFunc(snapshotTestGet(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", string(m.Data().(snapshotTestGet))}}
+	}, func(m Msg, c RcvContext) error {
+		v, err := c.Dict("D").Get(string(m.Data().(snapshotTestGet)))
+		if err != nil {
+			ch <- ""
+			return nil
+		}
+		ch <- v.(string)
+		return nil
+	})
+	return a
+}
+
+func TestAppSnapshotRestore(t *testing.T) {
+	ch := make(chan string)
+	h1 := newHiveForTest()
+	a1 := registerSnapshotApp(h1, ch)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	keys := []string{"k1", "k2", "k3"}
+	for _, k := range keys {
+		h1.Emit(snapshotTestPut{K: k, V: "v" + k})
+		<-ch
+	}
+
+	b, err := a1.Snapshot()
+	h1.Stop()
+	if err != nil {
+		t.Fatalf("cannot snapshot the app: %v", err)
+	}
+
+	h2 := newHiveForTest()
+	a2 := registerSnapshotApp(h2, ch)
+	if err := a2.Restore(b); err != nil {
+		t.Fatalf("cannot restore the app: %v", err)
+	}
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	for _, k := range keys {
+		h2.Emit(snapshotTestGet(k))
+		if v := <-ch; v != "v"+k {
+			t.Errorf("invalid restored value for %v: actual=%v want=%v", k, v,
+				"v"+k)
+		}
+	}
+
+	if err := a2.Restore(b); err != ErrAppStarted {
+		t.Errorf("invalid error on restoring a started app: actual=%v want=%v",
+			err, ErrAppStarted)
+	}
+}
+
+type appStopTestMsg int
+
+func registerAppStopApp(h Hive, name string, ch chan int) App {
+	a := h.NewApp(name)
+	a.HandleFunc(appStopTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", fmt.Sprint(m.Data())}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- int(m.Data().(appStopTestMsg))
+		return nil
+	})
+	return a
+}
+
+func TestAppStop(t *testing.T) {
+	h := newHiveForTest()
+	n := 10
+	ch1 := make(chan int, 2*n)
+	ch2 := make(chan int, 2*n)
+	a1 := registerAppStopApp(h, "appstop1", ch1)
+	registerAppStopApp(h, "appstop2", ch2)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < n; i++ {
+		h.Emit(appStopTestMsg(i))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch2:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("appstop2 missing messages: actual=%v want=%v", i, n)
+		}
+	}
+
+	if err := a1.Stop(); err != nil {
+		t.Fatalf("cannot stop app: %v", err)
+	}
+	if len(ch1) != n {
+		t.Errorf("appstop1 is not drained: actual=%v want=%v", len(ch1), n)
+	}
+	if err := a1.Stop(); err != ErrAppStopped {
+		t.Errorf("invalid error for a stopped app: actual=%v want=%v", err,
+			ErrAppStopped)
+	}
+
+	for i := 0; i < n; i++ {
+		h.Emit(appStopTestMsg(n + i))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch2:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("appstop2 missing messages after stop: actual=%v want=%v", i,
+				n)
+		}
+	}
+	if len(ch1) != n {
+		t.Errorf("stopped app received messages: actual=%v want=%v", len(ch1), n)
+	}
+}
+
+type appMiddlewareTestMsg int
+
+func TestAppMiddleware(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("appmiddleware")
+	events := make(chan string, 16)
+	a.Use(func(ctx RcvContext, msg Msg, next func() error) error {
+		events <- "m1"
+		err := next()
+		events <- "m1-end"
+		return err
+	})
+	a.Use(func(ctx RcvContext, msg Msg, next func() error) error {
+		if msg.Data().(appMiddlewareTestMsg) == 1 {
+			events <- "m2-skip"
+			return nil
+		}
+		events <- "m2"
+		return next()
+	})
+	a.HandleFunc(appMiddlewareTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		events <- "h"
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	check := func(want []string) {
+		for i, w := range want {
+			select {
+			case e := <-events:
+				if e != w {
+					t.Errorf("invalid event #%v: actual=%v want=%v", i, e, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("missing event #%v: want=%v", i, w)
+			}
+		}
+	}
+
+	h.Emit(appMiddlewareTestMsg(0))
+	check([]string{"m1", "m2", "h", "m1-end"})
+	h.Emit(appMiddlewareTestMsg(1))
+	check([]string{"m1", "m2-skip", "m1-end"})
+}
+
+type appDepsTestProduce int
+type appDepsTestConsume int
+
+func TestAppDependsOn(t *testing.T) {
+	h := newHiveForTest()
+	n := 100
+	ch := make(chan int, n)
+	mapf := func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+
+	producer := h.NewApp("depsproducer")
+	producer.HandleFunc(appDepsTestProduce(0), mapf,
+		func(m Msg, c RcvContext) error {
+			c.Emit(appDepsTestConsume(m.Data().(appDepsTestProduce)))
+			return nil
+		})
+	consumer := h.NewApp("depsconsumer")
+	consumer.HandleFunc(appDepsTestConsume(0), mapf,
+		func(m Msg, c RcvContext) error {
+			time.Sleep(time.Millisecond)
+			ch <- int(m.Data().(appDepsTestConsume))
+			return nil
+		})
+
+	if err := producer.DependsOn("depsconsumer"); err != nil {
+		t.Fatalf("cannot declare dependency: %v", err)
+	}
+	if err := consumer.DependsOn("depsproducer"); err != ErrDependencyCycle {
+		t.Errorf("invalid error for a cycle: actual=%v want=%v", err,
+			ErrDependencyCycle)
+	}
+
+	go h.Start()
+	waitTilStareted(h)
+
+	for i := 0; i < n; i++ {
+		h.Emit(appDepsTestProduce(i))
+	}
+	h.Stop()
+
+	if len(ch) != n {
+		t.Errorf("consumer is stopped before the producer is drained: "+
+			"actual=%v want=%v", len(ch), n)
+	}
+}
+
+type handlerTimeoutTestMsg int
+
+func TestHandlerTimeout(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan handlerTimeoutTestMsg)
+	app := h.NewApp("timeout", HandlerTimeout(100*time.Millisecond))
+	app.HandleFunc(handlerTimeoutTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			m := msg.Data().(handlerTimeoutTestMsg)
+			if m == 0 {
+				time.Sleep(time.Second)
+				return nil
+			}
+			ctx.Dict("D").Put("0", m)
+			ch <- m
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < 3; i++ {
+		h.Emit(handlerTimeoutTestMsg(i))
+	}
+	for i := 1; i < 3; i++ {
+		select {
+		case m := <-ch:
+			if m != handlerTimeoutTestMsg(i) {
+				t.Errorf("invalid message: actual=%v want=%v", m, i)
+			}
+		case <-time.After(900 * time.Millisecond):
+			t.Fatalf("message %v is not handled after the timeout", i)
+		}
+	}
+	if n := app.HandlerTimeouts(); n != 1 {
+		t.Errorf("invalid number of timeouts: actual=%v want=1", n)
+	}
+}
+
+func TestHandlerTimeoutAbandonsContext(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan handlerTimeoutTestMsg)
+	errs := make(chan error, 2)
+	app := h.NewApp("timeout", HandlerTimeout(100*time.Millisecond))
+	app.HandleFunc(handlerTimeoutTestMsg(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		},
+		func(msg Msg, ctx RcvContext) error {
+			m := msg.Data().(handlerTimeoutTestMsg)
+			if m != 0 {
+				ctx.Dict("D").Put("0", m)
+				ch <- m
+				return nil
+			}
+
+			d := ctx.Dict("D")
+			<-ctx.Context().Done()
+			errs <- d.Put("0", m)
+			defer func() {
+				err, _ := recover().(error)
+				errs <- err
+			}()
+			ctx.Emit(m)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(handlerTimeoutTestMsg(0))
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrHandlerTimeout {
+				t.Errorf("invalid error on an abandoned context: actual=%v want=%v",
+					err, ErrHandlerTimeout)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the context is not cancelled after the timeout")
+		}
+	}
+
+	h.Emit(handlerTimeoutTestMsg(1))
+	select {
+	case m := <-ch:
+		if m != 1 {
+			t.Errorf("invalid message: actual=%v want=1", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the message is not handled after the timeout")
+	}
+}
+
+type handlerTimeoutQuery int
+
+func TestHandlerTimeoutDetachesBlockedCalls(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan handlerTimeoutTestMsg)
+	errs := make(chan error, 1)
+	release := make(chan struct{})
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	h.NewApp("blocker").HandleFunc(handlerTimeoutQuery(0), mapf,
+		func(msg Msg, ctx RcvContext) error {
+			<-release
+			return ctx.Reply(msg, msg.Data())
+		})
+	app := h.NewApp("timeout", HandlerTimeout(100*time.Millisecond))
+	app.HandleFunc(handlerTimeoutTestMsg(0), mapf,
+		func(msg Msg, ctx RcvContext) error {
+			m := msg.Data().(handlerTimeoutTestMsg)
+			if m != 0 {
+				ch <- m
+				return nil
+			}
+
+			// The bee must not wait for the handler blocked in Sync.
+			_, err := ctx.Sync(context.Background(), handlerTimeoutQuery(0))
+			errs <- err
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(handlerTimeoutTestMsg(0))
+	h.Emit(handlerTimeoutTestMsg(1))
+	select {
+	case m := <-ch:
+		if m != 1 {
+			t.Errorf("invalid message: actual=%v want=1", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the bee is blocked by a handler blocked in a context call")
+	}
+
+	close(release)
+	select {
+	case err := <-errs:
+		if err != ErrHandlerTimeout {
+			t.Errorf("invalid error of a detached call: actual=%v want=%v", err,
+				ErrHandlerTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the detached call does not return")
+	}
+}
+
+type rmHandlerMsg int
+type rmHandlerMarker struct{}
+
+func TestAppRemoveHandler(t *testing.T) {
+	const n = 10
+	h := newHiveForTest()
+	release := make(chan struct{})
+	marked := make(chan struct{})
+	handled := 0
+	a := h.NewApp("rmhandler")
+	a.HandleFunc(rmHandlerMsg(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		if handled == 0 {
+			<-release
+		}
+		handled++
+		return nil
+	})
+	a.HandleFunc(rmHandlerMarker{}, func(msg Msg, ctx MapContext) MappedCells {
+		close(marked)
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < n; i++ {
+		h.Emit(rmHandlerMsg(i))
+	}
+	// The marker is mapped after all the messages are queued on the bee.
+	h.Emit(rmHandlerMarker{})
+	<-marked
+
+	errc := make(chan error)
+	go func() {
+		errc <- a.RemoveHandler(rmHandlerMsg(0))
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("RemoveHandler returns before the queue is drained: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatalf("cannot remove the handler: %v", err)
+	}
+	if handled != n {
+		t.Errorf("invalid number of drained messages: actual=%v want=%v", handled,
+			n)
+	}
+
+	h.Emit(rmHandlerMsg(n))
+	time.Sleep(100 * time.Millisecond)
+	if handled != n {
+		t.Errorf("message is handled after the handler is removed")
+	}
+
+	if err := a.RemoveHandler(rmHandlerMsg(0)); err != ErrNoHandler {
+		t.Errorf("invalid error for a removed handler: actual=%v want=%v", err,
+			ErrNoHandler)
+	}
+}
+
+type autoTxTestMsg int
+
+type autoTxTestEmitted int
+
+func TestAppAutoTx(t *testing.T) {
+	for _, autoTx := range []bool{false, true} {
+		h := newHiveForTest()
+		ch := make(chan autoTxTestEmitted, 1)
+		a := h.NewApp("autotx")
+		a.SetAutoTx(autoTx)
+		a.HandleFunc(autoTxTestMsg(0), func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ctx.Emit(autoTxTestEmitted(msg.Data().(autoTxTestMsg)))
+			return fmt.Errorf("error after emit")
+		})
+		a.HandleFunc(autoTxTestEmitted(0),
+			func(msg Msg, ctx MapContext) MappedCells {
+				return MappedCells{{"E", "0"}}
+			}, func(msg Msg, ctx RcvContext) error {
+				ch <- msg.Data().(autoTxTestEmitted)
+				return nil
+			})
+
+		go h.Start()
+		waitTilStareted(h)
+
+		h.Emit(autoTxTestMsg(1))
+		select {
+		case <-ch:
+			if autoTx {
+				t.Error("the message emitted by a failed handler is delivered")
+			}
+		case <-time.After(500 * time.Millisecond):
+			if !autoTx {
+				t.Error("the message emitted without auto tx is not delivered")
+			}
+		}
+		h.Stop()
+	}
+}
+
+type handlersTestMsgA struct{}
+type handlersTestMsgB struct{}
+
+func TestAppHandlers(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("handlers")
+	mapf := func(msg Msg, ctx MapContext) MappedCells { return nil }
+	rcvf := func(msg Msg, ctx RcvContext) error { return nil }
+	a.HandleFunc(handlersTestMsgA{}, mapf, rcvf)
+	a.HandleFunc(handlersTestMsgB{}, mapf, rcvf)
+
+	want := []string{MsgType(handlersTestMsgA{}), MsgType(handlersTestMsgB{})}
+	if types := a.Handlers(); fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Errorf("invalid handlers: actual=%v want=%v", types, want)
+	}
+
+	found := false
+	for _, n := range h.Apps() {
+		found = found || n == a.Name()
+	}
+	if !found {
+		t.Errorf("%v is not in the hive's apps: %v", a.Name(), h.Apps())
+	}
+
+	if err := a.RemoveHandler(handlersTestMsgA{}); err != nil {
+		t.Fatalf("cannot remove the handler: %v", err)
+	}
+	want = want[1:]
+	if types := a.Handlers(); fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Errorf("invalid handlers after removal: actual=%v want=%v", types, want)
+	}
+}
+
+func TestAppValidator(t *testing.T) {
+	rcvd := make(chan AppTestMsg, 10)
+	dead := make(chan DeadLetter, 10)
+	h := newHiveForTest()
+	a := h.NewApp("validated")
+	a.SetValidator(func(m Msg) error {
+		if m.Data().(AppTestMsg) < 0 {
+			return fmt.Errorf("negative message: %v", m.Data())
+		}
+		return nil
+	})
+	a.HandleFunc(AppTestMsg(0), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		rcvd <- m.Data().(AppTestMsg)
+		return nil
+	})
+	h.NewApp("deadletter").HandleFunc(DeadLetter{},
+		func(m Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, ctx RcvContext) error {
+			dead <- m.Data().(DeadLetter)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(AppTestMsg(-1))
+	h.Emit(AppTestMsg(1))
+	select {
+	case d := <-dead:
+		if d.App != "validated" || d.Data != AppTestMsg(-1) || d.Err == "" {
+			t.Errorf("invalid dead letter: %#v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter for an invalid message")
+	}
+	select {
+	case m := <-rcvd:
+		if m != 1 {
+			t.Errorf("the handler is invoked for an invalid message: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the valid message is not handled")
+	}
+	select {
+	case m := <-rcvd:
+		t.Errorf("unexpected message handled: %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type shardTestMsgA struct{ Key string }
+type shardTestMsgB struct{ Key string }
+
+func TestAppShardBy(t *testing.T) {
+	type res struct {
+		key string
+		bee uint64
+	}
+	ch := make(chan res, 10)
+	h := newHiveForTest()
+	a := h.NewApp("sharded")
+	a.ShardBy(shardTestMsgA{}, func(m interface{}) string {
+		return m.(shardTestMsgA).Key
+	})
+	a.ShardBy(shardTestMsgB{}, func(m interface{}) string {
+		return m.(shardTestMsgB).Key
+	})
+	rcvf := func(m Msg, ctx RcvContext) error {
+		var k string
+		switch d := m.Data().(type) {
+		case shardTestMsgA:
+			k = d.Key
+		case shardTestMsgB:
+			k = d.Key
+		}
+		ch <- res{key: k, bee: ctx.ID()}
+		return nil
+	}
+	a.HandleFunc(shardTestMsgA{}, nil, rcvf)
+	a.HandleFunc(shardTestMsgB{}, nil, rcvf)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(shardTestMsgA{Key: "x"})
+	h.Emit(shardTestMsgB{Key: "x"})
+	h.Emit(shardTestMsgA{Key: "y"})
+	h.Emit(shardTestMsgA{Key: "x"})
+
+	bees := make(map[string]uint64)
+	for i := 0; i < 4; i++ {
+		select {
+		case r := <-ch:
+			if b, ok := bees[r.key]; ok && b != r.bee {
+				t.Errorf("key %v is handled by bees %v and %v", r.key, b, r.bee)
+			}
+			bees[r.key] = r.bee
+		case <-time.After(5 * time.Second):
+			t.Fatal("sharded messages are not handled")
+		}
+	}
+	if bees["x"] == bees["y"] {
+		t.Errorf("keys x and y are handled by the same bee %v", bees["x"])
+	}
+}
+
+type beeIDTestMsg string
+
+func TestAppBeeIDFunc(t *testing.T) {
+	rcvd := make(chan uint64, 10)
+	names := make(chan string, 10)
+	dead := make(chan DeadLetter, 10)
+	h := newHiveForTest()
+	a := h.NewApp("named")
+	a.SetBeeIDFunc(func(k CellKey) string {
+		switch k.Key {
+		case "a", "b":
+			return "switch-5"
+		}
+		return ""
+	})
+	a.HandleFunc(beeIDTestMsg(""), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", string(m.Data().(beeIDTestMsg))}}
+	}, func(m Msg, ctx RcvContext) error {
+		names <- ctx.BeeName()
+		rcvd <- ctx.ID()
+		return nil
+	})
+	h.NewApp("deadletter").HandleFunc(DeadLetter{},
+		func(m Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, ctx RcvContext) error {
+			dead <- m.Data().(DeadLetter)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(beeIDTestMsg("a"))
+	var id uint64
+	select {
+	case id = <-rcvd:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message is not handled")
+	}
+	i, err := h.(*hive).registry.bee(id)
+	if err != nil {
+		t.Fatalf("cannot find bee %v: %v", id, err)
+	}
+	if i.Name != "switch-5" {
+		t.Errorf("invalid bee name: actual=%q want=%q", i.Name, "switch-5")
+	}
+	if n := <-names; n != "switch-5" {
+		t.Errorf("invalid bee name in context: actual=%q want=%q", n, "switch-5")
+	}
+	if b, ok := localBee(h, "named"); !ok ||
+		!strings.Contains(b.String(), "switch-5") {
+
+		t.Errorf("bee name is not in the string of the bee: %v", b)
+	}
+
+	// The messages of the same cell are handled by the named bee.
+	h.Emit(beeIDTestMsg("a"))
+	if rid := <-rcvd; rid != id {
+		t.Errorf("message is handled by another bee: actual=%v want=%v", rid, id)
+	}
+
+	h.Emit(beeIDTestMsg("b"))
+	select {
+	case d := <-dead:
+		if d.App != "named" || d.Data != beeIDTestMsg("b") ||
+			d.Err != ErrDuplicateBeeName.Error() {
+
+			t.Errorf("invalid dead letter: %#v", d)
+		}
+	case rid := <-rcvd:
+		t.Fatalf("the message of a colliding bee is handled by %v", rid)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the colliding bee is not rejected")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"math/bits"
+	"math/rand"
 	"path"
 	"runtime/debug"
 	"sync"
@@ -29,8 +31,25 @@ const (
 )
 
 var (
-	ErrOldTx       = errors.New("transaction has an old term")
+	ErrOldTx       = newRoutingError(ErrTxConflict, "transaction has an old term")
 	ErrIsNotMaster = errors.New("bee is not master")
+	ErrCellsLocked = newRoutingError(ErrTxConflict,
+		"cells are locked by another bee")
+	ErrLockTimeout = errors.New("timeout in locking cells")
+
+	ErrTooManyDetached = errors.New("too many detached bees")
+	ErrBeeUnreachable  = newRoutingError(ErrHiveUnreachable, "bee is unreachable")
+
+	// ErrHandlerTimeout is returned when the handler does not return within the
+	// handler timeout of the app. It is also returned, or panicked with, by the
+	// context of a handler that is timed out.
+	ErrHandlerTimeout = errors.New("handler timed out")
+
+	// ErrDraining is returned when a bee is created on a hive that is
+	// draining.
+	ErrDraining = errors.New("hive is draining")
+
+	errBackingOff = newRoutingError(ErrHiveUnreachable, "backing off")
 )
 
 type bee struct {
@@ -40,18 +59,30 @@ type bee struct {
 	beeColony Colony
 	detached  bool
 	proxy     bool
+	failover  bool // whether the follower handles messages of its leader.
 	status    beeStatus
 	qee       *qee
 	app       *app
 	hive      *hive
-	timers    []*time.Timer
+	timers    []ClockTimer
 	cells     map[CellKey]bool
 
+	staleLocks sync.WaitGroup // unlocks of the lock proposals that timed out.
+
+	queuedM sync.Mutex
+	queued  int  // messages queued on the bee and counted as hive inflight.
+	drained bool // whether the queued messages are no longer counted.
+
+	initialized bool            // whether all handlers are initialized.
+	inited      map[string]bool // initialized handlers by message type.
+
 	dataCh    *msgChannel
-	outCh     chan []*msg
+	outQ      *msgChannel // rate-limited messages; nil if the rate is unlimited.
 	ctrlCh    chan cmdAndChannel
+	done      chan struct{} // closed when the loop of the bee exits.
 	handleMsg func(mhs []msgAndHandler)
 	handleCmd func(cc cmdAndChannel)
+	worker    *worker // the worker of the app's scheduler, if any.
 	batchSize uint
 	prxClient clientBackoff
 
@@ -61,30 +92,73 @@ type bee struct {
 	emitInRaft bool
 	raftTerm   uint64
 	txTerm     uint64
+	txGen      uint64
+	txLastID   uint64          // the ID of the last applied commitTx.
+	outboxSent map[uint64]bool // outbox entries delivered by this bee.
 
 	stateL1  *state.Transactional
 	stateL2  *state.Transactional
 	msgBufL1 []*msg
 	msgBufL2 []*msg
 
-	local interface{}
+	txErr error  // the error to be returned when committing the current tx.
+	txSeq uint64 // the sequence of the current or the last tx.
+
+	hooksL1 txHooks // commit hooks of the L1 transaction.
+	hooksL2 txHooks // commit hooks of the L2 transaction.
+
+	restores uint64 // number of restored snapshots. Accessed atomically.
+
+	rand   *rand.Rand
+	local  interface{}
+	locals map[string]interface{} // keyed bee-local storage.
+	trace  uint64                 // trace ID of the message being handled.
+	clock  causalClock            // causal state of a causally ordered bee.
+
+	coalesceM sync.Mutex
+	coalesced map[string]*msg // the latest coalesced messages keyed by key.
 }
 
 func (b *bee) ID() uint64 {
 	return b.beeID
 }
 
+func (b *bee) Colony() Colony {
+	return b.colony()
+}
+
+func (b *bee) Generation() uint64 {
+	return b.hive.registry.generation(b.group())
+}
+
+// BeeName returns the name of the bee in the registry.
+func (b *bee) BeeName() string {
+	if b.app.beeIDFunc == nil {
+		return ""
+	}
+	info, err := b.hive.registry.bee(b.ID())
+	if err != nil {
+		return ""
+	}
+	return info.Name
+}
+
 func (b *bee) String() string {
+	var s string
 	switch {
 	case b.detached:
-		return fmt.Sprintf("detached bee %v/%v/%016X", b.hive.ID(), b.app.Name(),
+		s = fmt.Sprintf("detached bee %v/%v/%016X", b.hive.ID(), b.app.Name(),
 			b.ID())
 	case b.proxy:
-		return fmt.Sprintf("proxy bee %v/%v/%016X", b.hive.ID(), b.app.Name(),
+		s = fmt.Sprintf("proxy bee %v/%v/%016X", b.hive.ID(), b.app.Name(),
 			b.ID())
 	default:
-		return fmt.Sprintf("bee %v/%v/%016X", b.hive.ID(), b.app.Name(), b.ID())
+		s = fmt.Sprintf("bee %v/%v/%016X", b.hive.ID(), b.app.Name(), b.ID())
+	}
+	if n := b.BeeName(); n != "" {
+		s += fmt.Sprintf(" (%v)", n)
 	}
+	return s
 }
 
 func (b *bee) Printf(format string, a ...interface{}) {
@@ -159,7 +233,8 @@ func (b *bee) createGroup() error {
 		StateMachine:   b,
 		Peers:          b.peers(),
 		DataDir:        b.statePath(),
-		SnapCount:      1024,
+		SnapCount:      b.hive.config.SnapshotThreshold,
+		CatchUpEntries: b.hive.config.SnapshotThreshold,
 		FsyncTick:      b.hive.config.RaftFsyncTick,
 		ElectionTicks:  b.hive.config.RaftElectTicks,
 		HeartbeatTicks: b.hive.config.RaftHBTicks,
@@ -175,6 +250,7 @@ func (b *bee) createGroup() error {
 	}
 
 	b.enableEmit()
+	b.redeliverOutbox()
 	glog.V(2).Infof("%v started its raft node", b)
 	return nil
 }
@@ -336,20 +412,58 @@ func (b *bee) startDetached(h DetachedHandler) {
 		glog.Fatalf("%v is not detached", b)
 	}
 
+	started := make(chan bool, 1)
+	quit := make(chan struct{})
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
 				glog.Errorf("%v recovers from an error in Start(): %v", b, r)
 			}
 		}()
+		if !b.waitPollerPhase(quit) {
+			started <- false
+			return
+		}
+		started <- true
 		h.Start(b)
 	}()
-	defer h.Stop(b)
+	defer func() {
+		close(quit)
+		if <-started {
+			h.Stop(b)
+		}
+	}()
+	defer b.qee.detachedDone()
 
 	b.start()
 }
 
+// waitPollerPhase waits for the phase of the detached bee, if the app has a
+// poller jitter. It returns false if quit is closed before that.
+func (b *bee) waitPollerPhase(quit <-chan struct{}) bool {
+	d := b.app.pollerJitter
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-b.hive.config.Clock.After(pollerPhase(b.ID(), d)):
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// pollerPhase returns the phase of bee in [0, d). Bee IDs are multiplied by
+// 2^64/phi (i.e., Fibonacci hashing), which spreads consecutive IDs evenly
+// over the interval.
+func pollerPhase(bee uint64, d time.Duration) time.Duration {
+	p, _ := bits.Mul64(bee*0x9E3779B97F4A7C15, uint64(d))
+	return time.Duration(p)
+}
+
 func (b *bee) start() {
+	defer close(b.done)
+
 	if !b.proxy && !b.isColonyNil() && b.app.persistent() {
 		if err := b.createGroup(); err != nil {
 			glog.Errorf("%v cannot start raft: %v", b, err)
@@ -360,22 +474,40 @@ func (b *bee) start() {
 	b.status = beeStatusStarted
 	glog.V(2).Infof("%v started", b)
 
+	if s := b.app.sched; s != nil && !b.proxy && !b.detached {
+		b.worker = s.worker(b.ID())
+		defer s.release()
+	}
+
 	dataCh := b.dataCh.out()
 	batch := make([]msgAndHandler, 0, b.batchSize)
 
-	outCh := b.outCh
-	var outM []*msg
-	if b.outBucket.Unlimited() {
-		outM = nil
+	var outCh <-chan msgAndHandler
+	if b.outQ != nil {
+		outCh = b.outQ.out()
 	}
+	var outM msgAndHandler
 
 	b.inBucket.Reset()
 	b.outBucket.Reset()
 	var inT <-chan time.Time
 	var outT <-chan time.Time
 
+	paused, pauseCh := b.hive.pause.state()
+	if paused {
+		dataCh = nil
+	}
+
 	for b.status == beeStatusStarted {
 		select {
+		case <-pauseCh:
+			paused, pauseCh = b.hive.pause.state()
+			if paused {
+				dataCh = nil
+			} else if inT == nil {
+				dataCh = b.dataCh.out()
+			}
+
 		case mh := <-dataCh:
 			batch = append(batch, mh)
 		loop:
@@ -388,41 +520,44 @@ func (b *bee) start() {
 				}
 			}
 
+			b.dequeued(len(batch))
 			t := uint64(len(batch))
 			if !b.inBucket.Get(t) {
 				dataCh = nil
-				inT = time.After(b.inBucket.When(t))
+				inT = b.hive.config.Clock.After(b.inBucket.When(t))
 				break
 			}
 
-			b.handleMsg(batch)
+			b.schedule(batch)
 			batch = clearBatch(batch)
 
 		case <-inT:
 			if !b.inBucket.Get(uint64(len(batch))) {
 				glog.Fatalf("cannot get tokens after the wait")
 			}
-			b.handleMsg(batch)
+			b.schedule(batch)
 			batch = clearBatch(batch)
-			dataCh = b.dataCh.out()
+			if !paused {
+				dataCh = b.dataCh.out()
+			}
 			inT = nil
 
-		case outM = <-outCh:
-			l := uint64(len(outM))
-			if b.outBucket.Get(l) {
-				b.doEmit(outM)
+		case mh := <-outCh:
+			if b.outBucket.Get(1) {
+				b.doEmitThen([]*msg{mh.msg}, mh.emitted)
 				break
 			}
-			outT = time.After(b.outBucket.When(uint64(len(outM))))
+			outM = mh
+			outT = b.hive.config.Clock.After(b.outBucket.When(1))
 			outCh = nil
 
 		case <-outT:
-			if !b.outBucket.Get(uint64(len(outM))) {
+			if !b.outBucket.Get(1) {
 				glog.Fatalf("cannot get tokens after wait")
 			}
-			b.doEmit(outM)
-			outCh = b.outCh
-			outM = nil
+			b.doEmitThen([]*msg{outM.msg}, outM.emitted)
+			outCh = b.outQ.out()
+			outM = msgAndHandler{}
 			outT = nil
 
 		case c := <-b.ctrlCh:
@@ -431,6 +566,16 @@ func (b *bee) start() {
 	}
 }
 
+// schedule handles the batch on the bee's worker, or on the bee's goroutine if
+// the app has no scheduler.
+func (b *bee) schedule(batch []msgAndHandler) {
+	if b.worker == nil {
+		b.handleMsg(batch)
+		return
+	}
+	b.worker.do(func() { b.handleMsg(batch) })
+}
+
 func clearBatch(batch []msgAndHandler) []msgAndHandler {
 	for i := range batch {
 		batch[i].msg = nil
@@ -465,8 +610,30 @@ func (b *bee) callRcv(mh msgAndHandler) (err error) {
 		err = errRcv
 	}()
 
-	if err := mh.handler.Rcv(mh.msg, b); err != nil {
+	if b.app.causal && !b.causallyReady(mh) {
+		return nil
+	}
+
+	if b.isRedelivered(mh.msg) {
+		glog.V(2).Infof("%v drops redelivered message %v", b, mh.msg)
+		return nil
+	}
+
+	b.trace = mh.msg.MsgTrace
+	if v := b.app.validator; v != nil {
+		if err := v(mh.msg); err != nil {
+			glog.Errorf("%v drops invalid message %v: %v", b, mh.msg, err)
+			b.deadLetter(mh, err)
+			return errRcv
+		}
+	}
+
+	start := b.hive.config.Clock.Now()
+	defer b.hive.recordSpan(spanRcv, b.app.Name(), b.beeID, mh.msg, start)
+
+	if err := b.rcvWithTimeout(mh); err != nil {
 		b.recoverFromError(mh, err, false)
+		b.retry(mh, err)
 		return errRcv
 	}
 
@@ -481,15 +648,140 @@ func (b *bee) callRcv(mh msgAndHandler) (err error) {
 	return nil
 }
 
+// rcvPanic wraps the value recovered from a panic in a handler that runs in a
+// separate goroutine.
+type rcvPanic struct {
+	r interface{}
+}
+
+// rcvWithTimeout invokes rcv and waits at most for the handler timeout of the
+// app. The panics of the handler are propagated to the caller. The handler is
+// given a context that is abandoned once it times out.
+func (b *bee) rcvWithTimeout(mh msgAndHandler) error {
+	d := b.app.handlerTimeout
+	if d == 0 {
+		return b.rcv(b, mh, 0)
+	}
+
+	ctx := newTimedRcvContext(b)
+	defer ctx.cancel()
+
+	ch := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- rcvPanic{r: r}
+			}
+		}()
+		ch <- b.rcv(ctx, mh, 0)
+	}()
+
+	t := b.hive.config.Clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case res := <-ch:
+		return rcvResult(res)
+	case <-t.C():
+	}
+
+	ctx.abandon()
+	// The handler may have returned while the context was being abandoned.
+	select {
+	case res := <-ch:
+		return rcvResult(res)
+	default:
+	}
+
+	atomic.AddUint64(&b.app.timeouts, 1)
+	glog.Errorf("%v handler for %v does not return within %v", b,
+		mh.msg.Type(), d)
+	return ErrHandlerTimeout
+}
+
+// rcvResult returns the error of a handler run by rcvWithTimeout, and panics
+// if the handler has panicked.
+func rcvResult(res interface{}) error {
+	if p, ok := res.(rcvPanic); ok {
+		panic(p.r)
+	}
+	err, _ := res.(error)
+	return err
+}
+
+// rcv invokes the i-th middleware of the app, or the handler if there is no
+// middleware left.
+func (b *bee) rcv(ctx RcvContext, mh msgAndHandler, i int) error {
+	if i == len(b.app.middlewares) {
+		return mh.handler.Rcv(mh.msg, ctx)
+	}
+	return b.app.middlewares[i](ctx, mh.msg, func() error {
+		return b.rcv(ctx, mh, i+1)
+	})
+}
+
+// initRetry is the delay before the failed Init of the handlers is retried.
+const initRetry = 100 * time.Millisecond
+
+// initHandlers calls the Init method of the app's handlers that implement
+// Initializer and are not already initialized on this bee.
+func (b *bee) initHandlers() error {
+	b.hive.Lock()
+	handlers := make(map[string]Handler, len(b.app.handlers))
+	for t, h := range b.app.handlers {
+		handlers[t] = h
+	}
+	b.hive.Unlock()
+
+	for t, h := range handlers {
+		i, ok := h.(Initializer)
+		if !ok || b.inited[t] {
+			continue
+		}
+		if err := i.Init(b); err != nil {
+			return err
+		}
+		if b.inited == nil {
+			b.inited = make(map[string]bool)
+		}
+		b.inited[t] = true
+	}
+	b.initialized = true
+	return nil
+}
+
 func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
+	if !b.initialized {
+		if err := b.initHandlers(); err != nil {
+			glog.Errorf("%v cannot initialize its handlers: %v", b, err)
+			for _, mh := range mhs {
+				b.snooze(mh, initRetry)
+			}
+			return
+		}
+	}
+
+	if b.app.stateless {
+		b.handleMsgStateless(mhs)
+		return
+	}
 
 	usetx := b.app.transactional()
 	if usetx && len(mhs) > 1 {
+		b.Lock()
 		b.stateL2 = state.NewTransactional(b.stateL1)
 		b.stateL1.BeginTx()
+		b.Unlock()
+	}
+
+	// The latency of the messages in a batch includes the final commit, which is
+	// added after the batch is committed.
+	var lats []time.Duration
+	if usetx && b.stateL2 != nil {
+		lats = make([]time.Duration, len(mhs))
 	}
 
 	for i := range mhs {
+		start := b.hive.config.Clock.Now()
 		if usetx {
 			b.BeginTx()
 		}
@@ -504,7 +796,11 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 			var err error
 			if b.stateL2 == nil {
 				err = b.CommitTx()
-			} else if len(b.msgBufL1) == 0 && b.stateL2.HasEmptyTx() {
+			} else if b.txErr != nil {
+				err = b.abortOnTxErr()
+			} else if len(b.msgBufL1) == 0 && b.stateL2.HasEmptyTx() &&
+				b.hooksL2.empty() {
+
 				// If there is no pending L1 message and there is no state change,
 				// emit the buffered messages in L2 as a shortcut.
 				b.throttle(b.msgBufL2)
@@ -517,16 +813,27 @@ func (b *bee) handleMsgLeader(mhs []msgAndHandler) {
 				glog.Errorf("%v cannot commit a transaction: %v", b, err)
 			}
 		}
+
+		if lats != nil {
+			lats[i] = b.hive.config.Clock.Now().Sub(start)
+		} else {
+			b.app.latency.record(mh.msg.Type(), b.hive.config.Clock.Now().Sub(start))
+		}
 	}
 
 	if !usetx || b.stateL2 == nil {
 		return
 	}
 
+	start := b.hive.config.Clock.Now()
 	b.stateL2 = nil
 	if err := b.CommitTx(); err != nil && err != state.ErrNoTx {
 		glog.Errorf("%v cannot commit a transaction: %v", b, err)
 	}
+	commit := b.hive.config.Clock.Now().Sub(start)
+	for i := range mhs {
+		b.app.latency.record(mhs[i].msg.Type(), lats[i]+commit)
+	}
 }
 
 func (b *bee) group() uint64 {
@@ -544,10 +851,15 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdStop:
 		b.status = beeStatusStopped
 		b.disableEmit()
+		b.drainQueued()
+		if b.detached {
+			b.hive.unsubscribeDetached(b)
+		}
 		glog.V(2).Infof("%v stopped", b)
 
 	case cmdStart:
 		b.status = beeStatusStarted
+		b.countQueued()
 		glog.V(2).Infof("%v started", b)
 
 	case cmdSync:
@@ -556,6 +868,9 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdRestoreState:
 		err = b.stateL1.Restore(cmd.State)
 
+	case cmdSnapshot:
+		data, err = b.snapshot()
+
 	case cmdCampaign:
 		ctx, cnl := context.WithTimeout(context.Background(),
 			b.hive.config.RaftElectTimeout())
@@ -589,10 +904,22 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdAddMappedCells:
 		b.addMappedCells(cmd.Cells)
 
+	case cmdSplitCells:
+		data, err = b.splitCells(cmd.Cells)
+
+	case cmdMergeState:
+		err = b.mergeState(cmd.State)
+
+	case cmdRunOnBee:
+		err = b.runOnBee(cmd.F)
+
 	case cmdRefreshRole:
 		c := b.colony()
 		if c.Leader == b.ID() {
 			b.becomeLeader()
+			if b.app.persistent() {
+				b.redeliverOutbox()
+			}
 		} else {
 			b.becomeFollower()
 		}
@@ -600,6 +927,12 @@ func (b *bee) handleCmdLocal(cc cmdAndChannel) {
 	case cmdAddFollower:
 		err = b.addFollower(cmd.Bee, cmd.Hive)
 
+	case cmdReadReplica:
+		data, err = b.readReplica(cmd.Dict, cmd.Key)
+
+	case cmdRedeliverOutbox:
+		b.redeliverOutbox()
+
 	default:
 		err = fmt.Errorf("unknown bee command %#v", cmd)
 	}
@@ -651,10 +984,42 @@ func (b *bee) followerHandlers() (func(mhs []msgAndHandler),
 		glog.Fatalf("%v cannot find leader %v", b, c.Leader)
 	}
 
-	mfn, _ := b.proxyHandlers(c.Leader)
+	pfn, _ := b.proxyHandlers(c.Leader)
+	mfn := func(mhs []msgAndHandler) {
+		var fwd, failover []msgAndHandler
+		for _, mh := range mhs {
+			if mh.msg.MsgFailover {
+				failover = append(failover, mh)
+			} else {
+				fwd = append(fwd, mh)
+			}
+		}
+		if len(failover) != 0 {
+			b.handleMsgFailover(failover)
+		}
+		if len(fwd) != 0 {
+			pfn(fwd)
+		}
+	}
 	return mfn, b.handleCmdLocal
 }
 
+// dropBestEffort removes the best-effort messages from msgs, counts them as
+// dropped, and returns the remaining messages.
+func (b *bee) dropBestEffort(msgs []msg) []msg {
+	rest := msgs[:0]
+	for _, m := range msgs {
+		if m.MsgBestEffort {
+			b.hive.countBestEffortDrop()
+			glog.V(2).Infof("%v drops best-effort msg %v", b, m)
+			m.receipt.report(Dropped, m.MsgTo, nil)
+			continue
+		}
+		rest = append(rest, m)
+	}
+	return rest
+}
+
 func (b *bee) becomeProxy() {
 	b.proxy = true
 	b.handleMsg, b.handleCmd = b.proxyHandlers(b.ID())
@@ -669,44 +1034,24 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 	}
 
 	mfn := func(mhs []msgAndHandler) {
-		if !b.prxClient.backoff.Equal(time.Time{}) &&
-			time.Now().Before(b.prxClient.backoff) {
-
-			glog.Errorf("%v cannot send message: backing off", b)
-			return
-		}
-
-		if b.prxClient.client == nil {
-			c, err := b.hive.client.beeClient(to)
-			if err != nil {
-				if berr, ok := err.(*rpcBackoffError); ok {
-					b.prxClient = clientBackoff{backoff: berr.Until}
-				}
-				glog.Errorf("%v cannot send message: %v", b, err)
-				return
-			}
-			b.prxClient = clientBackoff{client: c}
-		}
-
 		msgs := make([]msg, 0, len(mhs))
 		for i := range mhs {
 			msg := *(mhs[i].msg)
 			msg.MsgTo = to
+			msg.MsgCausal = b.remoteStamp(mhs[i].msg)
 			msgs = append(msgs, msg)
 		}
 
-		for {
-			if err := b.prxClient.client.sendMsg(msgs); err == nil {
-				return
-			}
-
-			// Maybe a second try, if the previous connection is closed.
-			if b.prxClient.client, err = b.hive.client.resetBeeClient(to,
-				b.prxClient.client); err != nil {
-
-				glog.Errorf("%v cannot send message: %v", b, err)
-				return
-			}
+		err := b.sendProxied(to, msgs)
+		switch {
+		case err == nil:
+		case isOverloaded(err):
+			b.retryOverloaded(mhs)
+		case isNack(err), err == ErrMsgTooLarge:
+			// Rejected messages are not retried.
+			glog.Errorf("%v cannot send message: %v", b, err)
+		default:
+			b.handleUnreachable(to, mhs, err)
 		}
 	}
 
@@ -728,6 +1073,56 @@ func (b *bee) proxyHandlers(to uint64) (func(mhs []msgAndHandler),
 	return mfn, cfn
 }
 
+// sendProxied sends msgs to bee to. Best-effort messages are dropped if they
+// cannot be delivered on the first try.
+func (b *bee) sendProxied(to uint64, msgs []msg) error {
+	if info, err := b.hive.registry.bee(to); err == nil &&
+		b.hive.members.isDead(info.Hive) {
+
+		b.dropBestEffort(msgs)
+		return ErrBeeUnreachable
+	}
+
+	if !b.prxClient.backoff.Equal(time.Time{}) &&
+		b.hive.config.Clock.Now().Before(b.prxClient.backoff) {
+
+		b.dropBestEffort(msgs)
+		return errBackingOff
+	}
+
+	if b.prxClient.client == nil {
+		c, err := b.hive.client.beeClient(to)
+		if err != nil {
+			if berr, ok := err.(*rpcBackoffError); ok {
+				b.prxClient = clientBackoff{backoff: berr.Until}
+			}
+			b.dropBestEffort(msgs)
+			return err
+		}
+		b.prxClient = clientBackoff{client: c}
+	}
+
+	for {
+		err := b.prxClient.client.sendMsg(msgs)
+		if err == nil || isNack(err) || err == ErrMsgTooLarge {
+			reportDelivery(msgs, to, err)
+			return err
+		}
+
+		// Best-effort messages are not retried.
+		if msgs = b.dropBestEffort(msgs); len(msgs) == 0 {
+			return nil
+		}
+
+		// Maybe a second try, if the previous connection is closed.
+		if b.prxClient.client, err = b.hive.client.resetBeeClient(to,
+			b.prxClient.client); err != nil {
+
+			return err
+		}
+	}
+}
+
 func (b *bee) becomeDetached(h DetachedHandler) {
 	b.detached = true
 	b.handleMsg, b.handleCmd = b.detachedHandlers(h)
@@ -738,6 +1133,7 @@ func (b *bee) detachedHandlers(h DetachedHandler) (func(mhs []msgAndHandler),
 
 	mfn := func(mhs []msgAndHandler) {
 		for i := range mhs {
+			b.trace = mhs[i].msg.MsgTrace
 			h.Rcv(mhs[i].msg, b)
 		}
 	}
@@ -745,10 +1141,34 @@ func (b *bee) detachedHandlers(h DetachedHandler) (func(mhs []msgAndHandler),
 }
 
 func (b *bee) enqueMsg(mh msgAndHandler) {
+	mh = b.stampCausal(mh)
 	glog.V(3).Infof("%v enqueues message %v", b, mh.msg)
+	if !b.proxy {
+		mh.msg.receipt.report(Delivered, b.ID(), nil)
+	}
+	b.enqueued(1)
 	b.dataCh.in() <- mh
 }
 
+// enqueMsgs enqueues the messages routed to the bee at once.
+func (b *bee) enqueMsgs(mhs []msgAndHandler) {
+	if len(mhs) == 1 {
+		b.enqueMsg(mhs[0])
+		return
+	}
+
+	glog.V(3).Infof("%v enqueues %v messages", b, len(mhs))
+	b.enqueued(len(mhs))
+	in := b.dataCh.in()
+	for _, mh := range mhs {
+		mh = b.stampCausal(mh)
+		if !b.proxy {
+			mh.msg.receipt.report(Delivered, b.ID(), nil)
+		}
+		in <- mh
+	}
+}
+
 func (b *bee) enqueCmd(cc cmdAndChannel) {
 	glog.V(3).Infof("%v enqueues a command %v", b, cc)
 	b.ctrlCh <- cc
@@ -785,14 +1205,23 @@ func (b *bee) addMappedCells(cells MappedCells) {
 	}
 }
 
-func (b *bee) addTimer(t *time.Timer) {
+func (b *bee) delMappedCells(cells []CellKey) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, c := range cells {
+		delete(b.cells, c)
+	}
+}
+
+func (b *bee) addTimer(t ClockTimer) {
 	b.Lock()
 	defer b.Unlock()
 
 	b.timers = append(b.timers, t)
 }
 
-func (b *bee) delTimer(t *time.Timer) {
+func (b *bee) delTimer(t ClockTimer) {
 	b.Lock()
 	defer b.Unlock()
 
@@ -805,11 +1234,11 @@ func (b *bee) delTimer(t *time.Timer) {
 }
 
 func (b *bee) snooze(mh msgAndHandler, d time.Duration) {
-	t := time.NewTimer(d)
+	t := b.hive.config.Clock.NewTimer(d)
 	b.addTimer(t)
 
 	go func() {
-		<-t.C
+		<-t.C()
 		b.delTimer(t)
 		b.enqueMsg(mh)
 	}()
@@ -819,7 +1248,14 @@ func (b *bee) Hive() Hive {
 	return b.hive
 }
 
+func (b *bee) Context() context.Context {
+	return context.Background()
+}
+
 func (b *bee) Dict(n string) state.Dict {
+	if b.app.stateless {
+		panic(ErrStateless)
+	}
 	dicts, _ := b.currentState()
 	return dicts.Dict(n)
 }
@@ -830,47 +1266,111 @@ func (b *bee) App() string {
 
 // Emits a message. Note that m should be your data not an instance of Msg.
 func (b *bee) Emit(msgData interface{}) {
-	b.bufferOrEmit(newMsgFromData(msgData, b.ID(), 0))
+	b.bufferOrEmit(b.hive.newMsg(msgData, b.ID(), 0))
+}
+
+func (b *bee) EmitBatch(msgData []interface{}) {
+	msgs := make([]*msg, 0, len(msgData))
+	for _, d := range msgData {
+		msgs = append(msgs, b.hive.newMsg(d, b.ID(), 0))
+	}
+	b.bufferOrEmit(msgs...)
+}
+
+func (b *bee) EmitWithPriority(msgData interface{}, prio int) {
+	m := b.hive.newMsg(msgData, b.ID(), 0)
+	m.MsgPrio = prio
+	b.bufferOrEmit(m)
+}
+
+// EmitBestEffort emits a message that is dropped, instead of retried, if it
+// cannot be relayed to a remote bee.
+func (b *bee) EmitBestEffort(msgData interface{}) {
+	m := b.hive.newMsg(msgData, b.ID(), 0)
+	m.MsgBestEffort = true
+	b.bufferOrEmit(m)
 }
 
 func (b *bee) doEmit(msgs []*msg) {
+	b.doEmitThen(msgs, nil)
+}
+
+// doEmitThen emits msgs, and calls emitted, if not nil, once they are emitted.
+func (b *bee) doEmitThen(msgs []*msg, emitted func()) {
+	if b.hive.overloaded() {
+		b.deferOverloaded(msgs, emitted)
+		return
+	}
+
+	if b.app.emitBucket != nil {
+		b.emitLimited(msgs)
+	} else {
+		b.enqueEmitted(msgs)
+	}
+	if emitted != nil {
+		emitted()
+	}
+}
+
+// enqueEmitted enqueues the messages emitted by the bee on the hive.
+func (b *bee) enqueEmitted(msgs []*msg) {
 	for i := range msgs {
-		b.hive.enqueMsg(msgs[i])
+		b.startCausal(msgs[i])
+		b.hive.observeEmit(msgs[i])
 	}
+	b.hive.enqueMsgs(msgs)
 }
 
+// throttle emits msgs, or queues them for the bee's goroutine if the out rate
+// of the bee is limited. The queue is unbounded so that handlers emitting more
+// than the burst of the bee do not block the goroutine that drains it, and
+// messages are emitted in the order they are queued.
 func (b *bee) throttle(msgs []*msg) {
-	if b.outBucket.Unlimited() {
-		b.doEmit(msgs)
+	b.throttleThen(msgs, nil)
+}
+
+// throttleThen throttles msgs, and calls emitted, if not nil, once all of them
+// are emitted.
+func (b *bee) throttleThen(msgs []*msg, emitted func()) {
+	if b.outQ == nil || len(msgs) == 0 {
+		b.doEmitThen(msgs, emitted)
 		return
 	}
 
-	max := b.outBucket.Max()
-	len := uint64(len(msgs))
-	for {
-		if len == 0 {
-			return
-		}
-		if len <= max {
-			b.outCh <- msgs
-			return
+	for i, m := range msgs {
+		mh := msgAndHandler{msg: m}
+		if i == len(msgs)-1 {
+			mh.emitted = emitted
 		}
+		b.outQ.in() <- mh
+	}
+}
 
-		b.outCh <- msgs[:max]
-		msgs = msgs[max:]
-		len -= max
+// traceID returns the trace ID for the messages emitted by the bee. If the bee
+// is not handling a traced message, a new trace is started.
+func (b *bee) traceID() uint64 {
+	if b.trace != 0 {
+		return b.trace
 	}
+	return b.hive.newTraceID()
 }
 
-func (b *bee) bufferOrEmit(m *msg) {
-	dicts, msgs := b.currentState()
+func (b *bee) bufferOrEmit(msgs ...*msg) {
+	for _, m := range msgs {
+		if m.MsgTrace == 0 {
+			m.MsgTrace = b.traceID()
+		}
+		b.hive.localCopy(m)
+	}
+
+	dicts, buf := b.currentState()
 	if dicts.TxStatus() != state.TxOpen {
-		b.throttle([]*msg{m})
+		b.throttle(msgs)
 		return
 	}
 
-	glog.V(2).Infof("buffers msg %+v in tx", m)
-	*msgs = append(*msgs, m)
+	glog.V(2).Infof("buffers %v msgs in tx", len(msgs))
+	*buf = append(*buf, msgs...)
 }
 
 func (b *bee) SendToCell(msgData interface{}, app string, cell CellKey) {
@@ -878,21 +1378,71 @@ func (b *bee) SendToCell(msgData interface{}, app string, cell CellKey) {
 	if err != nil {
 		glog.Fatalf("cannot find any bee in app %v for cell %v", app, cell)
 	}
-	msg := newMsgFromData(msgData, bi.ID, 0)
+	msg := b.hive.newMsg(msgData, bi.ID, 0)
 	b.bufferOrEmit(msg)
 }
 
 func (b *bee) SendToBee(msgData interface{}, to uint64) {
-	b.bufferOrEmit(newMsgFromData(msgData, b.beeID, to))
+	b.bufferOrEmit(b.hive.newMsg(msgData, b.beeID, to))
+}
+
+func (b *bee) EmitToSelf(msgData interface{}) {
+	b.SendToBee(msgData, b.beeID)
+}
+
+func (b *bee) SendToBeeErr(msgData interface{}, to uint64) error {
+	if err := b.resolveBee(to); err != nil {
+		if dicts, _ := b.currentState(); dicts.TxStatus() == state.TxOpen &&
+			b.txErr == nil {
+
+			b.txErr = err
+		}
+		return err
+	}
+
+	b.SendToBee(msgData, to)
+	return nil
+}
+
+// resolveBee returns an error if bee is not registered or if its hive cannot
+// be connected to.
+func (b *bee) resolveBee(to uint64) error {
+	bi, err := b.hive.bee(to)
+	if err != nil {
+		return err
+	}
+
+	if bi.Hive == b.hive.ID() {
+		return nil
+	}
+
+	if _, err := b.hive.client.hiveClient(bi.Hive); err != nil {
+		glog.Errorf("%v cannot connect to the hive of bee %v: %v", b, to, err)
+		return ErrBeeUnreachable
+	}
+	return nil
+}
+
+// abortOnTxErr aborts the current tx and returns the error of SendToBeeErr, if
+// any.
+func (b *bee) abortOnTxErr() error {
+	err := b.txErr
+	if err == nil {
+		return nil
+	}
+
+	b.AbortTx()
+	b.txErr = nil
+	return err
 }
 
 // Reply to msg with the provided reply.
 func (b *bee) Reply(msg Msg, reply interface{}) error {
 	if msg.NoReply() {
-		return errors.New("Cannot reply to this message.")
+		return ErrCannotReply
 	}
 
-	b.SendToBee(reply, msg.From())
+	b.bufferOrEmit(b.hive.newColonyMsg(reply, b.ID(), msg.From()))
 	return nil
 }
 
@@ -901,7 +1451,136 @@ func (b *bee) DeferReply(msg Msg) Repliable {
 }
 
 func (b *bee) LockCells(keys []CellKey) error {
-	panic("error FIXME bee.LOCK")
+	return b.lockCells(keys, time.Time{})
+}
+
+func (b *bee) LockWithTimeout(keys []CellKey, d time.Duration) error {
+	return b.lockCells(keys, b.hive.config.Clock.Now().Add(d))
+}
+
+// lockRetryInterval is the interval between retries to lock cells that are
+// locked by another bee.
+const lockRetryInterval = 20 * time.Millisecond
+
+// lockCells locks keys for the colony of the bee. If the keys are locked by
+// another colony, it retries until the deadline. A zero deadline means no
+// retries.
+func (b *bee) lockCells(keys []CellKey, deadline time.Time) error {
+	col := b.colony()
+	if col.IsNil() {
+		return fmt.Errorf("%v has no colony", b)
+	}
+
+	for {
+		err := b.tryLockCells(keys, col, deadline)
+		if err != ErrCellsLocked {
+			return err
+		}
+		if deadline.IsZero() {
+			return err
+		}
+		clock := b.hive.config.Clock
+		if clock.Now().Add(lockRetryInterval).After(deadline) {
+			return ErrLockTimeout
+		}
+		<-clock.After(lockRetryInterval)
+	}
+}
+
+func (b *bee) UnlockCells(keys []CellKey) error {
+	col := b.colony()
+	if col.IsNil() {
+		return fmt.Errorf("%v has no colony", b)
+	}
+
+	_, err := b.hive.node.ProposeRetry(hiveGroup, unlockMappedCell{
+		Colony: col,
+		App:    b.app.Name(),
+		Cells:  keys,
+	}, b.hive.config.RaftElectTimeout(), -1)
+	if err != nil {
+		return err
+	}
+
+	b.delMappedCells(keys)
+	return nil
+}
+
+func (b *bee) tryLockCells(keys []CellKey, col Colony,
+	deadline time.Time) error {
+
+	// Wait for the unlocks of the earlier lock proposals that have timed out, so
+	// that they do not release the cells locked here.
+	b.staleLocks.Wait()
+	if b.hive.registry.lockedByOthers(b.app.Name(), keys, col) {
+		return ErrCellsLocked
+	}
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cnl context.CancelFunc
+		ctx, cnl = context.WithTimeout(ctx,
+			deadline.Sub(b.hive.config.Clock.Now()))
+		defer cnl()
+	}
+	unowned := b.hive.registry.unownedCells(b.app.Name(), keys, col)
+	res, err := b.hive.node.Propose(ctx, hiveGroup, lockMappedCell{
+		Colony: col,
+		App:    b.app.Name(),
+		Cells:  keys,
+	})
+	switch {
+	case err == context.DeadlineExceeded:
+		b.unlockStale(unowned, col)
+		return ErrLockTimeout
+	case err != nil:
+		return err
+	case res.(Colony).Leader != col.Leader:
+		return ErrCellsLocked
+	}
+
+	b.addMappedCells(keys)
+	return nil
+}
+
+// unlockStale unlocks keys, which are locked by a lock proposal that has timed
+// out. The proposal may still be committed after its deadline, and the keys
+// would remain locked by col forever otherwise.
+func (b *bee) unlockStale(keys []CellKey, col Colony) {
+	if len(keys) == 0 {
+		return
+	}
+
+	b.staleLocks.Add(1)
+	go func() {
+		defer b.staleLocks.Done()
+		_, err := b.hive.node.ProposeRetry(hiveGroup, unlockMappedCell{
+			Colony: col,
+			App:    b.app.Name(),
+			Cells:  keys,
+		}, b.hive.config.RaftElectTimeout(), -1)
+		if err != nil {
+			// ErrNotLocked means that the lock proposal is dropped.
+			glog.V(2).Infof("%v cannot unlock %v: %v", b, keys, err)
+		}
+	}()
+}
+
+func (b *bee) RunOnBee(f func(ctx RcvContext)) {
+	if _, err := b.processCmd(cmdRunOnBee{F: f}); err != nil {
+		glog.Errorf("%v cannot run function: %v", b, err)
+	}
+}
+
+// runOnBee runs f in the loop of the bee, recovering from its panics.
+func (b *bee) runOnBee(f func(ctx RcvContext)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	f(b)
+	return nil
 }
 
 func (b *bee) SetBeeLocal(d interface{}) {
@@ -912,6 +1591,41 @@ func (b *bee) BeeLocal() interface{} {
 	return b.local
 }
 
+func (b *bee) BeeLocalGet(key string) (v interface{}, ok bool) {
+	v, ok = b.locals[key]
+	return
+}
+
+func (b *bee) BeeLocalSet(key string, v interface{}) {
+	if b.locals == nil {
+		b.locals = make(map[string]interface{})
+	}
+	b.locals[key] = v
+}
+
+func (b *bee) BeeLocalGetOrInit(key string,
+	init func() interface{}) interface{} {
+
+	if v, ok := b.locals[key]; ok {
+		return v
+	}
+	v := init()
+	b.BeeLocalSet(key, v)
+	return v
+}
+
+func (b *bee) Rand() *rand.Rand {
+	if b.rand == nil {
+		b.rand = rand.New(rand.NewSource(beeSeed(b.hive.config.Seed, b.ID())))
+	}
+	return b.rand
+}
+
+// beeSeed returns the seed of the pseudo-random source of bee.
+func beeSeed(seed int64, bee uint64) int64 {
+	return int64(hashString(fmt.Sprintf("%v/%v", seed, bee)))
+}
+
 func (b *bee) Sync(ctx context.Context, req interface{}) (res interface{},
 	err error) {
 
@@ -920,6 +1634,10 @@ func (b *bee) Sync(ctx context.Context, req interface{}) (res interface{},
 
 func (b *bee) StartDetached(h DetachedHandler) uint64 {
 	d, err := b.qee.processCmd(cmdStartDetached{Handler: h})
+	if err == ErrTooManyDetached {
+		glog.Errorf("%v cannot start a detached bee: %v", b, err)
+		return 0
+	}
 	if err != nil {
 		glog.Fatalf("Cannot start a detached bee: %v", err)
 	}
@@ -932,21 +1650,72 @@ func (b *bee) StartDetachedFunc(start StartFunc, stop StopFunc,
 	return b.StartDetached(&funcDetached{start, stop, rcv})
 }
 
+func (b *bee) StopDetached(id uint64) error {
+	if id == b.ID() && b.detached {
+		// The bee cannot wait for its own stop command.
+		go b.qee.stopDetached(id)
+		return nil
+	}
+	return b.qee.stopDetached(id)
+}
+
+func (b *bee) SubscribeDetached(msgType interface{}) {
+	if !b.detached {
+		glog.Errorf("%v cannot subscribe to %v: not detached", b,
+			MsgType(msgType))
+		return
+	}
+	b.hive.subscribeDetached(MsgType(msgType), b)
+}
+
 func (b *bee) BeginTx() error {
 	dicts, _ := b.currentState()
 	if dicts.TxStatus() == state.TxOpen {
 		return state.ErrOpenTx
 	}
 
-	if err := dicts.BeginTx(); err != nil {
+	// The bee is locked so that snapshots do not race with the transaction.
+	b.Lock()
+	err := dicts.BeginTx()
+	b.Unlock()
+	if err != nil {
 		glog.Errorf("Cannot begin a transaction for %v: %v", b, err)
 		return err
 	}
+	b.txErr = nil
+	b.txSeq++
+	if b.app.optimisticTx && !b.detached {
+		b.OnPreCommit(b.validateTx(b.app.txVersions.current()))
+	}
 
 	glog.V(2).Infof("%v begins a new transaction", b)
 	return nil
 }
 
+func (b *bee) InTx() bool {
+	dicts, _ := b.currentState()
+	return dicts.TxStatus() == state.TxOpen
+}
+
+func (b *bee) TxSeq() uint64 {
+	return b.txSeq
+}
+
+func (b *bee) TxBufferedMsgs() []Msg {
+	_, msgs := b.currentState()
+	res := make([]Msg, 0, len(*msgs))
+	for _, m := range *msgs {
+		c := *m
+		res = append(res, &c)
+	}
+	return res
+}
+
+func (b *bee) TxBufferedOps() []state.Op {
+	dicts, _ := b.currentState()
+	return dicts.TxOps()
+}
+
 func (b *bee) commitTxBothLayers() (err error) {
 	hasL2 := b.stateL2 != nil
 	if hasL2 {
@@ -989,9 +1758,14 @@ func (b *bee) commitTxL2() (err error) {
 	if b.stateL2 == nil {
 		return state.ErrNoTx
 	}
-	if err = b.stateL2.CommitTx(); err == nil {
+	if err = b.hooksL2.runPre(); err != nil {
+		b.stateL2.AbortTx()
+	} else if err = b.stateL2.CommitTx(); err == nil {
 		b.msgBufL1 = append(b.msgBufL1, b.msgBufL2...)
+		// Post-commit hooks run once the L1 transaction commits.
+		b.hooksL1.post = append(b.hooksL1.post, b.hooksL2.post...)
 	}
+	b.hooksL2.reset()
 	b.resetTx(b.stateL2, &b.msgBufL2)
 	return
 }
@@ -1041,21 +1815,89 @@ func (b *bee) replicate() error {
 		Tx:   stx,
 		Msgs: msgs,
 	}
-	ctx, cnl := context.WithTimeout(context.Background(),
-		10*b.hive.config.RaftElectTimeout())
-	defer cnl()
 	commit := commitTx{
 		Tx:   tx,
 		Term: b.term(),
+		ID:   newCommitID(),
+	}
+	// Fence the transactions of a stale leader, e.g., a leader that is not yet
+	// aware of a failover of its colony.
+	if gen := b.hive.registry.generation(b.colony().ID); commit.Term < gen {
+		glog.Errorf("%v cannot commit a transaction of term %v in generation %v",
+			b, commit.Term, gen)
+		b.stepDown()
+		return ErrOldTx
 	}
-	if _, err := b.hive.node.Propose(ctx, b.group(), commit); err != nil {
+	if err := b.proposeCommit(commit); err != nil {
 		glog.Errorf("%v cannot replicate the transaction: %v", b, err)
+		if err == ErrOldTx {
+			b.stepDown()
+		}
 		return err
 	}
 	glog.V(2).Infof("%v successfully replicates transaction", b)
+	b.logTx(commit)
 	return nil
 }
 
+// proposeCommit proposes the commit to the colony, and retries according to the
+// hive's replication retry policy. A failed proposal may still be committed
+// later, and retries are deduplicated using the ID of the commit.
+func (b *bee) proposeCommit(commit commitTx) (err error) {
+	p := b.hive.cfg().ReplicationRetry
+	backoff := p.Backoff
+	for i := 1; ; i++ {
+		ctx, cnl := context.WithTimeout(context.Background(),
+			10*b.hive.config.RaftElectTimeout())
+		_, err = b.hive.node.Propose(ctx, b.group(), commit)
+		cnl()
+		if err == nil || i >= p.Attempts {
+			return err
+		}
+
+		glog.Warningf("%v retries replicating the transaction in %v: %v", b,
+			backoff, err)
+		<-b.hive.config.Clock.After(backoff)
+		backoff *= 2
+	}
+}
+
+func newCommitID() uint64 {
+	for {
+		if id := uint64(rand.Int63()); id != 0 {
+			return id
+		}
+	}
+}
+
+// stepDown aborts the open transaction of the bee and demotes the bee once it
+// learns that its colony has a newer generation. The bee adopts its colony in
+// the registry and becomes a follower, or a zombie if it is no longer a member
+// of the colony.
+func (b *bee) stepDown() {
+	b.AbortTx()
+
+	i, err := b.hive.registry.bee(b.ID())
+	if err != nil {
+		glog.Errorf("%v cannot find itself in the registry: %v", b, err)
+		return
+	}
+
+	c := i.Colony
+	if c.Leader == b.ID() {
+		// The registry is not updated yet.
+		return
+	}
+
+	glog.Warningf("%v steps down as the leader of %v", b, c)
+	b.setColony(c)
+	if c.IsNil() || !c.Contains(b.ID()) {
+		b.becomeZombie()
+		return
+	}
+	b.becomeFollower()
+}
+
 func (b *bee) maybeRecruitFollowers() error {
 	if b.detached {
 		return nil
@@ -1230,15 +2072,36 @@ func (b *bee) currentState() (dicts *state.Transactional, msgs *[]*msg) {
 }
 
 func (b *bee) CommitTx() error {
+	if err := b.abortOnTxErr(); err != nil {
+		return err
+	}
+
+	for _, h := range []*txHooks{&b.hooksL2, &b.hooksL1} {
+		if err := h.runPre(); err != nil {
+			b.AbortTx()
+			return err
+		}
+	}
+	post := append(b.hooksL2.post, b.hooksL1.post...)
+	b.hooksL2.reset()
+	b.hooksL1.reset()
+
 	// No need to replicate and/or persist the transaction.
-	if !b.app.persistent() || b.detached {
+	if !b.app.persistent() || b.detached || b.failover {
 		glog.V(2).Infof("%v commits in memory transaction", b)
-		b.commitTxBothLayers()
+		if err := b.commitTxBothLayers(); err != nil {
+			return err
+		}
+		b.runPostCommit(post)
 		return nil
 	}
 
 	glog.V(2).Infof("%v commits persistent transaction", b)
-	return b.replicate()
+	if err := b.replicate(); err != nil {
+		return err
+	}
+	b.runPostCommit(post)
+	return nil
 }
 
 func (b *bee) AbortTx() error {
@@ -1248,6 +2111,10 @@ func (b *bee) AbortTx() error {
 	}
 
 	glog.V(2).Infof("%v aborts tx", b)
+	b.txErr = nil
+	b.currentHooks().reset()
+	b.Lock()
+	defer b.Unlock()
 	err := dicts.AbortTx()
 	b.resetTx(dicts, msgs)
 	return err
@@ -1257,11 +2124,20 @@ func (b *bee) Snooze(d time.Duration) {
 	panic(d)
 }
 
+// Save returns a snapshot of the state of the bee. It is called by raft
+// concurrently with the handlers, and the bee is locked while the state is
+// saved.
 func (b *bee) Save() ([]byte, error) {
+	b.Lock()
+	defer b.Unlock()
 	return b.stateL1.Save()
 }
 
 func (b *bee) Restore(buf []byte) error {
+	glog.V(2).Infof("%v restores its state from a snapshot", b)
+	atomic.AddUint64(&b.restores, 1)
+	b.Lock()
+	defer b.Unlock()
 	return b.stateL1.Restore(buf)
 }
 
@@ -1277,6 +2153,11 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 			return nil, ErrOldTx
 		}
 
+		if r.ID != 0 && r.ID == b.txLastID {
+			glog.V(2).Infof("%v ignores retried %v", b, r)
+			return nil, nil
+		}
+
 		glog.V(2).Infof("%v commits %v", b, r)
 		leader := b.isLeader()
 
@@ -1295,16 +2176,33 @@ func (b *bee) Apply(req interface{}) (interface{}, error) {
 		if err := b.stateL1.Apply(r.Tx.Ops); err != nil {
 			return nil, err
 		}
+		b.txGen++
+		b.txLastID = r.ID
+
+		if len(r.Tx.Msgs) == 0 {
+			return nil, nil
+		}
 
-		if leader && b.emitInRaft {
+		// Messages are kept in the outbox until the leader delivers them, so
+		// that they are delivered after a crash or a leader change.
+		for _, msg := range r.Tx.Msgs {
+			msg.MsgFrom = b.beeID
+		}
+		seq := b.addToOutbox(r.Tx.Msgs)
+		if leader && b.emitInRaft && b.markOutboxSent(seq) {
 			for _, msg := range r.Tx.Msgs {
-				msg.MsgFrom = b.beeID
 				glog.V(2).Infof("%v emits %#v", b, msg)
 			}
-			b.throttle(r.Tx.Msgs)
+			// The entry is acknowledged once the messages are emitted, and not
+			// when they are queued for the rate limit of the bee.
+			b.throttleThen(r.Tx.Msgs, func() { go b.ackOutbox(seq) })
 		}
 		return nil, nil
 
+	case outboxAck:
+		b.removeFromOutbox(r.Seq)
+		return nil, nil
+
 	case noOp:
 		return nil, nil
 	}
@@ -1353,6 +2251,7 @@ func (b *bee) ApplyConfChange(cc raftpb.ConfChange, gn raft.GroupNode) error {
 type commitTx struct {
 	Tx   tx
 	Term uint64
+	ID   uint64 // the random ID of the commit, to detect retried proposals.
 }
 
 func init() {
@@ -1,6 +1,8 @@
 package beehive
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"testing"
@@ -62,6 +64,104 @@ func TestDeferReply(t *testing.T) {
 	<-ch
 }
 
+type emitToSelfTestMsg int
+
+func TestEmitToSelf(t *testing.T) {
+	type result struct {
+		ID    uint64
+		Stage emitToSelfTestMsg
+		Prev  interface{}
+	}
+	ch := make(chan result)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		stage := msg.Data().(emitToSelfTestMsg)
+		prev, _ := ctx.Dict("D").Get("stage")
+		ctx.Dict("D").Put("stage", stage)
+		if stage == 1 {
+			ctx.EmitToSelf(emitToSelfTestMsg(2))
+		}
+		ch <- result{ID: ctx.ID(), Stage: stage, Prev: prev}
+		return nil
+	}
+
+	h := newHiveForTest()
+	app := h.NewApp("emittoself")
+	app.HandleFunc(emitToSelfTestMsg(0), mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(emitToSelfTestMsg(1))
+	r1 := <-ch
+	r2 := <-ch
+	if r2.Stage != 2 {
+		t.Errorf("invalid follow-up stage: actual=%v want=2", r2.Stage)
+	}
+	if r2.ID != r1.ID {
+		t.Errorf("follow-up is handled by another bee: actual=%v want=%v", r2.ID,
+			r1.ID)
+	}
+	if r2.Prev != emitToSelfTestMsg(1) {
+		t.Errorf("follow-up is handled before commit: actual=%v want=1", r2.Prev)
+	}
+}
+
+type beeLocalTestMsg int
+
+type beeLocalTestResult struct {
+	Count  int
+	Last   interface{}
+	Single interface{}
+}
+
+func TestBeeLocalKeys(t *testing.T) {
+	ch := make(chan beeLocalTestResult)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		cnt := ctx.BeeLocalGetOrInit("count", func() interface{} {
+			return new(int)
+		}).(*int)
+		*cnt++
+
+		last, _ := ctx.BeeLocalGet("last")
+		ctx.BeeLocalSet("last", msg.Data())
+		ctx.SetBeeLocal("single")
+
+		ch <- beeLocalTestResult{Count: *cnt, Last: last, Single: ctx.BeeLocal()}
+		return nil
+	}
+
+	h := newHiveForTest()
+	app := h.NewApp("beelocal")
+	app.HandleFunc(beeLocalTestMsg(0), mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	for i := 1; i <= 3; i++ {
+		h.Emit(beeLocalTestMsg(i))
+		r := <-ch
+		if r.Count != i {
+			t.Errorf("invalid count: actual=%v want=%v", r.Count, i)
+		}
+		if i == 1 {
+			if r.Last != nil {
+				t.Errorf("invalid initial last: actual=%v want=nil", r.Last)
+			}
+		} else if r.Last != beeLocalTestMsg(i-1) {
+			t.Errorf("invalid last: actual=%v want=%v", r.Last, i-1)
+		}
+		if r.Single != "single" {
+			t.Errorf("invalid bee local: actual=%v want=single", r.Single)
+		}
+	}
+}
+
 func TestInRate(t *testing.T) {
 	h := newHiveForTest()
 	type rateTestMsg struct{}
@@ -91,6 +191,171 @@ func TestInRate(t *testing.T) {
 	}
 }
 
+func TestBeeQueueStats(t *testing.T) {
+	qcap := uint(4)
+	h := newHiveForTest(BeeQueueCap(qcap))
+	type queueTestMsg struct{}
+	blocked := make(chan uint64)
+	release := make(chan struct{})
+	first := true
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		if first {
+			first = false
+			blocked <- ctx.ID()
+			<-release
+		}
+		return nil
+	}
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+
+	app := h.NewApp("queue")
+	app.HandleFunc(queueTestMsg{}, mapf, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(queueTestMsg{})
+	id := <-blocked
+	defer close(release)
+
+	n := 10 * int(qcap)
+	for i := 0; i < n; i++ {
+		h.Emit(queueTestMsg{})
+	}
+
+	var s QueueStats
+	for i := 0; i < 50; i++ {
+		s = h.BeeQueueStats()[id]
+		if s.HighWater >= uint64(n)-1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s.Cap != qcap {
+		t.Errorf("invalid queue capacity: actual=%v want=%v", s.Cap, qcap)
+	}
+	if s.HighWater <= uint64(qcap) || uint64(n) < s.HighWater {
+		t.Errorf("invalid high-water mark: actual=%v want=(%v, %v]", s.HighWater,
+			qcap, n)
+	}
+	if s.Overflows == 0 {
+		t.Errorf("invalid overflows: actual=0 want>0")
+	}
+}
+
+type lockTestMsg struct {
+	Key     string
+	Timeout time.Duration
+	Unlock  bool
+}
+
+func TestBeeLockWithTimeout(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan error)
+	locked := []CellKey{{"L", "x"}}
+	app := h.NewApp("lock")
+	app.HandleFunc(lockTestMsg{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(lockTestMsg).Key}}
+	}, func(m Msg, c RcvContext) error {
+		lm := m.Data().(lockTestMsg)
+		if lm.Unlock {
+			ch <- c.UnlockCells(locked)
+			return nil
+		}
+		ch <- c.LockWithTimeout(locked, lm.Timeout)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(lockTestMsg{Key: "a", Timeout: time.Second})
+	if err := <-ch; err != nil {
+		t.Fatalf("cannot lock the cells: %v", err)
+	}
+
+	h.Emit(lockTestMsg{Key: "a", Timeout: time.Second})
+	if err := <-ch; err != nil {
+		t.Errorf("cannot lock the cells twice by the same bee: %v", err)
+	}
+
+	start := time.Now()
+	timeout := 200 * time.Millisecond
+	h.Emit(lockTestMsg{Key: "b", Timeout: timeout})
+	if err := <-ch; err != ErrLockTimeout {
+		t.Errorf("invalid error in locking a locked cell: actual=%v want=%v", err,
+			ErrLockTimeout)
+	}
+	if d := time.Since(start); d > 5*timeout {
+		t.Errorf("lock does not timeout in time: actual=%v want=%v", d, timeout)
+	}
+
+	h.Emit(lockTestMsg{Key: "b", Unlock: true})
+	if err := <-ch; err != ErrNotLocked {
+		t.Errorf("invalid error in unlocking unheld cells: actual=%v want=%v", err,
+			ErrNotLocked)
+	}
+
+	h.Emit(lockTestMsg{Key: "a", Unlock: true})
+	if err := <-ch; err != nil {
+		t.Errorf("cannot unlock the cells: %v", err)
+	}
+
+	h.Emit(lockTestMsg{Key: "b", Timeout: time.Second})
+	if err := <-ch; err != nil {
+		t.Errorf("cannot lock the released cells: %v", err)
+	}
+}
+
+type staleLockTestMsg string
+
+func TestBeeLockTimeoutReleasesCells(t *testing.T) {
+	h := newHiveForTest()
+	n := 10
+	ch := make(chan []CellKey)
+	errCh := make(chan error)
+	app := h.NewApp("lock")
+	app.HandleFunc(staleLockTestMsg(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", string(m.Data().(staleLockTestMsg))}}
+	}, func(m Msg, c RcvContext) error {
+		b := c.(*bee)
+		if m.Data().(staleLockTestMsg) == "b" {
+			errCh <- b.LockCells(<-ch)
+			return nil
+		}
+
+		// The lock proposals time out, but they may be committed afterwards.
+		var timedout []CellKey
+		for i := 0; i < n; i++ {
+			k := CellKey{Dict: "L", Key: fmt.Sprint(i)}
+			if b.tryLockCells([]CellKey{k}, b.colony(), time.Now()) ==
+				ErrLockTimeout {
+
+				timedout = append(timedout, k)
+			}
+		}
+		b.staleLocks.Wait()
+		ch <- timedout
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(staleLockTestMsg("a"))
+	timedout := <-ch
+	h.Emit(staleLockTestMsg("b"))
+	ch <- timedout
+	if err := <-errCh; err != nil {
+		t.Errorf("the cells of timed out locks are not released: %v", err)
+	}
+}
+
 func TestOutRate(t *testing.T) {
 	h := newHiveForTest()
 
@@ -140,6 +405,216 @@ func TestOutRate(t *testing.T) {
 	}
 }
 
+type outRateBurstMsg int
+type outRateBurstStart struct{}
+
+func TestOutRateSustained(t *testing.T) {
+	h := newHiveForTest()
+
+	n := 50
+	rate := 50 * bucket.TPS
+	driverf := func(msg Msg, ctx RcvContext) error {
+		for i := 0; i < n; i++ {
+			ctx.Emit(outRateBurstMsg(i))
+		}
+		return nil
+	}
+
+	ch := make(chan time.Time, n)
+	sinkf := func(msg Msg, ctx RcvContext) error {
+		ch <- time.Now()
+		return nil
+	}
+
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+	h.NewApp("driver", OutRate(rate, 1)).HandleFunc(outRateBurstStart{}, mapf,
+		driverf)
+	h.NewApp("collector").HandleFunc(outRateBurstMsg(0), mapf, sinkf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(outRateBurstStart{})
+	var first, last time.Time
+	for i := 0; i < n; i++ {
+		select {
+		case last = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v messages: want=%v", i, n)
+		}
+		if i == 0 {
+			first = last
+		}
+	}
+
+	// n messages are delivered in at least (n-1)/rate seconds.
+	min := time.Duration(n-1) * time.Second / time.Duration(rate)
+	if d := last.Sub(first); d < min*9/10 {
+		t.Errorf("output rate is not capped: actual=%v want>=%v", d, min)
+	}
+}
+
+type emitOrderStart struct{ Sink uint64 }
+type emitOrderMsg int
+
+func TestEmitOrderWithoutTx(t *testing.T) {
+	h := newHiveForTest()
+	n := 200
+
+	driverf := func(msg Msg, ctx RcvContext) error {
+		sink := msg.Data().(emitOrderStart).Sink
+		for i := 0; i < n; i++ {
+			// Alternate between broadcasts and unicasts to the same bee.
+			if i%2 == 0 {
+				ctx.Emit(emitOrderMsg(i))
+			} else {
+				ctx.SendToBee(emitOrderMsg(i), sink)
+			}
+		}
+		return nil
+	}
+
+	ids := make(chan uint64, 1)
+	ch := make(chan int, n)
+	sinkf := func(msg Msg, ctx RcvContext) error {
+		if i := int(msg.Data().(emitOrderMsg)); i >= 0 {
+			ch <- i
+			return nil
+		}
+		ids <- ctx.ID()
+		return nil
+	}
+
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	h.NewApp("driver", OutRate(10000*bucket.TPS, 8)).HandleFunc(
+		emitOrderStart{}, mapf, driverf)
+	h.NewApp("sink").HandleFunc(emitOrderMsg(0), mapf, sinkf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(emitOrderMsg(-1))
+	h.Emit(emitOrderStart{Sink: <-ids})
+	for i := 0; i < n; i++ {
+		select {
+		case j := <-ch:
+			if j != i {
+				t.Fatalf("invalid order: actual=%v want=%v", j, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v messages: want=%v", i, n)
+		}
+	}
+}
+
+func TestEmitRate(t *testing.T) {
+	h := newHiveForTest()
+
+	n := 50
+	rate := 50
+	driverf := func(msg Msg, ctx RcvContext) error {
+		for i := 0; i < n; i++ {
+			ctx.Emit(outRateBurstMsg(i))
+		}
+		return nil
+	}
+
+	ch := make(chan time.Time, n)
+	sinkf := func(msg Msg, ctx RcvContext) error {
+		ch <- time.Now()
+		return nil
+	}
+
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+	driver := h.NewApp("driver")
+	driver.SetEmitRate(rate, 1)
+	driver.HandleFunc(outRateBurstStart{}, mapf, driverf)
+	h.NewApp("collector").HandleFunc(outRateBurstMsg(0), mapf, sinkf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(outRateBurstStart{})
+	var first, last time.Time
+	for i := 0; i < n; i++ {
+		select {
+		case last = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v messages: want=%v", i, n)
+		}
+		if i == 0 {
+			first = last
+		}
+	}
+
+	// n messages are delivered in at least (n-1)/rate seconds.
+	min := time.Duration(n-1) * time.Second / time.Duration(rate)
+	if d := last.Sub(first); d < min*9/10 {
+		t.Errorf("emit rate is not capped: actual=%v want>=%v", d, min)
+	}
+}
+
+func TestEmitRateDrop(t *testing.T) {
+	h := newHiveForTest()
+
+	n := 50
+	burst := 5
+	driverf := func(msg Msg, ctx RcvContext) error {
+		for i := 0; i < n; i++ {
+			ctx.Emit(outRateBurstMsg(i))
+		}
+		return nil
+	}
+
+	ch := make(chan struct{}, n)
+	sinkf := func(msg Msg, ctx RcvContext) error {
+		ch <- struct{}{}
+		return nil
+	}
+
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return ctx.LocalMappedCells()
+	}
+	driver := h.NewApp("driver")
+	driver.SetEmitRate(10, burst)
+	driver.SetEmitPolicy(DropEmit)
+	driver.HandleFunc(outRateBurstStart{}, mapf, driverf)
+	h.NewApp("collector").HandleFunc(outRateBurstMsg(0), mapf, sinkf)
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// Let the bucket of the driver fill up.
+	time.Sleep(time.Duration(burst) * 100 * time.Millisecond)
+	h.Emit(outRateBurstStart{})
+
+	delivered := 0
+	for {
+		select {
+		case <-ch:
+			delivered++
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+	// A token may be added while the driver emits.
+	if delivered < burst || burst+1 < delivered {
+		t.Errorf("invalid number of delivered messages: actual=%v want=%v",
+			delivered, burst)
+	}
+}
+
 func TestBeeTxTerm(t *testing.T) {
 	h := newHiveForTest()
 
@@ -192,6 +667,122 @@ func TestBeeTxTerm(t *testing.T) {
 	}
 }
 
+type sendToBeeErrTrigger struct {
+	To uint64
+}
+
+type sendToBeeErrPayload struct{}
+
+type sendToBeeErrResult struct {
+	ID   uint64
+	Last uint64
+	Err  error
+}
+
+func TestSendToBeeErr(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("sendtobeeerr")
+	pch := make(chan uint64, 1)
+	rch := make(chan sendToBeeErrResult)
+	a.HandleFunc(sendToBeeErrPayload{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		pch <- c.ID()
+		return nil
+	})
+	a.HandleFunc(sendToBeeErrTrigger{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		var last uint64
+		if v, err := c.Dict("D").Get("last"); err == nil {
+			last = v.(uint64)
+		}
+		to := m.Data().(sendToBeeErrTrigger).To
+		c.Dict("D").Put("last", to)
+		rch <- sendToBeeErrResult{
+			ID:   c.ID(),
+			Last: last,
+			Err:  c.SendToBeeErr(sendToBeeErrPayload{}, to),
+		}
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	send := func(to uint64) sendToBeeErrResult {
+		h.Emit(sendToBeeErrTrigger{To: to})
+		select {
+		case r := <-rch:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no result for bee %v", to)
+		}
+		return sendToBeeErrResult{}
+	}
+
+	// An unknown bee. The transaction is aborted, so "last" is not stored.
+	r := send(1 << 40)
+	if r.Err != ErrNoSuchBee {
+		t.Errorf("invalid error for an unknown bee: actual=%v want=%v", r.Err,
+			ErrNoSuchBee)
+	}
+	id := r.ID
+
+	// A valid bee.
+	r = send(id)
+	if r.Err != nil {
+		t.Errorf("invalid error for a valid bee: actual=%v want=nil", r.Err)
+	}
+	if r.Last != 0 {
+		t.Errorf("tx with an unknown bee is committed: actual=%v want=0", r.Last)
+	}
+	select {
+	case to := <-pch:
+		if to != id {
+			t.Errorf("message delivered to an invalid bee: actual=%v want=%v", to,
+				id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("message is not delivered to bee %v", id)
+	}
+
+	// A bee on a hive that is down.
+	testPort++
+	dead := HiveInfo{ID: 1000, Addr: fmt.Sprintf("127.0.0.1:%v", testPort)}
+	hv := h.(*hive)
+	hv.registry.m.Lock()
+	hv.registry.addHive(dead)
+	hv.registry.m.Unlock()
+	did, err := hv.apps["sendtobeeerr"].qee.newBeeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hv.node.ProposeRetry(hiveGroup, addBee(BeeInfo{ID: did,
+		Hive: dead.ID, App: "sendtobeeerr", Colony: Colony{ID: did, Leader: did}}),
+		hv.config.RaftElectTimeout(), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	r = send(did)
+	if r.Err != ErrBeeUnreachable {
+		t.Errorf("invalid error for a bee on a downed hive: actual=%v want=%v",
+			r.Err, ErrBeeUnreachable)
+	}
+	if r.Last != id {
+		t.Errorf("tx with a valid bee is not committed: actual=%v want=%v", r.Last,
+			id)
+	}
+
+	r = send(id)
+	if r.Last != id {
+		t.Errorf("tx with an unreachable bee is committed: actual=%v want=%v",
+			r.Last, id)
+	}
+	<-pch
+}
+
 type benchBeeHandler struct {
 	data []byte
 }
@@ -274,3 +865,299 @@ func BenchmarkBeePersistence(b *testing.B) {
 	time.Sleep(1 * time.Second)
 	hive.node.Stop()
 }
+
+type inTxTestMsg int
+
+func TestInTx(t *testing.T) {
+	type result struct {
+		Before, Inside, After bool
+		Seq, SeqAfter         uint64
+	}
+	ch := make(chan result)
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		var r result
+		r.Before = ctx.InTx()
+		ctx.BeginTx()
+		r.Inside = ctx.InTx()
+		r.Seq = ctx.TxSeq()
+		ctx.CommitTx()
+		r.After = ctx.InTx()
+		r.SeqAfter = ctx.TxSeq()
+		ch <- r
+		return nil
+	}
+
+	h := newHiveForTest()
+	app := h.NewApp("intx", NonTransactional())
+	app.HandleFunc(inTxTestMsg(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	for i := uint64(1); i <= 2; i++ {
+		h.Emit(inTxTestMsg(i))
+		r := <-ch
+		if r.Before || r.After {
+			t.Errorf("InTx is true outside of the tx: before=%v after=%v", r.Before,
+				r.After)
+		}
+		if !r.Inside {
+			t.Error("InTx is false inside the tx")
+		}
+		if r.Seq != i || r.SeqAfter != i {
+			t.Errorf("invalid tx seq: actual=%v,%v want=%v", r.Seq, r.SeqAfter, i)
+		}
+	}
+}
+
+type txBufTestMsg int
+type txBufTestOut int
+
+func TestTxBufferedMsgs(t *testing.T) {
+	type result struct {
+		Msgs []Msg
+		Ops  []state.Op
+		Left int
+	}
+	ch := make(chan result)
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ctx.BeginTx()
+		for i := 0; i < 3; i++ {
+			ctx.Emit(txBufTestOut(i))
+		}
+		ctx.Dict("D").Put("k", 1)
+		r := result{Msgs: ctx.TxBufferedMsgs(), Ops: ctx.TxBufferedOps()}
+		ctx.CommitTx()
+		r.Left = len(ctx.TxBufferedMsgs())
+		ch <- r
+		return nil
+	}
+
+	h := newHiveForTest()
+	app := h.NewApp("txbuf", NonTransactional())
+	app.HandleFunc(txBufTestMsg(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, rcvf)
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(txBufTestMsg(0))
+	r := <-ch
+	if len(r.Msgs) != 3 {
+		t.Fatalf("invalid number of buffered msgs: actual=%v want=3", len(r.Msgs))
+	}
+	for i, m := range r.Msgs {
+		if m.Data() != txBufTestOut(i) {
+			t.Errorf("invalid buffered msg: actual=%v want=%v", m.Data(), i)
+		}
+	}
+	if len(r.Ops) != 1 || r.Ops[0].D != "D" || r.Ops[0].K != "k" {
+		t.Errorf("invalid buffered ops: actual=%v want=[put D/k]", r.Ops)
+	}
+	if r.Left != 0 {
+		t.Errorf("msgs are buffered after commit: actual=%v want=0", r.Left)
+	}
+}
+
+type randTestMsg struct{}
+
+func TestBeeRand(t *testing.T) {
+	type result struct {
+		Bee  uint64
+		Rand [3]int64
+	}
+	run := func() result {
+		ch := make(chan result)
+		h := newHiveForTest(Seed(42))
+		h.NewApp("rand").HandleFunc(randTestMsg{},
+			func(msg Msg, ctx MapContext) MappedCells {
+				return MappedCells{{"D", "0"}}
+			}, func(msg Msg, ctx RcvContext) error {
+				r := result{Bee: ctx.ID()}
+				for i := range r.Rand {
+					r.Rand[i] = ctx.Rand().Int63()
+				}
+				ch <- r
+				return nil
+			})
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+
+		h.Emit(randTestMsg{})
+		return <-ch
+	}
+
+	r1 := run()
+	r2 := run()
+	if r1 != r2 {
+		t.Errorf("bees of hives with the same seed are not reproducible: %v != %v",
+			r1, r2)
+	}
+}
+
+type initTestMsg int
+
+type initTestHandler struct {
+	inits  int
+	inited bool
+	ch     chan bool
+}
+
+func (h *initTestHandler) Init(ctx RcvContext) error {
+	h.inits++
+	if h.inits == 1 {
+		return errors.New("first init fails")
+	}
+	h.inited = true
+	return nil
+}
+
+func (h *initTestHandler) Rcv(msg Msg, ctx RcvContext) error {
+	h.ch <- h.inited
+	return nil
+}
+
+func (h *initTestHandler) Map(msg Msg, ctx MapContext) MappedCells {
+	return MappedCells{{"D", "0"}}
+}
+
+func TestHandlerInit(t *testing.T) {
+	h := newHiveForTest()
+	hdl := &initTestHandler{ch: make(chan bool)}
+	app := h.NewApp("init")
+	app.Handle(initTestMsg(0), hdl)
+
+	go h.Start()
+	defer h.Stop()
+
+	const n = 3
+	for i := 0; i < n; i++ {
+		h.Emit(initTestMsg(i))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case inited := <-hdl.ch:
+			if !inited {
+				t.Error("message is handled before init")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not handled")
+		}
+	}
+	if hdl.inits != 2 {
+		t.Errorf("invalid number of inits: actual=%v want=2", hdl.inits)
+	}
+}
+
+type optimisticTestMsg string
+
+func TestOptimisticTxConflict(t *testing.T) {
+	h := newHiveForTest()
+	ready := make(chan struct{})
+	commit := make(chan struct{})
+	ch := make(chan error)
+	app := h.NewApp("optimistic")
+	app.SetOptimisticTx(true)
+	app.HandleFunc(optimisticTestMsg(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", string(m.Data().(optimisticTestMsg))}}
+	}, func(m Msg, c RcvContext) error {
+		d := c.Dict("S")
+		n, _ := d.Get("shared")
+		i, _ := n.(int)
+		d.Put("shared", i+1)
+		ready <- struct{}{}
+		<-commit
+		ch <- c.CommitTx()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// Both transactions are open before either commits.
+	h.Emit(optimisticTestMsg("a"))
+	h.Emit(optimisticTestMsg("b"))
+	<-ready
+	<-ready
+
+	commit <- struct{}{}
+	if err := <-ch; err != nil {
+		t.Fatalf("cannot commit the first transaction: %v", err)
+	}
+	commit <- struct{}{}
+	if err := <-ch; err != ErrConcurrentTx {
+		t.Errorf("invalid error for the conflicting transaction: actual=%v want=%v",
+			err, ErrConcurrentTx)
+	}
+
+	// The cells are not locked by the first committer: a transaction of the
+	// other bee, which begins after the commit, commits.
+	h.Emit(optimisticTestMsg("b"))
+	<-ready
+	commit <- struct{}{}
+	if err := <-ch; err != nil {
+		t.Errorf("cannot commit the retried transaction: %v", err)
+	}
+}
+
+type initElsewhereTestMsg int
+
+type initElsewhereTestHandler struct {
+	fail uint64 // the hive on which Init fails.
+	ch   chan uint64
+}
+
+func (h *initElsewhereTestHandler) Init(ctx RcvContext) error {
+	if ctx.Hive().ID() == h.fail {
+		return errors.New("init fails on this hive")
+	}
+	return nil
+}
+
+func (h *initElsewhereTestHandler) Rcv(msg Msg, ctx RcvContext) error {
+	h.ch <- ctx.Hive().ID()
+	return nil
+}
+
+func (h *initElsewhereTestHandler) Map(msg Msg,
+	ctx MapContext) MappedCells {
+
+	return MappedCells{{"D", "0"}}
+}
+
+func TestHandlerInitElsewhere(t *testing.T) {
+	ch := make(chan uint64, 1)
+	h1 := newHiveForTest()
+	hdl := &initElsewhereTestHandler{fail: h1.ID(), ch: ch}
+	h1.NewApp("init").Handle(initElsewhereTestMsg(0), hdl)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	h2.NewApp("init").Handle(initElsewhereTestMsg(0), hdl)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(initElsewhereTestMsg(0))
+	select {
+	case id := <-ch:
+		if id != h2.ID() {
+			t.Errorf("the bee is not placed on %v: actual=%v", h2.ID(), id)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("message is not handled")
+	}
+
+	for _, b := range h1.(*hive).registry.bees() {
+		if b.App == "init" && b.Hive == h1.ID() {
+			t.Errorf("bee %v is started on %v", b.ID, h1.ID())
+		}
+	}
+}
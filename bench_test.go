@@ -18,6 +18,12 @@ var (
 func benchmarkEndToEnd(b *testing.B, name string, hives int, emittingHive int,
 	handler Handler, app ...AppOption) {
 
+	benchmarkEndToEndWithHive(b, name, hives, emittingHive, nil, handler, app...)
+}
+
+func benchmarkEndToEndWithHive(b *testing.B, name string, hives int,
+	emittingHive int, hopts []HiveOption, handler Handler, app ...AppOption) {
+
 	// Warm up.
 	b.StopTimer()
 
@@ -28,9 +34,10 @@ func benchmarkEndToEnd(b *testing.B, name string, hives int, emittingHive int,
 	for i := 0; i < hives; i++ {
 		var h Hive
 		if i == 0 {
-			h = newHiveForTest()
+			h = newHiveForTest(hopts...)
 		} else {
-			h = newHiveForTest(PeerAddrs(hs[0].(*hive).config.Addr))
+			h = newHiveForTest(append(hopts,
+				PeerAddrs(hs[0].(*hive).config.Addr))...)
 		}
 		a := h.NewApp("handler", app...)
 		a.Handle(BenchMsg(0), handler)
@@ -116,6 +123,18 @@ func BenchmarkEndToEndReplicatedGob(b *testing.B) {
 	benchmarkEndToEnd(b, "r-gob", 3, 0, benchGobHandler{}, Persistent(3))
 }
 
+// The bees of the small tx benchmarks commit a transaction per message.
+func BenchmarkEndToEndReplicatedSmallTxBytes(b *testing.B) {
+	benchmarkEndToEndWithHive(b, "r-small-bytes", 3, 0,
+		[]HiveOption{BatchSize(1)}, benchBytesHandler{}, Persistent(3))
+}
+
+func BenchmarkEndToEndGroupCommitSmallTxBytes(b *testing.B) {
+	benchmarkEndToEndWithHive(b, "gc-small-bytes", 3, 0,
+		[]HiveOption{BatchSize(1), GroupCommitWindow(time.Millisecond)},
+		benchBytesHandler{}, Persistent(3))
+}
+
 func BenchmarkEndToEndRemoteTransactionalNoOp(b *testing.B) {
 	benchmarkEndToEnd(b, "rt-noop", 3, 2, benchNoOpHandler{}, Transactional())
 }
@@ -222,3 +241,44 @@ func (h benchKillHandler) Rcv(msg Msg, ctx RcvContext) error {
 func (h benchKillHandler) Map(msg Msg, ctx MapContext) MappedCells {
 	return MappedCells{{benchDict, msg.Data().(benchKill).key()}}
 }
+
+func benchmarkEmit(b *testing.B, batch bool) {
+	b.StopTimer()
+	log.SetOutput(ioutil.Discard)
+	kch := make(chan benchKill)
+	h := newHiveForTest()
+	a := h.NewApp("handler", NonTransactional())
+	a.Handle(BenchMsg(0), benchNoOpHandler{})
+	a.Handle(benchKill{}, benchKillHandler{ch: kch})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(benchKill{BenchMsg: BenchMsg(1)})
+	<-kch
+
+	msgs := make([]interface{}, b.N)
+	for i := range msgs {
+		msgs[i] = BenchMsg(1)
+	}
+
+	b.StartTimer()
+	if batch {
+		h.EmitBatch(msgs)
+	} else {
+		for _, m := range msgs {
+			h.Emit(m)
+		}
+	}
+	h.Emit(benchKill{BenchMsg: BenchMsg(1)})
+	<-kch
+	b.StopTimer()
+}
+
+func BenchmarkEmit(b *testing.B) {
+	benchmarkEmit(b, false)
+}
+
+func BenchmarkEmitBatch(b *testing.B) {
+	benchmarkEmit(b, true)
+}
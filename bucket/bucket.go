@@ -14,6 +14,7 @@ type Bucket struct {
 	quantum    uint64
 	resolution time.Duration
 	timestamp  time.Time
+	now        func() time.Time // nil means time.Now.
 }
 
 // Rate represents the rate of token generation per second.
@@ -80,12 +81,32 @@ func (b *Bucket) minimizeResolution() {
 	b.resolution /= time.Duration(d)
 }
 
+// SetClock sets the function used to get the current time, and starts adding
+// tokens from now. By default, the bucket uses time.Now.
+func (b *Bucket) SetClock(now func() time.Time) {
+	if b.Unlimited() {
+		return
+	}
+
+	b.Lock()
+	b.now = now
+	b.timestamp = b.clock()
+	b.Unlock()
+}
+
+func (b *Bucket) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
 func (b *Bucket) has(tokens uint64) bool {
 	return tokens <= b.tokens
 }
 
 func (b *Bucket) fill() {
-	n := time.Now()
+	n := b.clock()
 	d := n.Sub(b.timestamp)
 	if d < b.resolution {
 		return
@@ -120,7 +141,7 @@ func (b *Bucket) Reset() {
 	}
 
 	b.Lock()
-	b.timestamp = time.Now()
+	b.timestamp = b.clock()
 	b.tokens = 0
 	b.Unlock()
 }
@@ -0,0 +1,334 @@
+package beehive
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+const (
+	// causalRetry is the interval in which a bee rechecks a message whose
+	// causal dependencies are not observed yet.
+	causalRetry = 10 * time.Millisecond
+	// defaultCausalTimeout is the default time after which a bee handles a
+	// message even if its causal dependencies are not observed.
+	defaultCausalTimeout = time.Second
+)
+
+// causalEntry identifies the last message sent from a bee to another bee: its
+// sequence among the messages between the two bees, and when it is sent.
+type causalEntry struct {
+	Seq  uint64
+	Time time.Time
+}
+
+// mclock is a matrix clock: for each receiver bee, the last messages sent to it
+// by each sender bee that are known to a bee. Matrix clocks are never modified
+// once created, so that they can be shared among messages.
+type mclock map[uint64]map[uint64]causalEntry
+
+// merge returns a matrix clock with the maximum entries of c and o. The entries
+// older than ttl are dropped, so that the clocks of long-running bees remain
+// bounded.
+func (c mclock) merge(o mclock, now time.Time, ttl time.Duration) mclock {
+	m := make(mclock, len(c))
+	for _, s := range []mclock{c, o} {
+		for to, row := range s {
+			for from, e := range row {
+				if now.Sub(e.Time) > ttl {
+					continue
+				}
+				r, ok := m[to]
+				if !ok {
+					r = make(map[uint64]causalEntry)
+					m[to] = r
+				}
+				if r[from].Seq < e.Seq {
+					r[from] = e
+				}
+			}
+		}
+	}
+	return m
+}
+
+// with returns a copy of c in which the last message from from to to is e.
+func (c mclock) with(from, to uint64, e causalEntry) mclock {
+	m := make(mclock, len(c)+1)
+	for t, row := range c {
+		m[t] = row
+	}
+	r := make(map[uint64]causalEntry, len(c[to])+1)
+	for f, e := range c[to] {
+		r[f] = e
+	}
+	r[from] = e
+	m[to] = r
+	return m
+}
+
+// causalStamp is the causal metadata of a message sent to a bee of a causally
+// ordered app.
+type causalStamp struct {
+	// Seq is the sequence of the message among the messages sent by its sender
+	// to the receiver. Zero means that the message is not causally ordered.
+	Seq uint64
+	// Clock is the matrix clock of the sender when the message is sent. It is
+	// nil while the message is routed on the hive of the sender.
+	Clock mclock
+}
+
+// causalClock is the causal state of a bee in a causally ordered app.
+type causalClock struct {
+	sync.Mutex
+	known mclock            // the messages known to the bee.
+	sent  map[uint64]uint64 // the last message sent to each bee.
+	deliv map[uint64]uint64 // the last message delivered from each bee.
+}
+
+// next returns the sequence of the next message sent from b to the bee to.
+func (c *causalClock) next(from, to uint64, now time.Time) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	if c.sent == nil {
+		c.sent = make(map[uint64]uint64)
+	}
+	c.sent[to]++
+	n := c.sent[to]
+	c.known = c.known.with(from, to, causalEntry{Seq: n, Time: now})
+	return n
+}
+
+// causalSend is a message emitted by a bee of a causally ordered app, while the
+// message is routed on the hive of its sender. Each copy of the message sent to
+// a bee of a causally ordered app gets its own sequence, and the copies are
+// stamped with the same matrix clock once the message is routed by all apps.
+type causalSend struct {
+	sync.Mutex
+	from    *bee
+	known   mclock            // the clock of the sender when it emitted.
+	seqs    map[uint64]uint64 // the sequence of the copy sent to each bee.
+	pending int               // the number of apps yet to route the message.
+	clock   mclock            // the clock of the copies, once routed.
+	done    chan struct{}     // closed once the message is routed.
+}
+
+// expect sets the number of causally ordered apps that route the message.
+func (s *causalSend) expect(apps int) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.clock != nil {
+		return
+	}
+	s.pending += apps - 1
+	s.completeIfRouted()
+}
+
+// routed is called when a causally ordered app has routed the message to its
+// bees.
+func (s *causalSend) routed() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.clock != nil {
+		return
+	}
+	s.pending--
+	s.completeIfRouted()
+}
+
+func (s *causalSend) completeIfRouted() {
+	if s.pending > 0 {
+		return
+	}
+
+	now := s.from.hive.config.Clock.Now()
+	s.clock = s.known
+	for to, n := range s.seqs {
+		s.clock = s.clock.with(s.from.ID(), to, causalEntry{Seq: n, Time: now})
+	}
+	close(s.done)
+}
+
+// seq returns the sequence of the copy of the message sent to the bee to.
+func (s *causalSend) seq(to uint64) uint64 {
+	s.Lock()
+	defer s.Unlock()
+	if n, ok := s.seqs[to]; ok {
+		return n
+	}
+
+	n := s.from.clock.next(s.from.ID(), to, s.from.hive.config.Clock.Now())
+	if s.seqs == nil {
+		s.seqs = make(map[uint64]uint64)
+	}
+	s.seqs[to] = n
+	return n
+}
+
+// stamp returns the causal stamp of the copy of a message, and whether the
+// message is routed.
+func (m *msg) stamp() (causalStamp, bool) {
+	if m.causal == nil {
+		return m.MsgCausal, true
+	}
+
+	select {
+	case <-m.causal.done:
+		return causalStamp{Seq: m.MsgCausal.Seq, Clock: m.causal.clock}, true
+	default:
+		return causalStamp{Seq: m.MsgCausal.Seq}, false
+	}
+}
+
+// waitStamp is like stamp, but waits at most for d until the message is routed.
+func (m *msg) waitStamp(clock Clock, d time.Duration) (causalStamp, bool) {
+	if st, ok := m.stamp(); ok {
+		return st, true
+	}
+
+	select {
+	case <-m.causal.done:
+	case <-clock.After(d):
+	}
+	return m.stamp()
+}
+
+// remoteStamp returns the causal stamp of a message sent to a remote bee. The
+// stamp is materialized in the message, since the message is encoded.
+func (b *bee) remoteStamp(m *msg) causalStamp {
+	st, ok := m.waitStamp(b.hive.config.Clock, b.app.causalTimeout())
+	if !ok {
+		glog.Warningf("%v sends %v before it is routed", b, m)
+	}
+	return st
+}
+
+// causalTimeout returns the time after which the bees of a causally ordered
+// app handle a message even if its causal dependencies are not observed.
+func (a *app) causalTimeout() time.Duration {
+	if a.causalTTL == 0 {
+		return defaultCausalTimeout
+	}
+	return a.causalTTL
+}
+
+// startCausal prepares m for causal ordering, if the app of the bee is
+// causally ordered. It is called when the bee emits m.
+func (b *bee) startCausal(m *msg) {
+	if !b.app.causal || b.detached || m.causal != nil || m.MsgCausal.Seq != 0 {
+		return
+	}
+
+	b.clock.Lock()
+	known := b.clock.known
+	b.clock.Unlock()
+	m.causal = &causalSend{
+		from:    b,
+		known:   known,
+		pending: 1,
+		done:    make(chan struct{}),
+	}
+}
+
+// stampCausal returns the copy of the message of mh that is sent to this bee,
+// if the message is emitted by a causally ordered app and the app of the bee
+// is causally ordered.
+func (b *bee) stampCausal(mh msgAndHandler) msgAndHandler {
+	m := mh.msg
+	if !b.app.causal || b.detached || m.causal == nil || m.MsgCausal.Seq != 0 {
+		return mh
+	}
+
+	c := *m
+	c.MsgCausal.Seq = m.causal.seq(b.ID())
+	mh.msg = &c
+	return mh
+}
+
+// causallyReady returns whether the bee has handled the causal dependencies of
+// mh: the earlier messages of its sender to this bee, and the messages sent to
+// this bee that happened before mh. If not, mh is snoozed and rechecked later.
+// mh is ready after the causal timeout of the app regardless of its
+// dependencies.
+func (b *bee) causallyReady(mh msgAndHandler) bool {
+	m := mh.msg
+	if m.MsgCausal.Seq == 0 {
+		return true
+	}
+
+	now := b.hive.config.Clock.Now()
+	ttl := b.app.causalTimeout()
+	st, routed := m.waitStamp(b.hive.config.Clock, causalRetry)
+	ready := routed && b.clock.ready(b.ID(), m.MsgFrom, st, now, ttl)
+
+	switch {
+	case ready:
+	case m.causalSince.IsZero():
+		c := *m
+		c.causalSince = now
+		b.snooze(msgAndHandler{msg: &c, handler: mh.handler}, causalRetry)
+		return false
+	case now.Sub(m.causalSince) < ttl:
+		b.snooze(mh, causalRetry)
+		return false
+	default:
+		glog.Warningf("%v handles %v before its causal dependencies", b, m)
+	}
+
+	b.clock.deliver(m.MsgFrom, st, now, ttl)
+	return true
+}
+
+// ready returns whether the dependencies of the message stamped with st, sent
+// from the bee from to the bee to, are delivered. The dependencies older than
+// ttl are ignored.
+func (c *causalClock) ready(to, from uint64, st causalStamp, now time.Time,
+	ttl time.Duration) bool {
+
+	c.Lock()
+	defer c.Unlock()
+	if c.deliv[from]+1 < st.Seq {
+		return false
+	}
+	for f, e := range st.Clock[to] {
+		if f != from && c.deliv[f] < e.Seq && now.Sub(e.Time) <= ttl {
+			return false
+		}
+	}
+	return true
+}
+
+// deliver records the delivery of the message stamped with st from the bee
+// from.
+func (c *causalClock) deliver(from uint64, st causalStamp, now time.Time,
+	ttl time.Duration) {
+
+	c.Lock()
+	defer c.Unlock()
+	if c.deliv == nil {
+		c.deliv = make(map[uint64]uint64)
+	}
+	if c.deliv[from] < st.Seq {
+		c.deliv[from] = st.Seq
+	}
+	if st.Clock != nil {
+		c.known = c.known.merge(st.Clock, now, ttl)
+	}
+}
+
+// routed marks the message of mh as routed by the qee, if the app of the qee is
+// causally ordered.
+func (q *qee) routed(mh msgAndHandler) {
+	if q.app.causal {
+		mh.msg.causal.routed()
+	}
+}
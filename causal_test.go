@@ -0,0 +1,130 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type causalTestMsg string
+
+func TestCausalOrdering(t *testing.T) {
+	ch := make(chan causalTestMsg, 10)
+	idCh := make(chan uint64, 1)
+	h := newHiveForTest()
+	timeout := 300 * time.Millisecond
+	a := h.NewApp("causal", CausalTimeout(timeout))
+	a.SetCausalOrdering(true)
+	a.HandleFunc(causalTestMsg(""), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		if m.Data().(causalTestMsg) == "W" {
+			idCh <- ctx.ID()
+			return nil
+		}
+		ch <- m.Data().(causalTestMsg)
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(causalTestMsg("W"))
+	r := <-idCh
+
+	// Bee 2 sends B after handling A, which is sent by bee 1. B is delivered
+	// before A.
+	now := time.Now()
+	a1 := newMsgFromData(causalTestMsg("A"), 1, 0)
+	a1.MsgCausal = causalStamp{
+		Seq:   1,
+		Clock: mclock{r: {1: {Seq: 1, Time: now}}},
+	}
+	b2 := newMsgFromData(causalTestMsg("B"), 2, 0)
+	b2.MsgCausal = causalStamp{
+		Seq:   1,
+		Clock: mclock{r: {1: {Seq: 1, Time: now}, 2: {Seq: 1, Time: now}}},
+	}
+	// C depends on a message that is never delivered.
+	c3 := newMsgFromData(causalTestMsg("C"), 3, 0)
+	c3.MsgCausal = causalStamp{
+		Seq:   1,
+		Clock: mclock{r: {3: {Seq: 1, Time: now}, 4: {Seq: 1, Time: now}}},
+	}
+	// D depends on a message sent to another bee, and is not delayed.
+	d5 := newMsgFromData(causalTestMsg("D"), 5, 0)
+	d5.MsgCausal = causalStamp{
+		Seq: 1,
+		Clock: mclock{
+			r:     {5: {Seq: 1, Time: now}},
+			r + 1: {4: {Seq: 1, Time: now}},
+		},
+	}
+
+	hv := h.(*hive)
+	hv.enqueMsg(b2)
+	hv.enqueMsg(c3)
+	hv.enqueMsg(d5)
+	time.Sleep(100 * time.Millisecond)
+	hv.enqueMsg(a1)
+
+	for _, want := range []causalTestMsg{"D", "A", "B", "C"} {
+		select {
+		case m := <-ch:
+			if m != want {
+				t.Errorf("invalid message order: actual=%v want=%v", m, want)
+			}
+		case <-time.After(2 * timeout):
+			t.Fatalf("message %v is not handled", want)
+		}
+	}
+}
+
+type causalTestCmd struct {
+	To   string
+	Kind string
+}
+
+func TestCausalUnrelatedTraffic(t *testing.T) {
+	const noise = 10
+	noiseCh := make(chan struct{}, noise)
+	doneCh := make(chan struct{}, 1)
+	h := newHiveForTest()
+	a := h.NewApp("causal", CausalTimeout(10*time.Second))
+	a.SetCausalOrdering(true)
+	a.HandleFunc(causalTestCmd{}, func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(causalTestCmd).To}}
+	}, func(m Msg, ctx RcvContext) error {
+		switch m.Data().(causalTestCmd).Kind {
+		case "start":
+			// w sends messages to y, which are unrelated to z.
+			for i := 0; i < noise; i++ {
+				ctx.Emit(causalTestCmd{To: "y", Kind: "noise"})
+			}
+			ctx.Emit(causalTestCmd{To: "x", Kind: "relay"})
+		case "relay":
+			ctx.Emit(causalTestCmd{To: "z", Kind: "done"})
+		case "noise":
+			noiseCh <- struct{}{}
+		case "done":
+			doneCh <- struct{}{}
+		}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(causalTestCmd{To: "w", Kind: "start"})
+	select {
+	case <-doneCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message to z is delayed by the messages to y")
+	}
+	for i := 0; i < noise; i++ {
+		select {
+		case <-noiseCh:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %v messages are handled by y", i)
+		}
+	}
+}
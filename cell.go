@@ -1,6 +1,9 @@
 package beehive
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
 // CellKey represents a key in a dictionary.
 type CellKey struct {
@@ -8,6 +11,49 @@ type CellKey struct {
 	Key  string
 }
 
+const (
+	cellKeySep = '/'
+	cellKeyEsc = '\\'
+)
+
+// NewCellKey creates a cell key in dict composed of the given parts. The parts
+// are encoded in order, and are escaped so that equal parts always result in
+// the same key while different parts (e.g., "a/b" and "a", "b") never collide.
+func NewCellKey(dict string, parts ...string) CellKey {
+	var b bytes.Buffer
+	for i, p := range parts {
+		if i != 0 {
+			b.WriteByte(cellKeySep)
+		}
+		for j := 0; j < len(p); j++ {
+			if p[j] == cellKeySep || p[j] == cellKeyEsc {
+				b.WriteByte(cellKeyEsc)
+			}
+			b.WriteByte(p[j])
+		}
+	}
+	return CellKey{Dict: dict, Key: b.String()}
+}
+
+// Parts decomposes a key created by NewCellKey into its parts.
+func (k CellKey) Parts() []string {
+	var parts []string
+	var b bytes.Buffer
+	for i := 0; i < len(k.Key); i++ {
+		switch c := k.Key[i]; {
+		case c == cellKeyEsc && i+1 < len(k.Key):
+			i++
+			b.WriteByte(k.Key[i])
+		case c == cellKeySep:
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(parts, b.String())
+}
+
 // AppCellKey represents a key in a dictionary of a specific app.
 type AppCellKey struct {
 	App  string
@@ -98,6 +144,15 @@ func (s *cellStore) assignBeeCells(app string, k CellKey, c Colony) {
 	keys[k.Key] = struct{}{}
 }
 
+func (s *cellStore) unassign(app string, k CellKey, c Colony) {
+	if keys, ok := s.CellBees[app][k.Dict]; ok {
+		delete(keys, k.Key)
+	}
+	if keys, ok := s.BeeCells[c.Leader][k.Dict]; ok {
+		delete(keys, k.Key)
+	}
+}
+
 func (s *cellStore) colony(app string, cell CellKey) (c Colony, ok bool) {
 	dicts, ok := s.CellBees[app]
 	if !ok {
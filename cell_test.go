@@ -0,0 +1,72 @@
+package beehive
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewCellKey(t *testing.T) {
+	tests := [][]string{
+		{"s1"},
+		{"s1", "p1"},
+		{"a/b", "c"},
+		{"a", "b/c"},
+		{`a\`, "b"},
+		{"", ""},
+	}
+	keys := make(map[CellKey][]string)
+	for _, parts := range tests {
+		k := NewCellKey("D", parts...)
+		if k2 := NewCellKey("D", parts...); k != k2 {
+			t.Errorf("unstable key for %v: %v != %v", parts, k, k2)
+		}
+		if p := k.Parts(); !reflect.DeepEqual(p, parts) {
+			t.Errorf("invalid parts: actual=%v want=%v", p, parts)
+		}
+		if prev, ok := keys[k]; ok {
+			t.Errorf("%v and %v have the same key %v", prev, parts, k)
+		}
+		keys[k] = parts
+	}
+
+	if NewCellKey("D", "a", "b") == NewCellKey("D", "b", "a") {
+		t.Error("the order of parts is not respected")
+	}
+}
+
+type cellKeyTestMsg []string
+
+func TestNewCellKeyRouting(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan uint64)
+	a := h.NewApp("cellkey")
+	a.HandleFunc(cellKeyTestMsg{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{NewCellKey("D", m.Data().(cellKeyTestMsg)...)}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.ID()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	var bees []uint64
+	for _, m := range []cellKeyTestMsg{{"s1", "p1"}, {"s1", "p1"}, {"p1", "s1"}} {
+		h.Emit(m)
+		select {
+		case id := <-ch:
+			bees = append(bees, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not received", m)
+		}
+	}
+	if bees[0] != bees[1] {
+		t.Errorf("equal keys are routed to different bees: %v != %v", bees[0],
+			bees[1])
+	}
+	if bees[0] == bees[2] {
+		t.Errorf("reversed keys are routed to the same bee %v", bees[0])
+	}
+}
@@ -0,0 +1,148 @@
+package beehive
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the time for the timers and deadlines of a hive, such as
+// handler timeouts, snoozes, rate limits, and the timeouts of EmitAndWait. It
+// can be replaced with a FakeClock in tests to advance time deterministically.
+// Network, raft, and tracing timeouts always use the system clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for d and then sends the current time on the returned
+	// channel.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer creates a timer that sends the current time on its channel after
+	// at least d.
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is a timer created by a Clock.
+type ClockTimer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// systemClock is the clock of the time package.
+type systemClock struct{}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c systemClock) NewTimer(d time.Duration) ClockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// FakeClock is a Clock whose time only moves forward when it is advanced.
+type FakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // pending timers, sorted by their firing time.
+}
+
+// NewFakeClock creates a fake clock that starts at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		ch:    make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].at.After(t.at)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return t
+}
+
+// Advance moves the time of the clock forward by d, and fires the timers that
+// expire, in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+	for len(c.timers) != 0 && !c.timers[0].at.After(c.now) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		t.ch <- c.now
+	}
+}
+
+// Timers returns the number of pending timers of the clock. Tests can use it to
+// wait until the code under test creates its timers before advancing the
+// clock.
+func (c *FakeClock) Timers() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+
+	for i := range c.timers {
+		if c.timers[i] == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+var _ Clock = systemClock{}
+var _ Clock = &FakeClock{}
@@ -0,0 +1,169 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewFakeClock(start)
+	t1 := c.NewTimer(time.Second)
+	t2 := c.NewTimer(2 * time.Second)
+	t3 := c.NewTimer(3 * time.Second)
+	if !t3.Stop() {
+		t.Error("cannot stop a pending timer")
+	}
+
+	c.Advance(time.Second)
+	select {
+	case now := <-t1.C():
+		if want := start.Add(time.Second); !now.Equal(want) {
+			t.Errorf("invalid time: actual=%v want=%v", now, want)
+		}
+	default:
+		t.Error("the timer is not fired")
+	}
+	select {
+	case <-t2.C():
+		t.Error("the timer is fired before its time")
+	default:
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case <-t2.C():
+	default:
+		t.Error("the timer is not fired")
+	}
+	select {
+	case <-t3.C():
+		t.Error("a stopped timer is fired")
+	default:
+	}
+	if n := c.Timers(); n != 0 {
+		t.Errorf("invalid number of pending timers: actual=%v want=0", n)
+	}
+}
+
+// waitForTimers waits until the clock has n pending timers.
+func waitForTimers(t *testing.T, c *FakeClock, n int) {
+	for i := 0; c.Timers() != n; i++ {
+		if i == 500 {
+			t.Fatalf("invalid number of timers: actual=%v want=%v", c.Timers(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type clockTestMsg int
+
+func TestSnoozeWithFakeClock(t *testing.T) {
+	c := NewFakeClock(time.Now())
+	ch := make(chan int, 2)
+	h := newHiveForTest(WithClock(c))
+	tries := 0
+	h.NewApp("clock").HandleFunc(clockTestMsg(0),
+		func(m Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, ctx RcvContext) error {
+			tries++
+			ch <- tries
+			if tries == 1 {
+				ctx.Snooze(time.Hour)
+			}
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(clockTestMsg(0))
+	<-ch
+	waitForTimers(t, c, 1)
+	select {
+	case <-ch:
+		t.Fatal("the snoozed message is delivered before the clock advances")
+	default:
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case n := <-ch:
+		if n != 2 {
+			t.Errorf("invalid number of tries: actual=%v want=2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the snoozed message is not delivered")
+	}
+}
+
+func TestHandlerTimeoutWithFakeClock(t *testing.T) {
+	c := NewFakeClock(time.Now())
+	done := make(chan struct{})
+	h := newHiveForTest(WithClock(c))
+	a := h.NewApp("clock", HandlerTimeout(time.Minute))
+	a.HandleFunc(clockTestMsg(0), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		<-done
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	defer close(done)
+	waitTilStareted(h)
+
+	h.Emit(clockTestMsg(0))
+	waitForTimers(t, c, 1)
+	if n := a.HandlerTimeouts(); n != 0 {
+		t.Fatalf("the handler timed out before the clock advances: %v", n)
+	}
+
+	c.Advance(time.Minute)
+	waitForTimers(t, c, 0)
+	for i := 0; a.HandlerTimeouts() != 1; i++ {
+		if i == 500 {
+			t.Fatalf("the handler did not time out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type clockTestRelay int
+
+func TestMsgTimeWithFakeClock(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	ch := make(chan time.Time, 2)
+	h := newHiveForTest(WithClock(c))
+	a := h.NewApp("clock")
+	a.HandleFunc(clockTestMsg(0), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		ch <- m.Time()
+		ctx.Emit(clockTestRelay(0))
+		return nil
+	})
+	a.HandleFunc(clockTestRelay(0), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		ch <- m.Time()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(clockTestMsg(0))
+	for i := 0; i < 2; i++ {
+		select {
+		case mt := <-ch:
+			if !mt.Equal(start) {
+				t.Errorf("invalid message time: actual=%v want=%v", mt, start)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message is not handled")
+		}
+	}
+}
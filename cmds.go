@@ -22,13 +22,41 @@ type cmdMigrate struct {
 }
 type cmdNewHiveID struct{}
 type cmdPing struct{}
+type cmdReadReplica struct {
+	Dict string
+	Key  string
+}
+type cmdRedeliverOutbox struct{}
+type cmdRegisterApp struct{ App *app }
+type cmdRemap struct {
+	Bee  uint64
+	Msgs []msgAndHandler
+}
+type cmdRegisterHandler struct {
+	App     string
+	Type    string
+	Handler Handler
+}
+type cmdRemoveHandler struct {
+	App   string
+	Types []string
+}
 type cmdReloadBee struct {
 	ID     uint64
 	Colony Colony
 }
+type cmdRoute struct{ Msg msgAndHandler }
+
+// cmdRunOnBee is a local command, and is not registered for encoding.
+type cmdRunOnBee struct{ F func(ctx RcvContext) }
+type cmdSetSticky struct{ Sticky bool }
+type cmdSnapshot struct{}
+type cmdSplitCells struct{ Cells MappedCells }
+type cmdMergeState struct{ State []byte }
 type cmdStart struct{}
 type cmdStartDetached struct{ Handler DetachedHandler }
 type cmdStop struct{}
+type cmdStopApp struct{ App string }
 type cmdSync struct{}
 
 func init() {
@@ -44,11 +72,21 @@ func init() {
 	gob.Register(cmdMigrate{})
 	gob.Register(cmdNewHiveID{})
 	gob.Register(cmdPing{})
+	gob.Register(cmdReadReplica{})
+	gob.Register(cmdRedeliverOutbox{})
 	gob.Register(cmdRefreshRole{})
+	gob.Register(cmdRemap{})
 	gob.Register(cmdReloadBee{})
+	gob.Register(cmdRemoveHandler{})
 	gob.Register(cmdRestoreState{})
+	gob.Register(cmdRoute{})
+	gob.Register(cmdSetSticky{})
+	gob.Register(cmdSnapshot{})
+	gob.Register(cmdSplitCells{})
+	gob.Register(cmdMergeState{})
 	gob.Register(cmdStartDetached{})
 	gob.Register(cmdStart{})
+	gob.Register(cmdStopApp{})
 	gob.Register(cmdStop{})
 	gob.Register(cmdSync{})
 }
@@ -0,0 +1,44 @@
+package beehive
+
+import "time"
+
+func (b *bee) EmitCoalesced(msgData interface{}, key string,
+	window time.Duration) {
+
+	m := b.hive.newMsg(msgData, b.ID(), 0)
+	m.MsgTrace = b.traceID()
+	b.hive.localCopy(m)
+
+	if b.InTx() {
+		b.OnPostCommit(func() { b.coalesce(key, m, window) })
+		return
+	}
+	b.coalesce(key, m, window)
+}
+
+// coalesce replaces the pending message of key with m. If there is no pending
+// message, m is emitted after window, unless it is replaced in the meantime.
+// Messages are stamped with the vector clock of the bee when they are emitted,
+// so that the superseded messages leave no gap in the clock.
+func (b *bee) coalesce(key string, m *msg, window time.Duration) {
+	b.coalesceM.Lock()
+	defer b.coalesceM.Unlock()
+
+	if b.coalesced == nil {
+		b.coalesced = make(map[string]*msg)
+	}
+	_, pending := b.coalesced[key]
+	b.coalesced[key] = m
+	if pending {
+		return
+	}
+
+	go func() {
+		<-b.hive.config.Clock.After(window)
+		b.coalesceM.Lock()
+		m := b.coalesced[key]
+		delete(b.coalesced, key)
+		b.coalesceM.Unlock()
+		b.throttle([]*msg{m})
+	}()
+}
@@ -0,0 +1,60 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type coalesceTestRefresh int
+type coalesceTestUpdate int
+
+func TestEmitCoalesced(t *testing.T) {
+	const (
+		nupdates = 10
+		window   = 500 * time.Millisecond
+	)
+
+	h := newHiveForTest()
+	src := h.NewApp("coalescesrc")
+	src.HandleFunc(coalesceTestRefresh(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"S", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			u := coalesceTestUpdate(m.Data().(coalesceTestRefresh))
+			c.EmitCoalesced(u, "matrix", window)
+			return nil
+		})
+
+	ch := make(chan coalesceTestUpdate, nupdates)
+	dst := h.NewApp("coalescedst")
+	dst.HandleFunc(coalesceTestUpdate(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			ch <- m.Data().(coalesceTestUpdate)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < nupdates; i++ {
+		h.Emit(coalesceTestRefresh(i))
+	}
+
+	select {
+	case u := <-ch:
+		if u != nupdates-1 {
+			t.Errorf("invalid update: actual=%v want=%v", u, nupdates-1)
+		}
+	case <-time.After(4 * window):
+		t.Fatal("no update is received")
+	}
+
+	select {
+	case u := <-ch:
+		t.Errorf("update %v is not coalesced", u)
+	case <-time.After(2 * window):
+	}
+}
@@ -1,6 +1,7 @@
 package composition
 
 import (
+	"math/rand"
 	"time"
 
 	bh "github.com/kandoo/beehive"
@@ -36,9 +37,27 @@ func (c mockContext) ID() uint64 {
 	return 0
 }
 
+func (c mockContext) BeeName() string {
+	return ""
+}
+
+func (c mockContext) Colony() bh.Colony {
+	return bh.Colony{}
+}
+
+func (c mockContext) Generation() uint64 {
+	return 0
+}
+
+func (c mockContext) Context() context.Context {
+	return context.Background()
+}
+
 func (c mockContext) Printf(format string, a ...interface{}) {}
 
 func (c mockContext) Emit(msgData interface{})                 {}
+func (c mockContext) EmitBatch(msgData []interface{})          {}
+func (c mockContext) EmitBestEffort(msgData interface{})       {}
 func (c mockContext) SendToBee(msgData interface{}, to uint64) {}
 func (c mockContext) SendToCell(msgData interface{}, to string,
 	dk bh.CellKey) {
@@ -52,11 +71,55 @@ func (c mockContext) StartDetachedFunc(start bh.StartFunc, stop bh.StopFunc,
 	rcv bh.RcvFunc) uint64 {
 	return 0
 }
+func (c mockContext) StopDetached(id uint64) error      { return nil }
 func (c mockContext) LockCells(keys []bh.CellKey) error { return nil }
 func (c mockContext) Snooze(d time.Duration)            {}
 func (c mockContext) BeeLocal() interface{}             { return nil }
 func (c mockContext) SetBeeLocal(d interface{})         {}
 
+func (c mockContext) SubscribeDetached(msgType interface{}) {}
+
+func (c *mockContext) RunOnBee(f func(ctx bh.RcvContext)) { f(c) }
+
+func (c mockContext) BeeLocalGet(key string) (interface{}, bool) {
+	return nil, false
+}
+func (c mockContext) BeeLocalSet(key string, v interface{}) {}
+func (c mockContext) BeeLocalGetOrInit(key string,
+	init func() interface{}) interface{} {
+	return init()
+}
+
+func (c mockContext) EmitWithPriority(msgData interface{}, prio int) {}
+
+func (c mockContext) EmitCoalesced(msgData interface{}, key string,
+	window time.Duration) {
+}
+
+func (c mockContext) EmitWithReceipt(msgData interface{},
+	onResult func(bh.DeliveryResult)) {
+}
+
+func (c mockContext) EmitToSelf(msgData interface{}) {}
+
+func (c mockContext) SendToBeeErr(msgData interface{}, to uint64) error {
+	return nil
+}
+
+func (c mockContext) LockWithTimeout(keys []bh.CellKey,
+	d time.Duration) error {
+	return nil
+}
+func (c mockContext) UnlockCells(keys []bh.CellKey) error { return nil }
+func (c mockContext) ReadFromReplica(app string, cell bh.CellKey, dict,
+	key string, rc bh.ReadConsistency) (bh.ReplicaValue, error) {
+	return bh.ReplicaValue{}, nil
+}
+func (c mockContext) QueryApp(app string, cell bh.CellKey, dict,
+	key string) (interface{}, error) {
+	return nil, nil
+}
+
 func (c mockContext) CommitTx() error {
 	c.txAborted = false
 	return c.Transactional.CommitTx()
@@ -67,6 +130,29 @@ func (c mockContext) AbortTx() error {
 	return c.Transactional.AbortTx()
 }
 
+func (c mockContext) OnPreCommit(f func() error) {}
+func (c mockContext) OnPostCommit(f func())      {}
+
+func (c mockContext) InTx() bool {
+	return c.TxStatus() == state.TxOpen
+}
+
+func (c mockContext) TxSeq() uint64 {
+	return 0
+}
+
+func (c mockContext) Rand() *rand.Rand {
+	return rand.New(rand.NewSource(0))
+}
+
+func (c mockContext) TxBufferedMsgs() []bh.Msg {
+	return nil
+}
+
+func (c mockContext) TxBufferedOps() []state.Op {
+	return c.TxOps()
+}
+
 func (c mockContext) DeferReply(msg bh.Msg) bh.Repliable {
 	return bh.Repliable{}
 }
@@ -0,0 +1,72 @@
+package beehive
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// mutableConfig are the fields of HiveConfig that can be updated while the hive
+// is running. They take effect for new messages, bees, and connections.
+var mutableConfig = map[string]bool{
+	"BeeQueueCap":       true,
+	"BatchSize":         true,
+	"ConnTimeout":       true,
+	"DialTimeout":       true,
+	"KeepAlive":         true,
+	"ReadTimeout":       true,
+	"WriteTimeout":      true,
+	"CompressThreshold": true,
+	"MaxMsgSize":        true,
+	"MaxInflight":       true,
+	"LocalCopy":         true,
+	"ReplicationRetry":  true,
+	"Tracer":            true,
+	"TxLog":             true,
+}
+
+// cfg returns the current configuration of the hive. The returned config must
+// not be modified.
+func (h *hive) cfg() *HiveConfig {
+	return h.liveConfig.Load().(*HiveConfig)
+}
+
+func (h *hive) UpdateConfig(update func(cfg *HiveConfig)) error {
+	h.configM.Lock()
+	defer h.configM.Unlock()
+
+	old := h.cfg()
+	cfg := *old
+	update(&cfg)
+	if err := checkConfigUpdate(*old, cfg); err != nil {
+		return err
+	}
+	if cfg.BatchSize == 0 {
+		return fmt.Errorf("invalid batch size: %v", cfg.BatchSize)
+	}
+	h.liveConfig.Store(&cfg)
+	return nil
+}
+
+// checkConfigUpdate returns an error if a field of HiveConfig other than the
+// mutable fields is changed from old to cfg.
+func checkConfigUpdate(old, cfg HiveConfig) error {
+	ov := reflect.ValueOf(old)
+	nv := reflect.ValueOf(cfg)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if mutableConfig[f.Name] {
+			continue
+		}
+		of, nf := ov.Field(i), nv.Field(i)
+		// Functions are only deeply equal if they are nil.
+		if of.Kind() == reflect.Func && of.Pointer() == nf.Pointer() {
+			continue
+		}
+		if !reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			return fmt.Errorf("%v cannot be changed while the hive is running",
+				f.Name)
+		}
+	}
+	return nil
+}
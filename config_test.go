@@ -0,0 +1,58 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	h := newHiveForTest()
+	block := make(chan struct{})
+	defer close(block)
+	h.NewApp("config").HandleFunc(overloadTestMsg(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			<-block
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < 20; i++ {
+		if err := h.Emit(overloadTestMsg(i)); err != nil {
+			t.Fatalf("cannot emit without a limit: %v", err)
+		}
+	}
+
+	if err := h.UpdateConfig(func(cfg *HiveConfig) {
+		cfg.MaxInflight = 5
+	}); err != nil {
+		t.Fatalf("cannot update the config: %v", err)
+	}
+	if m := h.Config().MaxInflight; m != 5 {
+		t.Errorf("invalid max inflight: actual=%v want=5", m)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Emit(overloadTestMsg(0)) != ErrOverloaded {
+		if time.Now().After(deadline) {
+			t.Fatal("the new limit is not enforced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	addr := h.Config().Addr
+	err := h.UpdateConfig(func(cfg *HiveConfig) {
+		cfg.Addr = "127.0.0.1:1"
+		cfg.MaxInflight = 0
+	})
+	if err == nil {
+		t.Error("the address of the hive is updated")
+	}
+	if cfg := h.Config(); cfg.Addr != addr || cfg.MaxInflight != 5 {
+		t.Errorf("the config is changed by a rejected update: %v %v", cfg.Addr,
+			cfg.MaxInflight)
+	}
+}
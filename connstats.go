@@ -0,0 +1,245 @@
+package beehive
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is the state of a connection between two hives.
+type ConnState string
+
+// Valid values for ConnState.
+const (
+	ConnConnected    ConnState = "connected"
+	ConnReconnecting ConnState = "reconnecting"
+	ConnClosed       ConnState = "closed"
+)
+
+// ConnStat represents the statistics of the connections between this hive and
+// a peer hive. The outgoing connections dialed by this hive are aggregated per
+// peer, and are kept across reconnects. Incoming connections are reported
+// individually while they are open.
+type ConnStat struct {
+	// Hive is the ID of the peer hive. It is Nil for incoming connections until
+	// the peer is identified by the messages or raft batches it sends.
+	Hive      uint64        `json:"hive"`
+	Addr      string        `json:"addr"`     // Address of the peer.
+	Outgoing  bool          `json:"outgoing"` // Whether dialed by this hive.
+	State     ConnState     `json:"state"`
+	BytesSent uint64        `json:"bytes_sent"`
+	BytesRcvd uint64        `json:"bytes_rcvd"`
+	MsgsSent  uint64        `json:"msgs_sent"`
+	MsgsRcvd  uint64        `json:"msgs_rcvd"`
+	LastError string        `json:"last_error"`
+	Uptime    time.Duration `json:"uptime"` // Since the connection is made.
+}
+
+// connStat maintains the statistics of a connection. The counters are
+// accessed atomically.
+type connStat struct {
+	bytesSent uint64
+	bytesRcvd uint64
+	msgsSent  uint64
+	msgsRcvd  uint64
+
+	sync.Mutex
+	hive     uint64
+	addr     string
+	outgoing bool
+	state    ConnState
+	since    time.Time
+	lastErr  error
+}
+
+func (s *connStat) setState(state ConnState) {
+	s.Lock()
+	defer s.Unlock()
+	if state == ConnConnected && s.state != ConnConnected {
+		s.since = time.Now()
+	}
+	s.state = state
+}
+
+func (s *connStat) setErr(err error) {
+	s.Lock()
+	s.lastErr = err
+	s.Unlock()
+}
+
+// setHive sets the peer of the connection, if it is not already known.
+func (s *connStat) setHive(hive uint64) {
+	s.Lock()
+	if s.hive == Nil {
+		s.hive = hive
+	}
+	s.Unlock()
+}
+
+func (s *connStat) knowsHive() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.hive != Nil
+}
+
+func (s *connStat) addMsgsSent(n int) {
+	atomic.AddUint64(&s.msgsSent, uint64(n))
+}
+
+func (s *connStat) addMsgsRcvd(n int) {
+	atomic.AddUint64(&s.msgsRcvd, uint64(n))
+}
+
+func (s *connStat) stat() ConnStat {
+	s.Lock()
+	defer s.Unlock()
+	cs := ConnStat{
+		Hive:      s.hive,
+		Addr:      s.addr,
+		Outgoing:  s.outgoing,
+		State:     s.state,
+		BytesSent: atomic.LoadUint64(&s.bytesSent),
+		BytesRcvd: atomic.LoadUint64(&s.bytesRcvd),
+		MsgsSent:  atomic.LoadUint64(&s.msgsSent),
+		MsgsRcvd:  atomic.LoadUint64(&s.msgsRcvd),
+	}
+	if s.lastErr != nil {
+		cs.LastError = s.lastErr.Error()
+	}
+	if s.state == ConnConnected {
+		cs.Uptime = time.Since(s.since)
+	}
+	return cs
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	stat *connStat
+}
+
+func (c countingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddUint64(&c.stat.bytesRcvd, uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddUint64(&c.stat.bytesSent, uint64(n))
+	return n, err
+}
+
+// dialer dials connections to other hives.
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// countingDialer dials connections whose bytes are counted in stat.
+type countingDialer struct {
+	dialer
+	stat *connStat
+}
+
+func (d countingDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, stat: d.stat}, nil
+}
+
+// connTable keeps the statistics of the connections of a hive.
+type connTable struct {
+	sync.Mutex
+	out map[uint64]*connStat
+	in  map[*connStat]struct{}
+}
+
+func newConnTable() *connTable {
+	return &connTable{
+		out: make(map[uint64]*connStat),
+		in:  make(map[*connStat]struct{}),
+	}
+}
+
+// outgoing returns the statistics of the connections to hive.
+func (t *connTable) outgoing(hive uint64, addr string) *connStat {
+	t.Lock()
+	defer t.Unlock()
+	s, ok := t.out[hive]
+	if !ok {
+		s = &connStat{
+			hive:     hive,
+			addr:     addr,
+			outgoing: true,
+			state:    ConnReconnecting,
+		}
+		t.out[hive] = s
+	}
+	return s
+}
+
+// incoming adds the statistics of a new connection accepted from addr.
+func (t *connTable) incoming(addr string) *connStat {
+	s := &connStat{addr: addr}
+	s.setState(ConnConnected)
+	t.Lock()
+	t.in[s] = struct{}{}
+	t.Unlock()
+	return s
+}
+
+// closeIncoming removes the statistics of a closed incoming connection.
+func (t *connTable) closeIncoming(s *connStat) {
+	s.setState(ConnClosed)
+	t.Lock()
+	delete(t.in, s)
+	t.Unlock()
+}
+
+// closeOutgoing marks all outgoing connections as closed.
+func (t *connTable) closeOutgoing() {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.out {
+		s.setState(ConnClosed)
+	}
+}
+
+func (t *connTable) stats() []ConnStat {
+	t.Lock()
+	stats := make([]ConnStat, 0, len(t.out)+len(t.in))
+	for _, s := range t.out {
+		stats = append(stats, s.stat())
+	}
+	for s := range t.in {
+		stats = append(stats, s.stat())
+	}
+	t.Unlock()
+
+	sort.Sort(connStats(stats))
+	return stats
+}
+
+// connStats sorts the statistics of outgoing connections first, by hive and
+// then by address.
+type connStats []ConnStat
+
+func (s connStats) Len() int      { return len(s) }
+func (s connStats) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s connStats) Less(i, j int) bool {
+	if s[i].Outgoing != s[j].Outgoing {
+		return s[i].Outgoing
+	}
+	if s[i].Hive != s[j].Hive {
+		return s[i].Hive < s[j].Hive
+	}
+	return s[i].Addr < s[j].Addr
+}
+
+func (h *hive) ConnStats() []ConnStat {
+	return h.conns.stats()
+}
@@ -0,0 +1,99 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type connStatsTestMsg int
+
+func TestConnStats(t *testing.T) {
+	const n = 10
+	ch := make(chan struct{}, n)
+	var hs []Hive
+	for i := 0; i < 2; i++ {
+		var opts []HiveOption
+		if i != 0 {
+			opts = append(opts, PeerAddrs(hs[0].Config().Addr))
+		}
+		h := newHiveForTest(opts...)
+		a := h.NewApp("connstats")
+		a.SetHivePreference(func(k CellKey) uint64 { return hs[1].ID() })
+		a.HandleFunc(connStatsTestMsg(0), func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			ch <- struct{}{}
+			return nil
+		})
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hs = append(hs, h)
+	}
+	h1, h2 := hs[0], hs[1]
+
+	for i := 0; i < n; i++ {
+		h1.Emit(connStatsTestMsg(i))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v messages: want=%v", i, n)
+		}
+	}
+
+	// The messages are counted on the sender once their rpc returns.
+	var out ConnStat
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out = outgoingStat(h1, h2.ID())
+		if out.MsgsSent == n || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if out.State != ConnConnected {
+		t.Errorf("invalid state: actual=%v want=%v", out.State, ConnConnected)
+	}
+	if out.MsgsSent != n {
+		t.Errorf("invalid sent messages: actual=%v want=%v", out.MsgsSent, n)
+	}
+	if out.BytesSent == 0 || out.BytesRcvd == 0 {
+		t.Errorf("invalid bytes: sent=%v rcvd=%v", out.BytesSent, out.BytesRcvd)
+	}
+	if out.Uptime == 0 {
+		t.Error("invalid uptime: 0")
+	}
+
+	var in ConnStat
+	for _, s := range h2.ConnStats() {
+		if s.Outgoing {
+			continue
+		}
+		in.MsgsRcvd += s.MsgsRcvd
+		in.BytesRcvd += s.BytesRcvd
+		in.BytesSent += s.BytesSent
+	}
+	if in.MsgsRcvd != out.MsgsSent {
+		t.Errorf("inconsistent messages: sent=%v rcvd=%v", out.MsgsSent,
+			in.MsgsRcvd)
+	}
+	if in.BytesRcvd == 0 || in.BytesSent == 0 {
+		t.Errorf("invalid incoming bytes: sent=%v rcvd=%v", in.BytesSent,
+			in.BytesRcvd)
+	}
+
+	if s := outgoingStat(h2, h1.ID()); s.BytesSent == 0 {
+		t.Errorf("no bytes sent from %v to %v", h2, h1)
+	}
+}
+
+func outgoingStat(h Hive, peer uint64) ConnStat {
+	for _, s := range h.ConnStats() {
+		if s.Outgoing && s.Hive == peer {
+			return s
+		}
+	}
+	return ConnStat{}
+}
@@ -2,6 +2,7 @@ package beehive
 
 import (
 	"encoding/gob"
+	"math/rand"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
@@ -56,38 +57,138 @@ func (r *Repliable) Reply(ctx RcvContext, replyData interface{}) {
 			Data: replyData,
 		}
 	}
+	switch c := ctx.(type) {
+	case *bee:
+		c.bufferOrEmit(c.hive.newColonyMsg(replyData, c.ID(), r.From))
+		return
+	case *timedRcvContext:
+		c.do(func() {
+			c.b.bufferOrEmit(c.b.hive.newColonyMsg(replyData, c.ID(), r.From))
+		})
+		return
+	}
 	ctx.SendToBee(replyData, r.From)
 }
 
 // RcvContext is passed to the rcv functions of message handlers. It provides
 // all the platform-level functions required to implement the rcv function.
+//
+// The messages emitted by a bee, whether broadcast, sent to a bee, or emitted
+// in a transaction, are handed to the hive in the order they are emitted and
+// are received by each destination bee in that order, with or without rate
+// limits. The exceptions are destination apps that reorder their queues, i.e.,
+// prioritized apps and apps with fair queuing, and messages that are snoozed
+// or retried.
 type RcvContext interface {
 	Context
 
 	// ID returns the bee id of this context.
 	ID() uint64
+	// BeeName returns the name of the bee (see App.SetBeeIDFunc), or "" if the
+	// bee is not named.
+	BeeName() string
+	// Colony returns a copy of the colony of the bee, i.e., its leader and
+	// followers. Modifying the returned colony has no effect on the bee.
+	Colony() Colony
+	// Generation returns the generation (i.e., the term) of the bee's colony,
+	// which is incremented whenever the colony fails over to a new leader.
+	Generation() uint64
+	// Context returns the context of the handler. For the apps with a handler
+	// timeout, it is cancelled once the handler returns or times out, and the
+	// methods of an RcvContext fail after its handler times out (see
+	// HandlerTimeout). Otherwise, it is never cancelled.
+	Context() context.Context
 
 	// Emit emits a message.
 	Emit(msgData interface{})
+	// EmitBatch emits a message for each entry in msgData. The messages are
+	// routed at once, and the messages routed to the same bee are enqueued on
+	// the bee at once. Within a transaction, the batch is buffered as a unit.
+	EmitBatch(msgData []interface{})
+	// EmitWithPriority emits a message with the given priority. Bees of
+	// prioritized applications handle messages of higher priorities first.
+	EmitWithPriority(msgData interface{}, prio int)
+	// EmitBestEffort emits a message with at-most-once semantics: If the
+	// message cannot be delivered to a remote bee on the first try, it is
+	// dropped instead of being retried.
+	EmitBestEffort(msgData interface{})
+	// EmitCoalesced emits msgData after window, unless it is superseded: the
+	// messages emitted by the bee with the same key within window collapse
+	// into the latest one, which is emitted once the window ends. The window
+	// starts with the first message of the key. It is useful for idempotent
+	// refreshes, where only the latest message matters. Inside a transaction,
+	// the message is coalesced after the transaction is committed.
+	EmitCoalesced(msgData interface{}, key string, window time.Duration)
+	// EmitWithReceipt emits msgData and calls onResult once the outcome of
+	// delivering it is known, for each bee it is routed to. If it cannot be
+	// routed to any bee, onResult is called once with a Nil bee. onResult is
+	// called asynchronously in the loop of the bee, and must not block. Inside
+	// a transaction, the message is emitted after the transaction is committed;
+	// if the transaction is aborted, onResult is never called.
+	EmitWithReceipt(msgData interface{}, onResult func(DeliveryResult))
 	// SendToCell sends a message to the bee of the give app that owns the
 	// given cell.
 	SendToCell(msgData interface{}, app string, cell CellKey)
 	// SendToBee sends a message to the given bee.
 	SendToBee(msgData interface{}, to uint64)
+	// EmitToSelf sends a message to the current bee. Inside a transaction, the
+	// message is delivered after the transaction is committed.
+	EmitToSelf(msgData interface{})
+	// SendToBeeErr sends a message to the given bee, and returns an error if the
+	// bee is not registered or its hive is unreachable. Inside a transaction,
+	// the error is also returned when the transaction is committed.
+	SendToBeeErr(msgData interface{}, to uint64) error
 	// Reply replies to a message: Sends a message from the current bee to the
-	// bee that emitted msg.
+	// bee that emitted msg. The reply is addressed to the colony of that bee,
+	// and is delivered to its current leader if the colony has failed over.
 	Reply(msg Msg, replyData interface{}) error
 	// DeferReply returns a Repliable that can be used to reply to a
 	// message (either a sync or a async message) later.
 	DeferReply(msg Msg) Repliable
 
-	// StartDetached spawns a detached handler.
+	// StartDetached spawns a detached handler and returns the ID of its bee. It
+	// returns 0 if the app has reached its MaxDetached limit.
 	StartDetached(h DetachedHandler) uint64
 	// StartDetachedFunc spawns a detached handler using the provide function.
 	StartDetachedFunc(start StartFunc, stop StopFunc, rcv RcvFunc) uint64
-
-	// LockCells proactively locks the cells in the given cell keys.
+	// StopDetached stops the detached bee of the app with the given ID on this
+	// hive, calls the Stop of its handler, and removes the bee. It returns
+	// ErrNoSuchBee if there is no such detached bee.
+	StopDetached(id uint64) error
+	// SubscribeDetached subscribes the current detached bee to the messages of
+	// the given type emitted on this hive. The subscription is removed when the
+	// bee stops. It is a no-op for bees that are not detached.
+	SubscribeDetached(msgType interface{})
+	// RunOnBee runs f in the loop of the current bee, and blocks until f
+	// returns. Detached handlers must use it to access the state of their bee
+	// from other goroutines, e.g., the goroutine of Start, since the state is
+	// not thread-safe and is also accessed by Rcv. f must use the context it is
+	// given. It must not be called from Rcv, which is already run in the loop
+	// of the bee.
+	RunOnBee(f func(ctx RcvContext))
+
+	// LockCells proactively locks the cells in the given cell keys. It returns
+	// ErrCellsLocked if any of the cells is locked by another bee.
 	LockCells(keys []CellKey) error
+	// LockWithTimeout locks the cells in the given cell keys. If any of the cells
+	// is locked by another bee, it retries until d elapses and then returns
+	// ErrLockTimeout.
+	LockWithTimeout(keys []CellKey, d time.Duration) error
+	// UnlockCells releases the cells in the given cell keys. It returns
+	// ErrNotLocked if any of the cells is not locked by this bee.
+	UnlockCells(keys []CellKey) error
+
+	// ReadFromReplica reads key from dict in the colony of the given app that
+	// owns cell. With ReadEventual, the read is served by a replica of the
+	// colony that is not known to lag behind its leader, and can be stale. The
+	// generation of the returned value can be used to detect stale reads.
+	ReadFromReplica(app string, cell CellKey, dict, key string,
+		rc ReadConsistency) (ReplicaValue, error)
+	// QueryApp reads key from dict in the state of the bee of the given app
+	// that owns cell. The read is served by the leader of the colony from its
+	// committed state, and does not lock cell. QueryApp blocks until the bee
+	// handles the query, so bees must not query each other's apps in a cycle.
+	QueryApp(app string, cell CellKey, dict, key string) (interface{}, error)
 
 	// Snooze exits the Rcv function, and schedules the current message to be
 	// enqued again after at least duration d.
@@ -99,6 +200,18 @@ type RcvContext interface {
 	BeeLocal() interface{}
 	// SetBeeLocal sets a data in the bee-local storage.
 	SetBeeLocal(d interface{})
+	// BeeLocalGet returns the value of key in the keyed bee-local storage. The
+	// keyed storage is independent of BeeLocal and SetBeeLocal.
+	BeeLocalGet(key string) (v interface{}, ok bool)
+	// BeeLocalSet sets the value of key in the keyed bee-local storage.
+	BeeLocalSet(key string, v interface{})
+	// BeeLocalGetOrInit returns the value of key in the keyed bee-local storage.
+	// If there is no such key, it stores and returns the result of init.
+	BeeLocalGetOrInit(key string, init func() interface{}) interface{}
+	// Rand returns the pseudo-random source of the bee. It is seeded using the
+	// bee ID and HiveConfig.Seed, so bees with the same ID on hives with the same
+	// seed generate the same sequence. Like bee-locals, it is ephemeral.
+	Rand() *rand.Rand
 
 	// Starts a transaction in this context. Transactions span multiple
 	// dictionaries and buffer all messages. When a transaction commits all the
@@ -113,6 +226,27 @@ type RcvContext interface {
 	CommitTx() error
 	// Aborts the transaction.
 	AbortTx() error
+	// InTx returns whether there is an open transaction in this context.
+	InTx() bool
+	// TxSeq returns the sequence number of the current transaction, or of the
+	// last transaction if there is no open transaction. Sequence numbers are
+	// local to the bee and start from 1.
+	TxSeq() uint64
+	// TxBufferedMsgs returns a copy of the messages emitted in the current
+	// transaction that are buffered until it commits.
+	TxBufferedMsgs() []Msg
+	// TxBufferedOps returns the state operations of the current transaction.
+	TxBufferedOps() []state.Op
+	// OnPreCommit registers a hook that is called before the current
+	// transaction commits. If the hook returns an error, the transaction is
+	// aborted and the error is returned by the commit. Hooks are discarded when
+	// the transaction aborts. It has no effect if there is no open transaction.
+	OnPreCommit(f func() error)
+	// OnPostCommit registers a hook that is called once the current transaction
+	// is committed, and replicated for persistent apps. It is not called if the
+	// transaction aborts or fails to commit. It has no effect if there is no
+	// open transaction.
+	OnPostCommit(f func())
 }
 
 func init() {
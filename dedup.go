@@ -0,0 +1,80 @@
+package beehive
+
+import "sync/atomic"
+
+// IdempotencyKeyer is implemented by the data of messages that carry an
+// idempotency key. For apps with a deduplication window, a message is dropped
+// if another message of the same type and key was recently emitted.
+type IdempotencyKeyer interface {
+	// IdempotencyKey returns the idempotency key of the message.
+	IdempotencyKey() string
+}
+
+// DedupStats represents the statistics of the deduplication window of an app
+// on a hive.
+type DedupStats struct {
+	Size      int    `json:"size"`      // number of keys in the window.
+	Hits      uint64 `json:"hits"`      // number of duplicates dropped.
+	Evictions uint64 `json:"evictions"` // number of keys evicted from the window.
+}
+
+// dedupWindow keeps the last n idempotency keys seen by a qee in a ring. The
+// keys are only accessed by the qee, but the counters are read atomically by
+// the hive.
+type dedupWindow struct {
+	keys map[string]struct{}
+	ring []string
+	next int // the position of the next key in ring.
+
+	size      int64  // accessed atomically.
+	hits      uint64 // accessed atomically.
+	evictions uint64 // accessed atomically.
+}
+
+func newDedupWindow(n int) *dedupWindow {
+	return &dedupWindow{
+		keys: make(map[string]struct{}, n),
+		ring: make([]string, n),
+	}
+}
+
+// dup returns whether key is in the window. If not, the key is added to the
+// window, evicting the oldest key when the window is full.
+func (w *dedupWindow) dup(key string) bool {
+	if _, ok := w.keys[key]; ok {
+		atomic.AddUint64(&w.hits, 1)
+		return true
+	}
+
+	if len(w.keys) == len(w.ring) {
+		delete(w.keys, w.ring[w.next])
+		atomic.AddUint64(&w.evictions, 1)
+	}
+	w.keys[key] = struct{}{}
+	w.ring[w.next] = key
+	w.next = (w.next + 1) % len(w.ring)
+	atomic.StoreInt64(&w.size, int64(len(w.keys)))
+	return false
+}
+
+func (w *dedupWindow) stats() DedupStats {
+	return DedupStats{
+		Size:      int(atomic.LoadInt64(&w.size)),
+		Hits:      atomic.LoadUint64(&w.hits),
+		Evictions: atomic.LoadUint64(&w.evictions),
+	}
+}
+
+// isDup returns whether mh is a duplicate of a message in the deduplication
+// window of the app.
+func (q *qee) isDup(mh msgAndHandler) bool {
+	w := q.app.dedup
+	if w == nil {
+		return false
+	}
+	k, ok := mh.msg.Data().(IdempotencyKeyer)
+	if !ok {
+		return false
+	}
+	return w.dup(mh.msg.Type() + "/" + k.IdempotencyKey())
+}
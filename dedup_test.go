@@ -0,0 +1,66 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type dedupTestMsg string
+
+func (m dedupTestMsg) IdempotencyKey() string { return string(m) }
+
+// runDedup emits keys twice on an app with a dedup window of size n, and
+// returns the dedup statistics of the app after all the messages that are not
+// dropped are received.
+func runDedup(t *testing.T, n int, keys []string) DedupStats {
+	ch := make(chan string, 2*len(keys))
+	h := newHiveForTest()
+	a := h.NewApp("dedup")
+	a.SetDedupWindow(n)
+	a.HandleFunc(dedupTestMsg(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- string(m.Data().(dedupTestMsg))
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < 2; i++ {
+		for _, k := range keys {
+			h.Emit(dedupTestMsg(k))
+		}
+	}
+	// Each message is either dropped as a duplicate or received.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := h.Stats().Apps["dedup"].Dedup
+		if int(s.Hits)+len(ch) == 2*len(keys) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages are not processed: stats=%+v received=%v", s,
+				len(ch))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDedupWindowStats(t *testing.T) {
+	keys := []string{"a", "b", "c", "d"}
+
+	s := runDedup(t, len(keys), keys)
+	want := DedupStats{Size: 4, Hits: 4}
+	if s != want {
+		t.Errorf("invalid stats for a large window: actual=%+v want=%+v", s, want)
+	}
+
+	// With a small window, the keys are evicted before their duplicates are
+	// emitted and no duplicate is caught.
+	s = runDedup(t, 2, keys)
+	want = DedupStats{Size: 2, Evictions: 6}
+	if s != want {
+		t.Errorf("invalid stats for a small window: actual=%+v want=%+v", s, want)
+	}
+}
@@ -59,3 +59,287 @@ func TestDetached(t *testing.T) {
 
 	h.Stop()
 }
+
+type testSubscribedMsg int
+
+func TestDetachedSubscribe(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("TestDetachedSubscribe")
+	started := make(chan bool)
+	rcvd := make(chan testSubscribedMsg)
+	app.DetachedFunc(func(ctx RcvContext) {
+		ctx.SubscribeDetached(testSubscribedMsg(0))
+		started <- true
+	}, func(ctx RcvContext) {
+	}, func(msg Msg, ctx RcvContext) error {
+		rcvd <- msg.Data().(testSubscribedMsg)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	<-started
+
+	h.Emit(testSubscribedMsg(1))
+	select {
+	case m := <-rcvd:
+		if m != 1 {
+			t.Errorf("invalid message: actual=%v want=1", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("detached handler did not receive the subscribed message")
+	}
+}
+
+func TestMaxDetached(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("TestMaxDetached", MaxDetached(2))
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	q := a.(*app).qee
+	start := func() (uint64, error) {
+		d, err := q.processCmd(cmdStartDetached{Handler: &funcDetached{
+			startFunc: func(ctx RcvContext) {},
+			stopFunc:  func(ctx RcvContext) {},
+			rcvFunc:   func(msg Msg, ctx RcvContext) error { return nil },
+		}})
+		if err != nil {
+			return 0, err
+		}
+		return d.(uint64), nil
+	}
+
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		id, err := start()
+		if err != nil {
+			t.Fatalf("cannot start detached bee %v: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := start(); err != ErrTooManyDetached {
+		t.Errorf("invalid error beyond the cap: actual=%v want=%v", err,
+			ErrTooManyDetached)
+	}
+	if n := q.numDetached(); n != 2 {
+		t.Errorf("invalid number of detached bees: actual=%v want=2", n)
+	}
+
+	b, ok := q.beeByID(ids[0])
+	if !ok {
+		t.Fatalf("cannot find detached bee %v", ids[0])
+	}
+	b.processCmd(cmdStop{})
+	for i := 0; q.numDetached() != 1; i++ {
+		if i == 100 {
+			t.Fatalf("detached bee count did not recover: actual=%v want=1",
+				q.numDetached())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := start(); err != nil {
+		t.Errorf("cannot start a detached bee after recovery: %v", err)
+	}
+}
+
+type stopDetachedTestMsg uint64
+
+func TestStopDetached(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("TestStopDetached")
+	errs := make(chan error)
+	a.HandleFunc(stopDetachedTestMsg(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		errs <- ctx.StopDetached(uint64(msg.Data().(stopDetachedTestMsg)))
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	q := a.(*app).qee
+	stopped := make(chan uint64, 2)
+	rcvd := make(chan uint64)
+	start := func() uint64 {
+		d, err := q.processCmd(cmdStartDetached{Handler: &funcDetached{
+			startFunc: func(ctx RcvContext) {},
+			stopFunc:  func(ctx RcvContext) { stopped <- ctx.ID() },
+			rcvFunc: func(msg Msg, ctx RcvContext) error {
+				rcvd <- ctx.ID()
+				return nil
+			},
+		}})
+		if err != nil {
+			t.Fatalf("cannot start a detached bee: %v", err)
+		}
+		return d.(uint64)
+	}
+	id1 := start()
+	id2 := start()
+
+	bees := a.DetachedBees()
+	if len(bees) != 2 || bees[0] != id1 || bees[1] != id2 {
+		t.Errorf("invalid detached bees: actual=%v want=%v", bees,
+			[]uint64{id1, id2})
+	}
+
+	h.Emit(stopDetachedTestMsg(id1))
+	if err := <-errs; err != nil {
+		t.Fatalf("cannot stop detached bee %v: %v", id1, err)
+	}
+	select {
+	case id := <-stopped:
+		if id != id1 {
+			t.Errorf("invalid stopped bee: actual=%v want=%v", id, id1)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the handler of the detached bee is not stopped")
+	}
+
+	bees = a.DetachedBees()
+	if len(bees) != 1 || bees[0] != id2 {
+		t.Errorf("invalid detached bees: actual=%v want=%v", bees,
+			[]uint64{id2})
+	}
+
+	h.SendToBee(testDetachedMsg(0), id2)
+	select {
+	case id := <-rcvd:
+		if id != id2 {
+			t.Errorf("invalid receiving bee: actual=%v want=%v", id, id2)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the other detached bee is not running")
+	}
+
+	h.Emit(stopDetachedTestMsg(id1))
+	if err := <-errs; err != ErrNoSuchBee {
+		t.Errorf("invalid error for a stopped bee: actual=%v want=%v", err,
+			ErrNoSuchBee)
+	}
+}
+
+type testRunOnBeeMsg int
+
+func TestDetachedRunOnBee(t *testing.T) {
+	const n = 100
+	h := newHiveForTest()
+	a := h.NewApp("TestDetachedRunOnBee")
+	inc := func(ctx RcvContext) {
+		d := ctx.Dict("D")
+		v, _ := d.Get("n")
+		i, _ := v.(int)
+		d.Put("n", i+1)
+	}
+	id := make(chan uint64)
+	done := make(chan int)
+	a.DetachedFunc(func(ctx RcvContext) {
+		id <- ctx.ID()
+		for i := 0; i < n; i++ {
+			ctx.RunOnBee(inc)
+		}
+		done <- 0
+	}, func(ctx RcvContext) {
+	}, func(msg Msg, ctx RcvContext) error {
+		inc(ctx)
+		if msg.Data().(testRunOnBeeMsg) == n-1 {
+			done <- 0
+		}
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	bid := <-id
+	for i := 0; i < n; i++ {
+		h.SendToBee(testRunOnBeeMsg(i), bid)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("detached bee is blocked")
+		}
+	}
+
+	b, ok := a.(*app).qee.beeByID(bid)
+	if !ok {
+		t.Fatalf("cannot find bee %v", bid)
+	}
+	var v interface{}
+	b.RunOnBee(func(ctx RcvContext) {
+		v, _ = ctx.Dict("D").Get("n")
+	})
+	if v != 2*n {
+		t.Errorf("invalid counter: actual=%v want=%v", v, 2*n)
+	}
+}
+
+type pollerJitterTestHandler struct {
+	ch chan hiveAndBeeID
+}
+
+func (p pollerJitterTestHandler) Start(ctx RcvContext) {
+	p.ch <- hiveAndBeeID{Hive: ctx.Hive().ID(), Bee: ctx.ID()}
+}
+
+func (p pollerJitterTestHandler) Stop(ctx RcvContext) {}
+
+func (p pollerJitterTestHandler) Rcv(msg Msg, ctx RcvContext) error {
+	return nil
+}
+
+func TestPollerJitter(t *testing.T) {
+	const (
+		npollers = 4
+		jitter   = 400 * time.Millisecond
+	)
+
+	h := newHiveForTest()
+	a := h.NewApp("jitter")
+	a.SetPollerJitter(jitter)
+	ch := make(chan hiveAndBeeID, npollers)
+	for i := 0; i < npollers; i++ {
+		a.Detached(pollerJitterTestHandler{ch: ch})
+	}
+
+	start := time.Now()
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	var min, max time.Duration
+	for i := 0; i < npollers; i++ {
+		var r hiveAndBeeID
+		select {
+		case r = <-ch:
+		case <-time.After(2 * jitter):
+			t.Fatalf("poller %v is not started", i)
+		}
+		phase := pollerPhase(r.Bee, jitter)
+		if phase < 0 || phase >= jitter {
+			t.Errorf("invalid phase for %v: %v", r.Bee, phase)
+		}
+		offset := time.Since(start)
+		if offset < phase {
+			t.Errorf("poller %v started at %v before its phase %v", r.Bee, offset,
+				phase)
+		}
+		if i == 0 || phase < min {
+			min = phase
+		}
+		if phase > max {
+			max = phase
+		}
+	}
+	if max-min < jitter/4 {
+		t.Errorf("pollers are not spread over %v: min=%v max=%v", jitter, min,
+			max)
+	}
+}
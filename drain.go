@@ -0,0 +1,145 @@
+package beehive
+
+import (
+	"fmt"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// DrainError is returned by Hive.Drain when some bees cannot be migrated to
+// any of the target hives.
+type DrainError struct {
+	Bees []uint64 // The bees that are left on the hive.
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("cannot drain bees %v", e.Bees)
+}
+
+func (h *hive) Drain(to []uint64) error {
+	if len(to) == 0 {
+		return fmt.Errorf("%v has no target hive to drain to", h)
+	}
+
+	h.setDrainTargets(to)
+	defer h.setDrainTargets(nil)
+
+	var stuck []uint64
+	n := 0
+	for _, name := range h.Apps() {
+		a, ok := h.app(name)
+		if !ok {
+			continue
+		}
+		leaders, others := h.drainableBees(a)
+		if a.sticky() {
+			stuck = append(stuck, leaders...)
+			stuck = append(stuck, others...)
+			continue
+		}
+		for _, b := range leaders {
+			if h.drainBee(a, b, to, n) {
+				n++
+				continue
+			}
+			stuck = append(stuck, b)
+		}
+		stuck = append(stuck, others...)
+	}
+
+	// Make sure that the registry reflects all the handoffs before returning.
+	if err := h.raftBarrier(); err != nil {
+		return err
+	}
+
+	if len(stuck) != 0 {
+		return &DrainError{Bees: stuck}
+	}
+	return nil
+}
+
+// drainableBees returns the local bees of a that lead their colony, and the
+// local bees of a that follow a colony.
+func (h *hive) drainableBees(a *app) (leaders, followers []uint64) {
+	a.qee.RLock()
+	defer a.qee.RUnlock()
+	for id, b := range a.qee.bees {
+		if b.proxy || b.detached {
+			continue
+		}
+		if b.colony().Leader != id {
+			followers = append(followers, id)
+			continue
+		}
+		leaders = append(leaders, id)
+	}
+	return leaders, followers
+}
+
+// setDrainTargets sets the targets of the drain in progress. nil means that the
+// hive is not draining.
+func (h *hive) setDrainTargets(to []uint64) {
+	h.Lock()
+	defer h.Unlock()
+	h.drainTo = to
+}
+
+// draining returns whether the hive is draining.
+func (h *hive) draining() bool {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.drainTo) != 0
+}
+
+// drainTarget returns a live target of the drain in progress, where new bees
+// are placed instead of this hive. It returns Nil if the hive is not draining
+// or no target is alive.
+func (h *hive) drainTarget() uint64 {
+	h.Lock()
+	to := h.drainTo
+	h.Unlock()
+	for _, t := range to {
+		if t != h.ID() && !h.members.isDead(t) {
+			return t
+		}
+	}
+	return Nil
+}
+
+// drainBee migrates bee to one of the target hives, starting from the n'th
+// target so that the bees are spread among the targets. It returns whether
+// the bee is migrated and its colony is routed to the new leader.
+func (h *hive) drainBee(a *app, bee uint64, to []uint64, n int) bool {
+	for i := range to {
+		t := to[(n+i)%len(to)]
+		if t == h.ID() {
+			continue
+		}
+		res, err := a.qee.processCmd(cmdMigrate{Bee: bee, To: t})
+		if err != nil {
+			glog.Errorf("%v cannot migrate %v to %v: %v", h, bee, t, err)
+			continue
+		}
+		if err := h.waitForLeader(res.(uint64)); err != nil {
+			glog.Errorf("%v cannot route to %v: %v", h, res, err)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// waitForLeader waits until bee is registered as the leader of its colony.
+func (h *hive) waitForLeader(bee uint64) error {
+	if err := h.raftBarrier(); err != nil {
+		return err
+	}
+	info, err := h.registry.bee(bee)
+	if err != nil {
+		return err
+	}
+	if info.Colony.Leader != bee {
+		return fmt.Errorf("%v is not the leader of %v", bee, info.Colony)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package beehive
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type drainTestMsg int
+
+func registerDrainApp(h Hive, ch chan hiveAndBeeID) App {
+	a := h.NewApp("drain")
+	a.HandleFunc(drainTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", strconv.Itoa(int(m.Data().(drainTestMsg)))}}
+	}, func(m Msg, c RcvContext) error {
+		c.Dict("D").Put("K", []byte{})
+		ch <- hiveAndBeeID{Hive: c.Hive().ID(), Bee: c.ID()}
+		return nil
+	})
+	return a
+}
+
+func TestHiveDrain(t *testing.T) {
+	const nbees = 4
+	ch := make(chan hiveAndBeeID, nbees)
+
+	var hs []Hive
+	for i := 0; i < 3; i++ {
+		var opts []HiveOption
+		if i != 0 {
+			opts = append(opts, PeerAddrs(hs[0].Config().Addr))
+		}
+		h := newHiveForTest(opts...)
+		registerDrainApp(h, ch)
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hs = append(hs, h)
+	}
+
+	for i := 0; i < nbees; i++ {
+		hs[0].Emit(drainTestMsg(i))
+		if r := <-ch; r.Hive != hs[0].ID() {
+			t.Fatalf("bee %v is not placed on %v", r.Bee, hs[0])
+		}
+	}
+
+	if err := hs[0].Drain([]uint64{hs[1].ID(), hs[2].ID()}); err != nil {
+		t.Fatalf("cannot drain %v: %v", hs[0], err)
+	}
+
+	for _, b := range hs[0].(*hive).registry.bees() {
+		if b.App == "drain" && b.Hive == hs[0].ID() && b.Colony.Leader == b.ID {
+			t.Errorf("bee %v is still a leader on %v", b.ID, hs[0])
+		}
+	}
+
+	for _, h := range hs {
+		for i := 0; i < nbees; i++ {
+			h.Emit(drainTestMsg(i))
+			select {
+			case r := <-ch:
+				if r.Hive == hs[0].ID() {
+					t.Errorf("message %v is handled on the drained hive", i)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %v is not handled", i)
+			}
+		}
+	}
+}
+
+func TestHiveDrainStickyAndNewBees(t *testing.T) {
+	ch := make(chan hiveAndBeeID, 1)
+	stickyCh := make(chan hiveAndBeeID, 1)
+
+	var hs []Hive
+	for i := 0; i < 2; i++ {
+		var opts []HiveOption
+		if i != 0 {
+			opts = append(opts, PeerAddrs(hs[0].Config().Addr))
+		}
+		h := newHiveForTest(opts...)
+		registerDrainApp(h, ch)
+		h.NewApp("drainsticky", Sticky()).HandleFunc(drainTestMsg(0),
+			func(m Msg, c MapContext) MappedCells {
+				return MappedCells{{"D", "0"}}
+			}, func(m Msg, c RcvContext) error {
+				stickyCh <- hiveAndBeeID{Hive: c.Hive().ID(), Bee: c.ID()}
+				return nil
+			})
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hs = append(hs, h)
+	}
+
+	hs[0].Emit(drainTestMsg(0))
+	<-ch
+	sticky := <-stickyCh
+	if sticky.Hive != hs[0].ID() {
+		t.Fatalf("sticky bee %v is not placed on %v", sticky.Bee, hs[0])
+	}
+
+	err := hs[0].Drain([]uint64{hs[1].ID()})
+	derr, ok := err.(*DrainError)
+	if !ok {
+		t.Fatalf("invalid error in drain: actual=%v want=*DrainError", err)
+	}
+	if len(derr.Bees) != 1 || derr.Bees[0] != sticky.Bee {
+		t.Errorf("invalid bees left on %v: actual=%v want=[%v]", hs[0],
+			derr.Bees, sticky.Bee)
+	}
+
+	// While the hive drains, new bees are placed on the targets.
+	h := hs[0].(*hive)
+	h.setDrainTargets([]uint64{hs[1].ID()})
+	defer h.setDrainTargets(nil)
+	hs[0].Emit(drainTestMsg(1))
+	select {
+	case r := <-ch:
+		if r.Hive != hs[1].ID() {
+			t.Errorf("new bee %v is placed on the draining hive", r.Bee)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not handled")
+	}
+}
@@ -0,0 +1,57 @@
+package beehive
+
+import (
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/bucket"
+)
+
+// EmitPolicy specifies what the bees of an app do with the messages that they
+// emit faster than the emit rate of the app (see App.SetEmitRate).
+type EmitPolicy int
+
+// Valid values for EmitPolicy.
+const (
+	// BlockEmit holds the emitting bee back until the app can emit the message.
+	// This is the default policy.
+	BlockEmit EmitPolicy = iota
+	// DropEmit drops the message.
+	DropEmit
+)
+
+func (a *app) SetEmitRate(msgsPerSec int, burst int) {
+	if msgsPerSec <= 0 {
+		a.emitBucket = nil
+		return
+	}
+
+	if burst <= 0 {
+		burst = 1
+	}
+	b := bucket.New(bucket.Rate(msgsPerSec), uint64(burst))
+	b.SetClock(a.hive.config.Clock.Now)
+	a.emitBucket = b
+}
+
+func (a *app) SetEmitPolicy(p EmitPolicy) {
+	a.emitPolicy = p
+}
+
+// emitLimited enqueues each message in msgs as soon as the emit rate of the
+// app allows, or drops it if the app has the DropEmit policy. The bucket of the
+// app is shared by all its local bees.
+func (b *bee) emitLimited(msgs []*msg) {
+	eb := b.app.emitBucket
+	for _, m := range msgs {
+		if b.app.emitPolicy == BlockEmit {
+			for !eb.Get(1) {
+				<-b.hive.config.Clock.After(eb.When(1))
+			}
+		} else if !eb.Get(1) {
+			glog.V(2).Infof("%v drops %v: emit rate of %v is exceeded", b, m,
+				b.app.Name())
+			m.receipt.report(Dropped, m.MsgTo, nil)
+			continue
+		}
+		b.enqueEmitted([]*msg{m})
+	}
+}
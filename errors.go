@@ -0,0 +1,57 @@
+package beehive
+
+// RoutingError is implemented by the errors returned when a message cannot be
+// routed, delivered, replied to, or committed. Each routing error belongs to a
+// category, and errors.Is matches the error with the sentinel of its category
+// (e.g., ErrBeeNotFound).
+type RoutingError interface {
+	error
+	// Category returns the sentinel error of the error's category.
+	Category() error
+}
+
+// Categories of routing errors.
+var (
+	// ErrNoHandler is returned when there is no handler for a message type.
+	ErrNoHandler = newRoutingCategory("no handler for the message type")
+	// ErrBeeNotFound is returned when the destination bee does not exist.
+	ErrBeeNotFound = newRoutingCategory("bee not found")
+	// ErrHiveUnreachable is returned when the hive of the destination bee
+	// cannot be reached.
+	ErrHiveUnreachable = newRoutingCategory("hive is unreachable")
+	// ErrTxConflict is returned when a transaction cannot be committed because
+	// it conflicts with the state of the colony.
+	ErrTxConflict = newRoutingCategory("transaction conflict")
+	// ErrCannotReply is returned when replying to a message that cannot be
+	// replied to.
+	ErrCannotReply = newRoutingCategory("cannot reply to this message")
+)
+
+type routingError struct {
+	category *routingError // nil for categories.
+	msg      string
+}
+
+func newRoutingCategory(msg string) *routingError {
+	return &routingError{msg: msg}
+}
+
+// newRoutingError returns a new routing error in the given category.
+func newRoutingError(category *routingError, msg string) *routingError {
+	return &routingError{category: category, msg: msg}
+}
+
+func (e *routingError) Error() string {
+	return e.msg
+}
+
+func (e *routingError) Category() error {
+	if e.category == nil {
+		return e
+	}
+	return e.category
+}
+
+func (e *routingError) Is(target error) bool {
+	return target == e.Category()
+}
@@ -0,0 +1,64 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type routingErrTestMsg struct{}
+
+func TestRoutingErrors(t *testing.T) {
+	type result struct {
+		Send  error
+		Reply error
+	}
+	ch := make(chan result)
+
+	h := newHiveForTest()
+	a := h.NewApp("routingerr")
+	a.HandleFunc(routingErrTestMsg{}, func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- result{
+			Send:  ctx.SendToBeeErr(routingErrTestMsg{}, 1<<60),
+			Reply: ctx.Reply(msg, routingErrTestMsg{}),
+		}
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(routingErrTestMsg{})
+	r := <-ch
+
+	tests := []struct {
+		desc     string
+		err      error
+		category error
+	}{
+		{"removing a missing handler", a.RemoveHandler(0), ErrNoHandler},
+		{"sending to a missing bee", r.Send, ErrBeeNotFound},
+		{"replying to an emitted message", r.Reply, ErrCannotReply},
+		{"replying on the hive", h.Reply(&msg{}, 0), ErrCannotReply},
+		{"an unreachable bee", ErrBeeUnreachable, ErrHiveUnreachable},
+		{"backing off", &rpcBackoffError{Until: time.Now()}, ErrHiveUnreachable},
+		{"an old transaction", ErrOldTx, ErrTxConflict},
+		{"locked cells", ErrCellsLocked, ErrTxConflict},
+	}
+	categories := []error{ErrNoHandler, ErrBeeNotFound, ErrHiveUnreachable,
+		ErrTxConflict, ErrCannotReply}
+	for _, test := range tests {
+		for _, c := range categories {
+			if is := errors.Is(test.err, c); is != (c == test.category) {
+				t.Errorf("invalid category for %v (%v): errors.Is(%v)=%v want=%v",
+					test.desc, test.err, c, is, !is)
+			}
+		}
+		if _, ok := test.err.(RoutingError); !ok {
+			t.Errorf("%v is not a RoutingError: %#v", test.desc, test.err)
+		}
+	}
+}
@@ -42,6 +42,8 @@ type SwitchStats map[Flow]uint64
 
 const (
 	matrixDict = "Matrix"
+	// updateWindow is the window in which the updates of a flow are coalesced.
+	updateWindow = 100 * time.Millisecond
 )
 
 type Collector struct {
@@ -52,16 +54,15 @@ type Collector struct {
 func (c *Collector) Rcv(m beehive.Msg, ctx beehive.RcvContext) error {
 	res := m.Data().(StatResult)
 	glog.V(2).Infof("Stat results: %+v", res)
-	matrix := ctx.Dict(matrixDict)
+	matrix := beehive.NewTypedDict[SwitchStats](ctx.Dict(matrixDict))
 	key := res.Switch.Key()
-	v, err := matrix.Get(key)
+	sw, err := matrix.Get(key)
 	if err != nil {
-		return fmt.Errorf("No such switch in matrix: %+v", res)
+		return fmt.Errorf("No such switch in matrix: %+v (%v)", res, err)
 	}
 
 	c.poller.query <- StatQuery{res.Switch}
 
-	sw := v.(SwitchStats)
 	stat, ok := sw[res.Flow]
 	sw[res.Flow] = res.Bytes
 
@@ -69,7 +70,8 @@ func (c *Collector) Rcv(m beehive.Msg, ctx beehive.RcvContext) error {
 	if !ok || res.Bytes-stat > c.delta {
 		glog.Infof("Found an elephent flow: %+v, %+v, %+v", res, stat,
 			ctx.Hive().ID())
-		ctx.Emit(MatrixUpdate(res))
+		key := fmt.Sprintf("%v/%+v", res.Switch, res.Flow)
+		ctx.EmitCoalesced(MatrixUpdate(res), key, updateWindow)
 	}
 
 	matrix.Put(key, sw)
@@ -145,7 +147,7 @@ func (s *SwitchJoinHandler) Rcv(m beehive.Msg, ctx beehive.RcvContext) error {
 	}
 
 	joined := m.Data().(SwitchJoined)
-	matrix := ctx.Dict(matrixDict)
+	matrix := beehive.NewTypedDict[SwitchStats](ctx.Dict(matrixDict))
 	key := joined.Switch.Key()
 	_, err := matrix.Get(key)
 	if err != nil {
@@ -27,6 +27,7 @@ func createHive(addr string, paddrs []string, minDriver, maxDriver int,
 	}
 	c := h.NewApp("Collector", cOps...)
 	p := NewPoller(1 * time.Second)
+	c.SetPollerJitter(p.timeout)
 	c.Detached(p)
 	c.Handle(StatResult{}, &Collector{uint64(maxSpike * (1 - elephantProb)), p})
 	c.Handle(SwitchJoined{}, &SwitchJoinHandler{p})
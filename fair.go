@@ -0,0 +1,82 @@
+package beehive
+
+// fairQueue queues messages per message type, and dequeues the types in a
+// round robin. As such, a burst of messages of one type cannot starve the
+// messages of other types.
+type fairQueue struct {
+	queues map[string][]msgAndHandler
+	types  []string // the types with queued messages in their dequeue order.
+	len    int
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		queues: make(map[string][]msgAndHandler),
+	}
+}
+
+func (q *fairQueue) push(mh msgAndHandler) {
+	t := mh.msg.Type()
+	mhs := q.queues[t]
+	if len(mhs) == 0 {
+		q.types = append(q.types, t)
+	}
+	q.queues[t] = append(mhs, mh)
+	q.len++
+}
+
+// peek returns the next message. The queue must not be empty.
+func (q *fairQueue) peek() msgAndHandler {
+	return q.queues[q.types[0]][0]
+}
+
+// pop removes the next message and moves its type to the end of the round
+// robin. The queue must not be empty.
+func (q *fairQueue) pop() {
+	t := q.types[0]
+	mhs := q.queues[t]
+	mhs[0] = msgAndHandler{}
+	mhs = mhs[1:]
+	q.len--
+
+	q.types = q.types[1:]
+	if len(mhs) == 0 {
+		delete(q.queues, t)
+		return
+	}
+	q.queues[t] = mhs
+	q.types = append(q.types, t)
+}
+
+// newFairMsgChannel creates a message channel that delivers the messages of
+// different types in a round robin. Its output channel is unbuffered so that
+// messages are ordered right before they are handled.
+func newFairMsgChannel(bufSize uint) *msgChannel {
+	q := &msgChannel{
+		chin:  make(chan msgAndHandler, bufSize),
+		chout: make(chan msgAndHandler),
+		size:  bufSize,
+		fair:  newFairQueue(),
+	}
+	go q.pipeFair()
+	return q
+}
+
+func (q *msgChannel) pipeFair() {
+	for {
+		var chout chan msgAndHandler
+		var first msgAndHandler
+		if q.fair.len != 0 {
+			chout = q.chout
+			first = q.fair.peek()
+		}
+
+		select {
+		case mh := <-q.chin:
+			q.fair.push(mh)
+			q.record(uint64(q.fair.len))
+		case chout <- first:
+			q.fair.pop()
+		}
+	}
+}
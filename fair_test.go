@@ -0,0 +1,39 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type fairTestFlood int
+
+type fairTestCtrl int
+
+func TestFairMsgChannel(t *testing.T) {
+	const n = 1024
+	ch := newFairMsgChannel(n + 1)
+	for i := 0; i < n; i++ {
+		ch.in() <- msgAndHandler{msg: &msg{MsgData: fairTestFlood(i)}}
+	}
+	ch.in() <- msgAndHandler{msg: &msg{MsgData: fairTestCtrl(0)}}
+	// Wait until all messages are queued.
+	for len(ch.chin) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	next := 0
+	for i := 0; i <= n; i++ {
+		mh := <-ch.out()
+		switch d := mh.msg.MsgData.(type) {
+		case fairTestCtrl:
+			if i > 1 {
+				t.Errorf("the starved message is dequeued late: actual=%v want<=1", i)
+			}
+		case fairTestFlood:
+			if int(d) != next {
+				t.Errorf("invalid order of messages: actual=%v want=%v", d, next)
+			}
+			next++
+		}
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"net/rpc"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,6 +39,16 @@ type Hive interface {
 	ID() uint64
 	// Config returns the hive configuration.
 	Config() HiveConfig
+	// UpdateConfig updates the configuration of the running hive. update is
+	// called with a copy of the current configuration, and the changes are
+	// applied atomically. Only the limits and timeouts that can take effect
+	// for new messages, bees, and connections can be changed: BeeQueueCap,
+	// BatchSize, ConnTimeout, DialTimeout, KeepAlive, ReadTimeout,
+	// WriteTimeout, CompressThreshold, MaxMsgSize, MaxInflight, LocalCopy,
+	// ReplicationRetry, Tracer, and TxLog.
+	// If any other field is changed, nothing is applied and an error is
+	// returned.
+	UpdateConfig(update func(cfg *HiveConfig)) error
 
 	// Start starts the hive. This function blocks.
 	Start() error
@@ -45,25 +57,145 @@ type Hive interface {
 	Stop() error
 
 	// Creates an app with the given name and the provided options.
-	// Note that apps are not active until the hive is started.
+	// Note that apps are not active until the hive is started. If the hive is
+	// already started, the app is registered and activated on the fly.
 	NewApp(name string, opts ...AppOption) App
-
-	// Emits a message containing msgData from this hive.
-	Emit(msgData interface{})
+	// Apps returns the names of the apps registered on the hive, including the
+	// internal apps of beehive, sorted by name.
+	Apps() []string
+
+	// Emits a message containing msgData from this hive. It returns
+	// ErrOverloaded, and drops the message, if the bees of the hive have more
+	// queued messages than HiveConfig.MaxInflight.
+	Emit(msgData interface{}) error
+	// EmitBatch emits a message for each entry in msgData. The messages are
+	// routed at once, and the messages routed to the same bee are enqueued on
+	// the bee at once. Like Emit, it returns ErrOverloaded, and drops the
+	// messages, if the hive is overloaded.
+	EmitBatch(msgData []interface{}) error
 	// Sends a message to a specific bee that owns a specific dictionary key.
 	SendToCellKey(msgData interface{}, to string, dk CellKey)
-	// Sends a message to a sepcific bee.
-	SendToBee(msgData interface{}, to uint64)
-	// Reply replies to the message.
+	// Sends a message to a sepcific bee. Like Emit, it returns ErrOverloaded,
+	// and drops the message, if the hive is overloaded.
+	SendToBee(msgData interface{}, to uint64) error
+	// EmitWhere sends a message to each live bee of app, on any hive, for which
+	// pred returns true. pred is called with the ID of the bee and the cells
+	// owned by its colony. App must have a handler for msgData on this hive.
+	EmitWhere(msgData interface{}, app string,
+		pred func(bee uint64, cells MappedCells) bool) error
+	// Reply replies to the message. Like Emit, it returns ErrOverloaded, and
+	// drops the reply, if the hive is overloaded.
 	Reply(msg Msg, replyData interface{}) error
 	// Sync processes a synchrounous message (req) and blocks until the response
-	// is recieved.
+	// is recieved. If the handler does not reply, Sync returns once the handler
+	// has finished its Rcv and committed its transaction, with the error
+	// returned by Rcv, if any. This works for handlers on any hive.
 	Sync(ctx context.Context, req interface{}) (res interface{}, err error)
+	// DeliverSync sends msgs to bee to, in order and without mapping them, and
+	// blocks until all of them are handled and their transactions are
+	// committed. It returns the first error returned by the handler, if any.
+	// DeliverSync is mostly useful to test stateful handlers
+	// deterministically.
+	DeliverSync(to uint64, msgs ...interface{}) error
+	// EmitAndWait emits a message and blocks until the first reply to it is
+	// received, or returns ErrReplyTimeout after timeout. It is the counterpart
+	// of RcvContext.Reply for code running outside of handlers. Only the replies
+	// sent while handling the message are received; deferred replies are not.
+	EmitAndWait(msgData interface{}, timeout time.Duration) (Msg, error)
+	// Route runs the map function of the app's handler for msgData and returns
+	// the mapped cells and the ID of the bee that would receive the message if
+	// it was emitted now. Route has no side effects: it does not lock the cells
+	// or create bees, and the bee ID is Nil if the cells are not owned by any
+	// bee yet. As in map functions, the mapped cells are nil if the message is
+	// dropped and empty if it is broadcast to the local bees, in which case the
+	// bee ID is Nil as well. Route returns ErrNoHandler if the app cannot handle
+	// msgData.
+	Route(msgData interface{}, app string) (MappedCells, uint64, error)
+
+	// Topology returns a consistent snapshot of the hives and the bees in the
+	// cluster, as seen by this hive.
+	Topology() Topology
+	// WatchTopology returns a channel that receives events whenever a hive joins
+	// or leaves the cluster, or a bee is added, removed, moved, or changes its
+	// colony. Events are dropped if the channel is not drained fast enough. The
+	// returned function stops the events and closes the channel.
+	WatchTopology() (<-chan TopologyEvent, func())
+	// LiveHives returns the hives in the cluster that are not detected as dead.
+	// Hives are probed periodically, and a hive is considered dead when it
+	// misses a few consecutive heartbeats (see FailureDetector).
+	LiveHives() []HiveInfo
+	// PeerHealth returns the health of the other hives in the cluster as seen
+	// by this hive, keyed by hive ID.
+	PeerHealth() map[uint64]PeerHealth
+
+	// Errors returns a channel that receives the errors the hive cannot recover
+	// from by itself, such as a listener that keeps failing to accept
+	// connections. Errors are dropped if the channel is not drained.
+	Errors() <-chan error
+
+	// Pause stops the bees of this hive from dequeuing messages, e.g., to
+	// quiesce the hive for maintenance. The messages that are being handled
+	// are not interrupted. The connections and the state of the hive are
+	// kept, and new messages are queued on the bees, subject to their queue
+	// caps, until the hive is resumed.
+	Pause()
+	// Resume resumes the bees of a paused hive. The queued messages are then
+	// handled in order.
+	Resume()
+	// Drain migrates the bees that lead their colonies on this hive to the
+	// given hives, e.g., to decommission this hive. Bees are spread among the
+	// targets, and Drain returns when all the migrations are completed and
+	// routed to the new leaders, so that the hive can be safely stopped. If
+	// some bees cannot be migrated to any target, a *DrainError listing them
+	// is returned. The bees of sticky apps and the followers of colonies are
+	// not migrated, and are listed in the error as well. While the hive
+	// drains, new bees are placed on the targets instead of this hive.
+	Drain(to []uint64) error
+
+	// BeeQueueStats returns the statistics of the input queues of the bees on
+	// this hive, keyed by bee ID.
+	BeeQueueStats() map[uint64]QueueStats
+	// Stats returns the statistics of this hive.
+	Stats() HiveStats
+	// ConnStats returns the statistics of the connections between this hive
+	// and its peers (see ConnStat).
+	ConnStats() []ConnStat
+	// BestEffortDrops returns the number of best-effort messages that this hive
+	// has dropped because they could not be delivered on the first try.
+	BestEffortDrops() uint64
+	// ReplicationLag returns the replication lag of the followers of the app's
+	// colonies that are led by bees on this hive, keyed by the follower bee ID.
+	// The lag of a follower is the number of committed raft entries (mostly
+	// transactions) that are not yet replicated on the follower.
+	ReplicationLag(app string) map[uint64]uint64
+
+	// SetEmitObserver sets a function that is called for every message emitted
+	// by the bees of this hive, when the message is handed to the hive for
+	// routing. Messages emitted in a transaction are observed when the
+	// transaction commits. It is mostly useful in tests. nil removes the
+	// observer.
+	SetEmitObserver(f func(Msg))
 
 	// Registers a message for encoding/decoding. This method should be called
 	// only on messages that have no active handler. Such messages are almost
-	// always replies to some detached handler.
+	// always replies to some detached handler. Message types passed to
+	// App.Handle and App.HandleFunc are registered automatically.
 	RegisterMsg(msg interface{})
+	// RegisterMsgs registers all the given messages for encoding/decoding.
+	RegisterMsgs(msgs ...interface{})
+}
+
+// HiveStats represents the statistics of a hive.
+type HiveStats struct {
+	Apps map[string]AppStats `json:"apps"` // Keyed by app name.
+}
+
+// AppStats represents the statistics of an app on a hive.
+type AppStats struct {
+	Dedup DedupStats `json:"dedup"` // Empty if the app has no dedup window.
+	// Latency is the latency of handling messages on the bees of the app on
+	// this hive, keyed by message type.
+	Latency map[string]LatencyStats `json:"latency"`
 }
 
 // HiveConfig represents the configuration of a hive.
@@ -72,7 +204,14 @@ type HiveConfig struct {
 	PeerAddrs []string // peer addresses.
 	StatePath string   // where to store state data.
 
+	// SeedAddrs are the addresses of the hives that the hive contacts to join
+	// the cluster and to learn about the other hives through gossip, until it
+	// knows other live hives. When PeerAddrs is empty, the hive joins the
+	// cluster through one of its seeds.
+	SeedAddrs []string
+
 	DataChBufSize uint // buffer size of the data channels.
+	BeeQueueCap   uint // capacity of the input queue of bees.
 	CmdChBufSize  uint // buffer size of the control channels.
 	BatchSize     uint // number of messages to batch.
 	SyncPoolSize  uint // number of sync go-routines.
@@ -89,7 +228,79 @@ type HiveConfig struct {
 	RaftInFlights  int           // maximum number of inflights to a node.
 	RaftMaxMsgSize uint64        // maximum size of an append message.
 
+	// SnapshotThreshold is the number of transactions after which the bees of
+	// persistent apps snapshot their state and compact their raft log. Replicas
+	// that are farther behind, such as new followers, receive the snapshot
+	// instead of replaying all the transactions.
+	SnapshotThreshold uint64
+
+	// ReplicationRetry is the retry policy of replicating transactions.
+	ReplicationRetry RetryPolicy
+	// GroupCommitWindow is the maximum duration the hive holds the commit of a
+	// transaction while the commits of other bees are in flight, so that the
+	// held transactions are replicated in the same batch. A commit is not held
+	// when no other commit is in flight. 0 disables group commit.
+	GroupCommitWindow time.Duration
+
+	Seed int64 // the seed of the pseudo-random sources of bees.
+
 	ConnTimeout time.Duration // timeout for connections between hives.
+	DialTimeout time.Duration // timeout for dialing other hives.
+	KeepAlive   time.Duration // keep-alive period of connections to hives.
+	JoinTimeout time.Duration // timeout for starting and joining the cluster.
+
+	// ReadTimeout is the maximum duration the hive waits for the next message
+	// on a connection from another hive. The deadline is refreshed on each
+	// read, and the connection is closed once it expires, which releases the
+	// connections of peers that vanished without closing them. Since idle
+	// connections are closed as well, it should be larger than the idle period
+	// of peers (e.g., a few raft ticks). 0 disables the read deadline.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration of sending data to another hive. A
+	// connection whose write times out is closed. 0 disables the write
+	// deadline.
+	WriteTimeout time.Duration
+
+	// FailureDetector represents how the hive detects that other hives have
+	// failed (see LiveHives).
+	FailureDetector FailureDetector
+
+	// CompressThreshold is the minimum size of a message batch, in bytes, that
+	// is compressed when sent to other hives. 0 disables compression.
+	CompressThreshold uint64
+	// MaxMsgSize is the maximum size of a message, in bytes, that the hive
+	// accepts from other hives. Larger messages are rejected before they are
+	// decoded. Since the limit applies to all messages received from other
+	// hives, it must be larger than the raft messages and snapshots of the
+	// hive. 0 means no limit.
+	MaxMsgSize uint64
+	// MuxConns makes the hive send all its rpcs to another hive, including
+	// messages, commands, and raft batches, on a single connection instead of a
+	// connection per kind. It reduces the number of sockets, at the cost of
+	// raft heartbeats sharing the connection with bulk traffic.
+	MuxConns bool
+	// ListenBacklog is the maximum length of the queue of pending connections
+	// of the hive's listener. 0 uses the default of the system. It is only
+	// supported for TCP addresses on Linux.
+	ListenBacklog int
+	// MaxInflight is the maximum number of messages queued on the bees of the
+	// hive. Once exceeded, Emit returns ErrOverloaded and the messages of other
+	// hives are rejected until the backlog drains. 0 means no limit.
+	MaxInflight uint64
+	// LocalCopy specifies how the data of messages delivered to the bees of
+	// the hive itself is copied (see LocalCopyMode). By default, the data is
+	// deep copied so that the emitter and the receivers do not share it.
+	LocalCopy LocalCopyMode
+
+	Tracer MsgTracer // the tracer of messages. nil disables tracing.
+	Clock  Clock     // the clock of timers and deadlines (see Clock).
+	TxLog  TxLogger  // the log of committed transactions. nil disables it.
+
+	// KeyHash hashes cell keys for routing decisions, i.e., placing keys on the
+	// ring of ConsistentHash mappers and splitting sticky apps. It can be used
+	// to align the partitioning of the hive with an external sharder. All the
+	// hives of a cluster must use the same hash. nil means DefaultKeyHash.
+	KeyHash func(k CellKey) uint64
 }
 
 // RaftElectTimeout returns the raft election timeout as
@@ -103,18 +314,47 @@ func (c HiveConfig) RaftHBTimeout() time.Duration {
 	return time.Duration(c.RaftHBTicks) * (c.RaftTick + c.RaftTickDelta)
 }
 
+// joinAddrs returns the addresses of the hives contacted to join the cluster.
+func (c HiveConfig) joinAddrs() []string {
+	if len(c.PeerAddrs) != 0 {
+		return c.PeerAddrs
+	}
+	return c.SeedAddrs
+}
+
+// dialer returns the dialer used for connections to other hives.
+func (c HiveConfig) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+}
+
 var raftLogOnce sync.Once
 
 // HiveOption represents a configuration option of a hive.
 type HiveOption args.V
 
 var addr = args.NewString(args.Flag("addr", "localhost:7677",
-	"the server listening address used for both RPC and HTTP"))
+	"the server listening address used for both RPC and HTTP. "+
+		"either host:port, tcp://host:port or unix:///path"))
 
 // Addr represents the listening address of the hive used for both inter-hive
-// RPC and its HTTP/web interface.
+// RPC and its HTTP/web interface. The address is either a TCP address
+// ("host:port" or "tcp://host:port") or the path of a Unix domain socket
+// ("unix:///path"). Peer addresses use the same format.
 func Addr(a string) HiveOption { return HiveOption(addr(a)) }
 
+// splitAddr returns the network and the address of a hive address.
+func splitAddr(a string) (network, address string) {
+	for _, n := range []string{"tcp", "unix"} {
+		if strings.HasPrefix(a, n+"://") {
+			return n, a[len(n)+3:]
+		}
+	}
+	return "tcp", a
+}
+
 var paddrs = args.NewString(args.Flag("paddrs", "",
 	"address of peers. Seperate entries with a comma"))
 
@@ -123,6 +363,15 @@ func PeerAddrs(pa ...string) HiveOption {
 	return HiveOption(paddrs(strings.Join(pa, ",")))
 }
 
+var saddrs = args.NewString(args.Flag("saddrs", "",
+	"address of seed hives. Seperate entries with a comma"))
+
+// SeedAddrs represents the seed addresses of the hive (see
+// HiveConfig.SeedAddrs).
+func SeedAddrs(sa ...string) HiveOption {
+	return HiveOption(saddrs(strings.Join(sa, ",")))
+}
+
 var dataChBufSize = args.NewUint(args.Flag("chsize", uint(1024),
 	"buffer size of data channels"))
 
@@ -130,6 +379,13 @@ var dataChBufSize = args.NewUint(args.Flag("chsize", uint(1024),
 // queen bees and bees.
 func DataChBufSize(s uint) HiveOption { return HiveOption(dataChBufSize(s)) }
 
+var beeQueueCap = args.NewUint(args.Flag("beeqcap", uint(1024),
+	"capacity of the input queue of bees"))
+
+// BeeQueueCap represents the capacity of the input queue of each bee. Bees
+// keep queueing messages beyond this capacity, but count them as overflows.
+func BeeQueueCap(c uint) HiveOption { return HiveOption(beeQueueCap(c)) }
+
 var cmdChBufSize = args.NewUint(args.Flag("cmdchsize", uint(128),
 	"buffer size of command channels"))
 
@@ -228,6 +484,15 @@ func RaftMaxMsgSize(s uint64) HiveOption {
 	return HiveOption(raftMaxMsgSize(s))
 }
 
+var snapshotThreshold = args.NewUint64(args.Flag("snapthresh", uint64(1024),
+	"number of transactions after which bees snapshot their state"))
+
+// SnapshotThreshold represents the number of transactions after which the
+// bees of persistent apps snapshot their state.
+func SnapshotThreshold(n uint64) HiveOption {
+	return HiveOption(snapshotThreshold(n))
+}
+
 var connTimeout = args.NewDuration(args.Flag("conntimeout", 60*time.Second,
 	"timeout for trying to connect to other hives"))
 
@@ -236,13 +501,186 @@ func ConnTimeout(t time.Duration) HiveOption {
 	return HiveOption(connTimeout(t))
 }
 
+var dialTimeout = args.NewDuration(args.Flag("dialtimeout", maxWait,
+	"timeout for dialing other hives"))
+
+// DialTimeout represents the maximum duration of dialing another hive. When
+// the dial times out, the message is handled as if the hive is unreachable.
+func DialTimeout(t time.Duration) HiveOption {
+	return HiveOption(dialTimeout(t))
+}
+
+var keepAlive = args.NewDuration(args.Flag("keepalive", 15*time.Second,
+	"keep-alive period of connections to other hives. negative disables"))
+
+// KeepAlive represents the TCP keep-alive period of the connections to other
+// hives, used to detect dead peers. A negative value disables keep-alives.
+func KeepAlive(t time.Duration) HiveOption {
+	return HiveOption(keepAlive(t))
+}
+
+var readTimeout = args.NewDuration(args.Flag("readtimeout", 0*time.Second,
+	"maximum idle time of connections from other hives. 0 disables"))
+
+// ReadTimeout represents the maximum duration the hive waits for the next
+// message on a connection from another hive before closing it.
+func ReadTimeout(t time.Duration) HiveOption {
+	return HiveOption(readTimeout(t))
+}
+
+var writeTimeout = args.NewDuration(args.Flag("writetimeout", 0*time.Second,
+	"maximum duration of writes to other hives. 0 disables"))
+
+// WriteTimeout represents the maximum duration of sending data to another
+// hive before the connection is closed.
+func WriteTimeout(t time.Duration) HiveOption {
+	return HiveOption(writeTimeout(t))
+}
+
+var seed = args.NewInt64(args.Flag("seed", int64(0),
+	"seed of the pseudo-random sources of bees"))
+
+// Seed represents the seed of the pseudo-random sources of bees (see
+// RcvContext.Rand).
+func Seed(s int64) HiveOption {
+	return HiveOption(seed(s))
+}
+
+var groupCommitWindow = args.NewDuration(args.Flag("groupcommit",
+	0*time.Millisecond, "the window to coalesce the commits of bees. 0 disables"))
+
+// GroupCommitWindow represents the maximum duration the hive waits to coalesce
+// the commits of different bees into a single replication batch. Larger windows
+// amortize the network cost of replication at the cost of commit latency.
+func GroupCommitWindow(d time.Duration) HiveOption {
+	return HiveOption(groupCommitWindow(d))
+}
+
+// RetryPolicy represents how an operation is retried.
+type RetryPolicy struct {
+	Attempts int           // the number of attempts. 0 and 1 mean no retry.
+	Backoff  time.Duration // the wait before the 2nd attempt. doubles after.
+}
+
+var replicationRetry = args.New(args.Default(RetryPolicy{Attempts: 1}))
+
+// ReplicationRetry represents the number of attempts to replicate a
+// transaction and the backoff between attempts. The backoff doubles after each
+// failed attempt. When all attempts fail, the transaction is aborted.
+func ReplicationRetry(attempts int, backoff time.Duration) HiveOption {
+	return HiveOption(replicationRetry(RetryPolicy{
+		Attempts: attempts,
+		Backoff:  backoff,
+	}))
+}
+
+var failureDetector = args.New(args.Default(FailureDetector{
+	HeartbeatInterval: heartbeatInterval,
+	TimeoutMultiplier: heartbeatMisses,
+}))
+
+// FailureDetection represents the parameters of the detector of failed hives.
+func FailureDetection(d FailureDetector) HiveOption {
+	return HiveOption(failureDetector(d))
+}
+
+var compressThreshold = args.NewUint64(args.Flag("compressthresh", uint64(0),
+	"minimum size of message batches compressed between hives. 0 disables"))
+
+// CompressThreshold represents the minimum size of message batches, in bytes,
+// that are compressed when sent to other hives. Smaller batches are sent
+// uncompressed. 0 disables compression.
+func CompressThreshold(n uint64) HiveOption {
+	return HiveOption(compressThreshold(n))
+}
+
+var maxMsgSize = args.NewUint64(args.Flag("maxmsgsize", uint64(0),
+	"maximum size of messages received from other hives. 0 means no limit"))
+
+// MaxMsgSize represents the maximum size of messages, in bytes, that the hive
+// accepts from other hives. 0 means no limit.
+func MaxMsgSize(n uint64) HiveOption {
+	return HiveOption(maxMsgSize(n))
+}
+
+var muxConns = args.NewBool(args.Flag("muxconns", false,
+	"whether to send all rpcs to another hive on a single connection"))
+
+// MuxConns represents whether the hive sends all its rpcs to another hive on a
+// single connection.
+func MuxConns(mux bool) HiveOption { return HiveOption(muxConns(mux)) }
+
+var listenBacklog = args.NewInt(args.Flag("listenbacklog", 0,
+	"the listen backlog of the hive. 0 uses the default of the system"))
+
+// ListenBacklog represents the maximum length of the queue of pending
+// connections of the hive's listener.
+func ListenBacklog(n int) HiveOption { return HiveOption(listenBacklog(n)) }
+
+var maxInflight = args.NewUint64(args.Flag("maxinflight", uint64(0),
+	"the maximum number of queued messages on the hive. 0 means no limit"))
+
+// MaxInflight represents the maximum number of messages queued on the bees of
+// the hive, after which the hive rejects new messages.
+func MaxInflight(n uint64) HiveOption { return HiveOption(maxInflight(n)) }
+
+var localCopy = args.NewString(args.Flag("localcopy", "deep",
+	"how the data of local messages is copied: deep, none, or serialize"))
+
+// LocalCopy represents how the data of messages delivered to the bees of the
+// hive itself is copied.
+func LocalCopy(m LocalCopyMode) HiveOption {
+	return HiveOption(localCopy(m.String()))
+}
+
+var joinTimeout = args.NewDuration(args.Flag("jointimeout", 0*time.Second,
+	"timeout for starting the hive and joining the cluster. 0 means no timeout"))
+
+// JoinTimeout represents the maximum duration that Start retries to listen
+// on the hive's address and join the cluster. If the hive cannot join the
+// cluster in time, Start returns an error. 0 means no timeout.
+func JoinTimeout(t time.Duration) HiveOption {
+	return HiveOption(joinTimeout(t))
+}
+
+var tracer = args.New()
+
+// Tracer represents the message tracer of the hive. When set, messages emitted
+// from outside of bees are stamped with a new trace ID, and the map and rcv
+// phases of traced messages are recorded.
+func Tracer(t MsgTracer) HiveOption { return HiveOption(tracer(t)) }
+
+var clock = args.New()
+
+// WithClock represents the clock of the hive's timers and deadlines. By
+// default, the hive uses the system clock.
+func WithClock(c Clock) HiveOption { return HiveOption(clock(c)) }
+
+var txLog = args.New()
+
+// TxLog represents the log of the transactions committed by the bees of
+// persistent apps on the hive (see TxLogger).
+func TxLog(l TxLogger) HiveOption { return HiveOption(txLog(l)) }
+
+var keyHash = args.New()
+
+// KeyHash represents the hash function of cell keys used for routing
+// decisions (see HiveConfig.KeyHash).
+func KeyHash(f func(k CellKey) uint64) HiveOption {
+	return HiveOption(keyHash(f))
+}
+
 func hiveConfig(opts ...HiveOption) (cfg HiveConfig) {
 	cfg.Addr = addr.Get(opts)
 	if pa := paddrs.Get(opts); pa != "" {
 		cfg.PeerAddrs = strings.Split(pa, ",")
 	}
+	if sa := saddrs.Get(opts); sa != "" {
+		cfg.SeedAddrs = strings.Split(sa, ",")
+	}
 	cfg.StatePath = statePath.Get(opts)
 	cfg.DataChBufSize = dataChBufSize.Get(opts)
+	cfg.BeeQueueCap = beeQueueCap.Get(opts)
 	cfg.CmdChBufSize = cmdChBufSize.Get(opts)
 	cfg.BatchSize = batchSize.Get(opts)
 	cfg.SyncPoolSize = syncPoolSize.Get(opts)
@@ -256,7 +694,42 @@ func hiveConfig(opts ...HiveOption) (cfg HiveConfig) {
 	cfg.RaftElectTicks = raftElectTicks.Get(opts)
 	cfg.RaftInFlights = raftInFlights.Get(opts)
 	cfg.RaftMaxMsgSize = raftMaxMsgSize.Get(opts)
+	cfg.SnapshotThreshold = snapshotThreshold.Get(opts)
+	cfg.ReplicationRetry = replicationRetry.Get(opts).(RetryPolicy)
+	cfg.GroupCommitWindow = groupCommitWindow.Get(opts)
+	cfg.Seed = seed.Get(opts)
 	cfg.ConnTimeout = connTimeout.Get(opts)
+	cfg.DialTimeout = dialTimeout.Get(opts)
+	cfg.KeepAlive = keepAlive.Get(opts)
+	cfg.JoinTimeout = joinTimeout.Get(opts)
+	cfg.ReadTimeout = readTimeout.Get(opts)
+	cfg.WriteTimeout = writeTimeout.Get(opts)
+	cfg.FailureDetector = failureDetector.Get(opts).(FailureDetector)
+	cfg.CompressThreshold = compressThreshold.Get(opts)
+	cfg.MaxMsgSize = maxMsgSize.Get(opts)
+	cfg.MuxConns = muxConns.Get(opts)
+	cfg.ListenBacklog = listenBacklog.Get(opts)
+	cfg.MaxInflight = maxInflight.Get(opts)
+	if m, ok := parseLocalCopyMode(localCopy.Get(opts)); ok {
+		cfg.LocalCopy = m
+	} else {
+		glog.Errorf("invalid local copy mode %q; using deep copy",
+			localCopy.Get(opts))
+	}
+	if t, ok := tracer.Get(opts).(MsgTracer); ok {
+		cfg.Tracer = t
+	}
+	if l, ok := txLog.Get(opts).(TxLogger); ok {
+		cfg.TxLog = l
+	}
+	if f, ok := keyHash.Get(opts).(func(k CellKey) uint64); ok {
+		cfg.KeyHash = f
+	}
+	if c, ok := clock.Get(opts).(Clock); ok {
+		cfg.Clock = c
+	} else {
+		cfg.Clock = systemClock{}
+	}
 	return cfg
 }
 
@@ -277,6 +750,7 @@ func NewHive(opts ...HiveOption) Hive {
 	cfg := hiveConfig(opts...)
 	os.MkdirAll(cfg.StatePath, 0700)
 	m := meta(cfg)
+	live := cfg
 	h := &hive{
 		id:     m.Hive.ID,
 		meta:   m,
@@ -285,12 +759,17 @@ func NewHive(opts ...HiveOption) Hive {
 		dataCh: newMsgChannel(cfg.DataChBufSize),
 		ctrlCh: make(chan cmdAndChannel),
 		syncCh: make(chan syncReqAndChan, cfg.DataChBufSize),
+		errCh:  make(chan error, errChBufSize),
 		apps:   make(map[string]*app, 0),
 		qees:   make(map[string][]qeeAndHandler),
+		subs:   make(map[string][]*bee),
 	}
+	h.liveConfig.Store(&live)
 
 	h.client = newRPCClientPool(h)
+	h.conns = newConnTable()
 	h.registry = newRegistry(h.String())
+	h.members = newMembership(h)
 	h.replStrategy = newRndReplication(h)
 	h.httpServer = newServer(h)
 
@@ -321,32 +800,52 @@ const (
 
 // The internal implementation of Hive.
 type hive struct {
-	sync.Mutex
+	sync.RWMutex
 
 	id     uint64
 	meta   hiveMeta
 	config HiveConfig
+	// liveConfig is the configuration of the hive with the runtime updates
+	// (*HiveConfig). The mutable fields of config must be read from it.
+	liveConfig atomic.Value
+	configM    sync.Mutex // serializes config updates.
 
 	status hiveStatus
+	joined bool // whether the hive is in sync with the cluster.
 
 	dataCh *msgChannel
 	ctrlCh chan cmdAndChannel
 	syncCh chan syncReqAndChan
+	replyS *replySink // the sink of EmitAndWait replies.
+	pause  pauser     // gates the bees while the hive is paused.
+	errCh  chan error // errors that are reported to the user.
 	sigCh  chan os.Signal
 
 	apps map[string]*app
 	qees map[string][]qeeAndHandler
+	subs map[string][]*bee // detached bees subscribed to message types.
+
+	drainTo []uint64 // the targets of Drain while the hive drains.
+	// reloaded is the app of each bee reloaded when the hive started. It is nil
+	// until the bees are reloaded.
+	reloaded map[uint64]string
 
 	httpServer *httpServer
 	listener   net.Listener
 
 	node     *raft.MultiNode
 	registry *registry
+	members  *membership
 	ticker   *randtime.Ticker
 	client   *rpcClientPool
+	conns    *connTable
 
 	replStrategy replicationStrategy
 	collector    collector
+
+	bestEffortDrops uint64       // accessed atomically.
+	inflight        int64        // messages queued on bees. Accessed atomically.
+	emitObserver    atomic.Value // of func(Msg).
 }
 
 func (h *hive) ID() uint64 {
@@ -357,14 +856,32 @@ func (h *hive) String() string {
 	return fmt.Sprintf("hive %v@%v", h.id, h.config.Addr)
 }
 
+func (h *hive) LiveHives() []HiveInfo {
+	return h.liveHives()
+}
+
+func (h *hive) liveHives() []HiveInfo {
+	return h.members.liveHives()
+}
+
+func (h *hive) PeerHealth() map[uint64]PeerHealth {
+	return h.members.health()
+}
+
 func (h *hive) Config() HiveConfig {
-	return h.config
+	return *h.cfg()
 }
 
 func (h *hive) RegisterMsg(msg interface{}) {
 	gob.Register(msg)
 }
 
+func (h *hive) RegisterMsgs(msgs ...interface{}) {
+	for _, m := range msgs {
+		h.RegisterMsg(m)
+	}
+}
+
 // Sync processes a synchrounous request and returns the response and error.
 func (h *hive) Sync(ctx context.Context, req interface{}) (res interface{},
 	err error) {
@@ -395,11 +912,170 @@ func (h *hive) Sync(ctx context.Context, req interface{}) (res interface{},
 		return nil, ctx.Err()
 	}
 }
+
+func (h *hive) DeliverSync(to uint64, msgs ...interface{}) error {
+	info, err := h.registry.bee(to)
+	if err != nil {
+		return err
+	}
+	a, ok := h.app(info.App)
+	if !ok {
+		return fmt.Errorf("no such application %s", info.App)
+	}
+	for _, m := range msgs {
+		if a.handler(MsgType(m)) == nil {
+			return fmt.Errorf("no handler for type %v on app %v", MsgType(m),
+				info.App)
+		}
+	}
+
+	// Messages are delivered one by one, so that they are handled in order
+	// regardless of which sync bee sends them.
+	var first error
+	for _, m := range msgs {
+		ch := make(chan syncRes, 1)
+		h.syncCh <- syncReqAndChan{
+			req: syncReq{ID: uint64(rand.Int63()), Data: m},
+			ch:  ch,
+			to:  to,
+		}
+		if r := <-ch; r.Err != nil && first == nil {
+			first = errors.New(r.Err.Error())
+		}
+	}
+	return first
+}
+
+func (h *hive) BeeQueueStats() map[uint64]QueueStats {
+	stats := make(map[uint64]QueueStats)
+	for _, a := range h.appList() {
+		a.qee.RLock()
+		for id, b := range a.qee.bees {
+			stats[id] = b.dataCh.stats()
+		}
+		a.qee.RUnlock()
+	}
+	return stats
+}
+
+func (h *hive) Stats() HiveStats {
+	stats := HiveStats{Apps: make(map[string]AppStats)}
+	for _, a := range h.appList() {
+		var as AppStats
+		if a.dedup != nil {
+			as.Dedup = a.dedup.stats()
+		}
+		as.Latency = a.latency.stats()
+		stats.Apps[a.Name()] = as
+	}
+	return stats
+}
+
+func (h *hive) BestEffortDrops() uint64 {
+	return atomic.LoadUint64(&h.bestEffortDrops)
+}
+
+func (h *hive) SetEmitObserver(f func(Msg)) {
+	h.emitObserver.Store(f)
+}
+
+// observeEmit calls the emit observer, if any, on m.
+func (h *hive) observeEmit(m *msg) {
+	if f, _ := h.emitObserver.Load().(func(Msg)); f != nil {
+		f(m)
+	}
+}
+
+func (h *hive) ReplicationLag(app string) map[uint64]uint64 {
+	lags := make(map[uint64]uint64)
+	a, ok := h.app(app)
+	if !ok {
+		return lags
+	}
+
+	var leaders []*bee
+	a.qee.RLock()
+	for _, b := range a.qee.bees {
+		if !b.proxy && !b.detached {
+			leaders = append(leaders, b)
+		}
+	}
+	a.qee.RUnlock()
+
+	for _, b := range leaders {
+		c := b.colony()
+		if c.Leader != b.ID() {
+			continue
+		}
+		for f, lag := range h.followerLags(c) {
+			lags[f] = lag
+		}
+	}
+	return lags
+}
+
+// followerLags returns the replication lag of the followers of c, if the leader
+// of c is on this hive.
+func (h *hive) followerLags(c Colony) map[uint64]uint64 {
+	if len(c.Followers) == 0 {
+		return nil
+	}
+
+	s := h.node.Status(c.ID)
+	if s == nil || s.Progress == nil {
+		return nil
+	}
+
+	lags := make(map[uint64]uint64)
+	for _, f := range c.Followers {
+		info, err := h.registry.bee(f)
+		if err != nil {
+			continue
+		}
+		p, ok := s.Progress[info.Hive]
+		if !ok {
+			continue
+		}
+		var lag uint64
+		if p.Match < s.Commit {
+			lag = s.Commit - p.Match
+		}
+		lags[f] = lag
+	}
+	return lags
+}
+
+func (h *hive) countBestEffortDrop() {
+	atomic.AddUint64(&h.bestEffortDrops, 1)
+}
+
+func (h *hive) Topology() Topology {
+	return h.registry.topology()
+}
+
+func (h *hive) WatchTopology() (<-chan TopologyEvent, func()) {
+	return h.registry.watch()
+}
+
 func (h *hive) app(name string) (*app, bool) {
+	h.RLock()
+	defer h.RUnlock()
 	a, ok := h.apps[name]
 	return a, ok
 }
 
+// appList returns the apps of the hive. Apps can be registered while the hive
+// is running, so the apps must be iterated over the returned copy.
+func (h *hive) appList() []*app {
+	h.RLock()
+	defer h.RUnlock()
+	apps := make([]*app, 0, len(h.apps))
+	for _, a := range h.apps {
+		apps = append(apps, a)
+	}
+	return apps
+}
+
 func (h *hive) hiveAddr(id uint64) (string, error) {
 	i, err := h.registry.hive(id)
 	return i.Addr, err
@@ -412,6 +1088,94 @@ func (h *hive) stopListener() {
 	}
 }
 
+// dependsOn returns whether app from depends on app to, directly or
+// indirectly. It must be called while the hive is locked.
+func (h *hive) dependsOn(from, to string, seen map[string]bool) bool {
+	if seen[from] {
+		return false
+	}
+	seen[from] = true
+
+	a, ok := h.apps[from]
+	if !ok {
+		return false
+	}
+	for _, d := range a.deps {
+		if d == to || h.dependsOn(d, to, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// stopOrder sorts qs such that each app comes before the apps it depends on.
+// Apps without dependencies are returned in an arbitrary order. It also
+// returns the apps that have a dependency or are a dependency.
+func (h *hive) stopOrder(qs map[*qee]bool) (order []*qee,
+	deps map[*qee]bool) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	byName := make(map[string]*qee)
+	for q := range qs {
+		byName[q.app.Name()] = q
+	}
+
+	deps = make(map[*qee]bool)
+	visited := make(map[*qee]bool)
+	var visit func(q *qee)
+	visit = func(q *qee) {
+		if visited[q] {
+			return
+		}
+		visited[q] = true
+		for _, n := range q.app.deps {
+			d, ok := byName[n]
+			if !ok {
+				continue
+			}
+			deps[q] = true
+			deps[d] = true
+			visit(d)
+		}
+		order = append(order, q)
+	}
+	for q := range qs {
+		visit(q)
+	}
+
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return
+}
+
+// flushMsgs routes the messages that are already enqueued on the hive. It must
+// be called from the hive's message loop.
+func (h *hive) flushMsgs() {
+	marker := &msg{MsgData: hiveFlush{}}
+	h.dataCh.in() <- msgAndHandler{msg: marker}
+	for mh := range h.dataCh.out() {
+		if mh.msg == marker {
+			return
+		}
+		h.dispatch(mh)
+	}
+}
+
+// dispatch routes mh, which is dequeued from the hive's message queue.
+func (h *hive) dispatch(mh msgAndHandler) {
+	if mh.batch != nil {
+		h.handleMsgBatch(mh.batch)
+		return
+	}
+	h.handleMsg(mh.msg)
+}
+
+// hiveFlush marks the end of the messages flushed by flushMsgs.
+type hiveFlush struct{}
+
 func (h *hive) stopQees() {
 	glog.Infof("%v is stopping qees...", h)
 	qs := make(map[*qee]bool)
@@ -421,8 +1185,20 @@ func (h *hive) stopQees() {
 		}
 	}
 
+	order, deps := h.stopOrder(qs)
+	if len(deps) != 0 {
+		h.flushMsgs()
+	}
+
 	stopCh := make(chan cmdResult)
-	for q := range qs {
+	for _, q := range order {
+		// Apps with dependencies are drained before they are stopped, and the
+		// messages they emit are routed to their dependencies.
+		if deps[q] {
+			q.app.drain()
+			h.flushMsgs()
+		}
+
 		q.ctrlCh <- newCmdAndChannel(cmdStop{}, h.ID(), q.app.Name(), 0, stopCh)
 		glog.V(3).Infof("waiting on a qee: %v", q)
 		stopped := false
@@ -451,8 +1227,9 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 	glog.V(2).Infof("%v handles cmd %+v", h, cc.cmd)
 	switch d := cc.cmd.Data.(type) {
 	case cmdStop:
-		// TODO(soheil): This has a race with Stop(). Use atomics here.
-		h.status = hiveStopped
+		h.setStatus(hiveStopped)
+		h.setJoined(false)
+		h.members.stop()
 		h.stopListener()
 		h.stopQees()
 		h.node.Stop()
@@ -482,8 +1259,37 @@ func (h *hive) handleCmd(cc cmdAndChannel) {
 
 	case cmdLiveHives:
 		cc.ch <- cmdResult{
-			Data: h.registry.hives(),
+			Data: h.liveHives(),
+		}
+
+	case cmdRegisterApp:
+		h.registerApp(d.App)
+		go d.App.qee.start()
+		cc.ch <- cmdResult{}
+
+	case cmdRegisterHandler:
+		a, ok := h.app(d.App)
+		if !ok {
+			cc.ch <- cmdResult{Err: fmt.Errorf("no such application %s", d.App)}
+			return
 		}
+		cc.ch <- cmdResult{Err: a.setHandler(d.Type, d.Handler)}
+
+	case cmdRemoveHandler:
+		a, ok := h.app(d.App)
+		if !ok {
+			cc.ch <- cmdResult{Err: fmt.Errorf("no such application %s", d.App)}
+			return
+		}
+		cc.ch <- cmdResult{Err: a.removeHandlers(d.Types...)}
+
+	case cmdStopApp:
+		a, ok := h.app(d.App)
+		if !ok {
+			cc.ch <- cmdResult{Err: fmt.Errorf("no such application %s", d.App)}
+			return
+		}
+		cc.ch <- cmdResult{Err: h.stopApp(a)}
 
 	default:
 		cc.ch <- cmdResult{
@@ -505,8 +1311,56 @@ func (h *hive) raftBarrier() error {
 	return err
 }
 
+// routeResult is the result of cmdRoute.
+type routeResult struct {
+	Cells MappedCells
+	Bee   uint64
+}
+
+func (h *hive) Route(msgData interface{}, app string) (MappedCells, uint64,
+	error) {
+
+	m := h.newMsg(msgData, 0, 0)
+	h.Lock()
+	a, ok := h.apps[app]
+	var hndlr Handler
+	if ok {
+		hndlr = a.handlers[m.Type()]
+	}
+	h.Unlock()
+	if !ok {
+		return nil, Nil, fmt.Errorf("no such application %s", app)
+	}
+	if hndlr == nil {
+		return nil, Nil, ErrNoHandler
+	}
+
+	res, err := a.qee.processCmd(cmdRoute{
+		Msg: msgAndHandler{msg: m, handler: hndlr},
+	})
+	if err != nil {
+		return nil, Nil, err
+	}
+	r := res.(routeResult)
+	return r.Cells, r.Bee, nil
+}
+
+func (h *hive) Apps() []string {
+	h.RLock()
+	defer h.RUnlock()
+
+	names := make([]string, 0, len(h.apps))
+	for n := range h.apps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (h *hive) registerApp(a *app) {
+	h.Lock()
 	h.apps[a.Name()] = a
+	h.Unlock()
 }
 
 func (h *hive) registerHandler(t string, q *qee, l Handler) {
@@ -520,11 +1374,51 @@ func (h *hive) registerHandler(t string, q *qee, l Handler) {
 	h.qees[t] = append(h.qees[t], qeeAndHandler{q, l})
 }
 
+// unregisterHandler stops routing messages of type t to q.
+func (h *hive) unregisterHandler(t string, q *qee) {
+	qhs := h.qees[t]
+	for i, qh := range qhs {
+		if qh.q != q {
+			continue
+		}
+		if len(qhs) == 1 {
+			delete(h.qees, t)
+			return
+		}
+		h.qees[t] = append(qhs[:i:i], qhs[i+1:]...)
+		return
+	}
+}
+
+// stopApp stops routing messages to the app.
+func (h *hive) stopApp(a *app) error {
+	if a.stopped {
+		return ErrAppStopped
+	}
+	a.stopped = true
+
+	for t, qhs := range h.qees {
+		rest := make([]qeeAndHandler, 0, len(qhs))
+		for _, qh := range qhs {
+			if qh.q != a.qee {
+				rest = append(rest, qh)
+			}
+		}
+		if len(rest) == 0 {
+			delete(h.qees, t)
+			continue
+		}
+		h.qees[t] = rest
+	}
+	return nil
+}
+
 func (h *hive) initSync() {
 	a := h.NewApp("beehive-sync")
 	for i := uint(0); i < h.config.SyncPoolSize; i++ {
 		newSync(a, h.syncCh)
 	}
+	h.replyS = newReplySink(a)
 }
 
 func (h *hive) bee(id uint64) (BeeInfo, error) {
@@ -537,26 +1431,184 @@ func (h *hive) handleMsg(m *msg) {
 		i, err := h.bee(m.MsgTo)
 		if err != nil {
 			glog.Errorf("no such bee %v", m.MsgTo)
+			m.receipt.report(Failed, m.MsgTo, err)
 			return
 		}
 		a, ok := h.app(i.App)
 		if !ok {
 			glog.Fatalf("no such application %s", i.App)
 		}
+		if a.stopped {
+			glog.V(2).Infof("%v drops %v for stopped application %s", h, m, i.App)
+			m.receipt.report(Dropped, m.MsgTo, nil)
+			return
+		}
+		if i.Detached || !a.causal {
+			m.causal.expect(0)
+		} else {
+			m.causal.expect(1)
+		}
 		if i.Detached {
 			a.qee.enqueMsg(msgAndHandler{msg: m})
 			return
 		}
 		a.qee.enqueMsg(msgAndHandler{msg: m, handler: a.handler(m.Type())})
 	default:
-		for _, qh := range h.qees[m.Type()] {
-			qh.q.enqueMsg(msgAndHandler{m, qh.h})
+		for _, qh := range h.bcastQees(m) {
+			qh.q.enqueMsg(msgAndHandler{msg: m, handler: qh.h})
+		}
+	}
+}
+
+// handleMsgBatch routes the messages emitted at once. The broadcast messages
+// of the same app are enqueued on its qee at once.
+func (h *hive) handleMsgBatch(mhs []msgAndHandler) {
+	var qees []*qee
+	batches := make(map[*qee][]msgAndHandler)
+	enque := func() {
+		for _, q := range qees {
+			q.enqueMsg(msgAndHandler{batch: batches[q]})
+			delete(batches, q)
+		}
+		qees = qees[:0]
+	}
+
+	for _, mh := range mhs {
+		if mh.msg.IsUnicast() {
+			// The messages routed earlier are enqueued first to keep the order.
+			enque()
+			h.handleMsg(mh.msg)
+			continue
+		}
+
+		for _, qh := range h.bcastQees(mh.msg) {
+			if _, ok := batches[qh.q]; !ok {
+				qees = append(qees, qh.q)
+			}
+			batches[qh.q] = append(batches[qh.q],
+				msgAndHandler{msg: mh.msg, handler: qh.h})
+		}
+	}
+
+	enque()
+}
+
+// bcastQees returns the qees that route the broadcast message m. m is enqueued
+// on the detached bees subscribed to its type.
+func (h *hive) bcastQees(m *msg) []qeeAndHandler {
+	qhs := h.qees[m.Type()]
+	causal := 0
+	for _, qh := range qhs {
+		if qh.q.app.causal {
+			causal++
 		}
 	}
+	m.causal.expect(causal)
+	subs := h.subscribers(m.Type())
+	for _, b := range subs {
+		b.enqueMsg(msgAndHandler{msg: m})
+	}
+	if len(qhs) == 0 && len(subs) == 0 {
+		m.receipt.report(Failed, Nil, ErrNoHandler)
+	}
+	return qhs
+}
+
+// rejectReason returns why the unicast message m, received from another hive,
+// cannot be handled on this hive. It returns an empty string if the message can
+// be handled.
+func (h *hive) rejectReason(m *msg) string {
+	if !m.IsUnicast() {
+		return ""
+	}
+
+	i, err := h.bee(m.MsgTo)
+	if err != nil || i.Detached {
+		return ""
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	a, ok := h.apps[i.App]
+	if !ok {
+		return fmt.Sprintf("no such application %s", i.App)
+	}
+	if _, ok := a.handlers[m.Type()]; !ok {
+		return fmt.Sprintf("no handler for type %v on app %v", m.Type(), i.App)
+	}
+	return ""
+}
+
+func (h *hive) subscribeDetached(t string, b *bee) {
+	h.Lock()
+	defer h.Unlock()
+	for _, s := range h.subs[t] {
+		if s == b {
+			return
+		}
+	}
+	h.subs[t] = append(h.subs[t], b)
+}
+
+func (h *hive) unsubscribeDetached(b *bee) {
+	h.Lock()
+	defer h.Unlock()
+	for t, bees := range h.subs {
+		subs := make([]*bee, 0, len(bees))
+		for _, s := range bees {
+			if s != b {
+				subs = append(subs, s)
+			}
+		}
+		if len(subs) == 0 {
+			delete(h.subs, t)
+			continue
+		}
+		h.subs[t] = subs
+	}
+}
+
+func (h *hive) subscribers(t string) []*bee {
+	h.Lock()
+	defer h.Unlock()
+	return h.subs[t]
+}
+
+func (h *hive) setJoined(j bool) {
+	h.Lock()
+	h.joined = j
+	h.Unlock()
+}
+
+func (h *hive) isJoined() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.joined
+}
+
+func (h *hive) setStatus(s hiveStatus) {
+	h.Lock()
+	h.status = s
+	h.Unlock()
+}
+
+func (h *hive) isStarted() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.status == hiveStarted
+}
+
+func (h *hive) isListening() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.listener != nil
 }
 
 func (h *hive) startQees() {
-	for _, a := range h.apps {
+	for _, a := range h.appList() {
+		if a.stopped {
+			continue
+		}
 		go a.qee.start()
 	}
 }
@@ -578,10 +1630,11 @@ func (h *hive) startRaftNode() {
 	h.ticker = randtime.NewTicker(h.config.RaftTick, h.config.RaftTickDelta)
 
 	ncfg := raft.Config{
-		ID:     h.id,
-		Name:   h.String(),
-		Send:   h.sendRaft,
-		Ticker: h.ticker.C,
+		ID:            h.id,
+		Name:          h.String(),
+		Send:          h.sendRaft,
+		Ticker:        h.ticker.C,
+		ProposeWindow: h.config.GroupCommitWindow,
 	}
 	h.node = raft.StartMultiNode(ncfg)
 
@@ -622,6 +1675,13 @@ func (h *hive) delBeeFromRegistry(id uint64) error {
 }
 
 func (h *hive) reloadState() {
+	reloaded := make(map[uint64]string)
+	defer func() {
+		h.Lock()
+		h.reloaded = reloaded
+		h.Unlock()
+	}()
+
 	for _, b := range h.registry.beesOfHive(h.id) {
 		if b.Detached || b.Colony.IsNil() {
 			glog.V(1).Infof(
@@ -635,27 +1695,78 @@ func (h *hive) reloadState() {
 			glog.Errorf("app %v is not registered but has a bee", b.App)
 			continue
 		}
+		reloaded[b.ID] = b.App
 		_, err := a.qee.processCmd(cmdReloadBee{ID: b.ID, Colony: b.Colony})
 		if err != nil {
 			glog.Errorf("cannot reload bee %v on %v", b.ID, h.id)
+			h.Lock()
+			a.failure = fmt.Errorf("cannot reload bee %v: %v", b.ID, err)
+			h.Unlock()
 			continue
 		}
 	}
 }
 
+// joinRetryInterval is the interval between retries to listen on the hive's
+// address when joining the cluster.
+const joinRetryInterval = 100 * time.Millisecond
+
+// listenAndJoin listens on the hive's address and syncs with the cluster. If
+// JoinTimeout is set, it retries listening until the timeout.
+func (h *hive) listenAndJoin() error {
+	var deadline time.Time
+	if h.config.JoinTimeout != 0 {
+		deadline = time.Now().Add(h.config.JoinTimeout)
+	}
+
+	for {
+		err := h.listen()
+		if err == nil {
+			break
+		}
+		if deadline.IsZero() || time.Now().Add(joinRetryInterval).After(deadline) {
+			return err
+		}
+		glog.Warningf("%v cannot listen, retrying: %v", h, err)
+		time.Sleep(joinRetryInterval)
+	}
+
+	if deadline.IsZero() {
+		return h.raftBarrier()
+	}
+
+	timeout := deadline.Sub(time.Now())
+	tries := int(timeout / h.config.RaftElectTimeout())
+	if tries <= 0 {
+		tries = 1
+	}
+	_, err := h.node.ProposeRetry(hiveGroup, noOp{},
+		timeout/time.Duration(tries), tries)
+	return err
+}
+
+// abortStart cleans up a hive that cannot be started.
+func (h *hive) abortStart() {
+	h.setStatus(hiveStopped)
+	signal.Stop(h.sigCh)
+	close(h.sigCh)
+	h.stopListener()
+	h.node.Stop()
+	h.ticker.Stop()
+}
+
 func (h *hive) Start() error {
-	h.status = hiveStarted
+	h.setStatus(hiveStarted)
 	h.registerSignals()
 	h.startRaftNode()
-	if err := h.listen(); err != nil {
-		glog.Errorf("%v cannot start listener: %v", h, err)
-		h.Stop()
+	if err := h.listenAndJoin(); err != nil {
+		glog.Errorf("%v cannot join the cluster: %v", h, err)
+		h.abortStart()
 		return err
 	}
-	if err := h.raftBarrier(); err != nil {
-		glog.Fatalf("error when joining the cluster: %v", err)
-	}
 	glog.V(2).Infof("%v is in sync with the cluster", h)
+	h.setJoined(true)
+	h.members.start()
 	h.startQees()
 	h.reloadState()
 
@@ -663,8 +1774,8 @@ func (h *hive) Start() error {
 	dataCh := h.dataCh.out()
 	for h.status == hiveStarted {
 		select {
-		case m := <-dataCh:
-			h.handleMsg(m.msg)
+		case mh := <-dataCh:
+			h.dispatch(mh)
 
 		case cmd := <-h.ctrlCh:
 			h.handleCmd(cmd)
@@ -686,7 +1797,7 @@ func (h *hive) Stop() error {
 		return errors.New("control channel is closed")
 	}
 
-	if h.status == hiveStopped {
+	if !h.isStarted() {
 		return errors.New("hive is already stopped")
 	}
 
@@ -705,7 +1816,6 @@ func (h *hive) NewApp(name string, options ...AppOption) App {
 		handlers: make(map[string]Handler),
 	}
 	a.initQee()
-	h.registerApp(a)
 
 	if len(options) == 0 {
 		options = defaultAppOptions
@@ -715,34 +1825,132 @@ func (h *hive) NewApp(name string, options ...AppOption) App {
 		opt(a)
 	}
 
+	// When the hive is running, the app is registered in the hive's message
+	// loop so that no message is routed while the app is half-registered.
+	if h.isStarted() {
+		if _, err := h.processCmd(cmdRegisterApp{App: a}); err != nil {
+			glog.Errorf("%v cannot register app %v: %v", h, name, err)
+		}
+		return a
+	}
+
+	h.registerApp(a)
 	return a
 }
 
-func (h *hive) Emit(msgData interface{}) {
-	h.enqueMsg(&msg{MsgData: msgData})
+func (h *hive) Emit(msgData interface{}) error {
+	if h.overloaded() {
+		return ErrOverloaded
+	}
+	m := &msg{
+		MsgData:  msgData,
+		MsgTrace: h.newTraceID(),
+		MsgTime:  h.config.Clock.Now(),
+	}
+	h.localCopy(m)
+	h.enqueMsg(m)
+	return nil
+}
+
+func (h *hive) EmitBatch(msgData []interface{}) error {
+	if h.overloaded() {
+		return ErrOverloaded
+	}
+	msgs := make([]*msg, 0, len(msgData))
+	for _, d := range msgData {
+		m := &msg{
+			MsgData:  d,
+			MsgTrace: h.newTraceID(),
+			MsgTime:  h.config.Clock.Now(),
+		}
+		h.localCopy(m)
+		msgs = append(msgs, m)
+	}
+	h.enqueMsgs(msgs)
+	return nil
 }
 
 func (h *hive) enqueMsg(msg *msg) {
 	h.dataCh.in() <- msgAndHandler{msg: msg}
 }
 
+// enqueMsgs enqueues msgs on the hive at once, so that they are routed in the
+// same iteration of the hive's loop.
+func (h *hive) enqueMsgs(msgs []*msg) {
+	switch len(msgs) {
+	case 0:
+		return
+	case 1:
+		h.enqueMsg(msgs[0])
+		return
+	}
+
+	batch := make([]msgAndHandler, 0, len(msgs))
+	for _, m := range msgs {
+		batch = append(batch, msgAndHandler{msg: m})
+	}
+	h.dataCh.in() <- msgAndHandler{batch: batch}
+}
+
 func (h *hive) SendToCellKey(msgData interface{}, to string, k CellKey) {
 	// TODO(soheil): Implement this hive.SendTo.
 	glog.Fatalf("FIXME implement SendToCellKey")
 }
 
-func (h *hive) SendToBee(msgData interface{}, to uint64) {
-	h.enqueMsg(newMsgFromData(msgData, 0, to))
+func (h *hive) SendToBee(msgData interface{}, to uint64) error {
+	if h.overloaded() {
+		return ErrOverloaded
+	}
+	m := h.newMsg(msgData, 0, to)
+	m.MsgTrace = h.newTraceID()
+	h.localCopy(m)
+	h.enqueMsg(m)
+	return nil
+}
+
+func (h *hive) EmitWhere(msgData interface{}, app string,
+	pred func(bee uint64, cells MappedCells) bool) error {
+
+	if h.overloaded() {
+		return ErrOverloaded
+	}
+
+	a, ok := h.app(app)
+	if !ok {
+		return fmt.Errorf("no such application %s", app)
+	}
+	if a.handler(MsgType(msgData)) == nil {
+		return fmt.Errorf("no handler for type %v on app %v", MsgType(msgData),
+			app)
+	}
+
+	for _, b := range h.registry.bees() {
+		if b.App != app || b.Detached || b.Colony.Leader != b.ID {
+			continue
+		}
+		if pred(b.ID, h.registry.cellsOf(b.ID)) {
+			if err := h.SendToBee(msgData, b.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // Reply to thatMsg with the provided replyData.
 func (h *hive) Reply(thatMsg Msg, replyData interface{}) error {
 	m := thatMsg.(*msg)
 	if m.NoReply() {
-		return errors.New("cannot reply to this message")
+		return ErrCannotReply
+	}
+	if h.overloaded() {
+		return ErrOverloaded
 	}
 
-	h.enqueMsg(newMsgFromData(replyData, 0, m.From()))
+	r := h.newColonyMsg(replyData, 0, m.From())
+	r.MsgTrace = m.MsgTrace
+	h.localCopy(r)
+	h.enqueMsg(r)
 	return nil
 }
 
@@ -754,20 +1962,25 @@ func (h *hive) registerSignals() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	go func() {
-		<-h.sigCh
-		h.Stop()
+		if _, ok := <-h.sigCh; ok {
+			h.Stop()
+		}
 	}()
 }
 
 func (h *hive) listen() (err error) {
-	h.listener, err = net.Listen("tcp", h.config.Addr)
+	network, addr := splitAddr(h.config.Addr)
+	l, err := h.listenNet(network, addr)
 	if err != nil {
 		glog.Errorf("%v cannot listen: %v", h, err)
 		return err
 	}
+	h.Lock()
+	h.listener = l
+	h.Unlock()
 	glog.Infof("%v is listening", h)
 
-	m := cmux.New(h.listener)
+	m := cmux.New(newBackoffListener(l, h.reportErr))
 	hl := m.Match(cmux.HTTP1Fast())
 	rl := m.Match(cmux.Any())
 
@@ -776,11 +1989,6 @@ func (h *hive) listen() (err error) {
 		glog.Infof("%v closed http listener", h)
 	}()
 
-	rs := rpc.NewServer()
-	if err := rs.RegisterName("rpcServer", newRPCServer(h)); err != nil {
-		glog.Fatalf("cannot register rpc server: %v", err)
-	}
-
 	go func() {
 		for {
 			conn, err := rl.Accept()
@@ -788,7 +1996,16 @@ func (h *hive) listen() (err error) {
 				glog.Infof("%v closed rpc listener", h)
 				return
 			}
-			go rs.ServeConn(conn)
+			cfg := h.cfg()
+			if cfg.ReadTimeout > 0 || cfg.WriteTimeout > 0 {
+				conn = newDeadlineConn(conn, cfg.ReadTimeout, cfg.WriteTimeout)
+			}
+			st := h.conns.incoming(conn.RemoteAddr().String())
+			conn = countingConn{Conn: conn, stat: st}
+			if max := cfg.MaxMsgSize; max != 0 {
+				conn = newMaxSizeConn(conn, max)
+			}
+			go h.serveRPC(conn, st)
 		}
 	}()
 
@@ -797,6 +2014,18 @@ func (h *hive) listen() (err error) {
 	return nil
 }
 
+// serveRPC serves the rpcs of another hive on conn. Each connection has its
+// own rpc server, so that the messages it carries are counted in st.
+func (h *hive) serveRPC(conn net.Conn, st *connStat) {
+	defer h.conns.closeIncoming(st)
+
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("rpcServer", newRPCServer(h, st)); err != nil {
+		glog.Fatalf("cannot register rpc server: %v", err)
+	}
+	rs.ServeConn(conn)
+}
+
 func (h *hive) sendRaft(batch *raft.Batch, r raft.Reporter) {
 	go func() {
 		if err := h.client.sendRaft(batch, r); err != nil &&
@@ -89,6 +89,456 @@ func TestHiveRestart(t *testing.T) {
 	runHiveTest(t)
 }
 
+func TestHiveNewAppAfterStart(t *testing.T) {
+	h := newHiveForTest()
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ch := make(chan MyMsg)
+	a := h.NewApp("dynamic")
+	a.HandleFunc(MyMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- m.Data().(MyMsg)
+		return nil
+	})
+
+	h.Emit(MyMsg(42))
+	select {
+	case m := <-ch:
+		if m != 42 {
+			t.Errorf("invalid message: actual=%v want=42", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("message is not handled by an app registered after start")
+	}
+}
+
+func TestHiveHandlersWhileRunning(t *testing.T) {
+	h := newHiveForTest()
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	a := h.NewApp("handlers")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			a.HandleFunc(MyMsg(0), func(m Msg, c MapContext) MappedCells {
+				return MappedCells{{"D", "0"}}
+			}, func(m Msg, c RcvContext) error {
+				return nil
+			})
+			a.RemoveHandler(MyMsg(0))
+		}
+	}()
+
+	none := func(bee uint64, cells MappedCells) bool { return false }
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		h.EmitWhere(MyMsg(0), "handlers", none)
+	}
+}
+
+func TestHiveJoinTimeout(t *testing.T) {
+	h1 := newHiveForTest()
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	testPort++
+	path := fmt.Sprintf("/tmp/bhtest-%v", testPort)
+	removeState(path)
+	h2 := NewHive(Addr(h1.Config().Addr), StatePath(path),
+		JoinTimeout(500*time.Millisecond))
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- h2.Start()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("hive started on an address already in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("hive hangs on an address already in use")
+	}
+}
+
+type emitBatchTestMsg int
+type emitBatchTestTrigger struct{}
+
+func TestHiveEmitBatch(t *testing.T) {
+	h := newHiveForTest()
+	n := 10
+	ch := make(chan emitBatchTestMsg)
+	a := h.NewApp("emitbatch")
+	a.HandleFunc(emitBatchTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", strconv.Itoa(int(m.Data().(emitBatchTestMsg)))}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- m.Data().(emitBatchTestMsg)
+		return nil
+	})
+	a.HandleFunc(emitBatchTestTrigger{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"T", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		var batch []interface{}
+		for i := 0; i < n; i++ {
+			batch = append(batch, emitBatchTestMsg(n+i))
+		}
+		c.EmitBatch(batch)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	var batch []interface{}
+	for i := 0; i < n; i++ {
+		batch = append(batch, emitBatchTestMsg(i))
+	}
+	h.EmitBatch(batch)
+	h.Emit(emitBatchTestTrigger{})
+
+	rcvd := make(map[emitBatchTestMsg]bool)
+	for i := 0; i < 2*n; i++ {
+		select {
+		case m := <-ch:
+			rcvd[m] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing messages: actual=%v want=%v", len(rcvd), 2*n)
+		}
+	}
+	if len(rcvd) != 2*n {
+		t.Errorf("duplicate messages: actual=%v want=%v", len(rcvd), 2*n)
+	}
+}
+
+func TestHiveEmitBatchEnqueuesOnce(t *testing.T) {
+	h := newHiveForTest().(*hive)
+	n := 10
+	a := h.NewApp("emitbatch")
+	a.HandleFunc(emitBatchTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		return nil
+	})
+
+	var msgs []*msg
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, newMsgFromData(emitBatchTestMsg(i), 0, 0))
+	}
+	h.enqueMsgs(msgs)
+	h.dispatch(<-h.dataCh.out())
+
+	select {
+	case mh := <-a.(*app).qee.dataCh.out():
+		if len(mh.batch) != n {
+			t.Errorf("invalid batch size: actual=%v want=%v", len(mh.batch), n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the batch is not enqueued on the qee")
+	}
+}
+
+type emitWhereTestMsg struct {
+	Key string
+}
+
+func TestHiveEmitWhere(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan uint64)
+	a := h.NewApp("emitwhere")
+	a.HandleFunc(emitWhereTestMsg{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(emitWhereTestMsg).Key}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.ID()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < 4; i++ {
+		h.Emit(emitWhereTestMsg{Key: strconv.Itoa(i)})
+		<-ch
+	}
+
+	want := make(map[uint64]bool)
+	err := h.EmitWhere(emitWhereTestMsg{}, "emitwhere",
+		func(bee uint64, cells MappedCells) bool {
+			for _, k := range cells {
+				if k.Key == "1" || k.Key == "3" {
+					want[bee] = true
+					return true
+				}
+			}
+			return false
+		})
+	if err != nil {
+		t.Fatalf("cannot emit: %v", err)
+	}
+	if len(want) != 2 {
+		t.Fatalf("invalid number of selected bees: actual=%v want=2", len(want))
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-ch:
+			if !want[id] {
+				t.Errorf("message is received by unselected bee %v", id)
+			}
+			delete(want, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("bees %v did not receive the message", want)
+		}
+	}
+	select {
+	case id := <-ch:
+		t.Errorf("message is received by unselected bee %v", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type bestEffortTestMsg struct{}
+type bestEffortTestTrigger struct {
+	N int
+}
+
+func registerBestEffortApp(h Hive, mch chan uint64, tch chan struct{}) {
+	a := h.NewApp("besteffort")
+	a.HandleFunc(bestEffortTestMsg{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		mch <- c.ID()
+		return nil
+	})
+	a.HandleFunc(bestEffortTestTrigger{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"T", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		for i := 0; i < m.Data().(bestEffortTestTrigger).N; i++ {
+			c.EmitBestEffort(bestEffortTestMsg{})
+		}
+		tch <- struct{}{}
+		return nil
+	})
+}
+
+func TestHiveEmitBestEffort(t *testing.T) {
+	n := 5
+	mch := make(chan uint64, n)
+	tch := make(chan struct{})
+
+	h := newHiveForTest()
+	registerBestEffortApp(h, mch, tch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// Place the receiver on a hive that is not listening.
+	testPort++
+	dead := HiveInfo{ID: 1000, Addr: fmt.Sprintf("127.0.0.1:%v", testPort)}
+	hv := h.(*hive)
+	hv.registry.m.Lock()
+	hv.registry.addHive(dead)
+	hv.registry.m.Unlock()
+
+	id, err := hv.apps["besteffort"].qee.newBeeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := Colony{ID: id, Leader: id}
+	var req batchReq
+	req.addReq(addBee(BeeInfo{ID: id, Hive: dead.ID, App: "besteffort",
+		Colony: col}))
+	req.addReq(lockMappedCell{Colony: col, App: "besteffort",
+		Cells: MappedCells{{"D", "0"}}})
+	if _, err := hv.node.ProposeRetry(hiveGroup, req,
+		hv.config.RaftElectTimeout(), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Emit(bestEffortTestTrigger{N: n})
+	<-tch
+
+	var drops uint64
+	for i := 0; i < 50; i++ {
+		if drops = h.BestEffortDrops(); drops >= uint64(n) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if drops != uint64(n) {
+		t.Errorf("invalid best-effort drops: actual=%v want=%v", drops, n)
+	}
+
+	select {
+	case id := <-mch:
+		t.Errorf("best-effort message delivered to %v", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type autoRegTestMsg struct {
+	V int
+}
+
+func registerAutoRegApp(h Hive, ch chan uint64) {
+	a := h.NewApp("autoreg")
+	a.HandleFunc(autoRegTestMsg{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.(*bee).hive.ID()
+		return nil
+	})
+}
+
+func TestHiveHandleRegistersMsg(t *testing.T) {
+	ch := make(chan uint64, 2)
+	h1 := newHiveForTest()
+	registerAutoRegApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerAutoRegApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// The bee is created on h1, and h2 has to send the message to h1.
+	for i, h := range []Hive{h1, h2} {
+		h.Emit(autoRegTestMsg{V: i})
+		select {
+		case id := <-ch:
+			if id != h1.ID() {
+				t.Errorf("message received on an invalid hive: actual=%v want=%v", id,
+					h1.ID())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message is not delivered from %v", h)
+		}
+	}
+}
+
+func TestHiveUnixSocket(t *testing.T) {
+	newUnixHive := func(opts ...HiveOption) Hive {
+		testPort++
+		path := fmt.Sprintf("/tmp/bhtest-%v", testPort)
+		removeState(path)
+		sock := fmt.Sprintf("unix:///tmp/bhtest-%v.sock", testPort)
+		return NewHive(append(opts, Addr(sock), StatePath(path))...)
+	}
+
+	ch := make(chan uint64, 2)
+	h1 := newUnixHive()
+	registerAutoRegApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newUnixHive(PeerAddrs(h1.Config().Addr))
+	registerAutoRegApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(autoRegTestMsg{V: 1})
+	<-ch
+
+	// h2 sends the message to the bee on h1 over the unix socket.
+	h2.Emit(autoRegTestMsg{V: 2})
+	select {
+	case id := <-ch:
+		if id != h1.ID() {
+			t.Errorf("message received on an invalid hive: actual=%v want=%v", id,
+				h1.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not delivered over the unix socket")
+	}
+}
+
+type emitObsIn struct{}
+type emitObsOut1 struct{}
+type emitObsOut2 struct{}
+
+func TestHiveEmitObserver(t *testing.T) {
+	h := newHiveForTest()
+	obs := make(chan Msg, 2)
+	h.SetEmitObserver(func(m Msg) {
+		obs <- m
+	})
+	h.NewApp("emitobs").HandleFunc(emitObsIn{},
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			c.Emit(emitObsOut1{})
+			c.Emit(emitObsOut2{})
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+
+	h.Emit(emitObsIn{})
+	for _, want := range []interface{}{emitObsOut1{}, emitObsOut2{}} {
+		select {
+		case m := <-obs:
+			if m.Type() != MsgType(want) {
+				t.Errorf("invalid observed message: actual=%v want=%v", m.Type(),
+					MsgType(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v is not observed", MsgType(want))
+		}
+	}
+
+	h.SetEmitObserver(nil)
+}
+
+func TestHiveNewAppsWhileRunning(t *testing.T) {
+	h := newHiveForTest()
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	const n = 10
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			h.NewApp(fmt.Sprintf("running%v", i))
+		}
+	}()
+
+	hv := h.(*hive)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		hv.app("running0")
+		hv.BeeQueueStats()
+	}
+	for i := 0; i < n; i++ {
+		if _, ok := hv.app(fmt.Sprintf("running%v", i)); !ok {
+			t.Errorf("app running%v is not registered", i)
+		}
+	}
+}
+
 func TestHiveCluster(t *testing.T) {
 	h1 := newHiveForTest()
 	go h1.Start()
@@ -148,3 +598,44 @@ func TestHiveFailure(t *testing.T) {
 	h3.Stop()
 	h2.Stop()
 }
+
+type routeTestMsg string
+
+func TestRoute(t *testing.T) {
+	ch := make(chan uint64)
+	h := newHiveForTest()
+	a := h.NewApp("route")
+	a.HandleFunc(routeTestMsg(""), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", string(m.Data().(routeTestMsg))}}
+	}, func(m Msg, ctx RcvContext) error {
+		ch <- ctx.ID()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	if _, _, err := h.Route(MyMsg(0), "route"); err != ErrNoHandler {
+		t.Errorf("invalid error for an unhandled type: actual=%v want=%v", err,
+			ErrNoHandler)
+	}
+
+	for _, k := range []string{"a", "b"} {
+		cells, bee, err := h.Route(routeTestMsg(k), "route")
+		if err != nil {
+			t.Fatalf("cannot route %v: %v", k, err)
+		}
+		if len(cells) != 1 || cells[0] != (CellKey{"D", k}) {
+			t.Errorf("invalid cells: actual=%v want=%v", cells, CellKey{"D", k})
+		}
+		if bee != Nil {
+			t.Errorf("route of an unmapped cell returns a bee: %v", bee)
+		}
+
+		h.Emit(routeTestMsg(k))
+		id := <-ch
+		if _, bee, _ := h.Route(routeTestMsg(k), "route"); bee != id {
+			t.Errorf("invalid bee for %v: actual=%v want=%v", k, bee, id)
+		}
+	}
+}
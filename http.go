@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/gorilla/mux"
 )
@@ -16,6 +18,19 @@ const (
 	serverV1BeesPath  = "/api/v1/bees"
 )
 
+// Health check endpoints. These are meant to be used as liveness and readiness
+// probes, and are served as json.
+const (
+	serverHealthzPath = "/healthz"
+	serverReadyzPath  = "/readyz"
+)
+
+// HealthStatus represents the result of a health check.
+type HealthStatus struct {
+	OK       bool     `json:"ok"`                  // OK is true when healthy.
+	NotReady []string `json:"not_ready,omitempty"` // What is not ready yet.
+}
+
 func buildURL(scheme, addr, path string) string {
 	var buffer bytes.Buffer
 	buffer.WriteString(scheme)
@@ -46,6 +61,8 @@ func newServer(h *hive) *httpServer {
 	}
 	v1 := v1Handler{srv: s}
 	v1.install(r)
+	hc := healthHandler{srv: s}
+	hc.install(r)
 	w := webHandler{}
 	w.install(r)
 	if h.config.Pprof {
@@ -98,6 +115,114 @@ func (h *v1Handler) handleBees(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
+type healthHandler struct {
+	srv *httpServer
+}
+
+func (h *healthHandler) install(r *mux.Router) {
+	r.HandleFunc(serverHealthzPath, h.handleHealthz)
+	r.HandleFunc(serverReadyzPath, h.handleReadyz)
+}
+
+// hiveNotReady returns what is missing for the hive to be considered alive.
+func (h *healthHandler) hiveNotReady() (notReady []string) {
+	hv := h.srv.hive
+	if !hv.isStarted() {
+		notReady = append(notReady, "hive is not started")
+	}
+	if !hv.isListening() {
+		notReady = append(notReady, "hive is not listening")
+	}
+	if !hv.isJoined() {
+		notReady = append(notReady, "hive has not joined the cluster")
+	}
+	return notReady
+}
+
+func (h *healthHandler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, h.hiveNotReady())
+}
+
+func (h *healthHandler) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	notReady := h.hiveNotReady()
+	notReady = append(notReady, h.appsNotReady()...)
+	writeHealth(w, notReady)
+}
+
+// appsNotReady returns what is missing for the apps of the hive to be
+// considered ready: the apps must be started and not failed, and the bees
+// reloaded when the hive started must exist, unless they are moved to other
+// hives.
+func (h *healthHandler) appsNotReady() (notReady []string) {
+	hv := h.srv.hive
+	hv.Lock()
+	names := make([]string, 0, len(hv.apps))
+	apps := make(map[string]*app, len(hv.apps))
+	failures := make(map[string]error)
+	for n, a := range hv.apps {
+		names = append(names, n)
+		apps[n] = a
+		if a.failure != nil {
+			failures[n] = a.failure
+		}
+	}
+	reloaded := hv.reloaded
+	hv.Unlock()
+
+	sort.Strings(names)
+	for _, n := range names {
+		if err, ok := failures[n]; ok {
+			notReady = append(notReady, fmt.Sprintf("app %v has failed: %v", n,
+				err))
+		}
+		if !apps[n].qee.isStarted() {
+			notReady = append(notReady, fmt.Sprintf("app %v is not started", n))
+		}
+	}
+
+	if reloaded == nil {
+		return append(notReady, "hive has not reloaded its bees")
+	}
+	ids := make([]uint64, 0, len(reloaded))
+	for id := range reloaded {
+		ids = append(ids, id)
+	}
+	sort.Sort(beeIDs(ids))
+	for _, id := range ids {
+		a, ok := apps[reloaded[id]]
+		if !ok {
+			continue
+		}
+		if _, ok := a.qee.beeByID(id); ok {
+			continue
+		}
+		if info, err := hv.registry.bee(id); err != nil || info.Hive != hv.ID() {
+			continue
+		}
+		notReady = append(notReady, fmt.Sprintf("bee %v of app %v is not loaded",
+			id, a.Name()))
+	}
+	return notReady
+}
+
+func writeHealth(w http.ResponseWriter, notReady []string) {
+	s := HealthStatus{
+		OK:       len(notReady) == 0,
+		NotReady: notReady,
+	}
+
+	j, err := json.Marshal(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !s.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
+
 func init() {
 	gob.Register(HiveState{})
 }
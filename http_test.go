@@ -0,0 +1,134 @@
+package beehive
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, h *hive, path string) (int, HealthStatus) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.httpServer.router.ServeHTTP(w, req)
+	var s HealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatalf("invalid health response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, s
+}
+
+func TestHealthCheck(t *testing.T) {
+	h := newHiveForTest()
+	h.NewApp("healthapp")
+
+	for _, p := range []string{serverHealthzPath, serverReadyzPath} {
+		code, s := getHealth(t, h.(*hive), p)
+		if code != http.StatusServiceUnavailable || s.OK {
+			t.Errorf("%v before start: actual=%v want=%v", p, code,
+				http.StatusServiceUnavailable)
+		}
+		if len(s.NotReady) == 0 {
+			t.Errorf("%v before start has no reason", p)
+		}
+	}
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for _, p := range []string{serverHealthzPath, serverReadyzPath} {
+		var code int
+		var s HealthStatus
+		for i := 0; i < 10; i++ {
+			if code, s = getHealth(t, h.(*hive), p); code == http.StatusOK {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if code != http.StatusOK || !s.OK {
+			t.Errorf("%v after start: actual=%v (%v) want=%v", p, code, s.NotReady,
+				http.StatusOK)
+		}
+	}
+}
+
+func TestHealthzWhileStarting(t *testing.T) {
+	h := newHiveForTest()
+	go h.Start()
+	defer h.Stop()
+
+	// The health of the hive is checked while the hive starts.
+	for i := 0; ; i++ {
+		if code, _ := getHealth(t, h.(*hive), serverHealthzPath); code ==
+			http.StatusOK {
+			break
+		}
+		if i == 500 {
+			t.Fatal("the hive is not healthy after start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type readyzTestMsg int
+
+func TestReadyzAppsAndBees(t *testing.T) {
+	ch := make(chan uint64, 1)
+	h := newHiveForTest()
+	a := h.NewApp("readyzapp")
+	a.HandleFunc(readyzTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.ID()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(readyzTestMsg(0))
+	id := <-ch
+
+	hv := h.(*hive)
+	waitReady := func(want int) HealthStatus {
+		var code int
+		var s HealthStatus
+		for i := 0; i < 10; i++ {
+			if code, s = getHealth(t, hv, serverReadyzPath); code == want {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if code != want {
+			t.Fatalf("invalid readiness: actual=%v (%v) want=%v", code, s.NotReady,
+				want)
+		}
+		return s
+	}
+	waitReady(http.StatusOK)
+
+	hv.Lock()
+	a.(*app).failure = errors.New("readyz test failure")
+	hv.Unlock()
+	s := waitReady(http.StatusServiceUnavailable)
+	if len(s.NotReady) != 1 || !strings.Contains(s.NotReady[0], "failed") {
+		t.Errorf("invalid reason for a failed app: %v", s.NotReady)
+	}
+
+	hv.Lock()
+	a.(*app).failure = nil
+	hv.reloaded[id] = "readyzapp"
+	hv.Unlock()
+	a.(*app).qee.removeBee(id)
+	s = waitReady(http.StatusServiceUnavailable)
+	if len(s.NotReady) != 1 || !strings.Contains(s.NotReady[0], "not loaded") {
+		t.Errorf("invalid reason for a missing bee: %v", s.NotReady)
+	}
+}
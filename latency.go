@@ -0,0 +1,118 @@
+package beehive
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of latency histograms,
+// from 100us to about 13s. Latencies above the last bound are counted in an
+// extra bucket.
+var latencyBounds = func() []time.Duration {
+	b := make([]time.Duration, 18)
+	for i := range b {
+		b[i] = 100 * time.Microsecond << uint(i)
+	}
+	return b
+}()
+
+// LatencyStats represents the histogram of the latency of handling messages,
+// from when a bee starts handling a message until its handler returns and its
+// transaction, if any, is committed.
+type LatencyStats struct {
+	Count   uint64          `json:"count"`   // number of messages.
+	Sum     time.Duration   `json:"sum"`     // total latency of messages.
+	Max     time.Duration   `json:"max"`     // maximum latency.
+	Buckets []LatencyBucket `json:"buckets"` // the histogram.
+}
+
+// LatencyBucket is a bucket of a latency histogram.
+type LatencyBucket struct {
+	// Bound is the upper bound of the latencies in the bucket. It is 0 for the
+	// last bucket, which has no upper bound.
+	Bound time.Duration `json:"bound"`
+	Count uint64        `json:"count"` // number of messages in the bucket.
+}
+
+// latencyHist is a latency histogram updated atomically.
+type latencyHist struct {
+	count   uint64
+	sum     int64
+	max     int64
+	buckets []uint64
+}
+
+func newLatencyHist() *latencyHist {
+	return &latencyHist{buckets: make([]uint64, len(latencyBounds)+1)}
+}
+
+func (h *latencyHist) record(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && latencyBounds[i] < d {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	for {
+		m := atomic.LoadInt64(&h.max)
+		if int64(d) <= m || atomic.CompareAndSwapInt64(&h.max, m, int64(d)) {
+			break
+		}
+	}
+}
+
+func (h *latencyHist) stats() LatencyStats {
+	s := LatencyStats{
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+		Max:     time.Duration(atomic.LoadInt64(&h.max)),
+		Buckets: make([]LatencyBucket, len(h.buckets)),
+	}
+	for i := range h.buckets {
+		if i < len(latencyBounds) {
+			s.Buckets[i].Bound = latencyBounds[i]
+		}
+		s.Buckets[i].Count = atomic.LoadUint64(&h.buckets[i])
+	}
+	return s
+}
+
+// latencyRecorder keeps the latency histograms of an app by message type. It
+// is shared by the bees of the app.
+type latencyRecorder struct {
+	sync.RWMutex
+	hists map[string]*latencyHist
+}
+
+func (r *latencyRecorder) record(msgType string, d time.Duration) {
+	r.RLock()
+	h, ok := r.hists[msgType]
+	r.RUnlock()
+	if !ok {
+		r.Lock()
+		if h, ok = r.hists[msgType]; !ok {
+			if r.hists == nil {
+				r.hists = make(map[string]*latencyHist)
+			}
+			h = newLatencyHist()
+			r.hists[msgType] = h
+		}
+		r.Unlock()
+	}
+	h.record(d)
+}
+
+func (r *latencyRecorder) stats() map[string]LatencyStats {
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.hists) == 0 {
+		return nil
+	}
+	s := make(map[string]LatencyStats, len(r.hists))
+	for t, h := range r.hists {
+		s[t] = h.stats()
+	}
+	return s
+}
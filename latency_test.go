@@ -0,0 +1,97 @@
+package beehive
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type latencyTestMsg int
+
+func TestHandlerLatency(t *testing.T) {
+	const (
+		n     = 3
+		sleep = 10 * time.Millisecond
+	)
+	done := make(chan struct{}, n)
+	h := newHiveForTest()
+	h.NewApp("latency").HandleFunc(latencyTestMsg(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			time.Sleep(sleep)
+			// The commit time is part of the latency.
+			c.OnPreCommit(func() error {
+				time.Sleep(sleep)
+				return nil
+			})
+			c.OnPostCommit(func() { done <- struct{}{} })
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < n; i++ {
+		h.Emit(latencyTestMsg(i))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not handled", i)
+		}
+	}
+
+	var s LatencyStats
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s = h.Stats().Apps["latency"].Latency[MsgType(latencyTestMsg(0))]
+		if s.Count == n || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s.Count != n {
+		t.Fatalf("invalid number of messages: actual=%v want=%v", s.Count, n)
+	}
+	if s.Sum < n*2*sleep || s.Max < 2*sleep {
+		t.Errorf("latency is less than the handler and the commit: sum=%v max=%v",
+			s.Sum, s.Max)
+	}
+	var c uint64
+	for _, b := range s.Buckets {
+		if b.Bound != 0 && b.Bound < 2*sleep {
+			c += b.Count
+		}
+	}
+	if c != 0 {
+		t.Errorf("%v messages are in buckets below %v: %v", c, 2*sleep, s.Buckets)
+	}
+}
+
+func TestStatsWithNewApps(t *testing.T) {
+	h := newHiveForTest()
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			h.NewApp(fmt.Sprintf("stats%v", i))
+		}
+	}()
+	for {
+		h.Stats()
+		select {
+		case <-done:
+			if n := len(h.Stats().Apps); n < 10 {
+				t.Errorf("invalid number of apps: actual=%v want>=10", n)
+			}
+			return
+		default:
+		}
+	}
+}
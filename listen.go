@@ -0,0 +1,86 @@
+package beehive
+
+import (
+	"net"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+const (
+	// minAcceptBackoff is the delay after the first temporary accept error.
+	minAcceptBackoff = 5 * time.Millisecond
+	// maxAcceptBackoff is the maximum delay between retries of accept.
+	maxAcceptBackoff = time.Second
+	// acceptErrThreshold is the number of consecutive temporary accept errors
+	// after which the error is reported on the error channel of the hive.
+	acceptErrThreshold = 10
+)
+
+// errChBufSize is the buffer size of the error channel of hives.
+const errChBufSize = 16
+
+// backoffListener retries the temporary errors of Accept (e.g., too many open
+// files) with an exponential backoff, instead of returning them to an accept
+// loop that would retry immediately and spin.
+type backoffListener struct {
+	net.Listener
+	min       time.Duration
+	max       time.Duration
+	threshold int
+	report    func(err error) // called once threshold errors are in a row.
+}
+
+func newBackoffListener(l net.Listener, report func(err error)) net.Listener {
+	return &backoffListener{
+		Listener:  l,
+		min:       minAcceptBackoff,
+		max:       maxAcceptBackoff,
+		threshold: acceptErrThreshold,
+		report:    report,
+	}
+}
+
+func (l *backoffListener) Accept() (net.Conn, error) {
+	var d time.Duration
+	for n := 1; ; n++ {
+		c, err := l.Listener.Accept()
+		if ne, ok := err.(net.Error); err == nil || !ok || !ne.Temporary() {
+			return c, err
+		}
+
+		if n == l.threshold && l.report != nil {
+			l.report(err)
+		}
+		if d == 0 {
+			d = l.min
+		} else if d *= 2; d > l.max {
+			d = l.max
+		}
+		glog.Errorf("cannot accept on %v: %v; retrying in %v", l.Addr(), err, d)
+		time.Sleep(d)
+	}
+}
+
+func (h *hive) Errors() <-chan error {
+	return h.errCh
+}
+
+// reportErr sends err on the error channel of the hive. The error is dropped if
+// the channel is full.
+func (h *hive) reportErr(err error) {
+	select {
+	case h.errCh <- err:
+	default:
+		glog.Errorf("%v drops error: %v", h, err)
+	}
+}
+
+// listenNet listens on the address, using the listen backlog of the hive if
+// set.
+func (h *hive) listenNet(network, addr string) (net.Listener, error) {
+	if n := h.config.ListenBacklog; n > 0 && network == "tcp" {
+		return listenWithBacklog(addr, n)
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package beehive
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenWithBacklog listens on the TCP address with a listen backlog of n.
+func listenWithBacklog(addr string, n int) (net.Listener, error) {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := a.IP.To4(); a.IP == nil || ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: a.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: a.Port}
+		copy(sa6.Addr[:], a.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC,
+		0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "tcp:"+addr)
+	defer f.Close()
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, n); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package beehive
+
+import (
+	"net"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// listenWithBacklog listens on the TCP address with the default backlog of the
+// system, since setting the backlog is only supported on Linux.
+func listenWithBacklog(addr string, n int) (net.Listener, error) {
+	glog.Warningf("listen backlog is not supported on this platform")
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,81 @@
+package beehive
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type tempErr struct{}
+
+func (e tempErr) Error() string   { return "temporary error" }
+func (e tempErr) Temporary() bool { return true }
+func (e tempErr) Timeout() bool   { return false }
+
+// errListener fails to accept with a temporary error until it is closed.
+type errListener struct {
+	accepts uint64
+	closed  uint32
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	atomic.AddUint64(&l.accepts, 1)
+	if atomic.LoadUint32(&l.closed) != 0 {
+		return nil, errors.New("listener is closed")
+	}
+	return nil, tempErr{}
+}
+
+func (l *errListener) Close() error {
+	atomic.StoreUint32(&l.closed, 1)
+	return nil
+}
+
+func (l *errListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestBackoffListener(t *testing.T) {
+	el := &errListener{}
+	reported := make(chan error, 1)
+	l := &backoffListener{
+		Listener:  el,
+		min:       time.Millisecond,
+		max:       20 * time.Millisecond,
+		threshold: 3,
+		report:    func(err error) { reported <- err },
+	}
+	defer l.Close()
+	go l.Accept()
+
+	select {
+	case err := <-reported:
+		if _, ok := err.(tempErr); !ok {
+			t.Errorf("invalid error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("repeated accept errors are not reported")
+	}
+
+	// 1ms + 2ms + 4ms + 8ms + 16ms + 20ms for the rest. A busy loop accepts
+	// millions of times in this window.
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadUint64(&el.accepts); n > 20 {
+		t.Errorf("listener does not back off: %v accepts in 200ms", n)
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	h := newHiveForTest(ListenBacklog(16))
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	c, err := net.Dial("tcp", h.Config().Addr)
+	if err != nil {
+		t.Fatalf("cannot connect to the hive: %v", err)
+	}
+	c.Close()
+}
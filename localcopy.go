@@ -0,0 +1,172 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// LocalCopyMode specifies how the data of messages is copied when they are
+// delivered to the bees of the same hive. Messages sent to other hives are
+// always serialized.
+type LocalCopyMode int
+
+const (
+	// LocalCopyDeep deep copies the data of local messages when they are
+	// emitted. Maps, slices, pointers, and the exported fields of structs are
+	// copied, while channels, functions, and unexported fields are shared. It
+	// is the default mode.
+	LocalCopyDeep LocalCopyMode = iota
+	// LocalCopyNone delivers the emitted data as is. The emitter and the
+	// receivers share the data, and must not modify it after it is emitted.
+	LocalCopyNone
+	// LocalCopySerialize encodes and decodes the data of local messages using
+	// gob, exactly as messages sent to other hives. The data must be
+	// registered in gob.
+	LocalCopySerialize
+)
+
+func (m LocalCopyMode) String() string {
+	switch m {
+	case LocalCopyDeep:
+		return "deep"
+	case LocalCopyNone:
+		return "none"
+	case LocalCopySerialize:
+		return "serialize"
+	}
+	return "unknown"
+}
+
+// parseLocalCopyMode returns the mode named s.
+func parseLocalCopyMode(s string) (LocalCopyMode, bool) {
+	for _, m := range []LocalCopyMode{LocalCopyDeep, LocalCopyNone,
+		LocalCopySerialize} {
+		if m.String() == s {
+			return m, true
+		}
+	}
+	return LocalCopyDeep, false
+}
+
+// localCopy replaces the data of m with a copy, based on the hive's LocalCopy.
+// It is called once when a local message is emitted, so that the emitter can
+// modify the data afterwards.
+func (h *hive) localCopy(m *msg) {
+	if m.MsgData == nil {
+		return
+	}
+
+	switch h.cfg().LocalCopy {
+	case LocalCopyNone:
+	case LocalCopySerialize:
+		d, err := serializeCopy(m.MsgData)
+		if err != nil {
+			glog.Errorf("%v cannot serialize %v: %v", h, m.Type(), err)
+			return
+		}
+		m.MsgData = d
+	default:
+		m.MsgData = deepCopy(m.MsgData)
+	}
+}
+
+// serializeCopy returns a copy of d by encoding and decoding it using gob.
+func serializeCopy(d interface{}) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&d); err != nil {
+		return nil, err
+	}
+	var c interface{}
+	if err := gob.NewDecoder(&buf).Decode(&c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// deepCopy returns a deep copy of d.
+func deepCopy(d interface{}) interface{} {
+	v := reflect.ValueOf(d)
+	if !v.IsValid() {
+		return d
+	}
+	c := copier{ptrs: make(map[ptrKey]reflect.Value)}
+	return c.copy(v).Interface()
+}
+
+type ptrKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// copier deep copies values. Pointers that are already copied are reused, so
+// that cycles and shared pointers are preserved in the copy.
+type copier struct {
+	ptrs map[ptrKey]reflect.Value
+}
+
+func (c copier) copy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		k := ptrKey{ptr: v.Pointer(), typ: v.Type()}
+		if p, ok := c.ptrs[k]; ok {
+			return p
+		}
+		p := reflect.New(v.Type().Elem())
+		c.ptrs[k] = p
+		p.Elem().Set(c.copy(v.Elem()))
+		return p
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		i := reflect.New(v.Type()).Elem()
+		i.Set(c.copy(v.Elem()))
+		return i
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		m := reflect.MakeMap(v.Type())
+		for _, k := range v.MapKeys() {
+			m.SetMapIndex(k, c.copy(v.MapIndex(k)))
+		}
+		return m
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Cap())
+		for i := 0; i < v.Len(); i++ {
+			s.Index(i).Set(c.copy(v.Index(i)))
+		}
+		return s
+
+	case reflect.Array:
+		a := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			a.Index(i).Set(c.copy(v.Index(i)))
+		}
+		return a
+
+	case reflect.Struct:
+		s := reflect.New(v.Type()).Elem()
+		s.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := s.Field(i); f.CanSet() {
+				f.Set(c.copy(v.Field(i)))
+			}
+		}
+		return s
+	}
+
+	return v
+}
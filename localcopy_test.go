@@ -0,0 +1,57 @@
+package beehive
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type localCopyTestMsg struct {
+	Values []int
+	Attrs  map[string]string
+	Next   *localCopyTestMsg
+}
+
+func TestLocalCopyDeep(t *testing.T) {
+	h := newHiveForTest()
+	mutated := make(chan struct{})
+	ch := make(chan localCopyTestMsg, 1)
+	h.NewApp("localcopy").HandleFunc(localCopyTestMsg{},
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			<-mutated
+			ch <- m.Data().(localCopyTestMsg)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	data := localCopyTestMsg{
+		Values: []int{1, 2},
+		Attrs:  map[string]string{"k": "v"},
+		Next:   &localCopyTestMsg{Values: []int{3}},
+	}
+	want := localCopyTestMsg{
+		Values: []int{1, 2},
+		Attrs:  map[string]string{"k": "v"},
+		Next:   &localCopyTestMsg{Values: []int{3}},
+	}
+	if err := h.Emit(data); err != nil {
+		t.Fatalf("cannot emit: %v", err)
+	}
+	data.Values[0] = 10
+	data.Attrs["k"] = "mutated"
+	data.Next.Values[0] = 30
+	close(mutated)
+
+	select {
+	case got := <-ch:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("invalid message data: actual=%+v want=%+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+}
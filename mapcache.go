@@ -0,0 +1,55 @@
+package beehive
+
+// RoutingKeyer is implemented by the data of messages that can be routed by a
+// key. For apps with a map cache, messages with the same routing key must
+// always be mapped to the same cells.
+type RoutingKeyer interface {
+	// RoutingKey returns the routing key of the message.
+	RoutingKey() string
+}
+
+// mapCache caches the mapped cells and the bees of messages by their routing
+// keys. The entries are valid as long as the colonies in the registry do not
+// change. It is only accessed by the qee.
+type mapCache struct {
+	gen     uint64 // the colony generation of the registry.
+	entries map[string]mapCacheEntry
+}
+
+type mapCacheEntry struct {
+	cells MappedCells
+	bee   *bee
+}
+
+// get returns the entry of key, if it is cached in generation gen.
+func (c *mapCache) get(key string, gen uint64) (mapCacheEntry, bool) {
+	if c.gen != gen {
+		c.gen = gen
+		c.entries = nil
+		return mapCacheEntry{}, false
+	}
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+// put caches the entry of key in generation gen.
+func (c *mapCache) put(key string, gen uint64, e mapCacheEntry) {
+	if c.gen != gen || c.entries == nil {
+		c.gen = gen
+		c.entries = make(map[string]mapCacheEntry)
+	}
+	c.entries[key] = e
+}
+
+// mapCacheKey returns the key of mh in the map cache, and whether the message
+// can be cached.
+func (q *qee) mapCacheKey(mh msgAndHandler) (string, bool) {
+	if !q.app.mapCache || (q.app.sticky() && q.app.stickySplit > 0) {
+		return "", false
+	}
+	k, ok := mh.msg.Data().(RoutingKeyer)
+	if !ok {
+		return "", false
+	}
+	return mh.msg.Type() + "/" + k.RoutingKey(), true
+}
@@ -0,0 +1,116 @@
+package beehive
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type mapCacheTestMsg string
+
+func (m mapCacheTestMsg) RoutingKey() string { return string(m) }
+
+// registerMapCacheApp registers an app that counts the invocations of its map
+// function in maps, and sends the ID of the receiving bees on ch.
+func registerMapCacheApp(h Hive, cache bool, maps *uint64,
+	ch chan uint64) App {
+
+	a := h.NewApp("mapcache")
+	a.SetMapCache(cache)
+	a.HandleFunc(mapCacheTestMsg(""), func(m Msg, c MapContext) MappedCells {
+		atomic.AddUint64(maps, 1)
+		return MappedCells{{"D", string(m.Data().(mapCacheTestMsg))}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.ID()
+		return nil
+	})
+	return a
+}
+
+func TestMapCacheInvalidation(t *testing.T) {
+	var maps uint64
+	ch := make(chan uint64)
+	h := newHiveForTest()
+	a := registerMapCacheApp(h, true, &maps, ch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	rcv := func() uint64 {
+		select {
+		case id := <-ch:
+			return id
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message is not delivered")
+		}
+		return 0
+	}
+
+	h.Emit(mapCacheTestMsg("k"))
+	b1 := rcv()
+	// The first message is mapped again once its bee is created.
+	h.Emit(mapCacheTestMsg("k"))
+	rcv()
+	before := atomic.LoadUint64(&maps)
+
+	h.Emit(mapCacheTestMsg("k"))
+	if id := rcv(); id != b1 {
+		t.Errorf("invalid bee for a cached message: actual=%v want=%v", id, b1)
+	}
+	if n := atomic.LoadUint64(&maps); n != before {
+		t.Errorf("map is invoked for a cached message: actual=%v want=%v", n,
+			before)
+	}
+
+	// Move the cells to another bee, which changes the colony of the cells.
+	if _, err := a.(*app).qee.processCmd(cmdRemap{Bee: b1}); err != nil {
+		t.Fatalf("cannot remap the cells: %v", err)
+	}
+
+	h.Emit(mapCacheTestMsg("k"))
+	b2 := rcv()
+	if b2 == b1 {
+		t.Errorf("the cached bee is used after the colony changed: %v", b1)
+	}
+	if n := atomic.LoadUint64(&maps); n != before+1 {
+		t.Errorf("map is not invoked after the colony changed: actual=%v want=%v",
+			n, before+1)
+	}
+}
+
+func benchmarkMapCache(b *testing.B, cache bool) {
+	var maps uint64
+	ch := make(chan uint64, 1024)
+	h := newHiveForTest()
+	registerMapCacheApp(h, cache, &maps, ch)
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	keys := []mapCacheTestMsg{"a", "b", "c", "d"}
+	for _, k := range keys {
+		h.Emit(k)
+		<-ch
+	}
+
+	atomic.StoreUint64(&maps, 0)
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			h.Emit(keys[i%len(keys)])
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-ch
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadUint64(&maps))/float64(b.N), "maps/op")
+}
+
+func BenchmarkMapWithoutCache(b *testing.B) {
+	benchmarkMapCache(b, false)
+}
+
+func BenchmarkMapWithCache(b *testing.B) {
+	benchmarkMapCache(b, true)
+}
@@ -0,0 +1,133 @@
+package beehive
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// CellMapper rewrites the mapped cells of messages before they are assigned to
+// bees. It is applied to the result of the map function of every handler of
+// the application.
+type CellMapper interface {
+	// MapCells returns the cells that should be locked instead of cells.
+	MapCells(cells MappedCells) MappedCells
+}
+
+// keyHashMapper is implemented by the cell mappers that hash cell keys, so that
+// they use the key hash of the hive (see HiveConfig.KeyHash).
+type keyHashMapper interface {
+	mapCellsWithHash(cells MappedCells, hash func(k CellKey) uint64) MappedCells
+}
+
+// ConsistentHash is a cell mapper that maps the keys of each dictionary onto a
+// fixed number of buckets using a consistent-hash ring. Since each bucket is
+// owned by one bee, the keys are evenly spread among the bees regardless of how
+// skewed the key space is. Changing the number of buckets moves only a minimal
+// set of keys.
+type ConsistentHash struct {
+	buckets int
+	points  []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	bucket int
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int           { return len(p) }
+func (p ringPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p ringPoints) Less(i, j int) bool { return p[i].hash < p[j].hash }
+
+// NewConsistentHash creates a consistent-hash cell mapper with the given number
+// of buckets, each placed virtualNodes times on the ring. More virtual nodes
+// result in a more even distribution.
+func NewConsistentHash(buckets, virtualNodes int) *ConsistentHash {
+	if buckets < 1 {
+		buckets = 1
+	}
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+
+	c := &ConsistentHash{
+		buckets: buckets,
+		points:  make([]ringPoint, 0, buckets*virtualNodes),
+	}
+	for b := 0; b < buckets; b++ {
+		for v := 0; v < virtualNodes; v++ {
+			c.points = append(c.points, ringPoint{
+				hash:   hashString(strconv.Itoa(b) + "/" + strconv.Itoa(v)),
+				bucket: b,
+			})
+		}
+	}
+	sort.Sort(ringPoints(c.points))
+	return c
+}
+
+// Bucket returns the bucket of the given cell, hashed using DefaultKeyHash.
+func (c *ConsistentHash) Bucket(k CellKey) int {
+	return c.bucketOf(DefaultKeyHash(k))
+}
+
+// bucketOf returns the bucket of the first point on the ring at or after h.
+func (c *ConsistentHash) bucketOf(h uint64) int {
+	i := sort.Search(len(c.points), func(i int) bool {
+		return c.points[i].hash >= h
+	})
+	if i == len(c.points) {
+		i = 0
+	}
+	return c.points[i].bucket
+}
+
+func (c *ConsistentHash) MapCells(cells MappedCells) MappedCells {
+	return c.mapCellsWithHash(cells, DefaultKeyHash)
+}
+
+func (c *ConsistentHash) mapCellsWithHash(cells MappedCells,
+	hash func(k CellKey) uint64) MappedCells {
+
+	seen := make(map[CellKey]struct{}, len(cells))
+	res := make(MappedCells, 0, len(cells))
+	for _, k := range cells {
+		m := CellKey{Dict: k.Dict, Key: strconv.Itoa(c.bucketOf(hash(k)))}
+		if _, ok := seen[m]; ok {
+			continue
+		}
+		seen[m] = struct{}{}
+		res = append(res, m)
+	}
+	return res
+}
+
+// DefaultKeyHash is the default hash of cell keys used for routing decisions
+// (see HiveConfig.KeyHash).
+func DefaultKeyHash(k CellKey) uint64 {
+	return hashString(k.Dict + "/" + k.Key)
+}
+
+// keyHash hashes k using the key hash of the hive.
+func (h *hive) keyHash(k CellKey) uint64 {
+	if f := h.config.KeyHash; f != nil {
+		return f(k)
+	}
+	return DefaultKeyHash(k)
+}
+
+// hashString hashes s using FNV-1a. Since FNV does not spread similar strings
+// over the whole ring, the result is mixed using the finalizer of MurmurHash3.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,153 @@
+package beehive
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// skewedKeys returns keys that mostly share the same prefix, similar to flows
+// of a few elephant switches.
+func skewedKeys(n int) []CellKey {
+	keys := make([]CellKey, 0, n)
+	for i := 0; i < n; i++ {
+		sw := 0
+		if i%10 == 0 {
+			sw = i % 97
+		}
+		keys = append(keys, CellKey{"S", fmt.Sprintf("switch-%d/flow-%d", sw, i)})
+	}
+	return keys
+}
+
+func TestConsistentHashDistribution(t *testing.T) {
+	buckets := 10
+	c := NewConsistentHash(buckets, 128)
+	keys := skewedKeys(20000)
+
+	cnt := make([]float64, buckets)
+	for _, k := range keys {
+		cnt[c.Bucket(k)]++
+	}
+
+	mean := float64(len(keys)) / float64(buckets)
+	var v float64
+	for _, n := range cnt {
+		v += (n - mean) * (n - mean)
+	}
+	v /= float64(buckets)
+	if cv := math.Sqrt(v) / mean; cv > 0.2 {
+		t.Errorf("uneven distribution %v: actual cv=%v want<=0.2", cnt, cv)
+	}
+}
+
+func TestConsistentHashRebalance(t *testing.T) {
+	keys := skewedKeys(10000)
+	c1 := NewConsistentHash(10, 128)
+	c2 := NewConsistentHash(11, 128)
+
+	moved := 0
+	for _, k := range keys {
+		if b := c1.Bucket(k); b != c2.Bucket(k) {
+			if b2 := c2.Bucket(k); b2 != 10 {
+				t.Fatalf("key %v moved between old buckets %v and %v", k, b, b2)
+			}
+			moved++
+		}
+	}
+	if max := 2 * len(keys) / 11; moved > max {
+		t.Errorf("too many keys moved: actual=%v want<=%v", moved, max)
+	}
+}
+
+func TestConsistentHashApp(t *testing.T) {
+	h := newHiveForTest()
+	buckets := 4
+	ch := make(chan uint64)
+	a := h.NewApp("consistenthash", Mapper(NewConsistentHash(buckets, 16)))
+	a.HandleFunc(int(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", fmt.Sprint(m.Data())}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.ID()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	n := 64
+	for i := 0; i < n; i++ {
+		h.Emit(i)
+	}
+
+	bees := make(map[uint64]struct{})
+	for i := 0; i < n; i++ {
+		select {
+		case id := <-ch:
+			bees[id] = struct{}{}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing messages: actual=%v want=%v", i, n)
+		}
+	}
+	if len(bees) > buckets {
+		t.Errorf("invalid number of bees: actual=%v want<=%v", len(bees), buckets)
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	const (
+		buckets = 4
+		nkeys   = 32
+	)
+	// The hash spreads the keys evenly on the ring, unlike the default hash.
+	hash := func(k CellKey) uint64 {
+		n, _ := strconv.ParseUint(k.Key, 10, 64)
+		return n * (math.MaxUint64 / nkeys)
+	}
+	c := NewConsistentHash(buckets, 16)
+
+	h := newHiveForTest(KeyHash(hash))
+	type keyAndBee struct {
+		key int
+		bee uint64
+	}
+	ch := make(chan keyAndBee)
+	a := h.NewApp("keyhash", Mapper(c))
+	a.HandleFunc(int(0), func(m Msg, mc MapContext) MappedCells {
+		return MappedCells{{"D", strconv.Itoa(m.Data().(int))}}
+	}, func(m Msg, rc RcvContext) error {
+		ch <- keyAndBee{key: m.Data().(int), bee: rc.ID()}
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	bucketBees := make(map[int]uint64)
+	beeBuckets := make(map[uint64]int)
+	for i := 0; i < nkeys; i++ {
+		h.Emit(i)
+		var r keyAndBee
+		select {
+		case r = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not handled", i)
+		}
+
+		b := c.bucketOf(hash(CellKey{Dict: "D", Key: strconv.Itoa(i)}))
+		if bee, ok := bucketBees[b]; ok && bee != r.bee {
+			t.Errorf("key %v of bucket %v is routed to %v instead of %v", i, b,
+				r.bee, bee)
+		}
+		if bb, ok := beeBuckets[r.bee]; ok && bb != b {
+			t.Errorf("key %v of bucket %v is routed to the bee of bucket %v", i, b,
+				bb)
+		}
+		bucketBees[b] = r.bee
+		beeBuckets[r.bee] = b
+	}
+}
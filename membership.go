@@ -0,0 +1,390 @@
+package beehive
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+var errGossipTimeout = errors.New("gossip timed out")
+
+const (
+	// heartbeatInterval is the default interval between two heartbeats to each
+	// hive.
+	heartbeatInterval = 500 * time.Millisecond
+	// heartbeatMisses is the default number of consecutive missed heartbeats
+	// after which a hive is marked as dead.
+	heartbeatMisses = 3
+	// phiWindow is the number of heartbeat intervals used to estimate the
+	// distribution of intervals in the phi-accrual failure detector.
+	phiWindow = 100
+)
+
+// FailureDetector represents the parameters of detecting failed hives. Hives
+// probe each other every HeartbeatInterval, and a hive is suspected to be dead
+// once it misses TimeoutMultiplier consecutive heartbeats. If PhiThreshold is
+// positive, a phi-accrual failure detector is used instead: the intervals
+// between the heartbeats of each hive are tracked, and the hive is suspected
+// when the suspicion level (phi) of the time since its last heartbeat exceeds
+// PhiThreshold. Phi adapts to the latency of the network, and a threshold of
+// 8 to 12 is usually suitable. Larger thresholds avoid false positives on
+// high-latency links at the cost of detecting failures later.
+type FailureDetector struct {
+	HeartbeatInterval time.Duration // 0 means 500ms.
+	TimeoutMultiplier int           // 0 means 3.
+	PhiThreshold      float64       // 0 disables phi-accrual.
+}
+
+func (d FailureDetector) interval() time.Duration {
+	if d.HeartbeatInterval <= 0 {
+		return heartbeatInterval
+	}
+	return d.HeartbeatInterval
+}
+
+func (d FailureDetector) multiplier() int {
+	if d.TimeoutMultiplier <= 0 {
+		return heartbeatMisses
+	}
+	return d.TimeoutMultiplier
+}
+
+// PeerHealth represents the health of a peer hive as seen by this hive.
+type PeerHealth struct {
+	Hive uint64 `json:"hive"`
+	// LastHeartbeat is when the last heartbeat of the peer is received. It is
+	// zero if the peer has never responded.
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Misses        int       `json:"misses"` // Consecutive missed heartbeats.
+	// Suspicion is the suspicion level of the peer. It is phi when the hive
+	// uses a phi-accrual failure detector, and the ratio of consecutive missed
+	// heartbeats to TimeoutMultiplier otherwise. The peer is suspected once its
+	// suspicion reaches PhiThreshold, or 1, respectively.
+	Suspicion float64 `json:"suspicion"`
+	Suspected bool    `json:"suspected"`
+}
+
+// peerState is the heartbeat history of a hive.
+type peerState struct {
+	last      time.Time
+	misses    int
+	intervals []time.Duration // The last phiWindow intervals.
+	dead      bool
+}
+
+func (p *peerState) addInterval(d time.Duration) {
+	if len(p.intervals) == phiWindow {
+		copy(p.intervals, p.intervals[1:])
+		p.intervals = p.intervals[:phiWindow-1]
+	}
+	p.intervals = append(p.intervals, d)
+}
+
+// phi returns the suspicion level of the hive at now. The intervals of
+// heartbeats are assumed to be normally distributed, and phi is
+// -log10(P(interval > now - last)). The mean defaults to the heartbeat
+// interval, and the standard deviation is at least a quarter of it.
+func (p *peerState) phi(now time.Time, interval time.Duration) float64 {
+	if p.last.IsZero() {
+		return 0
+	}
+
+	mean := float64(interval)
+	if len(p.intervals) != 0 {
+		mean = 0
+		for _, d := range p.intervals {
+			mean += float64(d)
+		}
+		mean /= float64(len(p.intervals))
+	}
+	var variance float64
+	for _, d := range p.intervals {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	if len(p.intervals) != 0 {
+		variance /= float64(len(p.intervals))
+	}
+	stddev := math.Max(math.Sqrt(variance), float64(interval)/4)
+
+	z := (float64(now.Sub(p.last)) - mean) / (stddev * math.Sqrt2)
+	later := math.Erfc(z) / 2
+	if later < math.SmallestNonzeroFloat64 {
+		return math.MaxFloat64
+	}
+	return -math.Log10(later)
+}
+
+// membership tracks the hives of the cluster and their liveness. A hive joins
+// the cluster by contacting one of its seed (or peer) addresses, and learns
+// about the other hives through gossip: in each heartbeat interval, it
+// exchanges the hives it knows with a random live hive, or with its seeds if
+// it knows no other hive. The hives in the replicated registry are known as
+// well. Membership probes all the known hives periodically to detect
+// failures.
+type membership struct {
+	sync.RWMutex
+	hive    *hive
+	peers   map[uint64]*peerState
+	members map[uint64]HiveInfo // The hives learned through gossip.
+	done    chan struct{}
+}
+
+func newMembership(h *hive) *membership {
+	return &membership{
+		hive:    h,
+		peers:   make(map[uint64]*peerState),
+		members: make(map[uint64]HiveInfo),
+	}
+}
+
+func (m *membership) detector() FailureDetector {
+	return m.hive.config.FailureDetector
+}
+
+func (m *membership) start() {
+	m.done = make(chan struct{})
+	go func(done chan struct{}) {
+		t := time.NewTicker(m.detector().interval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.heartbeat()
+			case <-done:
+				return
+			}
+		}
+	}(m.done)
+}
+
+func (m *membership) stop() {
+	if m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+}
+
+// hives returns the hives known to this hive, including itself.
+func (m *membership) hives() []HiveInfo {
+	hives := m.hive.registry.hives()
+	known := make(map[uint64]bool, len(hives))
+	for _, h := range hives {
+		known[h.ID] = true
+	}
+	m.RLock()
+	defer m.RUnlock()
+	for id, h := range m.members {
+		if !known[id] {
+			hives = append(hives, h)
+		}
+	}
+	return hives
+}
+
+// merge adds the hives learned from another hive to the members.
+func (m *membership) merge(hives []HiveInfo) {
+	m.Lock()
+	defer m.Unlock()
+	for _, h := range hives {
+		if h.ID == Nil || h.ID == m.hive.ID() {
+			continue
+		}
+		if _, ok := m.members[h.ID]; !ok {
+			glog.V(2).Infof("%v learns about %v through gossip", m.hive, h)
+		}
+		m.members[h.ID] = h
+	}
+}
+
+// gossiped merges the hives gossiped by another hive, and returns the hives
+// known to this hive in response.
+func (m *membership) gossiped(hives []HiveInfo) []HiveInfo {
+	m.merge(hives)
+	return m.hives()
+}
+
+// gossip exchanges the known hives with a random live hive, or with the seeds
+// if no other hive is known.
+func (m *membership) gossip(hives []HiveInfo) {
+	var addrs []string
+	for _, h := range hives {
+		if h.ID != m.hive.ID() && !m.isDead(h.ID) {
+			addrs = append(addrs, h.Addr)
+		}
+	}
+	if len(addrs) != 0 {
+		addrs = []string{addrs[rand.Intn(len(addrs))]}
+	} else {
+		addrs = m.hive.config.SeedAddrs
+	}
+
+	for _, a := range addrs {
+		if a == m.hive.config.Addr {
+			continue
+		}
+		reply, err := m.exchange(a, hives)
+		if err != nil {
+			glog.V(2).Infof("%v cannot gossip with %v: %v", m.hive, a, err)
+			continue
+		}
+		m.merge(reply)
+	}
+}
+
+// exchange sends the hives to the hive at addr, and returns the hives known to
+// that hive. It waits for at most one heartbeat interval.
+func (m *membership) exchange(addr string, hives []HiveInfo) ([]HiveInfo,
+	error) {
+
+	i := m.detector().interval()
+	d := m.hive.cfg().dialer()
+	if d.Timeout == 0 || i < d.Timeout {
+		d.Timeout = i
+	}
+	c, err := newMuxRPCClient(addr, d)
+	if err != nil {
+		return nil, err
+	}
+	defer c.stop()
+
+	select {
+	case call := <-c.gossip(hives):
+		return *call.Reply.(*[]HiveInfo), call.Error
+	case <-time.After(i):
+		return nil, errGossipTimeout
+	}
+}
+
+// heartbeat gossips with another hive, and probes all the known hives in
+// parallel.
+func (m *membership) heartbeat() {
+	hives := m.hives()
+	m.gossip(hives)
+
+	var wg sync.WaitGroup
+	for _, h := range m.hives() {
+		if h.ID == m.hive.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func(h HiveInfo) {
+			defer wg.Done()
+			m.record(h, m.probe(h))
+		}(h)
+	}
+	wg.Wait()
+}
+
+// probe returns whether the hive accepts connections within the heartbeat
+// interval.
+func (m *membership) probe(h HiveInfo) bool {
+	d := m.hive.cfg().dialer()
+	if i := m.detector().interval(); d.Timeout == 0 || i < d.Timeout {
+		d.Timeout = i
+	}
+	network, addr := splitAddr(h.Addr)
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (m *membership) record(h HiveInfo, alive bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	p, ok := m.peers[h.ID]
+	if !ok {
+		p = &peerState{}
+		m.peers[h.ID] = p
+	}
+
+	now := m.hive.config.Clock.Now()
+	if alive {
+		if p.dead {
+			glog.Infof("%v detects that %v is alive", m.hive, h.ID)
+		}
+		if !p.last.IsZero() {
+			p.addInterval(now.Sub(p.last))
+		}
+		p.last = now
+		p.misses = 0
+		p.dead = false
+		return
+	}
+
+	p.misses++
+	if !p.dead && m.suspected(p, now) {
+		glog.Warningf("%v detects that %v is dead", m.hive, h.ID)
+		p.dead = true
+	}
+}
+
+// suspicion returns the suspicion level of p at now.
+func (m *membership) suspicion(p *peerState, now time.Time) float64 {
+	d := m.detector()
+	if d.PhiThreshold > 0 {
+		return p.phi(now, d.interval())
+	}
+	return float64(p.misses) / float64(d.multiplier())
+}
+
+func (m *membership) suspected(p *peerState, now time.Time) bool {
+	t := m.detector().PhiThreshold
+	if t <= 0 {
+		t = 1
+	}
+	return m.suspicion(p, now) >= t
+}
+
+// isDead returns whether the hive is marked as dead.
+func (m *membership) isDead(id uint64) bool {
+	m.RLock()
+	defer m.RUnlock()
+	p, ok := m.peers[id]
+	return ok && p.dead
+}
+
+// liveHives returns the known hives that are not marked as dead.
+func (m *membership) liveHives() []HiveInfo {
+	hives := m.hives()
+	m.RLock()
+	defer m.RUnlock()
+	live := hives[:0]
+	for _, h := range hives {
+		if p, ok := m.peers[h.ID]; !ok || !p.dead {
+			live = append(live, h)
+		}
+	}
+	return live
+}
+
+// health returns the health of the known hives, other than this hive, keyed
+// by hive ID.
+func (m *membership) health() map[uint64]PeerHealth {
+	hives := m.hives()
+	now := m.hive.config.Clock.Now()
+	health := make(map[uint64]PeerHealth)
+	m.RLock()
+	defer m.RUnlock()
+	for _, h := range hives {
+		if h.ID == m.hive.ID() {
+			continue
+		}
+		ph := PeerHealth{Hive: h.ID}
+		if p, ok := m.peers[h.ID]; ok {
+			ph.LastHeartbeat = p.last
+			ph.Misses = p.misses
+			ph.Suspicion = m.suspicion(p, now)
+			ph.Suspected = p.dead
+		}
+		health[h.ID] = ph
+	}
+	return health
+}
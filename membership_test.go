@@ -0,0 +1,191 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func hasHive(hives []HiveInfo, id uint64) bool {
+	for _, h := range hives {
+		if h.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLiveHives(t *testing.T) {
+	h1 := newHiveForTest()
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h3 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	go h3.Start()
+	waitTilStareted(h3)
+
+	for _, h := range []Hive{h1, h2} {
+		for i := 0; len(h.LiveHives()) != 3; i++ {
+			if i == 100 {
+				t.Fatalf("%v does not see all hives: actual=%v want=3", h,
+					len(h.LiveHives()))
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	h3.Stop()
+
+	deadline := time.Now().Add(heartbeatInterval * (heartbeatMisses + 4))
+	for _, h := range []Hive{h1, h2} {
+		for hasHive(h.LiveHives(), h3.ID()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v does not detect that %v is dead", h, h3)
+			}
+			time.Sleep(heartbeatInterval / 5)
+		}
+		if !hasHive(h.LiveHives(), h1.ID()) || !hasHive(h.LiveHives(), h2.ID()) {
+			t.Errorf("%v detects a live hive as dead: %v", h, h.LiveHives())
+		}
+	}
+}
+
+func TestSeedGossip(t *testing.T) {
+	h1 := newHiveForTest()
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(SeedAddrs(h1.Config().Addr))
+	go h2.Start()
+	waitTilStareted(h2)
+
+	h3 := newHiveForTest(SeedAddrs(h1.Config().Addr))
+	go h3.Start()
+	defer h3.Stop()
+	waitTilStareted(h3)
+
+	for _, h := range []Hive{h1, h2, h3} {
+		for i := 0; len(h.LiveHives()) != 3; i++ {
+			if i == 100 {
+				t.Fatalf("%v does not see all hives: actual=%v want=3", h,
+					len(h.LiveHives()))
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	for i := 0; ; i++ {
+		m := h3.(*hive).members
+		m.RLock()
+		_, ok := m.members[h2.ID()]
+		m.RUnlock()
+		if ok {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("%v does not learn about %v through gossip", h3, h2)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	h2.Stop()
+
+	deadline := time.Now().Add(heartbeatInterval * (heartbeatMisses + 4))
+	for _, h := range []Hive{h1, h3} {
+		for hasHive(h.LiveHives(), h2.ID()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v does not detect that %v is dead", h, h2)
+			}
+			time.Sleep(heartbeatInterval / 5)
+		}
+		if !hasHive(h.LiveHives(), h1.ID()) || !hasHive(h.LiveHives(), h3.ID()) {
+			t.Errorf("%v detects a live hive as dead: %v", h, h.LiveHives())
+		}
+	}
+}
+
+// newFailureDetectorForTest returns the membership of a hive that uses d and
+// c, and has a single peer hive.
+func newFailureDetectorForTest(d FailureDetector, c Clock) (*membership,
+	HiveInfo) {
+
+	h := &hive{
+		id:       1,
+		config:   hiveConfig(FailureDetection(d), WithClock(c)),
+		registry: newRegistry("test"),
+	}
+	peer := HiveInfo{ID: 2, Addr: "localhost:7767"}
+	h.registry.addHive(peer)
+	return newMembership(h), peer
+}
+
+func TestFailureDetectorMisses(t *testing.T) {
+	c := NewFakeClock(time.Now())
+	d := FailureDetector{HeartbeatInterval: time.Second, TimeoutMultiplier: 5}
+	m, peer := newFailureDetectorForTest(d, c)
+
+	m.record(peer, true)
+	for i := 1; i <= d.TimeoutMultiplier; i++ {
+		c.Advance(d.HeartbeatInterval)
+		m.record(peer, false)
+		ph := m.health()[peer.ID]
+		if ph.Misses != i {
+			t.Errorf("invalid misses: actual=%v want=%v", ph.Misses, i)
+		}
+		if want := i == d.TimeoutMultiplier; ph.Suspected != want {
+			t.Errorf("invalid suspicion after %v misses: actual=%v want=%v", i,
+				ph.Suspected, want)
+		}
+	}
+
+	m.record(peer, true)
+	if ph := m.health()[peer.ID]; ph.Suspected || ph.Suspicion != 0 {
+		t.Errorf("peer is suspected after a heartbeat: %+v", ph)
+	}
+}
+
+func TestFailureDetectorPhi(t *testing.T) {
+	interval := 100 * time.Millisecond
+	for _, test := range []struct {
+		threshold float64
+		misses    int // the number of misses after which the peer is suspected.
+	}{
+		{threshold: 8, misses: 3},
+		{threshold: 20, misses: 4},
+	} {
+		c := NewFakeClock(time.Now())
+		d := FailureDetector{
+			HeartbeatInterval: interval,
+			PhiThreshold:      test.threshold,
+		}
+		m, peer := newFailureDetectorForTest(d, c)
+
+		for i := 0; i < 10; i++ {
+			m.record(peer, true)
+			c.Advance(interval)
+		}
+		// A delayed heartbeat is never suspected, since it arrives.
+		c.Advance(interval / 2)
+		m.record(peer, true)
+
+		for i := 1; i <= test.misses; i++ {
+			c.Advance(interval)
+			m.record(peer, false)
+			ph := m.health()[peer.ID]
+			if want := i == test.misses; ph.Suspected != want {
+				t.Errorf("invalid suspicion after %v misses with threshold %v: "+
+					"actual=%v want=%v (phi=%v)", i, test.threshold, ph.Suspected,
+					want, ph.Suspicion)
+			}
+			if ph.Suspected != (ph.Suspicion >= test.threshold) {
+				t.Errorf("peer is suspected with phi=%v and threshold %v",
+					ph.Suspicion, test.threshold)
+			}
+		}
+	}
+}
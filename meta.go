@@ -2,6 +2,7 @@ package beehive
 
 import (
 	"encoding/gob"
+	"net"
 	"os"
 	"path"
 	"time"
@@ -19,7 +20,7 @@ type hiveMeta struct {
 	Peers map[uint64]HiveInfo
 }
 
-func peersInfo(addrs []string) map[uint64]HiveInfo {
+func peersInfo(addrs []string, d *net.Dialer) map[uint64]HiveInfo {
 	if len(addrs) == 0 {
 		return nil
 	}
@@ -27,7 +28,7 @@ func peersInfo(addrs []string) map[uint64]HiveInfo {
 	ch := make(chan []HiveInfo, len(addrs))
 	for _, a := range addrs {
 		go func(a string) {
-			s, err := getHiveState(a)
+			s, err := getHiveState(a, d)
 			if err != nil {
 				glog.Errorf("cannot communicate with %v: %v", a, err)
 				return
@@ -46,7 +47,7 @@ func peersInfo(addrs []string) map[uint64]HiveInfo {
 	return infos
 }
 
-func hiveIDFromPeers(addr string, paddrs []string) uint64 {
+func hiveIDFromPeers(addr string, paddrs []string, d *net.Dialer) uint64 {
 	if len(paddrs) == 0 {
 		return 1
 	}
@@ -55,7 +56,7 @@ func hiveIDFromPeers(addr string, paddrs []string) uint64 {
 	for _, paddr := range paddrs {
 		glog.Infof("requesting hive ID from %v", paddr)
 		go func(paddr string) {
-			c, err := newRPCClient(paddr)
+			c, err := newRPCClient(paddr, d)
 			if err != nil {
 				glog.Error(err)
 				return
@@ -108,16 +109,17 @@ func meta(cfg HiveConfig) hiveMeta {
 	if err != nil {
 		// TODO(soheil): We should also update our peer addresses when we have an
 		// existing meta.
-		m.Peers = peersInfo(cfg.PeerAddrs)
+		addrs := cfg.joinAddrs()
+		m.Peers = peersInfo(addrs, cfg.dialer())
 		m.Hive.Addr = cfg.Addr
-		if len(cfg.PeerAddrs) == 0 {
+		if len(addrs) == 0 {
 			// The initial ID is 1. There is no raft node up yet to allocate an ID. So
 			// we must do this when the hive starts.
 			m.Hive.ID = 1
 			goto save
 		}
 
-		m.Hive.ID = hiveIDFromPeers(cfg.Addr, cfg.PeerAddrs)
+		m.Hive.ID = hiveIDFromPeers(cfg.Addr, addrs, cfg.dialer())
 		goto save
 	}
 
@@ -1,7 +1,7 @@
 package beehive
 
 import (
-	"errors"
+	"math/rand"
 	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
@@ -40,12 +40,25 @@ func (m MockMsg) NoReply() bool {
 	return m.MsgFrom == Nil
 }
 
+func (m MockMsg) TraceID() uint64 {
+	return m.MsgTrace
+}
+
+func (m MockMsg) Time() time.Time {
+	return m.MsgTime
+}
+
+func (m MockMsg) Priority() int {
+	return m.MsgPrio
+}
+
 // MockRcvContext is a mock for RcvContext.
 type MockRcvContext struct {
 	CtxHive  Hive
 	CtxApp   string
 	CtxDicts *state.InMem
 	CtxID    uint64
+	CtxName  string
 	CtxMsgs  []Msg
 	// TODO(soheil): add message handling methods.
 }
@@ -69,6 +82,22 @@ func (m MockRcvContext) ID() uint64 {
 	return m.CtxID
 }
 
+func (m MockRcvContext) BeeName() string {
+	return m.CtxName
+}
+
+func (m MockRcvContext) Colony() Colony {
+	return Colony{ID: m.CtxID, Leader: m.CtxID}
+}
+
+func (m MockRcvContext) Generation() uint64 {
+	return 0
+}
+
+func (m MockRcvContext) Context() context.Context {
+	return context.Background()
+}
+
 func (m MockRcvContext) Printf(format string, a ...interface{}) {}
 
 func (m *MockRcvContext) Emit(msgData interface{}) {
@@ -79,6 +108,40 @@ func (m *MockRcvContext) Emit(msgData interface{}) {
 	m.CtxMsgs = append(m.CtxMsgs, msg)
 }
 
+func (m *MockRcvContext) EmitBatch(msgData []interface{}) {
+	for _, d := range msgData {
+		m.Emit(d)
+	}
+}
+
+func (m *MockRcvContext) EmitBestEffort(msgData interface{}) {
+	m.Emit(msgData)
+}
+
+// EmitCoalesced emits the message immediately, without coalescing.
+func (m *MockRcvContext) EmitCoalesced(msgData interface{}, key string,
+	window time.Duration) {
+
+	m.Emit(msgData)
+}
+
+// EmitWithReceipt emits the message immediately, and reports it as delivered.
+func (m *MockRcvContext) EmitWithReceipt(msgData interface{},
+	onResult func(DeliveryResult)) {
+
+	m.Emit(msgData)
+	onResult(DeliveryResult{Status: Delivered})
+}
+
+func (m *MockRcvContext) EmitWithPriority(msgData interface{}, prio int) {
+	msg := MockMsg{
+		MsgData: msgData,
+		MsgFrom: m.ID(),
+		MsgPrio: prio,
+	}
+	m.CtxMsgs = append(m.CtxMsgs, msg)
+}
+
 func (m MockRcvContext) SendToCell(msgData interface{}, app string,
 	cell CellKey) {
 }
@@ -96,9 +159,18 @@ func (m *MockRcvContext) SendToBee(msgData interface{}, to uint64) {
 	m.CtxMsgs = append(m.CtxMsgs, msg)
 }
 
+func (m *MockRcvContext) EmitToSelf(msgData interface{}) {
+	m.SendToBee(msgData, m.ID())
+}
+
+func (m *MockRcvContext) SendToBeeErr(msgData interface{}, to uint64) error {
+	m.SendToBee(msgData, to)
+	return nil
+}
+
 func (m *MockRcvContext) Reply(msg Msg, replyData interface{}) error {
 	if msg.NoReply() {
-		return errors.New("cannot reply")
+		return ErrCannotReply
 	}
 	m.SendToBee(replyData, msg.To())
 	return nil
@@ -113,10 +185,42 @@ func (m MockRcvContext) StartDetachedFunc(start StartFunc, stop StopFunc,
 	return 0
 }
 
+func (m MockRcvContext) StopDetached(id uint64) error {
+	return nil
+}
+
+func (m MockRcvContext) SubscribeDetached(msgType interface{}) {}
+
+func (m *MockRcvContext) RunOnBee(f func(ctx RcvContext)) {
+	f(m)
+}
+
 func (m MockRcvContext) LockCells(keys []CellKey) error {
 	return nil
 }
 
+func (m MockRcvContext) LockWithTimeout(keys []CellKey,
+	d time.Duration) error {
+
+	return nil
+}
+
+func (m MockRcvContext) UnlockCells(keys []CellKey) error {
+	return nil
+}
+
+func (m MockRcvContext) ReadFromReplica(app string, cell CellKey, dict,
+	key string, rc ReadConsistency) (ReplicaValue, error) {
+
+	return ReplicaValue{}, nil
+}
+
+func (m MockRcvContext) QueryApp(app string, cell CellKey, dict,
+	key string) (interface{}, error) {
+
+	return nil, nil
+}
+
 func (m MockRcvContext) Snooze(d time.Duration) {}
 
 func (m MockRcvContext) BeeLocal() interface{} {
@@ -125,6 +229,22 @@ func (m MockRcvContext) BeeLocal() interface{} {
 
 func (m MockRcvContext) SetBeeLocal(d interface{}) {}
 
+func (m MockRcvContext) BeeLocalGet(key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (m MockRcvContext) BeeLocalSet(key string, v interface{}) {}
+
+func (m MockRcvContext) BeeLocalGetOrInit(key string,
+	init func() interface{}) interface{} {
+
+	return init()
+}
+
+func (m MockRcvContext) Rand() *rand.Rand {
+	return rand.New(rand.NewSource(beeSeed(0, m.CtxID)))
+}
+
 func (m MockRcvContext) BeginTx() error {
 	return nil
 }
@@ -137,6 +257,26 @@ func (m MockRcvContext) AbortTx() error {
 	return nil
 }
 
+func (m MockRcvContext) InTx() bool {
+	return false
+}
+
+func (m MockRcvContext) TxSeq() uint64 {
+	return 0
+}
+
+func (m MockRcvContext) TxBufferedMsgs() []Msg {
+	return nil
+}
+
+func (m MockRcvContext) TxBufferedOps() []state.Op {
+	return nil
+}
+
+func (m MockRcvContext) OnPreCommit(f func() error) {}
+
+func (m MockRcvContext) OnPostCommit(f func()) {}
+
 func (m MockRcvContext) Sync(ctx context.Context, req interface{}) (
 	res interface{}, err error) {
 
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 // Msg is a generic interface for messages emitted in the system. Messages
@@ -25,6 +27,14 @@ type Msg interface {
 	IsBroadCast() bool
 	// IsUnicast returns whether the message is a unicast.
 	IsUnicast() bool
+
+	// TraceID returns the trace ID of this message, or 0 if the message is not
+	// traced. Messages emitted while handling a message inherit its trace ID.
+	TraceID() uint64
+	// Time returns when the message was emitted.
+	Time() time.Time
+	// Priority returns the priority of the message. The default priority is 0.
+	Priority() int
 }
 
 // Typed is a message data with an explicit type.
@@ -33,9 +43,35 @@ type Typed interface {
 }
 
 type msg struct {
-	MsgData interface{}
-	MsgFrom uint64
-	MsgTo   uint64
+	MsgData  interface{}
+	MsgFrom  uint64
+	MsgTo    uint64
+	MsgTrace uint64
+	MsgTime  time.Time
+	MsgPrio  int
+	// MsgBestEffort indicates that the message must be dropped if it cannot
+	// be delivered on the first try.
+	MsgBestEffort bool
+	// MsgFailover indicates that the message is routed to a follower because
+	// the leader of its colony is unreachable.
+	MsgFailover bool
+	// MsgCausal is the causal stamp of the message, if it is sent from a bee of
+	// a causally ordered app to a bee of a causally ordered app.
+	MsgCausal causalStamp
+	// MsgToColony indicates that the unicast message is addressed to the colony
+	// of MsgTo, and is delivered to the current leader of the colony. Replies
+	// are addressed to colonies so that they survive the failover of the
+	// requester.
+	MsgToColony bool
+	// MsgOutbox identifies the message in the outbox of the persistent colony
+	// that emitted it. Receivers use it to drop the messages that are
+	// redelivered after a crash or a failover of the emitter.
+	MsgOutbox outboxMsgID
+
+	retries     int         // the number of times the message is redelivered.
+	causalSince time.Time   // when the bee started waiting for its dependencies.
+	causal      *causalSend // the message while routed on the hive of its sender.
+	receipt     *receipt    // reports the delivery to the emitter, if requested.
 }
 
 func (m msg) NoReply() bool {
@@ -66,6 +102,18 @@ func (m msg) From() uint64 {
 	return m.MsgFrom
 }
 
+func (m msg) TraceID() uint64 {
+	return m.MsgTrace
+}
+
+func (m msg) Time() time.Time {
+	return m.MsgTime
+}
+
+func (m msg) Priority() int {
+	return m.MsgPrio
+}
+
 func (m msg) String() string {
 	if m.Data() == nil {
 		return fmt.Sprintf("%v -> %v\t(nil)", m.From(), m.To())
@@ -89,9 +137,37 @@ func newMsgFromData(data interface{}, from uint64, to uint64) *msg {
 	}
 }
 
+// newMsg creates a message emitted at the current time of the hive clock.
+func (h *hive) newMsg(data interface{}, from uint64, to uint64) *msg {
+	m := newMsgFromData(data, from, to)
+	m.MsgTime = h.config.Clock.Now()
+	return m
+}
+
+// newColonyMsg creates a message addressed to the colony of bee to.
+func (h *hive) newColonyMsg(data interface{}, from uint64, to uint64) *msg {
+	m := h.newMsg(data, from, to)
+	m.MsgToColony = true
+	return m
+}
+
 type msgAndHandler struct {
 	msg     *msg
 	handler Handler
+	// batch holds the messages enqueued at once on a hive or a qee, if msg is
+	// nil.
+	batch []msgAndHandler
+	// emitted, if not nil, is called once msg is emitted from the out queue of
+	// a bee.
+	emitted func()
+}
+
+// appendMsgs appends mh to mhs, or the messages of mh if it is a batch.
+func appendMsgs(mhs []msgAndHandler, mh msgAndHandler) []msgAndHandler {
+	if mh.batch != nil {
+		return append(mhs, mh.batch...)
+	}
+	return append(mhs, mh)
 }
 
 type Emitter interface {
@@ -108,6 +184,19 @@ type msgChannel struct {
 	buf   []msgAndHandler
 	start int
 	end   int
+	size  uint       // capacity of the queue.
+	prio  *prioHeap  // non-nil for priority queues.
+	fair  *fairQueue // non-nil for fair queues.
+
+	highWater uint64 // maximum number of queued messages (atomic).
+	overflows uint64 // number of messages queued beyond the capacity (atomic).
+}
+
+// QueueStats represents the statistics of a message queue.
+type QueueStats struct {
+	Cap       uint   `json:"cap"`        // Capacity of the queue.
+	HighWater uint64 `json:"high_water"` // Maximum number of queued messages.
+	Overflows uint64 `json:"overflows"`  // Messages queued while it was full.
 }
 
 func newMsgChannel(bufSize uint) *msgChannel {
@@ -115,6 +204,7 @@ func newMsgChannel(bufSize uint) *msgChannel {
 		chin:  make(chan msgAndHandler, bufSize),
 		chout: make(chan msgAndHandler, bufSize),
 		buf:   make([]msgAndHandler, bufSize),
+		size:  bufSize,
 	}
 	go q.pipe()
 	return q
@@ -228,6 +318,26 @@ func (q *msgChannel) enque(mh msgAndHandler) {
 	if q.end >= len(q.buf) {
 		q.end = 0
 	}
+
+	q.record(uint64(q.len() + len(q.chout)))
+}
+
+// record updates the statistics of the queue when it has l messages.
+func (q *msgChannel) record(l uint64) {
+	if atomic.LoadUint64(&q.highWater) < l {
+		atomic.StoreUint64(&q.highWater, l)
+	}
+	if uint64(q.size) < l {
+		atomic.AddUint64(&q.overflows, 1)
+	}
+}
+
+func (q *msgChannel) stats() QueueStats {
+	return QueueStats{
+		Cap:       q.size,
+		HighWater: atomic.LoadUint64(&q.highWater),
+		Overflows: atomic.LoadUint64(&q.overflows),
+	}
 }
 
 func (q *msgChannel) deque() (msgAndHandler, bool) {
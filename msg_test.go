@@ -3,6 +3,7 @@ package beehive
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMsgChannelQueue(t *testing.T) {
@@ -101,3 +102,62 @@ func BenchmarkMsgChannel(b *testing.B) {
 
 	wg.Wait()
 }
+
+type msgMetaTestTrigger struct{}
+type msgMetaTestMsg int
+
+func TestMsgMetadata(t *testing.T) {
+	h := newHiveForTest()
+	n := 10
+	sender := make(chan uint64, 1)
+	rcvd := make(chan Msg, n)
+	a := h.NewApp("msgmeta")
+	a.HandleFunc(msgMetaTestTrigger{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"T", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		sender <- c.ID()
+		for i := 0; i < n; i++ {
+			c.Emit(msgMetaTestMsg(i))
+		}
+		return nil
+	})
+	a.HandleFunc(msgMetaTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"R", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		rcvd <- m
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	start := time.Now()
+	h.Emit(msgMetaTestTrigger{})
+	from := <-sender
+
+	var prev time.Time
+	for i := 0; i < n; i++ {
+		var m Msg
+		select {
+		case m = <-rcvd:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing messages: actual=%v want=%v", i, n)
+		}
+		if m.From() != from {
+			t.Errorf("invalid sender: actual=%v want=%v", m.From(), from)
+		}
+		if m.To() != Nil {
+			t.Errorf("invalid receiver: actual=%v want=%v", m.To(), Nil)
+		}
+		if m.Type() != MsgType(msgMetaTestMsg(0)) {
+			t.Errorf("invalid type: actual=%v want=%v", m.Type(),
+				MsgType(msgMetaTestMsg(0)))
+		}
+		if m.Time().Before(start) || m.Time().Before(prev) ||
+			m.Time().After(time.Now()) {
+			t.Errorf("invalid time: actual=%v want>=%v", m.Time(), prev)
+		}
+		prev = m.Time()
+	}
+}
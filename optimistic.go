@@ -0,0 +1,74 @@
+package beehive
+
+import (
+	"sync"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// ErrConcurrentTx is returned when an optimistic transaction cannot be
+// committed because another bee has committed a transaction on the same cells.
+var ErrConcurrentTx = newRoutingError(ErrTxConflict,
+	"transaction conflicts with a transaction of another bee")
+
+// txVersions are the versions of the cells of an app with optimistic
+// transactions. The version of a cell is the sequence of the last transaction
+// that has written it.
+type txVersions struct {
+	sync.Mutex
+	seq   uint64             // the sequence of the last committed tx.
+	cells map[CellKey]uint64 // the version of the written cells.
+}
+
+// current returns the sequence of the last committed transaction.
+func (v *txVersions) current() uint64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.seq
+}
+
+// commit validates a transaction that has started after the transaction start
+// was committed. If a cell accessed in the transaction is written by a
+// transaction committed since then, it returns ErrConcurrentTx. Otherwise, it
+// sets the version of the written cells to the sequence of the transaction.
+func (v *txVersions) commit(start uint64, accessed, written []CellKey) error {
+	v.Lock()
+	defer v.Unlock()
+	for _, c := range accessed {
+		if v.cells[c] > start {
+			return ErrConcurrentTx
+		}
+	}
+	if len(written) == 0 {
+		return nil
+	}
+
+	v.seq++
+	if v.cells == nil {
+		v.cells = make(map[CellKey]uint64)
+	}
+	for _, c := range written {
+		v.cells[c] = v.seq
+	}
+	return nil
+}
+
+// validateTx returns the pre-commit hook of an optimistic transaction that has
+// started after the transaction start was committed.
+func (b *bee) validateTx(start uint64) func() error {
+	return func() error {
+		dicts, _ := b.currentState()
+		var accessed []CellKey
+		dicts.ForEachTxKey(func(d, k string) {
+			accessed = append(accessed, CellKey{Dict: d, Key: k})
+		})
+		var written []CellKey
+		for _, op := range dicts.TxOps() {
+			if op.T == state.SetLimit {
+				continue
+			}
+			written = append(written, CellKey{Dict: op.D, Key: op.K})
+		}
+		return b.app.txVersions.commit(start, accessed, written)
+	}
+}
@@ -0,0 +1,212 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// outboxDict is the reserved dictionary of persistent bees that stores the
+// messages of committed transactions until they are delivered. Since it is
+// part of the bee's state, the outbox is replicated and snapshotted along with
+// the application dictionaries.
+const outboxDict = "__outbox__"
+
+// outboxSeqKey stores the sequence of the last transaction added to the
+// outbox.
+const outboxSeqKey = "seq"
+
+// outboxRcvdDict is the reserved dictionary that records the outbox messages
+// received by a bee, keyed by the colony of their emitter. It is updated in
+// the transaction of the handler, so that the messages redelivered after a
+// crash or a failover of the emitter are not handled twice.
+const outboxRcvdDict = "__outbox_rcvd__"
+
+// outboxRcvdWindow is the number of transactions of each colony remembered in
+// outboxRcvdDict.
+const outboxRcvdWindow = 256
+
+// outboxMsgID identifies a message in the outbox of a colony. It is zero for
+// the messages that are not emitted by a persistent bee.
+type outboxMsgID struct {
+	Colony uint64
+	Seq    uint64
+	Index  int
+}
+
+// outboxRcvd is the outbox messages of a colony received by a bee.
+type outboxRcvd struct {
+	// Low is the highest sequence forgotten from Msgs. The messages of older
+	// transactions are considered received.
+	Low uint64
+	// Msgs has the indices of the received messages keyed by the sequence of
+	// their transaction.
+	Msgs map[uint64][]int
+}
+
+// outboxEntry is the messages of a committed transaction waiting to be
+// delivered.
+type outboxEntry struct {
+	Seq  uint64
+	Msgs []*msg
+}
+
+// outboxAck is proposed by the leader once the messages of a transaction are
+// delivered. It removes the entry from the outbox of all replicas.
+type outboxAck struct {
+	Seq uint64
+}
+
+func outboxKey(seq uint64) string {
+	return fmt.Sprintf("%016x", seq)
+}
+
+// addToOutbox stores msgs in the outbox, stamps them with their outbox ID, and
+// returns their transaction sequence. It must be called while the bee is
+// locked.
+func (b *bee) addToOutbox(msgs []*msg) uint64 {
+	d := b.stateL1.State.Dict(outboxDict)
+	var seq uint64
+	if v, err := d.Get(outboxSeqKey); err == nil {
+		seq = v.(uint64)
+	}
+	seq++
+	for i, m := range msgs {
+		m.MsgOutbox = outboxMsgID{Colony: b.beeColony.ID, Seq: seq, Index: i}
+	}
+	d.Put(outboxSeqKey, seq)
+	d.Put(outboxKey(seq), outboxEntry{Seq: seq, Msgs: msgs})
+	return seq
+}
+
+// removeFromOutbox removes the entry of the given sequence from the outbox. It
+// must be called while the bee is locked.
+func (b *bee) removeFromOutbox(seq uint64) {
+	b.stateL1.State.Dict(outboxDict).Del(outboxKey(seq))
+	delete(b.outboxSent, seq)
+}
+
+// markOutboxSent marks the entry of the given sequence as delivered by this
+// bee, and returns false if it was already delivered. It must be called while
+// the bee is locked.
+func (b *bee) markOutboxSent(seq uint64) bool {
+	if b.outboxSent[seq] {
+		return false
+	}
+	if b.outboxSent == nil {
+		b.outboxSent = make(map[uint64]bool)
+	}
+	b.outboxSent[seq] = true
+	return true
+}
+
+// pendingOutbox returns the entries of the outbox that are not delivered by
+// this bee, sorted by their sequence, and marks them as delivered. It must be
+// called while the bee is locked.
+func (b *bee) pendingOutbox() (entries []outboxEntry) {
+	b.stateL1.State.Dict(outboxDict).ForEach(func(k string,
+		v interface{}) bool {
+
+		if k == outboxSeqKey {
+			return true
+		}
+		e := v.(outboxEntry)
+		if b.markOutboxSent(e.Seq) {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	sort.Sort(outboxEntries(entries))
+	return
+}
+
+// redeliverOutbox delivers the messages of the transactions that are
+// committed but not yet acknowledged as delivered, e.g., when the bee recovers
+// from a crash or takes over the leadership of its colony. It must be called
+// in the bee's loop.
+func (b *bee) redeliverOutbox() {
+	b.Lock()
+	if !b.isLeader() || !b.emitInRaft {
+		b.Unlock()
+		return
+	}
+	entries := b.pendingOutbox()
+	b.Unlock()
+
+	for _, e := range entries {
+		glog.V(2).Infof("%v redelivers the messages of tx %v", b, e.Seq)
+		seq := e.Seq
+		b.throttleThen(e.Msgs, func() { go b.ackOutbox(seq) })
+	}
+}
+
+// ackOutbox proposes the removal of the entry of seq from the outbox. If the
+// proposal fails, the messages are delivered again by the next leader.
+func (b *bee) ackOutbox(seq uint64) {
+	_, err := b.hive.node.ProposeRetry(b.group(), outboxAck{Seq: seq},
+		b.hive.config.RaftElectTimeout(), 10)
+	if err != nil {
+		glog.Errorf("%v cannot acknowledge the delivery of tx %v: %v", b, seq, err)
+	}
+}
+
+// isRedelivered returns whether m is an outbox message that is already
+// received by the bee, and records m as received otherwise. It must be called
+// in the transaction of the handler.
+func (b *bee) isRedelivered(m *msg) bool {
+	id := m.MsgOutbox
+	if id.Seq == 0 || b.app.stateless {
+		return false
+	}
+
+	d := b.Dict(outboxRcvdDict)
+	k := outboxKey(id.Colony)
+	var r outboxRcvd
+	if v, err := d.Get(k); err == nil {
+		r = v.(outboxRcvd)
+	}
+	if id.Seq <= r.Low {
+		return true
+	}
+	for _, i := range r.Msgs[id.Seq] {
+		if i == id.Index {
+			return true
+		}
+	}
+
+	// The record may be shared with the committed state, and is copied before
+	// it is updated.
+	msgs := make(map[uint64][]int, len(r.Msgs)+1)
+	for s, is := range r.Msgs {
+		msgs[s] = is
+	}
+	is := make([]int, len(msgs[id.Seq]), len(msgs[id.Seq])+1)
+	copy(is, msgs[id.Seq])
+	msgs[id.Seq] = append(is, id.Index)
+	for len(msgs) > outboxRcvdWindow {
+		min := id.Seq
+		for s := range msgs {
+			if s < min {
+				min = s
+			}
+		}
+		delete(msgs, min)
+		r.Low = min
+	}
+	d.Put(k, outboxRcvd{Low: r.Low, Msgs: msgs})
+	return false
+}
+
+type outboxEntries []outboxEntry
+
+func (e outboxEntries) Len() int           { return len(e) }
+func (e outboxEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e outboxEntries) Less(i, j int) bool { return e[i].Seq < e[j].Seq }
+
+func init() {
+	gob.Register(outboxAck{})
+	gob.Register(outboxEntry{})
+	gob.Register(outboxRcvd{})
+}
@@ -0,0 +1,217 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/bucket"
+)
+
+type outboxTestIn int
+type outboxTestOut int
+
+func TestOutboxRedelivery(t *testing.T) {
+	h := newHiveForTest()
+
+	a := h.NewApp("OutboxTest", Persistent(1))
+	rcvd := make(chan bool)
+	a.HandleFunc(outboxTestIn(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ctx.Dict("D").Put("0", int(msg.Data().(outboxTestIn)))
+		ctx.Emit(outboxTestOut(msg.Data().(outboxTestIn)))
+		rcvd <- true
+		return nil
+	})
+
+	out := make(chan outboxTestOut, 16)
+	h.NewApp("OutboxTestSink").HandleFunc(outboxTestOut(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		}, func(msg Msg, ctx RcvContext) error {
+			out <- msg.Data().(outboxTestOut)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(outboxTestIn(1))
+	<-rcvd
+	select {
+	case o := <-out:
+		if o != 1 {
+			t.Errorf("invalid message: actual=%v want=1", o)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message of the first tx is not delivered")
+	}
+
+	var b *bee
+	for _, b = range a.(*app).qee.bees {
+		break
+	}
+
+	// Simulate a crash after the state commit but before the delivery.
+	b.disableEmit()
+	h.Emit(outboxTestIn(2))
+	<-rcvd
+	select {
+	case o := <-out:
+		t.Fatalf("message %v is delivered while emit is disabled", o)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var pending []outboxEntry
+	b.Lock()
+	b.stateL1.State.Dict(outboxDict).ForEach(func(k string,
+		v interface{}) bool {
+
+		if k != outboxSeqKey {
+			pending = append(pending, v.(outboxEntry))
+		}
+		return true
+	})
+	b.Unlock()
+	if len(pending) != 1 {
+		t.Fatalf("invalid outbox entries: actual=%v want=1", len(pending))
+	}
+
+	b.enableEmit()
+	b.processCmd(cmdRedeliverOutbox{})
+	b.processCmd(cmdRedeliverOutbox{})
+
+	select {
+	case o := <-out:
+		if o != 2 {
+			t.Errorf("invalid redelivered message: actual=%v want=2", o)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message of the second tx is not redelivered")
+	}
+	select {
+	case o := <-out:
+		t.Errorf("message %v is delivered more than once", o)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// A new leader redelivers the messages that are not acknowledged yet, and
+	// the receiver must drop them.
+	b.throttle(pending[0].Msgs)
+	select {
+	case o := <-out:
+		t.Errorf("redelivered message %v is handled again", o)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	for i := 0; ; i++ {
+		b.Lock()
+		n := 0
+		b.stateL1.State.Dict(outboxDict).ForEach(func(k string,
+			v interface{}) bool {
+
+			if k != outboxSeqKey {
+				n++
+			}
+			return true
+		})
+		b.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("outbox is not acknowledged: actual=%v want=0", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// outboxLen returns the number of entries in the outbox of b.
+func outboxLen(b *bee) int {
+	b.Lock()
+	defer b.Unlock()
+	n := 0
+	b.stateL1.State.Dict(outboxDict).ForEach(func(k string,
+		v interface{}) bool {
+
+		if k != outboxSeqKey {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+func TestOutboxRateLimited(t *testing.T) {
+	h := newHiveForTest()
+
+	a := h.NewApp("OutboxTest", Persistent(1), OutRate(2*bucket.TPS, 1))
+	a.HandleFunc(outboxTestIn(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ctx.Dict("D").Put("0", int(msg.Data().(outboxTestIn)))
+		ctx.Emit(outboxTestOut(msg.Data().(outboxTestIn)))
+		return nil
+	})
+
+	out := make(chan outboxTestOut, 16)
+	h.NewApp("OutboxTestSink").HandleFunc(outboxTestOut(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return ctx.LocalMappedCells()
+		}, func(msg Msg, ctx RcvContext) error {
+			out <- msg.Data().(outboxTestOut)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// The first message takes the token of the bee, and the second one is held
+	// back by the rate limit.
+	h.Emit(outboxTestIn(1))
+	h.Emit(outboxTestIn(2))
+	select {
+	case <-out:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message of the first tx is not delivered")
+	}
+
+	b, ok := localBee(h, "OutboxTest")
+	if !ok {
+		t.Fatal("no local bee")
+	}
+
+	// The entry of the message held back must stay in the outbox until the
+	// message is emitted, so that it is redelivered if the bee crashes.
+	for {
+		if outboxLen(b) == 0 {
+			select {
+			case o := <-out:
+				if o != 2 {
+					t.Errorf("invalid message: actual=%v want=2", o)
+				}
+			case <-time.After(100 * time.Millisecond):
+				t.Error("the outbox is acknowledged before the message is emitted")
+			}
+			return
+		}
+		select {
+		case o := <-out:
+			if o != 2 {
+				t.Fatalf("invalid message: actual=%v want=2", o)
+			}
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	for i := 0; outboxLen(b) != 0; i++ {
+		if i == 200 {
+			t.Fatal("the outbox is not acknowledged after the message is emitted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+package beehive
+
+import (
+	"errors"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// PartitionPolicy specifies what a hive does with the messages of a bee whose
+// hive is unreachable, e.g., during a network partition.
+type PartitionPolicy int
+
+// Valid values for PartitionPolicy.
+const (
+	// FailFast drops the messages. This is the default policy.
+	FailFast PartitionPolicy = iota
+	// RouteToReplica sends the messages to a follower of the bee's colony. The
+	// follower handles the messages on its local replica of the state without
+	// replicating the changes, which is only safe for idempotent applications.
+	RouteToReplica
+	// Remap transfers the cells of the bee to a new bee on the local hive, and
+	// sends the messages to the new bee.
+	Remap
+)
+
+var errNoReplica = errors.New("no reachable replica")
+
+// handleUnreachable applies the partition policy of the app on the messages
+// that cannot be delivered to bee to. Best-effort messages are already dropped.
+func (b *bee) handleUnreachable(to uint64, mhs []msgAndHandler, err error) {
+	rest := make([]msgAndHandler, 0, len(mhs))
+	for _, mh := range mhs {
+		if !mh.msg.MsgBestEffort {
+			rest = append(rest, mh)
+		}
+	}
+
+	if len(rest) != 0 {
+		switch b.app.partition {
+		case RouteToReplica:
+			if rerr := b.routeToReplica(to, rest); rerr != nil {
+				err = rerr
+			} else {
+				err = nil
+			}
+		case Remap:
+			b.remap(to, rest)
+			err = nil
+		}
+	}
+
+	if err != nil {
+		glog.Errorf("%v cannot send message: %v", b, err)
+		for _, mh := range rest {
+			mh.msg.receipt.report(Failed, to, err)
+		}
+	}
+}
+
+// routeToReplica sends mhs to the first follower of to's colony that is on a
+// live hive.
+func (b *bee) routeToReplica(to uint64, mhs []msgAndHandler) error {
+	info, err := b.hive.registry.bee(to)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range info.Colony.Followers {
+		finfo, err := b.hive.registry.bee(f)
+		if err != nil || b.hive.members.isDead(finfo.Hive) {
+			continue
+		}
+
+		if finfo.Hive == b.hive.ID() {
+			fb, ok := b.qee.beeByID(f)
+			if !ok || fb.proxy {
+				continue
+			}
+			for _, mh := range mhs {
+				m := *mh.msg
+				m.MsgTo = f
+				m.MsgFailover = true
+				fb.enqueMsg(msgAndHandler{msg: &m, handler: mh.handler})
+			}
+			glog.V(2).Infof("%v routes messages to follower %v", b, f)
+			return nil
+		}
+
+		c, err := b.hive.client.hiveClient(finfo.Hive)
+		if err != nil {
+			continue
+		}
+		msgs := make([]msg, 0, len(mhs))
+		for _, mh := range mhs {
+			m := *mh.msg
+			m.MsgTo = f
+			m.MsgFailover = true
+			msgs = append(msgs, m)
+		}
+		if err := c.sendMsg(msgs); err != nil {
+			continue
+		}
+		glog.V(2).Infof("%v routes messages to follower %v on %v", b, f,
+			finfo.Hive)
+		return nil
+	}
+	return errNoReplica
+}
+
+// remap asks the qee to transfer the cells of to to a new local bee and to
+// enqueue mhs on that bee.
+func (b *bee) remap(to uint64, mhs []msgAndHandler) {
+	// The qee may be blocked on enqueuing messages for this bee.
+	go func() {
+		if _, err := b.qee.processCmd(cmdRemap{Bee: to, Msgs: mhs}); err != nil {
+			glog.Errorf("%v cannot remap the cells of %v: %v", b, to, err)
+		}
+	}()
+}
+
+// handleMsgFailover handles the messages that are routed to this follower
+// because the leader of its colony is unreachable.
+func (b *bee) handleMsgFailover(mhs []msgAndHandler) {
+	glog.V(2).Infof("%v handles %v messages of an unreachable leader", b,
+		len(mhs))
+	b.failover = true
+	b.handleMsgLeader(mhs)
+	b.failover = false
+}
+
+// remap transfers the cells of bee bid to a new local bee, and returns the
+// new bee.
+func (q *qee) remap(bid uint64) (*bee, error) {
+	info, err := q.hive.registry.bee(bid)
+	if err != nil {
+		return nil, err
+	}
+
+	cells := q.hive.registry.cellsOf(info.Colony.Leader)
+	if len(cells) == 0 {
+		return nil, ErrInvalidParam
+	}
+
+	b, err := q.newLocalBee(true)
+	if err != nil {
+		return nil, err
+	}
+
+	t := transferCells{
+		From: info.Colony,
+		To:   b.colony(),
+	}
+	if _, err := q.hive.node.ProposeRetry(hiveGroup, t,
+		q.hive.config.RaftElectTimeout(), 10); err != nil {
+
+		b.processCmd(cmdStop{})
+		return nil, err
+	}
+
+	b.processCmd(cmdAddMappedCells{Cells: cells})
+	glog.V(2).Infof("%v remaps the cells of %v to %v", q, bid, b)
+	return b, nil
+}
@@ -0,0 +1,84 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type partitionTestMsg int
+
+func registerPartitionApp(h Hive, ch chan uint64, opts ...AppOption) {
+	app := h.NewApp("partition", opts...)
+	mf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	rf := func(msg Msg, ctx RcvContext) error {
+		ctx.Dict("D").Put("0", msg.Data())
+		ch <- h.ID()
+		return nil
+	}
+	app.HandleFunc(partitionTestMsg(0), mf, rf)
+}
+
+// testPartition handles a message on h1, makes h1 unreachable, and emits the
+// next message on h2. It returns the ID of the hive that handles the message
+// and the IDs of h1 and h2.
+func testPartition(t *testing.T, opts ...AppOption) (id, id1, id2 uint64) {
+	ch := make(chan uint64, 1)
+
+	h1 := newHiveForTest()
+	registerPartitionApp(h1, ch, opts...)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerPartitionApp(h2, ch, opts...)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h3 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerPartitionApp(h3, ch, opts...)
+	go h3.Start()
+	defer h3.Stop()
+	waitTilStareted(h3)
+
+	h1.Emit(partitionTestMsg(1))
+	if id := <-ch; id != h1.ID() {
+		t.Fatalf("message is handled on an invalid hive: actual=%v want=%v", id,
+			h1.ID())
+	}
+
+	// Make the owning hive unreachable.
+	time.Sleep(3 * h1.Config().RaftElectTimeout())
+	h1.Stop()
+	for i := 0; hasHive(h2.LiveHives(), h1.ID()); i++ {
+		if i == 100 {
+			t.Fatalf("%v does not detect that %v is dead", h2, h1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	h2.Emit(partitionTestMsg(2))
+	select {
+	case id = <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal("message is not delivered")
+	}
+	return id, h1.ID(), h2.ID()
+}
+
+func TestRouteToReplica(t *testing.T) {
+	id, id1, _ := testPartition(t, Persistent(2), OnPartition(RouteToReplica))
+	if id == id1 {
+		t.Errorf("message is handled on the unreachable hive")
+	}
+}
+
+func TestRemap(t *testing.T) {
+	id, _, id2 := testPartition(t, OnPartition(Remap))
+	if id != id2 {
+		t.Errorf("message is not remapped to the local hive: actual=%v want=%v",
+			id, id2)
+	}
+}
@@ -0,0 +1,52 @@
+package beehive
+
+import (
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// pauser gates the dequeue loops of the bees of a hive. The zero value is a
+// hive that is not paused.
+type pauser struct {
+	sync.Mutex
+	paused bool
+	ch     chan struct{} // closed on the next pause or resume.
+}
+
+// state returns whether the hive is paused, and a channel that is closed
+// when the hive is paused or resumed.
+func (p *pauser) state() (paused bool, changed <-chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+	if p.ch == nil {
+		p.ch = make(chan struct{})
+	}
+	return p.paused, p.ch
+}
+
+func (p *pauser) set(paused bool) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	if p.ch != nil {
+		close(p.ch)
+	}
+	p.ch = make(chan struct{})
+	return true
+}
+
+func (h *hive) Pause() {
+	if h.pause.set(true) {
+		glog.V(2).Infof("%v is paused", h)
+	}
+}
+
+func (h *hive) Resume() {
+	if h.pause.set(false) {
+		glog.V(2).Infof("%v is resumed", h)
+	}
+}
@@ -0,0 +1,49 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type pauseTestMsg int
+
+func TestPauseResume(t *testing.T) {
+	ch := make(chan int, 100)
+	h := newHiveForTest()
+	h.NewApp("pause").HandleFunc(pauseTestMsg(0),
+		func(m Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, ctx RcvContext) error {
+			ch <- int(m.Data().(pauseTestMsg))
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(pauseTestMsg(0))
+	<-ch
+
+	h.Pause()
+	const n = 10
+	for i := 1; i <= n; i++ {
+		h.Emit(pauseTestMsg(i))
+	}
+	select {
+	case i := <-ch:
+		t.Fatalf("message %v is handled on a paused hive", i)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	h.Resume()
+	for i := 1; i <= n; i++ {
+		select {
+		case j := <-ch:
+			if j != i {
+				t.Errorf("invalid message order: actual=%v want=%v", j, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %v is not handled after resume", i)
+		}
+	}
+}
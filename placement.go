@@ -29,3 +29,22 @@ func (r RandomPlacement) Place(cells MappedCells, thisHive Hive,
 
 	return liveHives[r.Intn(len(liveHives))]
 }
+
+// hivePreference is a placement method that places mapped cells on the hive
+// preferred for their first cell, if that hive is alive. Otherwise, cells are
+// placed on the local hive.
+type hivePreference func(k CellKey) uint64
+
+func (p hivePreference) Place(cells MappedCells, thisHive Hive,
+	liveHives []HiveInfo) HiveInfo {
+
+	if len(cells) != 0 {
+		id := p(cells[0])
+		for _, h := range liveHives {
+			if h.ID == id {
+				return h
+			}
+		}
+	}
+	return HiveInfo{ID: thisHive.ID(), Addr: thisHive.Config().Addr}
+}
@@ -74,3 +74,48 @@ func TestPlacement(t *testing.T) {
 		}
 	}
 }
+
+func TestHivePreference(t *testing.T) {
+	ch := make(chan testPlacementRes)
+	var hives []Hive
+
+	nh := 2
+	for i := 0; i < nh; i++ {
+		var h Hive
+		if i == 0 {
+			h = newHiveForTest()
+		} else {
+			h = newHiveForTest(PeerAddrs(hives[0].(*hive).config.Addr))
+		}
+		hives = append(hives, h)
+		a := h.NewApp("preferenceapp", NonTransactional())
+		a.SetHivePreference(func(k CellKey) uint64 {
+			if k.Key == "1" {
+				return hives[1].ID()
+			}
+			// Not a live hive.
+			return 0
+		})
+		a.HandleFunc(int(0), func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", strconv.Itoa(msg.Data().(int))}}
+		}, func(msg Msg, ctx RcvContext) error {
+			ch <- testPlacementRes{hive: ctx.Hive().ID(), msg: msg.Data().(int)}
+			return nil
+		})
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+	}
+
+	hives[0].Emit(1)
+	if res := <-ch; res.hive != hives[1].ID() {
+		t.Errorf("bee is not placed on the preferred hive: actual=%v want=%v",
+			res.hive, hives[1].ID())
+	}
+
+	hives[0].Emit(2)
+	if res := <-ch; res.hive != hives[0].ID() {
+		t.Errorf("bee is not placed on the local hive: actual=%v want=%v",
+			res.hive, hives[0].ID())
+	}
+}
@@ -0,0 +1,69 @@
+package beehive
+
+import "container/heap"
+
+// prioAging is the number of messages that a priority level is worth. A message
+// overtakes the messages of lower priorities only if they are queued less than
+// prioAging messages per priority level before it. As such, messages of low
+// priorities are delayed but never starved.
+const prioAging = 1024
+
+type prioMsg struct {
+	mh  msgAndHandler
+	key int64
+}
+
+// prioHeap is a min-heap of messages ordered by their aged priority.
+type prioHeap []prioMsg
+
+func (h prioHeap) Len() int            { return len(h) }
+func (h prioHeap) Less(i, j int) bool  { return h[i].key < h[j].key }
+func (h prioHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *prioHeap) Push(x interface{}) { *h = append(*h, x.(prioMsg)) }
+
+func (h *prioHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	m := old[n-1]
+	old[n-1] = prioMsg{}
+	*h = old[:n-1]
+	return m
+}
+
+// newPrioMsgChannel creates a message channel that delivers messages of higher
+// priorities first. Its output channel is unbuffered so that messages are
+// ordered right before they are handled.
+func newPrioMsgChannel(bufSize uint) *msgChannel {
+	q := &msgChannel{
+		chin:  make(chan msgAndHandler, bufSize),
+		chout: make(chan msgAndHandler),
+		size:  bufSize,
+		prio:  &prioHeap{},
+	}
+	go q.pipePrio()
+	return q
+}
+
+func (q *msgChannel) pipePrio() {
+	var seq int64
+	for {
+		var chout chan msgAndHandler
+		var first msgAndHandler
+		if q.prio.Len() != 0 {
+			chout = q.chout
+			first = (*q.prio)[0].mh
+		}
+
+		select {
+		case mh := <-q.chin:
+			seq++
+			heap.Push(q.prio, prioMsg{
+				mh:  mh,
+				key: seq - int64(mh.msg.MsgPrio)*prioAging,
+			})
+			q.record(uint64(q.prio.Len()))
+		case chout <- first:
+			heap.Pop(q.prio)
+		}
+	}
+}
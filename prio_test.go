@@ -0,0 +1,88 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrioMsgChannelAging(t *testing.T) {
+	n := 2 * prioAging
+	ch := newPrioMsgChannel(uint(n + 1))
+	ch.in() <- msgAndHandler{msg: &msg{MsgData: -1}}
+	for i := 0; i < n; i++ {
+		ch.in() <- msgAndHandler{msg: &msg{MsgData: i, MsgPrio: 1}}
+	}
+	// Wait until all messages are queued.
+	for len(ch.chin) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i <= n; i++ {
+		mh := <-ch.out()
+		if mh.msg.MsgData != -1 {
+			continue
+		}
+		if i < prioAging-1 || i > prioAging {
+			t.Errorf("invalid position for low priority message: actual=%v want=%v",
+				i, prioAging)
+		}
+		return
+	}
+	t.Error("low priority message is starved")
+}
+
+type prioTestTrigger struct{}
+type prioTestMsg int
+
+func TestAppPrioritized(t *testing.T) {
+	h := newHiveForTest()
+	n := 200
+	high := prioTestMsg(-1)
+	release := make(chan struct{})
+	rcvd := make(chan prioTestMsg, n+1)
+	a := h.NewApp("prioritized", Prioritized())
+	a.HandleFunc(prioTestTrigger{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"T", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		for i := 0; i < n; i++ {
+			c.Emit(prioTestMsg(i))
+		}
+		c.EmitWithPriority(high, 1)
+		return nil
+	})
+	a.HandleFunc(prioTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"R", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		if m.Data().(prioTestMsg) == 0 {
+			<-release
+		}
+		rcvd <- m.Data().(prioTestMsg)
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(prioTestTrigger{})
+	// Let the backlog build up behind the first message.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+
+	for i := 0; i <= n; i++ {
+		select {
+		case m := <-rcvd:
+			if m != high {
+				continue
+			}
+			if i > n/2 {
+				t.Errorf("high priority message is handled late: actual=%v want<=%v",
+					i, n/2)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing messages: actual=%v want=%v", i, n+1)
+		}
+	}
+	t.Error("high priority message is not received")
+}
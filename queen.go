@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
@@ -25,30 +27,47 @@ type qee struct {
 	ctrlCh      chan cmdAndChannel
 	placementCh chan placementRes
 	stopped     bool
+	started     bool // whether the message loop is running.
 
-	state *state.Transactional
+	state    *state.Transactional
+	snapshot *appSnapshot // to be restored when the qee starts.
 
 	bees         map[uint64]*bee
 	pendingCells map[CellKey]*pendingCells
 
 	maxID  uint64
 	nextID uint64
+
+	detached int // number of running detached bees.
+
+	split stickySplit // the split state of sticky apps.
+
+	mapCache mapCache // the map cache of apps with SetMapCache.
 }
 
 func (q *qee) start() {
-	batch := make([]msgAndHandler, 0, q.hive.config.BatchSize)
+	batch := make([]msgAndHandler, 0, q.hive.cfg().BatchSize)
 	q.stopped = false
+	if q.snapshot != nil {
+		q.restoreSnapshot()
+	}
+	q.setStarted(true)
+	defer q.setStarted(false)
 	dataCh := q.dataCh.out()
+	var splitT <-chan time.Time
+	if q.app.stickySplit > 0 {
+		splitT = q.hive.config.Clock.After(stickySplitWindow)
+	}
 	for !q.stopped {
 		select {
 		case d := <-dataCh:
-			batch = append(batch, d)
+			batch = appendMsgs(batch, d)
 			l := len(dataCh)
 			if cap(batch)-1 < l {
 				l = cap(batch) - 1
 			}
 			for i := 0; i < l; i++ {
-				batch = append(batch, <-dataCh)
+				batch = appendMsgs(batch, <-dataCh)
 			}
 			q.handleMsgs(batch)
 			batch = batch[0:0]
@@ -57,12 +76,28 @@ func (q *qee) start() {
 			// TODO(soheil): maybe batch.
 			q.handlePlacementRes(p)
 
+		case <-splitT:
+			q.rebalanceSplit()
+			splitT = q.hive.config.Clock.After(stickySplitWindow)
+
 		case c := <-q.ctrlCh:
 			q.handleCmd(c)
 		}
 	}
 }
 
+func (q *qee) setStarted(s bool) {
+	q.Lock()
+	q.started = s
+	q.Unlock()
+}
+
+func (q *qee) isStarted() bool {
+	q.RLock()
+	defer q.RUnlock()
+	return q.started
+}
+
 func (q *qee) String() string {
 	return fmt.Sprintf("%d/%s/Q", q.hive.ID(), q.app.Name())
 }
@@ -107,9 +142,15 @@ func (q *qee) addBee(b *bee) {
 	q.Unlock()
 }
 
+func (q *qee) removeBee(id uint64) {
+	q.Lock()
+	delete(q.bees, id)
+	q.Unlock()
+}
+
 func (q *qee) allocateBeeID() error {
 	a := allocateBeeIDs{
-		Len: q.hive.config.BatchSize,
+		Len: q.hive.cfg().BatchSize,
 	}
 	res, err := q.hive.node.ProposeRetry(hiveGroup, a,
 		q.hive.config.RaftElectTimeout(), -1)
@@ -144,12 +185,19 @@ func (q *qee) newLocalBee(withColony bool) (*bee, error) {
 		return nil, fmt.Errorf("bee %v already exists", id)
 	}
 
+	b := q.makeLocalBee(id, withColony)
+	if err := b.initHandlers(); err != nil {
+		return nil, fmt.Errorf("%v cannot initialize the handlers of bee %v: %v",
+			q, id, err)
+	}
+
 	info := q.defaultBeeInfo(id, false, withColony)
 	if err := q.registerBee(info); err != nil {
 		return nil, err
 	}
 
-	return q.newLocalBeeWithID(id, withColony)
+	q.startLocalBee(b)
+	return b, nil
 }
 
 func (q *qee) defaultBeeInfo(id uint64, detached bool, initColony bool) (
@@ -173,6 +221,13 @@ func (q *qee) defaultColony(bee uint64) Colony {
 }
 
 func (q *qee) newLocalBeeWithID(id uint64, withColony bool) (*bee, error) {
+	b := q.makeLocalBee(id, withColony)
+	q.startLocalBee(b)
+	return b, nil
+}
+
+// makeLocalBee creates a local bee without starting it.
+func (q *qee) makeLocalBee(id uint64, withColony bool) *bee {
 	b := q.defaultLocalBee(id)
 	b.setState(q.app.newState())
 
@@ -182,10 +237,13 @@ func (q *qee) newLocalBeeWithID(id uint64, withColony bool) (*bee, error) {
 	} else {
 		b.becomeZombie()
 	}
+	return b
+}
 
+// startLocalBee adds the local bee b to the qee and starts it.
+func (q *qee) startLocalBee(b *bee) {
 	q.addBee(b)
 	go b.start()
-	return b, nil
 }
 
 func (q *qee) newProxyBee(info BeeInfo) (*bee, error) {
@@ -201,8 +259,17 @@ func (q *qee) newProxyBee(info BeeInfo) (*bee, error) {
 }
 
 func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
+	q.Lock()
+	if q.app.maxDetached > 0 && q.detached >= q.app.maxDetached {
+		q.Unlock()
+		return nil, ErrTooManyDetached
+	}
+	q.detached++
+	q.Unlock()
+
 	id, err := q.newBeeID()
 	if err != nil {
+		q.detachedDone()
 		return nil, fmt.Errorf("%v cannot allocate a new bee ID: %v", q, err)
 	}
 	b := q.defaultLocalBee(id)
@@ -210,6 +277,7 @@ func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
 	b.becomeDetached(h)
 
 	if err := q.registerBee(q.defaultBeeInfo(id, true, false)); err != nil {
+		q.detachedDone()
 		return nil, err
 	}
 
@@ -219,6 +287,56 @@ func (q *qee) newDetachedBee(h DetachedHandler) (*bee, error) {
 	return b, nil
 }
 
+// detachedDone is called when a detached bee stops or fails to start.
+func (q *qee) detachedDone() {
+	q.Lock()
+	q.detached--
+	q.Unlock()
+}
+
+// detachedBees returns the IDs of the running detached bees.
+func (q *qee) detachedBees() []uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	var ids []uint64
+	for id, b := range q.bees {
+		if b.detached {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(beeIDs(ids))
+	return ids
+}
+
+type beeIDs []uint64
+
+func (b beeIDs) Len() int           { return len(b) }
+func (b beeIDs) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b beeIDs) Less(i, j int) bool { return b[i] < b[j] }
+
+// stopDetached stops the detached bee id, and removes it from the qee and the
+// registry. The handler of the bee is stopped once the bee stops.
+func (q *qee) stopDetached(id uint64) error {
+	b, ok := q.beeByID(id)
+	if !ok || !b.detached {
+		return ErrNoSuchBee
+	}
+
+	q.removeBee(id)
+	if _, err := b.processCmd(cmdStop{}); err != nil {
+		return err
+	}
+	go q.hive.delBeeFromRegistry(id)
+	return nil
+}
+
+// numDetached returns the number of running detached bees.
+func (q *qee) numDetached() int {
+	q.RLock()
+	defer q.RUnlock()
+	return q.detached
+}
+
 func (q *qee) registerBee(info BeeInfo) error {
 	// TODO(soheil): we should not block on this.
 	_, err := q.hive.node.ProposeRetry(hiveGroup, addBee(info),
@@ -308,6 +426,9 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 		q.stopped = true
 		glog.V(3).Infof("stopping bees of %p", q)
 		q.stopBees()
+		if q.app.sched != nil {
+			q.app.sched.stop()
+		}
 
 	case cmdFindBee:
 		id := cmd.ID
@@ -319,6 +440,10 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 		res = r
 
 	case cmdCreateBee:
+		if q.hive.draining() {
+			err = ErrDraining
+			break
+		}
 		var b *bee
 		b, err = q.newLocalBee(false)
 		if err != nil {
@@ -340,6 +465,24 @@ func (q *qee) handleCmd(cc cmdAndChannel) {
 	case cmdMigrate:
 		res, err = q.migrate(cmd.Bee, cmd.To)
 
+	case cmdSetSticky:
+		err = q.setSticky(cmd.Sticky)
+
+	case cmdRoute:
+		var r routeResult
+		r.Cells, r.Bee, err = q.route(cmd.Msg)
+		res = r
+
+	case cmdRemap:
+		var b *bee
+		if b, err = q.remap(cmd.Bee); err != nil {
+			break
+		}
+		for _, mh := range cmd.Msgs {
+			b.enqueMsg(mh)
+		}
+		res = b.ID()
+
 	default:
 		err = fmt.Errorf("unknown queen bee command %#v", cmd)
 	}
@@ -385,9 +528,143 @@ func (q *qee) invokeMap(mh msgAndHandler) (ms MappedCells) {
 	}()
 
 	glog.V(2).Infof("%v invokes map for %v", q, mh.msg)
+	start := q.hive.config.Clock.Now()
+	ms = q.mapMsg(mh)
+	q.hive.recordSpan(spanMap, q.app.Name(), 0, mh.msg, start)
+	ms = q.withAppCells(ms)
+	if q.app.sticky() && q.app.stickySplit > 0 && len(ms) != 0 {
+		ms = q.withStickySplit(ms)
+	}
+	return ms
+}
+
+// shardDict is the pseudo dictionary of the cells of sharded messages.
+const shardDict = "__shard_dict__"
+
+// mapMsg maps the message using its shard key, if its type is sharded, and
+// using the map function of its handler otherwise.
+func (q *qee) mapMsg(mh msgAndHandler) MappedCells {
+	d := mh.msg.Data()
+	if s, ok := d.(syncReq); ok {
+		d = s.Data
+	}
+	if key, ok := q.app.shards[MsgType(d)]; ok {
+		return MappedCells{{shardDict, key(d)}}
+	}
 	return mh.handler.Map(mh.msg, q)
 }
 
+// withAppCells applies the cell mapper and the affinity groups of the app to
+// the cells returned by a map function.
+func (q *qee) withAppCells(ms MappedCells) MappedCells {
+	if q.app.mapper != nil && len(ms) != 0 {
+		if m, ok := q.app.mapper.(keyHashMapper); ok {
+			ms = m.mapCellsWithHash(ms, q.hive.keyHash)
+		} else {
+			ms = q.app.mapper.MapCells(ms)
+		}
+	}
+	if q.app.stickyBy != nil && len(ms) != 0 {
+		ms = q.withAffinity(ms)
+	}
+	return ms
+}
+
+// route maps the message the same way as invokeMap and returns the mapped
+// cells and the bee that owns them. Unlike invokeMap, it does not count the
+// message towards the sticky split rate, and it neither locks the cells nor
+// creates bees. The bee is Nil if the cells are not owned by any bee yet.
+func (q *qee) route(mh msgAndHandler) (ms MappedCells, bee uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error in map of %s: %v", q.app.Name(), r)
+		}
+	}()
+
+	ms = q.withAppCells(q.mapMsg(mh))
+	if len(ms) == 0 {
+		return ms, Nil, nil
+	}
+	if q.app.sticky() && q.app.stickySplit > 0 {
+		ms = q.splitCells(ms)
+	}
+
+	info, _, err := q.hive.registry.beeForCells(q.app.Name(), ms)
+	if err != nil {
+		return ms, Nil, nil
+	}
+	return ms, info.ID, nil
+}
+
+// affinityDict is the pseudo dictionary used to lock affinity groups.
+const affinityDict = "__affinity_dict__"
+
+// withAffinity adds the affinity groups of the cells to the mapped cells. Since
+// the cells of an affinity group share the same pseudo cell, they are always
+// locked by the same bee.
+func (q *qee) withAffinity(cells MappedCells) MappedCells {
+	groups := make(map[string]struct{})
+	res := make(MappedCells, 0, len(cells)+1)
+	for _, c := range cells {
+		if c.Dict == affinityDict {
+			continue
+		}
+		g := q.app.stickyBy(c)
+		if _, ok := groups[g]; !ok {
+			groups[g] = struct{}{}
+			res = append(res, CellKey{Dict: affinityDict, Key: g})
+		}
+	}
+	return append(res, cells...)
+}
+
+// stickySplitDict is the pseudo dictionary used to lock the split groups of
+// sticky apps.
+const stickySplitDict = "__sticky_split_dict__"
+
+// stickySplitWindow is the window in which the message rate of a sticky app is
+// measured.
+const stickySplitWindow = time.Second
+
+// stickySplit is the state of splitting a sticky app.
+type stickySplit struct {
+	groups int // the number of split groups.
+	msgs   int // the number of messages in the current window.
+}
+
+// withStickySplit counts the message towards the rate of the sticky app, and
+// adds the split group of cells to cells.
+func (q *qee) withStickySplit(cells MappedCells) MappedCells {
+	q.split.msgs++
+	return q.splitCells(cells)
+}
+
+// splitCells adds the split group of a sticky app to cells. The group is the
+// hash of the key, or the affinity group, of the first cell.
+func (q *qee) splitCells(cells MappedCells) MappedCells {
+	for _, c := range cells {
+		if c.Dict == stickySplitDict {
+			return cells
+		}
+	}
+	return append(MappedCells{q.splitKey(q.splitGroup(cells[0]))}, cells...)
+}
+
+// splitGroup returns the split group of cell c.
+func (q *qee) splitGroup(c CellKey) int {
+	groups := q.split.groups
+	if groups == 0 {
+		groups = 1
+	}
+	k := CellKey{Key: q.distributionGroup(c)}
+	return int(q.hive.keyHash(k) % uint64(groups))
+}
+
+// splitKey returns the pseudo cell locked by the bee of split group g.
+func (q *qee) splitKey(g int) CellKey {
+	return CellKey{Dict: stickySplitDict, Key: strconv.Itoa(g)}
+}
+
 func (q *qee) isDetached(id uint64) bool {
 	b, err := q.hive.registry.bee(id)
 	return err == nil && b.Detached
@@ -395,6 +672,10 @@ func (q *qee) isDetached(id uint64) bool {
 
 func (q *qee) handleUnicastMsg(mh msgAndHandler) {
 	glog.V(2).Infof("unicast msg: %v", mh.msg)
+	if mh.msg.MsgToColony {
+		mh = q.routeToLeader(mh)
+	}
+
 	b, ok := q.beeByID(mh.msg.To())
 	if !ok {
 		info, err := q.hive.registry.bee(mh.msg.To())
@@ -409,6 +690,7 @@ func (q *qee) handleUnicastMsg(mh msgAndHandler) {
 		if b, ok = q.beeByID(info.ID); !ok {
 			if b, err = q.newProxyBee(info); err != nil {
 				glog.Errorf("%v cannnot find remote bee %v", q, mh.msg.To())
+				mh.msg.receipt.report(Failed, mh.msg.To(), err)
 				return
 			}
 		}
@@ -421,6 +703,26 @@ func (q *qee) handleUnicastMsg(mh msgAndHandler) {
 	b.enqueMsg(mh)
 }
 
+// routeToLeader readdresses mh to the current leader of the colony of its
+// destination, if the colony has a new leader.
+func (q *qee) routeToLeader(mh msgAndHandler) msgAndHandler {
+	info, err := q.hive.registry.bee(mh.msg.To())
+	if err != nil {
+		return mh
+	}
+
+	l := info.Colony.Leader
+	if l == Nil || l == info.ID {
+		return mh
+	}
+
+	glog.V(2).Infof("%v routes %v to the leader of %v", q, mh.msg, info.Colony)
+	// The message may be handled by other apps, so it is copied.
+	m := *mh.msg
+	m.MsgTo = l
+	return msgAndHandler{msg: &m, handler: mh.handler}
+}
+
 func (q *qee) handleLocalBcast(mh msgAndHandler) {
 	glog.V(2).Infof("%v sends a message to all local bees: %v", q, mh.msg)
 
@@ -437,6 +739,32 @@ func (q *qee) handleLocalBcast(mh msgAndHandler) {
 	q.RUnlock()
 }
 
+// beeMsgs groups the messages routed to each bee, so that they are enqueued on
+// the bee at once.
+type beeMsgs struct {
+	bees []*bee
+	msgs map[*bee][]msgAndHandler
+}
+
+func (bm *beeMsgs) add(b *bee, mh msgAndHandler) {
+	if bm.msgs == nil {
+		bm.msgs = make(map[*bee][]msgAndHandler)
+	}
+	if _, ok := bm.msgs[b]; !ok {
+		bm.bees = append(bm.bees, b)
+	}
+	bm.msgs[b] = append(bm.msgs[b], mh)
+}
+
+// enque enqueues the messages on their bees, and resets bm.
+func (bm *beeMsgs) enque() {
+	for _, b := range bm.bees {
+		b.enqueMsgs(bm.msgs[b])
+		delete(bm.msgs, b)
+	}
+	bm.bees = bm.bees[:0]
+}
+
 type placementRes struct {
 	hive   uint64
 	colony Colony
@@ -507,6 +835,8 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 	if res.colony.IsNil() {
 		b, err := q.newLocalBee(true)
 		if err != nil {
+			glog.Errorf("%v cannot create a new bee: %v", q, err)
+			q.retryPending(res.pCells)
 			return err
 		}
 
@@ -515,9 +845,16 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 			App:    q.app.Name(),
 			Cells:  res.pCells.MappedCells(),
 		}
+		lock.Name = q.beeName(lock.Cells)
 
 		lockRes, err := q.hive.node.ProposeRetry(hiveGroup, lock,
 			q.hive.config.RaftElectTimeout(), -1)
+		if err == ErrDuplicateBeeName {
+			q.removeBee(b.ID())
+			b.processCmd(cmdStop{})
+			q.rejectPending(res.pCells, lock.Name, b.ID())
+			return err
+		}
 		if err != nil {
 			return err
 		}
@@ -534,6 +871,7 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 
 		for _, mh := range res.pCells.msgs {
 			b.enqueMsg(mh)
+			q.routed(mh)
 		}
 		return nil
 	}
@@ -551,40 +889,68 @@ func (q *qee) handlePlacementRes(res placementRes) error {
 	q.addBee(b)
 	for _, mh := range res.pCells.msgs {
 		b.enqueMsg(mh)
+		q.routed(mh)
 	}
 	return nil
 }
 
 func (q *qee) handleMsgs(mhs []msgAndHandler) {
 	pendingC := make(map[CellKey]*pendingCells)
+	// The messages queued for the bees that are not created yet.
+	deferred := make(map[*msg]bool)
+	var routed beeMsgs
 
 	for i := range mhs {
 		mh := mhs[i]
 		if mh.msg.IsUnicast() {
+			// The messages routed earlier are enqueued first to keep the order.
+			routed.enque()
 			q.handleUnicastMsg(mh)
 			continue
 		}
 
 		glog.V(2).Infof("%v broadcasts message %v", q, mh.msg)
 
+		if q.isDup(mh) {
+			glog.V(2).Infof("%v drops duplicate message %v", q, mh.msg)
+			mh.msg.receipt.report(Dropped, Nil, nil)
+			continue
+		}
+
+		key, cacheable := q.mapCacheKey(mh)
+		var gen uint64
+		if cacheable {
+			gen = q.hive.registry.colonyGeneration()
+			if e, ok := q.mapCache.get(key, gen); ok {
+				routed.add(e.bee, mh)
+				continue
+			}
+		}
+
 		cells := q.invokeMap(mh)
 		if cells == nil {
 			glog.V(2).Infof("%v drops message %v", q, mh.msg)
+			mh.msg.receipt.report(Dropped, Nil, nil)
 			continue
 		}
 
 		if cells.LocalBroadcast() {
+			routed.enque()
 			q.handleLocalBcast(mh)
 			continue
 		}
 
 		if q.queueIfPending(cells, mh) {
+			deferred[mh.msg] = true
 			continue
 		}
 
 		b, err := q.beeByCells(cells)
 		if err == nil {
-			b.enqueMsg(mh)
+			if cacheable {
+				q.mapCache.put(key, gen, mapCacheEntry{cells: cells, bee: b})
+			}
+			routed.add(b, mh)
 			continue
 		}
 
@@ -607,6 +973,14 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 		}
 
 		bcm.msgs = append(bcm.msgs, mhs[i])
+		deferred[mh.msg] = true
+	}
+
+	routed.enque()
+	for _, mh := range mhs {
+		if !deferred[mh.msg] {
+			q.routed(mh)
+		}
 	}
 
 	if len(pendingC) == 0 {
@@ -640,11 +1014,19 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			// TODO(soheil): this shouldn't be fatal.
 			glog.Fatalf("%v cannot allocate a bee ID %v", q, err)
 		}
+		pc.bee = q.makeLocalBee(pc.beeID, true)
+		if err := pc.bee.initHandlers(); err != nil {
+			glog.Errorf("%v cannot initialize the handlers of a new bee: %v", q,
+				err)
+			q.placeElsewhere(pc)
+			continue
+		}
 		lockBatch.addReq(addBee(q.defaultBeeInfo(pc.beeID, false, true)))
 		lockBatch.addReq(lockMappedCell{
 			Colony: q.defaultColony(pc.beeID),
 			App:    q.app.Name(),
 			Cells:  mapped,
+			Name:   q.beeName(mapped),
 		})
 	}
 
@@ -656,11 +1038,16 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 
 	var wg sync.WaitGroup
 	for i, r := range lockRes.(batchRes) {
+		lock, ok := lockBatch.Reqs[i].(lockMappedCell)
 		if !r.Err.IsNil() {
+			if ok && r.Err.Error() == ErrDuplicateBeeName.Error() {
+				q.rejectPending(pendingC[lock.Cells[0]], lock.Name,
+					lock.Colony.Leader)
+				continue
+			}
 			glog.Fatalf("cannot lock the cells TODO: %v", r.Err)
 		}
 
-		lock, ok := lockBatch.Reqs[i].(lockMappedCell)
 		if !ok {
 			// We can simply ignore add bee requests in the batch.
 			continue
@@ -671,12 +1058,7 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			cells := lock.Cells
 			pc := pendingC[cells[0]]
 			if res.(Colony).Leader == lock.Colony.Leader {
-				if pc.bee == nil {
-					var err error
-					if pc.bee, err = q.newLocalBeeWithID(pc.beeID, true); err != nil {
-						glog.Fatalf("%v cannot create local bee %v", q, err)
-					}
-				}
+				q.startLocalBee(pc.bee)
 				pc.bee.processCmd(cmdAddMappedCells{Cells: cells})
 			} else {
 				// TODO(soheil): maybe, we can find by id.
@@ -689,6 +1071,7 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 			for _, mh := range pc.msgs {
 				glog.V(2).Infof("%v enques message to bee %v: %v", q, pc.bee, mh.msg)
 				pc.bee.enqueMsg(mh)
+				q.routed(mh)
 			}
 			wg.Done()
 		}(r.Res, lock)
@@ -697,6 +1080,61 @@ func (q *qee) handleMsgs(mhs []msgAndHandler) {
 	wg.Wait()
 }
 
+// beeName returns the name of the bee for cells, using the bee ID function of
+// the app. The cells added by the platform are skipped.
+func (q *qee) beeName(cells MappedCells) string {
+	if q.app.beeIDFunc == nil {
+		return ""
+	}
+	for _, k := range cells {
+		switch k.Dict {
+		case affinityDict, stickySplitDict, beeNameDict:
+			continue
+		}
+		return q.app.beeIDFunc(k)
+	}
+	return ""
+}
+
+// rejectPending emits the messages of pc as DeadLetters, because the name of
+// their new bee is taken by another bee. The rejected bee is removed from the
+// registry.
+func (q *qee) rejectPending(pc *pendingCells, name string, bee uint64) {
+	glog.Errorf("%v rejects the bee for %v: name %q is taken", q,
+		pc.MappedCells(), name)
+	for _, mh := range pc.msgs {
+		q.deadLetter(mh, ErrDuplicateBeeName)
+		q.routed(mh)
+	}
+	go q.hive.delBeeFromRegistry(bee)
+}
+
+// placeElsewhere places the bee of pc on another live hive, since the handlers
+// of the app cannot be initialized on this hive. If there is no other live
+// hive, the messages of pc are retried later.
+func (q *qee) placeElsewhere(pc *pendingCells) {
+	for _, h := range q.hive.liveHives() {
+		if h.ID != q.hive.ID() {
+			q.addToPendings(pc)
+			go q.newRemoteBee(pc, h.ID)
+			return
+		}
+	}
+	q.retryPending(pc)
+}
+
+// retryPending enqueues the messages of pc on the qee after initRetry, so that
+// they are mapped and placed again.
+func (q *qee) retryPending(pc *pendingCells) {
+	msgs := pc.msgs
+	go func() {
+		<-q.hive.config.Clock.After(initRetry)
+		for _, mh := range msgs {
+			q.enqueMsg(mh)
+		}
+	}()
+}
+
 func (q *qee) newRemoteBee(pc *pendingCells, hive uint64) {
 	var col Colony
 	cmd := cmd{
@@ -733,6 +1171,10 @@ fallback:
 }
 
 func (q *qee) placeBee(cells MappedCells) (hiveID uint64) {
+	if to := q.hive.drainTarget(); to != Nil {
+		return to
+	}
+
 	if q.app.placement == nil || q.app.placement == PlacementMethod(nil) {
 		return q.hive.ID()
 	}
@@ -743,7 +1185,7 @@ func (q *qee) placeBee(cells MappedCells) (hiveID uint64) {
 		}
 	}()
 
-	h := q.app.placement.Place(cells, q.hive, q.hive.registry.hives())
+	h := q.app.placement.Place(cells, q.hive, q.hive.liveHives())
 	return h.ID
 }
 
@@ -872,20 +1314,38 @@ func (q *qee) defaultLocalBee(id uint64) *bee {
 	} else {
 		outb = bucket.New(q.app.rate.outRate, q.app.rate.outMaxTokens)
 	}
+	inb.SetClock(q.hive.config.Clock.Now)
+	outb.SetClock(q.hive.config.Clock.Now)
 
+	cfg := q.hive.cfg()
 	var batch uint
-	if uint(inb.Max()) < q.hive.config.BatchSize {
+	if uint(inb.Max()) < cfg.BatchSize {
 		batch = uint(inb.Max())
 	} else {
-		batch = q.hive.config.BatchSize
+		batch = cfg.BatchSize
+	}
+
+	var dataCh *msgChannel
+	if q.app.prioritized() {
+		dataCh = newPrioMsgChannel(cfg.BeeQueueCap)
+	} else if q.app.fairQueuing {
+		dataCh = newFairMsgChannel(cfg.BeeQueueCap)
+	} else {
+		dataCh = newMsgChannel(cfg.BeeQueueCap)
+	}
+
+	var outQ *msgChannel
+	if !outb.Unlimited() {
+		outQ = newMsgChannel(uint(cap(q.ctrlCh)))
 	}
 
 	return &bee{
 		qee:       q,
 		beeID:     id,
-		dataCh:    newMsgChannel(q.hive.config.DataChBufSize),
-		outCh:     make(chan []*msg, cap(q.ctrlCh)),
+		dataCh:    dataCh,
+		outQ:      outQ,
 		ctrlCh:    make(chan cmdAndChannel, cap(q.ctrlCh)),
+		done:      make(chan struct{}),
 		hive:      q.hive,
 		app:       q.app,
 		batchSize: batch,
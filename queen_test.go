@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestQueenMultipleKeys(t *testing.T) {
@@ -39,6 +40,199 @@ func TestQueenMultipleKeys(t *testing.T) {
 	}
 }
 
+func TestQueenStickyBy(t *testing.T) {
+	h := newHiveForTest()
+	type rcvd struct {
+		key string
+		bee uint64
+	}
+	ch := make(chan rcvd)
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", msg.Data().(string)}}
+	}
+	rcvf := func(msg Msg, ctx RcvContext) error {
+		ch <- rcvd{key: msg.Data().(string), bee: ctx.ID()}
+		return nil
+	}
+
+	group := func(k CellKey) string { return k.Key[:1] }
+	a := h.NewApp("stickyby", StickyBy(group))
+	a.HandleFunc("", mapf, rcvf)
+
+	keys := []string{"a1", "b1", "a2", "b2", "a3", "b3"}
+	for _, k := range keys {
+		h.Emit(k)
+	}
+
+	go h.Start()
+	defer h.Stop()
+
+	bees := make(map[string]uint64)
+	for range keys {
+		r := <-ch
+		g := group(CellKey{Key: r.key})
+		b, ok := bees[g]
+		if !ok {
+			bees[g] = r.bee
+			continue
+		}
+		if b != r.bee {
+			t.Errorf("invalid bee for %v: actual=%v want=%v", r.key, r.bee, b)
+		}
+	}
+
+	if len(bees) != 2 || bees["a"] == bees["b"] {
+		t.Errorf("invalid bees for groups: actual=%v want=2 distinct bees", bees)
+	}
+}
+
+type stickyTestMsg struct {
+	Op  string // put or get.
+	Key string
+}
+
+type stickyTestRes struct {
+	Bee uint64
+	Val string
+}
+
+func TestQueenSetStickyFalse(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan stickyTestRes)
+	a := h.NewApp("unstick", Sticky(), StickySplit(1000))
+	a.HandleFunc(stickyTestMsg{}, func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(stickyTestMsg).Key}}
+	}, func(m Msg, ctx RcvContext) error {
+		sm := m.Data().(stickyTestMsg)
+		d := ctx.Dict("D")
+		if sm.Op == "put" {
+			d.Put(sm.Key, sm.Key+"!")
+		}
+		v, _ := d.Get(sm.Key)
+		s, _ := v.(string)
+		ch <- stickyTestRes{Bee: ctx.ID(), Val: s}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	keys := []string{"a", "b", "c", "d"}
+	bees := make(map[uint64]bool)
+	for _, k := range keys {
+		h.Emit(stickyTestMsg{Op: "put", Key: k})
+		bees[(<-ch).Bee] = true
+	}
+	if len(bees) != 1 {
+		t.Fatalf("sticky app uses more than one bee: %v", bees)
+	}
+
+	if err := a.SetSticky(false); err != nil {
+		t.Fatalf("cannot distribute the sticky app: %v", err)
+	}
+
+	bees = make(map[uint64]bool)
+	for _, k := range keys {
+		h.Emit(stickyTestMsg{Op: "get", Key: k})
+		r := <-ch
+		if r.Val != k+"!" {
+			t.Errorf("invalid state for %v on %v: actual=%q want=%q", k, r.Bee,
+				r.Val, k+"!")
+		}
+		bees[r.Bee] = true
+	}
+	if len(bees) != len(keys) {
+		t.Errorf("invalid number of bees: actual=%v want=%v", len(bees),
+			len(keys))
+	}
+}
+
+func TestQueenStickySplit(t *testing.T) {
+	c := NewFakeClock(time.Now())
+	h := newHiveForTest(WithClock(c))
+	ch := make(chan stickyTestRes)
+	a := h.NewApp("stickysplit", Sticky(), StickySplit(10))
+	a.HandleFunc(stickyTestMsg{}, func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(stickyTestMsg).Key}}
+	}, func(m Msg, ctx RcvContext) error {
+		sm := m.Data().(stickyTestMsg)
+		d := ctx.Dict("D")
+		if sm.Op == "put" {
+			d.Put(sm.Key, sm.Key+"!")
+		}
+		v, _ := d.Get(sm.Key)
+		s, _ := v.(string)
+		ch <- stickyTestRes{Bee: ctx.ID(), Val: s}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	emit := func(op string) map[uint64]bool {
+		bees := make(map[uint64]bool)
+		for _, k := range keys {
+			h.Emit(stickyTestMsg{Op: op, Key: k})
+			r := <-ch
+			if r.Val != k+"!" {
+				t.Errorf("invalid state for %v on %v: actual=%q want=%q", k, r.Bee,
+					r.Val, k+"!")
+			}
+			bees[r.Bee] = true
+		}
+		return bees
+	}
+	owners := func() map[uint64]bool {
+		bees := make(map[uint64]bool)
+		for _, k := range keys {
+			info, _, err := h.(*hive).registry.beeForCells("stickysplit",
+				MappedCells{{"D", k}})
+			if err == nil {
+				bees[info.ID] = true
+			}
+		}
+		return bees
+	}
+	// advance advances the clock by a split window, and waits until the keys
+	// are owned by n bees.
+	advance := func(n int) {
+		waitForTimers(t, c, 1)
+		c.Advance(stickySplitWindow)
+		for i := 0; len(owners()) != n; i++ {
+			if i == 500 {
+				t.Fatalf("keys are not re-mapped: actual=%v want=%v bees",
+					len(owners()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Below the threshold, all keys are mapped to the same bee.
+	if bees := emit("put"); len(bees) != 1 {
+		t.Fatalf("sticky app is split below the threshold: actual=%v want=1 bee",
+			bees)
+	}
+
+	// Above the threshold, the existing keys are spread among more bees with
+	// their state.
+	advance(2)
+	if bees := emit("get"); len(bees) != 2 {
+		t.Fatalf("invalid bees after the split: actual=%v want=2 bees", bees)
+	}
+	advance(3)
+
+	// Once the rate drops, the keys are consolidated with their state.
+	advance(2)
+	advance(1)
+	if bees := emit("get"); len(bees) != 1 {
+		t.Fatalf("invalid bees after consolidation: actual=%v want=1 bee", bees)
+	}
+}
+
 type qeeBenchHandler struct {
 	last string
 	done chan struct{}
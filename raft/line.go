@@ -54,6 +54,14 @@ func (l *line) call(r Response) {
 	}
 }
 
+// len returns the number of requests waiting for their response.
+func (l *line) len() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.list)
+}
+
 func (l *line) cancel(id RequestID) {
 	l.Lock()
 	defer l.Unlock()
@@ -109,6 +109,7 @@ type group struct {
 	diskStorage  DiskStorage
 	fsyncTime    time.Duration
 	snapCount    uint64
+	catchUp      uint64
 
 	leader    uint64
 	confState raftpb.ConfState
@@ -496,8 +497,8 @@ func (g *group) snapshot() {
 
 		// keep some in memory log entries for slow followers.
 		compacti := uint64(1)
-		if snapi > numberOfCatchUpEntries {
-			compacti = snapi - numberOfCatchUpEntries
+		if snapi > g.catchUp {
+			compacti = snapi - g.catchUp
 		}
 		if err = g.raftStorage.Compact(compacti); err != nil {
 			// the compaction was done asynchronously with the progress of raft.
@@ -558,9 +559,10 @@ type MultiNode struct {
 	pmu           sync.Mutex
 	pendingElects map[uint64][]chan struct{}
 
-	ticker <-chan time.Time
-	stop   chan struct{}
-	done   chan struct{}
+	ticker     <-chan time.Time
+	propWindow time.Duration
+	stop       chan struct{}
+	done       chan struct{}
 }
 
 // Config represents the configuration of a MultiNode.
@@ -569,6 +571,12 @@ type Config struct {
 	Name   string           // Node name.
 	Send   SendFunc         // Network send function.
 	Ticker <-chan time.Time // Ticker of the node.
+	// ProposeWindow is the maximum duration the node waits for the proposals of
+	// other groups after receiving a proposal, so that their entries are
+	// replicated in the same batch (i.e., group commit). The node keeps
+	// handling messages while waiting, and stops waiting early when it is idle
+	// or the batch is full. 0 disables waiting.
+	ProposeWindow time.Duration
 }
 
 // StartMultiNode starts a MultiNode with the given id and name. Send function
@@ -590,6 +598,7 @@ func StartMultiNode(cfg Config) (node *MultiNode) {
 		send:          cfg.Send,
 		pendingElects: make(map[uint64][]chan struct{}),
 		ticker:        cfg.Ticker,
+		propWindow:    cfg.ProposeWindow,
 		stop:          make(chan struct{}),
 		done:          make(chan struct{}),
 	}
@@ -620,7 +629,17 @@ func (n *MultiNode) start() {
 
 	readyc := n.node.Ready()
 	groupc := n.groupc
+	// The group commit window. The proposals received within the window are
+	// held, and stepped at once so that their entries are replicated in the
+	// same batch.
+	var props []multiMessage
+	var windowc <-chan time.Time
 	for {
+		if len(props) != 0 && n.flushWindow(len(props)) {
+			n.stepProposals(props)
+			props, windowc = nil, nil
+		}
+
 		select {
 		case <-n.ticker:
 			n.node.Tick()
@@ -641,20 +660,18 @@ func (n *MultiNode) start() {
 			}
 
 		case mm := <-n.propc:
-			ch := time.After(1 * time.Millisecond)
-			n.node.Step(context.TODO(), mm.group, mm.msg)
-		loopp:
-			for {
-				select {
-				case mm := <-n.propc:
-					n.node.Step(context.TODO(), mm.group, mm.msg)
-				case <-ch:
-					break loopp
-				default:
-					break loopp
-				}
+			props = n.queuedProposals(append(props, mm))
+			if n.propWindow <= 0 {
+				n.stepProposals(props)
+				props = nil
+			} else if windowc == nil {
+				windowc = time.After(n.propWindow)
 			}
 
+		case <-windowc:
+			n.stepProposals(props)
+			props, windowc = nil, nil
+
 		case req := <-groupc:
 			n.handleGroupRequest(req)
 
@@ -674,6 +691,35 @@ func (n *MultiNode) start() {
 	}
 }
 
+// queuedProposals appends the proposals that are already queued to props.
+func (n *MultiNode) queuedProposals(props []multiMessage) []multiMessage {
+	for {
+		select {
+		case mm := <-n.propc:
+			props = append(props, mm)
+		default:
+			return props
+		}
+	}
+}
+
+func (n *MultiNode) stepProposals(props []multiMessage) {
+	for _, mm := range props {
+		n.node.Step(context.TODO(), mm.group, mm.msg)
+	}
+}
+
+// maxGroupCommit is the maximum number of proposals in a group commit window.
+const maxGroupCommit = 256
+
+// flushWindow returns whether the group commit window with held proposals
+// should be closed before it expires: when it is full, or when the node is
+// idle, i.e., no other proposal of the node is in flight or on its way to
+// the window.
+func (n *MultiNode) flushWindow(held int) bool {
+	return held >= maxGroupCommit || n.line.len() <= held
+}
+
 func (n *MultiNode) handleBatch(bt batchTimeout) {
 	ctx, cnl := context.WithTimeout(context.Background(), bt.timeout)
 	for g, msgs := range bt.batch.Messages {
@@ -814,6 +860,7 @@ type GroupConfig struct {
 	HeartbeatTicks int             // Number of ticks to fire heartbeats.
 	MaxInFlights   int             // Maximum number of inflight messages.
 	MaxMsgSize     uint64          // Maximum number of entries in a message.
+	CatchUpEntries uint64          // Entries kept after a snapshot for followers.
 }
 
 func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
@@ -843,6 +890,10 @@ func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
 		// TODO(soheil): Figure this one out:
 		//               Applied: lsi,
 	}
+	catchUp := cfg.CatchUpEntries
+	if catchUp == 0 {
+		catchUp = numberOfCatchUpEntries
+	}
 	g := &group{
 		node:         n,
 		id:           cfg.ID,
@@ -854,6 +905,7 @@ func (n *MultiNode) CreateGroup(ctx context.Context, cfg GroupConfig) error {
 		savec:        make(chan readySaved, 1),
 		fsyncTime:    cfg.FsyncTick,
 		snapCount:    cfg.SnapCount,
+		catchUp:      catchUp,
 		snapped:      snap.Metadata.Index,
 		applied:      snap.Metadata.Index,
 		confState:    snap.Metadata.ConfState,
@@ -0,0 +1,131 @@
+package beehive
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// DeliveryStatus is the outcome of delivering a message emitted with
+// RcvContext.EmitWithReceipt.
+type DeliveryStatus int
+
+// Valid values for DeliveryStatus.
+const (
+	// Delivered means that the message is enqueued on the destination bee, or
+	// is accepted by the hive of the destination bee.
+	Delivered DeliveryStatus = iota
+	// Dropped means that the message is discarded on purpose: its map function
+	// returns no cells, it is a duplicate, the app of its destination is
+	// stopped, or it is a best-effort message that cannot be relayed.
+	Dropped
+	// Failed means that the message cannot be routed to its destination: no
+	// app handles it, or the destination bee does not exist, is unreachable,
+	// or rejects the message.
+	Failed
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case Delivered:
+		return "delivered"
+	case Dropped:
+		return "dropped"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("DeliveryStatus(%d)", int(s))
+}
+
+// DeliveryResult represents the outcome of delivering a message to one of its
+// destinations.
+type DeliveryResult struct {
+	Status DeliveryStatus
+	// Bee is the destination bee. It is Nil if the message is not routed to
+	// any bee.
+	Bee uint64
+	Err error // The error of a failed delivery, if any.
+}
+
+// receipt reports the delivery results of a message to its emitter. Each
+// destination bee is reported at most once, so that redeliveries and retries
+// of the message are not reported again.
+type receipt struct {
+	sync.Mutex
+	f        func(DeliveryResult)
+	reported map[uint64]bool
+}
+
+func newReceipt(f func(DeliveryResult)) *receipt {
+	return &receipt{
+		f:        f,
+		reported: make(map[uint64]bool),
+	}
+}
+
+// report reports the delivery of the message to bee. It is a no-op for
+// messages emitted without a receipt.
+func (r *receipt) report(s DeliveryStatus, bee uint64, err error) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	if r.reported[bee] {
+		r.Unlock()
+		return
+	}
+	r.reported[bee] = true
+	r.Unlock()
+
+	r.f(DeliveryResult{Status: s, Bee: bee, Err: err})
+}
+
+func (b *bee) EmitWithReceipt(msgData interface{},
+	onResult func(DeliveryResult)) {
+
+	m := b.hive.newMsg(msgData, b.ID(), 0)
+	m.receipt = newReceipt(func(r DeliveryResult) {
+		b.runOnBeeAsync(func(ctx RcvContext) { onResult(r) })
+	})
+
+	if b.InTx() {
+		b.OnPostCommit(func() { b.bufferOrEmit(m) })
+		return
+	}
+	b.bufferOrEmit(m)
+}
+
+// runOnBeeAsync runs f in the loop of the bee without waiting for it. Unlike
+// RunOnBee, it can be called from the goroutines that the bee may be waiting
+// on. f is dropped if the bee stops before running it.
+func (b *bee) runOnBeeAsync(f func(ctx RcvContext)) {
+	cc := newCmdAndChannel(cmdRunOnBee{F: f}, b.hive.ID(), b.app.Name(), b.ID(),
+		nil)
+	go b.enqueCmdUnlessDone(cc)
+}
+
+// enqueCmdUnlessDone enqueues cc on the bee, unless the bee stops first. It
+// returns whether cc is enqueued.
+func (b *bee) enqueCmdUnlessDone(cc cmdAndChannel) bool {
+	select {
+	case b.ctrlCh <- cc:
+		return true
+	case <-b.done:
+		glog.V(2).Infof("%v is stopped and drops %v", b, cc)
+		return false
+	}
+}
+
+// reportDelivery reports the result of sending msgs to bee to, as returned by
+// an rpc client.
+func reportDelivery(msgs []msg, to uint64, err error) {
+	s := Delivered
+	if err != nil {
+		s = Failed
+	}
+	for i := range msgs {
+		msgs[i].receipt.report(s, to, err)
+	}
+}
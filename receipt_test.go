@@ -0,0 +1,125 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type receiptTestStart struct{}
+type receiptTestMsg int
+type receiptTestUnhandled int
+
+func TestEmitWithReceipt(t *testing.T) {
+	h := newHiveForTest()
+
+	results := make(chan DeliveryResult, 2)
+	src := h.NewApp("receiptsrc")
+	src.HandleFunc(receiptTestStart{},
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"S", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			c.SetBeeLocal(0)
+			onResult := func(r DeliveryResult) {
+				// The bee-local data is not synchronized, and is only safe to use
+				// in the loop of the bee.
+				c.SetBeeLocal(c.BeeLocal().(int) + 1)
+				results <- r
+			}
+			c.EmitWithReceipt(receiptTestMsg(1), onResult)
+			c.EmitWithReceipt(receiptTestUnhandled(1), onResult)
+			return nil
+		})
+
+	dsts := make(chan uint64, 1)
+	dst := h.NewApp("receiptdst")
+	dst.HandleFunc(receiptTestMsg(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			dsts <- c.ID()
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(receiptTestStart{})
+
+	var delivered, failed *DeliveryResult
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			switch r.Status {
+			case Delivered:
+				delivered = &r
+			case Failed:
+				failed = &r
+			default:
+				t.Errorf("unexpected result: %+v", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no delivery result is received")
+		}
+	}
+
+	if delivered == nil {
+		t.Fatal("the handled message is not reported as delivered")
+	}
+	if bee := <-dsts; delivered.Bee != bee {
+		t.Errorf("invalid destination: actual=%v want=%v", delivered.Bee, bee)
+	}
+	if failed == nil {
+		t.Fatal("the unhandled message is not reported as failed")
+	}
+	if failed.Bee != Nil || !errors.Is(failed.Err, ErrNoHandler) {
+		t.Errorf("invalid failure: %+v", *failed)
+	}
+}
+
+func TestReceiptOnStoppedBee(t *testing.T) {
+	h := newHiveForTest()
+	h.NewApp("receiptstop").HandleFunc(receiptTestMsg(0),
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(receiptTestMsg(0))
+	var b *bee
+	for i := 0; ; i++ {
+		var ok bool
+		if b, ok = localBee(h, "receiptstop"); ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("no bee is created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.processCmd(cmdStop{})
+	b.qee.removeBee(b.ID())
+
+	// The commands to the stopped bee are dropped, instead of blocking on its
+	// control channel once the channel is full.
+	for len(b.ctrlCh) < cap(b.ctrlCh) {
+		b.ctrlCh <- newCmdAndChannel(cmdRunOnBee{}, h.ID(), "receiptstop", b.ID(),
+			nil)
+	}
+	res := make(chan bool, 1)
+	cc := newCmdAndChannel(cmdRunOnBee{}, h.ID(), "receiptstop", b.ID(), nil)
+	go func() { res <- b.enqueCmdUnlessDone(cc) }()
+	select {
+	case ok := <-res:
+		if ok {
+			t.Error("a command is enqueued on a stopped bee")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a command to a stopped bee is blocked")
+	}
+}
@@ -18,8 +18,10 @@ var (
 	ErrInvalidParam       = errors.New("registry: invalid parameter")
 	ErrNoSuchHive         = errors.New("registry: no such hive")
 	ErrDuplicateHive      = errors.New("registry: duplicate hive")
-	ErrNoSuchBee          = errors.New("registry: no such bee")
+	ErrNoSuchBee          = newRoutingError(ErrBeeNotFound, "registry: no such bee")
 	ErrDuplicateBee       = errors.New("registry: duplicate bee")
+	ErrDuplicateBeeName   = errors.New("registry: duplicate bee name")
+	ErrNotLocked          = errors.New("registry: cell is not locked by colony")
 )
 
 // noOp is a barrier: a raft request to make sure all the updates are
@@ -49,6 +51,9 @@ type BeeInfo struct {
 	App      string `json:"app"`
 	Colony   Colony `json:"colony"`
 	Detached bool   `json:"detached"`
+	// Name is the name assigned to the colony of the bee by the app's bee ID
+	// function (see App.SetBeeIDFunc). It is unique in the app.
+	Name string `json:"name,omitempty"`
 }
 
 // addBee is a registery request to add a new bee.
@@ -71,17 +76,29 @@ type updateColony struct {
 	New  Colony
 }
 
-// lockMappedCell locks a mapped cell for a colony.
+// lockMappedCell locks a mapped cell for a colony. If Name is not empty, it is
+// also locked for the colony, and the request fails with ErrDuplicateBeeName if
+// the name belongs to another colony.
 type lockMappedCell struct {
 	Colony Colony
 	App    string
 	Cells  MappedCells
+	Name   string
 }
 
-// transferCells transfers cells of a colony to another colony.
+// unlockMappedCell unlocks mapped cells locked by a colony.
+type unlockMappedCell struct {
+	Colony Colony
+	App    string
+	Cells  MappedCells
+}
+
+// transferCells transfers cells of a colony to another colony. If Cells is
+// empty, all the cells of the colony are transferred.
 type transferCells struct {
-	From Colony
-	To   Colony
+	From  Colony
+	To    Colony
+	Cells MappedCells
 }
 
 // batchReq is a batch of registery requests that should be processed in a
@@ -113,6 +130,11 @@ type registry struct {
 	Hives  map[uint64]HiveInfo
 	Bees   map[uint64]BeeInfo
 	Store  cellStore
+
+	watchers []chan TopologyEvent
+
+	// colonyGen is incremented whenever a colony or its cells change.
+	colonyGen uint64
 }
 
 func newRegistry(name string) *registry {
@@ -137,6 +159,7 @@ func (r *registry) Restore(b []byte) error {
 	r.m.Lock()
 	defer r.m.Unlock()
 	glog.V(2).Info("registry restored")
+	r.colonyGen++
 	return bhgob.Decode(r, b)
 }
 
@@ -150,6 +173,11 @@ func (r *registry) Apply(req interface{}) (interface{}, error) {
 func (r *registry) doApply(req interface{}) (interface{}, error) {
 	glog.V(2).Infof("%v applies: %#v", r, req)
 
+	switch req.(type) {
+	case delBee, moveBee, updateColony, unlockMappedCell, transferCells:
+		r.colonyGen++
+	}
+
 	switch req := req.(type) {
 	case noOp:
 		return nil, nil
@@ -167,6 +195,8 @@ func (r *registry) doApply(req interface{}) (interface{}, error) {
 		return nil, r.updateColony(req)
 	case lockMappedCell:
 		return r.lockCell(req)
+	case unlockMappedCell:
+		return nil, r.unlockCell(req)
 	case transferCells:
 		return nil, r.transfer(req)
 	case batchReq:
@@ -235,7 +265,9 @@ func (r *registry) delHive(id uint64) error {
 	if _, ok := r.Hives[id]; !ok {
 		return fmt.Errorf("no such hive %v", id)
 	}
+	h := r.Hives[id]
 	delete(r.Hives, id)
+	r.notify(TopologyEvent{Type: HiveLeft, Hive: h})
 	return nil
 }
 
@@ -259,6 +291,9 @@ func (r *registry) addHive(info HiveInfo) error {
 				info.Addr, info.ID, h.ID)
 		}
 	}
+	if _, ok := r.Hives[info.ID]; !ok {
+		r.notify(TopologyEvent{Type: HiveJoined, Hive: info})
+	}
 	r.Hives[info.ID] = info
 	return nil
 }
@@ -280,15 +315,18 @@ func (r *registry) addBee(info BeeInfo) error {
 		glog.Fatalf("%v has invalid bee ID: %v < %v", r, info.ID, r.HiveID)
 	}
 	r.Bees[info.ID] = info
+	r.notify(TopologyEvent{Type: BeeAdded, Bee: info})
 	return nil
 }
 
 func (r *registry) delBee(id uint64) error {
 	glog.V(2).Infof("%v removes bee %v", r, id)
-	if _, ok := r.Bees[id]; !ok {
+	b, ok := r.Bees[id]
+	if !ok {
 		return ErrNoSuchBee
 	}
 	delete(r.Bees, id)
+	r.notify(TopologyEvent{Type: BeeRemoved, Bee: b})
 	return nil
 }
 
@@ -308,6 +346,7 @@ func (r *registry) moveBee(m moveBee) error {
 
 	b.Hive = m.ToHive
 	r.Bees[m.ID] = b
+	r.notify(TopologyEvent{Type: BeeMoved, Bee: b})
 	return nil
 }
 
@@ -321,6 +360,8 @@ func (r *registry) updateColony(up updateColony) error {
 	if err := r.Store.updateColony(b.App, up.Old, up.New, up.Term); err != nil {
 		return err
 	}
+	// The name belongs to the colony, and moves to its new leader.
+	name := r.Bees[up.Old.Leader].Name
 
 	if up.Old.Leader != up.New.Leader {
 		b = r.mustFindBee(up.Old.Leader)
@@ -348,7 +389,11 @@ func (r *registry) updateColony(up updateColony) error {
 
 	b = r.mustFindBee(up.New.Leader)
 	b.Colony = up.New
+	if name != "" {
+		b.Name = name
+	}
 	r.Bees[up.New.Leader] = b
+	r.notify(TopologyEvent{Type: ColonyUpdated, Bee: b})
 
 	return nil
 }
@@ -361,11 +406,46 @@ func (r *registry) mustFindBee(id uint64) BeeInfo {
 	return info
 }
 
+// beeNameDict is the pseudo dictionary used to lock the names of bees.
+const beeNameDict = "__bee_name_dict__"
+
 func (r *registry) lockCell(l lockMappedCell) (Colony, error) {
 	if l.Colony.Leader == 0 {
 		return Colony{}, ErrInvalidParam
 	}
 
+	if l.Name == "" {
+		return r.lockCells(l)
+	}
+
+	nk := CellKey{Dict: beeNameDict, Key: l.Name}
+	if c, ok := r.Store.colony(l.App, nk); ok && !r.ownsAny(l.App, l.Cells, c) {
+		return Colony{}, ErrDuplicateBeeName
+	}
+
+	l.Cells = append(MappedCells{nk}, l.Cells...)
+	col, err := r.lockCells(l)
+	if err != nil {
+		return col, err
+	}
+	if b, ok := r.Bees[col.Leader]; ok && b.Name == "" {
+		b.Name = l.Name
+		r.Bees[col.Leader] = b
+	}
+	return col, nil
+}
+
+// ownsAny returns whether any of the cells is locked by col.
+func (r *registry) ownsAny(app string, cells MappedCells, col Colony) bool {
+	for _, k := range cells {
+		if c, ok := r.Store.colony(app, k); ok && c.Equals(col) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *registry) lockCells(l lockMappedCell) (Colony, error) {
 	locked := false
 	openk := make(MappedCells, 0, 10)
 	for _, k := range l.Cells {
@@ -401,11 +481,37 @@ func (r *registry) lockCell(l lockMappedCell) (Colony, error) {
 	return l.Colony, nil
 }
 
+func (r *registry) unlockCell(u unlockMappedCell) error {
+	for _, k := range u.Cells {
+		c, ok := r.Store.colony(u.App, k)
+		if !ok || c.Leader != u.Colony.Leader {
+			return ErrNotLocked
+		}
+	}
+
+	for _, k := range u.Cells {
+		r.Store.unassign(u.App, k, u.Colony)
+	}
+	return nil
+}
+
 func (r *registry) transfer(t transferCells) error {
 	i, ok := r.Bees[t.From.Leader]
 	if !ok {
 		return ErrNoSuchBee
 	}
+	if len(t.Cells) != 0 {
+		for _, k := range t.Cells {
+			if c, ok := r.Store.colony(i.App, k); !ok || c.Leader != t.From.Leader {
+				return ErrNotLocked
+			}
+		}
+		for _, k := range t.Cells {
+			r.Store.unassign(i.App, k, t.From)
+			r.Store.assign(i.App, k, t.To)
+		}
+		return nil
+	}
 	keys := r.Store.cells(t.From.Leader)
 	if len(keys) == 0 {
 		return ErrInvalidParam
@@ -458,6 +564,13 @@ func (r *registry) beesOfHive(id uint64) []BeeInfo {
 	return bees
 }
 
+// cellsOf returns the cells locked by the colony led by bee.
+func (r *registry) cellsOf(bee uint64) MappedCells {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.Store.cells(bee)
+}
+
 func (r *registry) bee(id uint64) (BeeInfo, error) {
 	r.m.RLock()
 	i, ok := r.Bees[id]
@@ -468,6 +581,21 @@ func (r *registry) bee(id uint64) (BeeInfo, error) {
 	return i, nil
 }
 
+// generation returns the generation (i.e., the term) of the colony.
+func (r *registry) generation(colony uint64) uint64 {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.Store.Colonies[colony]
+}
+
+// colonyGeneration returns a counter that is incremented whenever a colony
+// or its cells change.
+func (r *registry) colonyGeneration() uint64 {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.colonyGen
+}
+
 func (r *registry) beeAndHive(id uint64) (BeeInfo, HiveInfo, error) {
 	r.m.RLock()
 	defer r.m.RUnlock()
@@ -487,6 +615,38 @@ func (r *registry) beeAndHive(id uint64) (BeeInfo, HiveInfo, error) {
 	return bi, hi, nil
 }
 
+// lockedByOthers returns whether any of the cells is locked by a colony other
+// than col.
+func (r *registry) lockedByOthers(app string, cells []CellKey,
+	col Colony) bool {
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	for _, k := range cells {
+		if c, ok := r.Store.colony(app, k); ok && c.Leader != col.Leader {
+			return true
+		}
+	}
+	return false
+}
+
+// unownedCells returns the cells that are not locked by col.
+func (r *registry) unownedCells(app string, cells []CellKey,
+	col Colony) []CellKey {
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var unowned []CellKey
+	for _, k := range cells {
+		if c, ok := r.Store.colony(app, k); !ok || c.Leader != col.Leader {
+			unowned = append(unowned, k)
+		}
+	}
+	return unowned
+}
+
 func (r *registry) beeForCells(app string, cells MappedCells) (info BeeInfo,
 	hasAll bool, err error) {
 
@@ -561,5 +721,6 @@ func init() {
 	gob.Register(newHiveID{})
 	gob.Register(noOp{})
 	gob.Register(transferCells{})
+	gob.Register(unlockMappedCell{})
 	gob.Register(updateColony{})
 }
@@ -0,0 +1,150 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+)
+
+// ReadConsistency represents the consistency level of reads from replicas.
+type ReadConsistency int
+
+// Valid values for ReadConsistency.
+const (
+	// ReadEventual reads from any replica of the colony. The value can be
+	// stale.
+	ReadEventual ReadConsistency = iota
+	// ReadFromMaster always reads from the master of the colony.
+	ReadFromMaster
+)
+
+// ReplicaValue is the result of reading a key from a replica.
+type ReplicaValue struct {
+	Value      interface{} // The value of the key.
+	Bee        uint64      // The bee that served the read.
+	Generation uint64      // Number of transactions applied on that bee.
+}
+
+func (b *bee) ReadFromReplica(app string, cell CellKey, dict, key string,
+	rc ReadConsistency) (ReplicaValue, error) {
+
+	a, ok := b.hive.app(app)
+	if !ok {
+		return ReplicaValue{}, fmt.Errorf("no such application %s", app)
+	}
+
+	info, _, err := b.hive.registry.beeForCells(app, MappedCells{cell})
+	if err != nil {
+		return ReplicaValue{}, err
+	}
+
+	col := info.Colony
+	to := col.Leader
+	weights := a.weights()
+	switch {
+	case rc != ReadEventual:
+	case weights != nil:
+		if r, ok := b.weightedReplica(weights, col); ok {
+			to = r
+		}
+	default:
+		if fs := b.syncedFollowers(col); len(fs) != 0 {
+			to = fs[rand.Intn(len(fs))]
+		}
+	}
+
+	if to == b.ID() {
+		return b.readReplica(dict, key)
+	}
+
+	res, err := a.qee.sendCmdToBee(to, cmdReadReplica{Dict: dict, Key: key})
+	if err != nil {
+		return ReplicaValue{}, err
+	}
+	return res.(ReplicaValue), nil
+}
+
+func (b *bee) QueryApp(app string, cell CellKey, dict, key string) (
+	interface{}, error) {
+
+	v, err := b.ReadFromReplica(app, cell, dict, key, ReadFromMaster)
+	if err != nil {
+		return nil, err
+	}
+	return v.Value, nil
+}
+
+// syncedFollowers returns the followers of col that are not lagging behind
+// their leader.
+func (b *bee) syncedFollowers(col Colony) []uint64 {
+	lags := b.hive.followerLags(col)
+	var fs []uint64
+	for _, f := range col.Followers {
+		if lags[f] == 0 {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// weightedReplica picks a replica of col, that is not lagging behind its
+// leader, with a probability proportional to the weight of its hive. It
+// returns false if no replica has a positive weight.
+func (b *bee) weightedReplica(weights map[uint64]int, col Colony) (uint64,
+	bool) {
+
+	lags := b.hive.followerLags(col)
+	var replicas []uint64
+	var ws []int
+	total := 0
+	for _, r := range append([]uint64{col.Leader}, col.Followers...) {
+		if lags[r] != 0 {
+			continue
+		}
+		info, err := b.hive.registry.bee(r)
+		if err != nil {
+			continue
+		}
+		w, ok := weights[info.Hive]
+		if !ok {
+			w = 1
+		}
+		if w <= 0 {
+			continue
+		}
+		replicas = append(replicas, r)
+		ws = append(ws, w)
+		total += w
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	n := b.Rand().Intn(total)
+	for i, w := range ws {
+		if n < w {
+			return replicas[i], true
+		}
+		n -= w
+	}
+	return replicas[len(replicas)-1], true
+}
+
+func (b *bee) readReplica(dict, key string) (ReplicaValue, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	v, err := b.stateL1.Dict(dict).Get(key)
+	if err != nil {
+		return ReplicaValue{}, err
+	}
+	return ReplicaValue{
+		Value:      v,
+		Bee:        b.beeID,
+		Generation: b.txGen,
+	}, nil
+}
+
+func init() {
+	gob.Register(ReplicaValue{})
+}
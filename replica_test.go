@@ -0,0 +1,210 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type replicaTestWrite struct{}
+type replicaTestRead struct{}
+
+type replicaTestResult struct {
+	val ReplicaValue
+	err error
+}
+
+func registerReplicaApp(h Hive, wch chan uint64,
+	rch chan replicaTestResult) App {
+
+	a := h.NewApp("replica", Persistent(3))
+	a.HandleFunc(replicaTestWrite{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		c.Dict("Test").Put("K", "v")
+		wch <- c.ID()
+		return nil
+	})
+	a.HandleFunc(replicaTestRead{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "1"}}
+	}, func(m Msg, c RcvContext) error {
+		v, err := c.ReadFromReplica("replica", CellKey{"D", "0"}, "Test", "K",
+			ReadEventual)
+		rch <- replicaTestResult{val: v, err: err}
+		return nil
+	})
+	return a
+}
+
+func TestReadFromReplica(t *testing.T) {
+	wch := make(chan uint64)
+	rch := make(chan replicaTestResult)
+
+	h1 := newHiveForTest()
+	registerReplicaApp(h1, wch, rch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	for i := 0; i < 2; i++ {
+		h := newHiveForTest(PeerAddrs(h1.Config().Addr))
+		registerReplicaApp(h, wch, rch)
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+	}
+
+	h1.Emit(replicaTestWrite{})
+	master := <-wch
+
+	elect := h1.Config().RaftElectTimeout()
+	for i := 0; i < 10; i++ {
+		h1.Emit(replicaTestRead{})
+		res := <-rch
+		if res.err == nil && res.val.Value == "v" && res.val.Bee != master {
+			if res.val.Generation == 0 {
+				t.Errorf("invalid generation: actual=0 want>0")
+			}
+			return
+		}
+		time.Sleep(elect)
+	}
+	t.Error("cannot read from a non-master replica")
+}
+
+func TestReadFromWeightedReplicas(t *testing.T) {
+	wch := make(chan uint64)
+	rch := make(chan replicaTestResult)
+
+	var hives []Hive
+	var apps []App
+	for i := 0; i < 3; i++ {
+		var opts []HiveOption
+		if i != 0 {
+			opts = append(opts, PeerAddrs(hives[0].Config().Addr))
+		}
+		h := newHiveForTest(opts...)
+		apps = append(apps, registerReplicaApp(h, wch, rch))
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hives = append(hives, h)
+	}
+
+	h1 := hives[0]
+	h1.Emit(replicaTestWrite{})
+	<-wch
+
+	// Wait until both followers have caught up with the leader on h1.
+	elect := h1.Config().RaftElectTimeout()
+	for i := 0; ; i++ {
+		lags := h1.ReplicationLag("replica")
+		caughtUp := len(lags) == 2
+		for _, l := range lags {
+			caughtUp = caughtUp && l == 0
+		}
+		if caughtUp {
+			break
+		}
+		if i == 10 {
+			t.Fatalf("followers have not caught up: %v", lags)
+		}
+		time.Sleep(elect)
+	}
+
+	weights := map[uint64]int{
+		hives[0].ID(): 6,
+		hives[1].ID(): 3,
+		hives[2].ID(): 1,
+	}
+	apps[0].SetReplicaWeights(weights)
+
+	const reads = 300
+	counts := make(map[uint64]int)
+	for i := 0; i < reads; i++ {
+		h1.Emit(replicaTestRead{})
+		res := <-rch
+		if res.err != nil {
+			t.Fatalf("cannot read from a replica: %v", res.err)
+		}
+		info, err := h1.(*hive).registry.bee(res.val.Bee)
+		if err != nil {
+			t.Fatalf("cannot find bee %v: %v", res.val.Bee, err)
+		}
+		counts[info.Hive]++
+	}
+
+	for h, w := range weights {
+		got := float64(counts[h]) / reads
+		want := float64(w) / 10
+		if got < want-0.08 || want+0.08 < got {
+			t.Errorf("invalid read ratio for hive %v: actual=%.2f want=%.2f", h, got,
+				want)
+		}
+	}
+}
+
+type queryTestRoute struct{ Dst, Port string }
+type queryTestLookup string
+
+type queryTestResult struct {
+	val interface{}
+	err error
+}
+
+func registerQueryApps(h Hive, wch chan struct{}, rch chan queryTestResult) {
+	r := h.NewApp("router")
+	r.HandleFunc(queryTestRoute{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"Routes", m.Data().(queryTestRoute).Dst}}
+	}, func(m Msg, c RcvContext) error {
+		route := m.Data().(queryTestRoute)
+		c.Dict("Routes").Put(route.Dst, route.Port)
+		wch <- struct{}{}
+		return nil
+	})
+
+	c := h.NewApp("collector")
+	c.HandleFunc(queryTestLookup(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"Stats", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		dst := string(m.Data().(queryTestLookup))
+		v, err := c.QueryApp("router", CellKey{"Routes", dst}, "Routes", dst)
+		rch <- queryTestResult{val: v, err: err}
+		return nil
+	})
+}
+
+func TestQueryApp(t *testing.T) {
+	wch := make(chan struct{})
+	rch := make(chan queryTestResult)
+
+	h1 := newHiveForTest()
+	registerQueryApps(h1, wch, rch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerQueryApps(h2, wch, rch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// The router's bee of "a" is on h1, and the one of "b" is on h2. The
+	// collector's bee is on h1.
+	h1.Emit(queryTestRoute{Dst: "a", Port: "1"})
+	<-wch
+	h2.Emit(queryTestRoute{Dst: "b", Port: "2"})
+	<-wch
+
+	for dst, want := range map[string]string{"a": "1", "b": "2"} {
+		h1.Emit(queryTestLookup(dst))
+		res := <-rch
+		if res.err != nil {
+			t.Errorf("cannot query the route of %v: %v", dst, res.err)
+			continue
+		}
+		if res.val != want {
+			t.Errorf("invalid route for %v: actual=%v want=%v", dst, res.val, want)
+		}
+	}
+}
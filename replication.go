@@ -22,7 +22,7 @@ func (r *rndRepliction) selectHives(blacklist []uint64, n int) []uint64 {
 		blmap[h] = h
 	}
 
-	lives := r.hive.registry.hives()
+	lives := r.hive.liveHives()
 	whitelist := make([]uint64, 0, len(lives))
 	for _, h := range lives {
 		if h.ID == r.hive.ID() || blmap[h.ID] != 0 {
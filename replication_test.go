@@ -0,0 +1,447 @@
+package beehive
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type replLagTestMsg int
+
+func registerReplLagApp(h Hive, ch chan struct{}) {
+	a := h.NewApp("repllag", Persistent(3))
+	a.HandleFunc(replLagTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		c.Dict("D").Put("0", m.Data())
+		ch <- struct{}{}
+		return nil
+	})
+}
+
+// waitForLag waits until cond holds on the replication lag of the app on h.
+func waitForLag(t *testing.T, h Hive, desc string,
+	cond func(lags map[uint64]uint64) bool) map[uint64]uint64 {
+
+	for i := 0; ; i++ {
+		lags := h.ReplicationLag("repllag")
+		if cond(lags) {
+			return lags
+		}
+		if i == 100 {
+			t.Fatalf("replication lag is not %v: %v", desc, lags)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	ch := make(chan struct{})
+
+	h1 := newHiveForTest()
+	registerReplLagApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerReplLagApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// h3 does not start an election while it is partitioned.
+	h3 := newHiveForTest(PeerAddrs(h1.Config().Addr), RaftElectTicks(1000))
+	registerReplLagApp(h3, ch)
+	go h3.Start()
+	defer h3.Stop()
+	waitTilStareted(h3)
+
+	h1.Emit(replLagTestMsg(0))
+	<-ch
+
+	zero := func(lags map[uint64]uint64) bool {
+		if len(lags) != 2 {
+			return false
+		}
+		for _, l := range lags {
+			if l != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	waitForLag(t, h1, "zero", zero)
+
+	// Delay the follower on h3 by cutting the raft messages from h1 to h3.
+	p := h1.(*hive).client
+	p.setRetry(h3.ID(), &dialTry{next: time.Now().Add(time.Hour), wait: minWait})
+	p.deleteHive(h3.ID())
+
+	for i := 1; i <= 3; i++ {
+		h1.Emit(replLagTestMsg(i))
+		<-ch
+	}
+
+	waitForLag(t, h1, "nonzero", func(lags map[uint64]uint64) bool {
+		for f, l := range lags {
+			if info, err := h1.(*hive).registry.bee(f); err == nil &&
+				info.Hive == h3.ID() {
+
+				return l != 0
+			}
+		}
+		return false
+	})
+
+	p.setRetry(h3.ID(), &dialTry{wait: minWait})
+	waitForLag(t, h1, "zero after catching up", zero)
+}
+
+type snapTestMsg int
+
+func registerSnapApp(h Hive, ch chan struct{}) {
+	a := h.NewApp("snapcatchup", Persistent(3))
+	a.HandleFunc(snapTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		c.Dict("D").Put(fmt.Sprintf("%v", m.Data()), m.Data())
+		ch <- struct{}{}
+		return nil
+	})
+}
+
+// localBee returns the first non-proxy bee of the app on h.
+func localBee(h Hive, app string) (*bee, bool) {
+	a, ok := h.(*hive).app(app)
+	if !ok {
+		return nil, false
+	}
+	q := a.qee
+	q.RLock()
+	defer q.RUnlock()
+	for _, b := range q.bees {
+		if !b.proxy {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	const n = 20
+	ch := make(chan struct{})
+
+	h1 := newHiveForTest(SnapshotThreshold(5))
+	registerSnapApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr), SnapshotThreshold(5))
+	registerSnapApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	for i := 0; i < n; i++ {
+		h1.Emit(snapTestMsg(i))
+		<-ch
+	}
+
+	h3 := newHiveForTest(PeerAddrs(h1.Config().Addr), SnapshotThreshold(5))
+	registerSnapApp(h3, ch)
+	go h3.Start()
+	defer h3.Stop()
+	waitTilStareted(h3)
+
+	// The next transaction recruits a follower on h3.
+	h1.Emit(snapTestMsg(n))
+	<-ch
+
+	for i := 0; ; i++ {
+		if b, ok := localBee(h3, "snapcatchup"); ok {
+			b.Lock()
+			cnt := 0
+			b.stateL1.Dict("D").ForEach(func(k string, v interface{}) bool {
+				cnt++
+				return true
+			})
+			b.Unlock()
+			if cnt == n+1 {
+				if r := atomic.LoadUint64(&b.restores); r == 0 {
+					t.Errorf("the new replica does not restore a snapshot")
+				}
+				return
+			}
+		}
+		if i == 100 {
+			t.Fatal("the new replica does not catch up")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+type replRetryTestMsg int
+
+func registerReplRetryApp(h Hive, ch chan error) {
+	a := h.NewApp("replretry", Persistent(2))
+	a.HandleFunc(replRetryTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		c.Dict("D").Put(fmt.Sprintf("%v", m.Data()), m.Data())
+		ch <- c.CommitTx()
+		return nil
+	})
+}
+
+func TestReplicationRetry(t *testing.T) {
+	ch := make(chan error)
+	opts := []HiveOption{
+		RaftTick(20 * time.Millisecond),
+		ReplicationRetry(3, 100*time.Millisecond),
+	}
+
+	h1 := newHiveForTest(opts...)
+	registerReplRetryApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(append(opts, PeerAddrs(h1.Config().Addr))...)
+	registerReplRetryApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(replRetryTestMsg(0))
+	if err := <-ch; err != nil {
+		t.Fatalf("cannot commit the first tx: %v", err)
+	}
+
+	// Cut the raft messages from h1 to the follower on h2, so that the first
+	// attempt times out, and heal the connection before the second one does.
+	timeout := 10 * h1.Config().RaftElectTimeout()
+	p := h1.(*hive).client
+	p.setRetry(h2.ID(), &dialTry{next: time.Now().Add(time.Hour), wait: minWait})
+	p.deleteHive(h2.ID())
+	go func() {
+		time.Sleep(timeout + timeout/2)
+		p.setRetry(h2.ID(), &dialTry{wait: minWait})
+	}()
+
+	h1.Emit(replRetryTestMsg(1))
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Errorf("cannot commit the tx after a retry: %v", err)
+		}
+	case <-time.After(4 * timeout):
+		t.Fatal("the tx is not committed")
+	}
+}
+
+type fenceTestMsg int
+
+func registerFenceApp(h Hive, ch chan error) {
+	a := h.NewApp("fence", Persistent(2))
+	a.HandleFunc(fenceTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		c.Dict("D").Put(fmt.Sprintf("%v", m.Data()), m.Data())
+		ch <- c.CommitTx()
+		return nil
+	})
+}
+
+func TestGenerationFencing(t *testing.T) {
+	ch := make(chan error)
+
+	h1 := newHiveForTest()
+	registerFenceApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerFenceApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(fenceTestMsg(0))
+	if err := <-ch; err != nil {
+		t.Fatalf("cannot commit the first tx: %v", err)
+	}
+
+	b, ok := localBee(h1, "fence")
+	if !ok {
+		t.Fatal("cannot find the bee")
+	}
+	oldc := b.colony()
+	if len(oldc.Followers) == 0 {
+		t.Fatalf("the colony has no followers: %v", oldc)
+	}
+
+	// Advance the generation of the colony as if its follower took over.
+	newc := oldc.DeepCopy()
+	newc.Leader = oldc.Followers[0]
+	newc.DelFollower(newc.Leader)
+	newc.AddFollower(oldc.Leader)
+	up := updateColony{
+		Term: b.term() + 1,
+		Old:  oldc,
+		New:  newc,
+	}
+	_, err := h1.(*hive).node.ProposeRetry(hiveGroup, up,
+		h1.Config().RaftElectTimeout(), 10)
+	if err != nil {
+		t.Fatalf("cannot update the colony: %v", err)
+	}
+
+	// Deliver a message directly to the stale leader.
+	a, _ := h1.(*hive).app("fence")
+	b.enqueMsg(msgAndHandler{
+		msg:     &msg{MsgData: fenceTestMsg(1), MsgTo: b.ID()},
+		handler: a.handler(MsgType(fenceTestMsg(0))),
+	})
+	if err := <-ch; err != ErrOldTx {
+		t.Errorf("invalid error for a stale commit: actual=%v want=%v", err,
+			ErrOldTx)
+	}
+
+	if c := b.colony(); c.Leader == b.ID() {
+		t.Errorf("the stale leader did not step down: %v", c)
+	}
+	b.Lock()
+	_, err = b.stateL1.Dict("D").Get("1")
+	b.Unlock()
+	if err == nil {
+		t.Error("the stale transaction is committed")
+	}
+}
+
+func TestColonyGeneration(t *testing.T) {
+	ch := make(chan error)
+
+	h1 := newHiveForTest()
+	registerFenceApp(h1, ch)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerFenceApp(h2, ch)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	h1.Emit(fenceTestMsg(0))
+	if err := <-ch; err != nil {
+		t.Fatalf("cannot commit the first tx: %v", err)
+	}
+
+	b, ok := localBee(h1, "fence")
+	if !ok {
+		t.Fatal("cannot find the bee")
+	}
+	oldc := b.Colony()
+	if oldc.Leader != b.ID() || len(oldc.Followers) == 0 {
+		t.Fatalf("invalid colony: %v", oldc)
+	}
+	gen := b.Generation()
+
+	// Fail over the colony to its follower.
+	newc := oldc.DeepCopy()
+	newc.Leader = oldc.Followers[0]
+	newc.DelFollower(newc.Leader)
+	newc.AddFollower(oldc.Leader)
+	up := updateColony{
+		Term: gen + 1,
+		Old:  oldc,
+		New:  newc,
+	}
+	_, err := h1.(*hive).node.ProposeRetry(hiveGroup, up,
+		h1.Config().RaftElectTimeout(), 10)
+	if err != nil {
+		t.Fatalf("cannot update the colony: %v", err)
+	}
+
+	if g := b.Generation(); g != gen+1 {
+		t.Errorf("invalid generation after failover: actual=%v want=%v", g,
+			gen+1)
+	}
+}
+
+type groupCommitTestMsg int
+
+func registerGroupCommitApp(h Hive, ch chan error) {
+	a := h.NewApp("groupcommit", Persistent(3))
+	a.HandleFunc(groupCommitTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", fmt.Sprintf("%v", m.Data())}}
+	}, func(m Msg, c RcvContext) error {
+		i := int(m.Data().(groupCommitTestMsg))
+		c.Dict("D").Put(fmt.Sprintf("%v", i), i)
+		if i%2 == 0 {
+			ch <- c.CommitTx()
+		} else {
+			ch <- c.AbortTx()
+		}
+		return nil
+	})
+}
+
+func TestGroupCommit(t *testing.T) {
+	const n = 8
+	ch := make(chan error, n)
+
+	var hs []Hive
+	for i := 0; i < 3; i++ {
+		opts := []HiveOption{GroupCommitWindow(50 * time.Millisecond)}
+		if i != 0 {
+			opts = append(opts, PeerAddrs(hs[0].Config().Addr))
+		}
+		h := newHiveForTest(opts...)
+		registerGroupCommitApp(h, ch)
+		go h.Start()
+		defer h.Stop()
+		waitTilStareted(h)
+		hs = append(hs, h)
+	}
+
+	// The transactions of the bees are replicated to the other hives.
+	for i := 0; i < n; i++ {
+		hs[0].Emit(groupCommitTestMsg(i))
+	}
+	for i := 0; i < n; i++ {
+		if err := <-ch; err != nil {
+			t.Errorf("cannot commit or abort the tx: %v", err)
+		}
+	}
+
+	committed := make(map[string]bool)
+	a, _ := hs[0].(*hive).app("groupcommit")
+	q := a.qee
+	q.RLock()
+	for _, b := range q.bees {
+		if b.proxy || b.colony().Leader != b.ID() {
+			continue
+		}
+		b.Lock()
+		b.stateL1.Dict("D").ForEach(func(k string, v interface{}) bool {
+			committed[k] = true
+			return true
+		})
+		b.Unlock()
+	}
+	q.RUnlock()
+
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%v", i)
+		if committed[k] != (i%2 == 0) {
+			t.Errorf("invalid state of tx %v: committed=%v want=%v", i, committed[k],
+				i%2 == 0)
+		}
+	}
+}
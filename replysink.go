@@ -0,0 +1,111 @@
+package beehive
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrReplyTimeout is returned by Hive.EmitAndWait when no reply is received
+// before the timeout.
+var ErrReplyTimeout = errors.New("no reply received before the timeout")
+
+// replySink is a detached handler that receives the replies to the messages
+// emitted by Hive.EmitAndWait. Messages are emitted with a fresh trace ID that
+// is carried by the replies sent while handling them, and replies are matched
+// with their waiters by that trace ID.
+type replySink struct {
+	sync.Mutex
+	id      uint64 // the ID of the sink bee.
+	started chan struct{}
+	waits   map[uint64]chan Msg
+}
+
+func newReplySink(a App) *replySink {
+	s := &replySink{
+		started: make(chan struct{}),
+		waits:   make(map[uint64]chan Msg),
+	}
+	a.Detached(s)
+	return s
+}
+
+// Start is to implement DetachedHandler.
+func (s *replySink) Start(ctx RcvContext) {
+	s.Lock()
+	s.id = ctx.ID()
+	s.Unlock()
+	close(s.started)
+}
+
+// Stop is to implement DetachedHandler.
+func (s *replySink) Stop(ctx RcvContext) {}
+
+// Rcv is to implement DetachedHandler. Only the first reply to each message is
+// delivered, and the rest are dropped.
+func (s *replySink) Rcv(m Msg, ctx RcvContext) error {
+	s.Lock()
+	ch, ok := s.waits[m.TraceID()]
+	delete(s.waits, m.TraceID())
+	s.Unlock()
+	if ok {
+		ch <- m
+	}
+	return nil
+}
+
+// wait registers a one-shot waiter and returns the ID of the sink bee and the
+// trace ID of the message to emit.
+func (s *replySink) wait(ch chan Msg) (bee uint64, trace uint64) {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		trace = uint64(rand.Int63())
+		if _, ok := s.waits[trace]; !ok && trace != 0 {
+			break
+		}
+	}
+	s.waits[trace] = ch
+	return s.id, trace
+}
+
+func (s *replySink) cancel(trace uint64) {
+	s.Lock()
+	delete(s.waits, trace)
+	s.Unlock()
+}
+
+func (h *hive) EmitAndWait(msgData interface{}, timeout time.Duration) (Msg,
+	error) {
+
+	t := h.config.Clock.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-h.replyS.started:
+	case <-t.C():
+		return nil, ErrReplyTimeout
+	}
+
+	ch := make(chan Msg, 1)
+	from, trace := h.replyS.wait(ch)
+	m := &msg{
+		MsgData:  msgData,
+		MsgFrom:  from,
+		MsgTrace: trace,
+		MsgTime:  h.config.Clock.Now(),
+	}
+	h.localCopy(m)
+	h.enqueMsg(m)
+
+	select {
+	case r := <-ch:
+		return r, nil
+	case <-t.C():
+		h.replyS.cancel(trace)
+		return nil, ErrReplyTimeout
+	}
+}
+
+var _ DetachedHandler = &replySink{}
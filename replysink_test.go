@@ -0,0 +1,41 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type emitAndWaitTestMsg string
+
+func TestEmitAndWait(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("emitandwait")
+	a.HandleFunc(emitAndWaitTestMsg(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		d := m.Data().(emitAndWaitTestMsg)
+		if d == "noreply" {
+			return nil
+		}
+		return c.Reply(m, d+"!")
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for _, d := range []emitAndWaitTestMsg{"a", "b"} {
+		r, err := h.EmitAndWait(d, 5*time.Second)
+		if err != nil {
+			t.Fatalf("cannot receive the reply to %v: %v", d, err)
+		}
+		if r.Data() != d+"!" {
+			t.Errorf("invalid reply: actual=%v want=%v", r.Data(), d+"!")
+		}
+	}
+
+	_, err := h.EmitAndWait(emitAndWaitTestMsg("noreply"), 100*time.Millisecond)
+	if err != ErrReplyTimeout {
+		t.Errorf("invalid error without a reply: actual=%v want=%v", err,
+			ErrReplyTimeout)
+	}
+}
@@ -0,0 +1,94 @@
+package beehive
+
+import (
+	"encoding/gob"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// BackoffFunc returns the delay before the n-th redelivery of a message, where
+// n starts from 1.
+type BackoffFunc func(n int) time.Duration
+
+// ConstantBackoff returns a BackoffFunc that always waits for d.
+func ConstantBackoff(d time.Duration) BackoffFunc {
+	return func(n int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff returns a BackoffFunc that waits for d before the first
+// redelivery, and doubles the delay after each redelivery.
+func ExponentialBackoff(d time.Duration) BackoffFunc {
+	return func(n int) time.Duration {
+		return d << uint(n-1)
+	}
+}
+
+// DeadLetter is emitted when a message is dropped because the handler of an
+// app has failed on the message and all its redeliveries (see App.SetRetry),
+// or because the message is rejected by the validator of the app (see
+// App.SetValidator).
+type DeadLetter struct {
+	App     string      // the app whose handler failed.
+	Data    interface{} // the data of the dropped message.
+	Retries int         // the number of redeliveries.
+	Err     string      // the last error of the handler.
+}
+
+// retry redelivers mh to the bee after the backoff of the app, or emits a
+// DeadLetter if mh is already redelivered as many times as the app allows.
+func (b *bee) retry(mh msgAndHandler, err error) {
+	max, backoff := b.app.retryMax, b.app.retryBackoff
+	if max <= 0 {
+		return
+	}
+
+	if mh.msg.retries >= max {
+		glog.Errorf("%v drops %v after %v retries: %v", b, mh.msg, max, err)
+		b.deadLetter(mh, err)
+		return
+	}
+
+	// The message may be handled by other apps, so it is copied.
+	m := *mh.msg
+	m.retries++
+	var d time.Duration
+	if backoff != nil {
+		d = backoff(m.retries)
+	}
+	glog.V(2).Infof("%v retries %v in %v", b, mh.msg, d)
+	b.snooze(msgAndHandler{msg: &m, handler: mh.handler}, d)
+}
+
+// deadLetter emits a DeadLetter for mh, unless mh is a DeadLetter itself.
+func (b *bee) deadLetter(mh msgAndHandler, err error) {
+	if _, ok := mh.msg.Data().(DeadLetter); ok {
+		return
+	}
+	b.hive.enqueMsg(b.hive.newMsg(DeadLetter{
+		App:     b.app.Name(),
+		Data:    mh.msg.Data(),
+		Retries: mh.msg.retries,
+		Err:     err.Error(),
+	}, b.ID(), 0))
+}
+
+// deadLetter emits a DeadLetter for mh, which is dropped before reaching a bee.
+func (q *qee) deadLetter(mh msgAndHandler, err error) {
+	mh.msg.receipt.report(Failed, Nil, err)
+	if _, ok := mh.msg.Data().(DeadLetter); ok {
+		return
+	}
+	q.hive.enqueMsg(q.hive.newMsg(DeadLetter{
+		App:     q.app.Name(),
+		Data:    mh.msg.Data(),
+		Retries: mh.msg.retries,
+		Err:     err.Error(),
+	}, Nil, 0))
+}
+
+func init() {
+	gob.Register(DeadLetter{})
+}
@@ -0,0 +1,68 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type retryTestMsg string
+
+func TestRetry(t *testing.T) {
+	calls := make(chan int, 10)
+	dead := make(chan DeadLetter, 10)
+	h := newHiveForTest()
+	a := h.NewApp("retry")
+	a.SetRetry(3, ConstantBackoff(10*time.Millisecond))
+	tries := make(map[retryTestMsg]int)
+	a.HandleFunc(retryTestMsg(""), func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		d := m.Data().(retryTestMsg)
+		tries[d]++
+		if d == "ok" {
+			calls <- tries[d]
+		}
+		if d == "fail" || tries[d] <= 2 {
+			return errors.New("not ready")
+		}
+		return nil
+	})
+	h.NewApp("deadletter").HandleFunc(DeadLetter{},
+		func(m Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, ctx RcvContext) error {
+			dead <- m.Data().(DeadLetter)
+			return nil
+		})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(retryTestMsg("ok"))
+	for i := 1; i <= 3; i++ {
+		select {
+		case n := <-calls:
+			if n != i {
+				t.Errorf("invalid invocation: actual=%v want=%v", n, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the message is not redelivered for the %v-th time", i)
+		}
+	}
+	select {
+	case n := <-calls:
+		t.Errorf("the message is redelivered after success: %v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	h.Emit(retryTestMsg("fail"))
+	select {
+	case d := <-dead:
+		if d.App != "retry" || d.Data != retryTestMsg("fail") || d.Retries != 3 {
+			t.Errorf("invalid dead letter: %#v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter for a failing message")
+	}
+}
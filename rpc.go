@@ -1,9 +1,17 @@
 package beehive
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/rpc"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,6 +34,10 @@ type HiveState struct {
 	Peers []HiveInfo `json:"peers"` // Peers of the hive.
 }
 
+// ErrMsgTooLarge is returned when the encoded messages are larger than the
+// maximum message size of the hive (see MaxMsgSize).
+var ErrMsgTooLarge = errors.New("message is larger than the maximum size")
+
 type rpcBackoffError struct {
 	Until time.Time
 }
@@ -34,6 +46,12 @@ func (e *rpcBackoffError) Error() string {
 	return fmt.Sprintf("rpc-client: backoff until %v", e.Until)
 }
 
+func (e *rpcBackoffError) Category() error { return ErrHiveUnreachable }
+
+func (e *rpcBackoffError) Is(target error) bool {
+	return target == e.Category()
+}
+
 func (e *rpcBackoffError) Temporary() bool { return true }
 func (e *rpcBackoffError) Timeout() bool   { return true }
 
@@ -84,6 +102,7 @@ func (p *rpcClientPool) stop() {
 	for _, client := range p.hiveClients {
 		client.stop()
 	}
+	p.hive.conns.closeOutgoing()
 }
 
 func (p *rpcClientPool) shouldReset(err error) bool {
@@ -109,6 +128,7 @@ func (p *rpcClientPool) sendRaft(batch *raft.Batch, r raft.Reporter) error {
 	if err = client.sendRaft(batch, r); p.shouldReset(err) {
 		p.resetHiveClient(batch.To, client)
 	}
+	client.recordErr(err)
 	return err
 }
 
@@ -129,7 +149,11 @@ func (p *rpcClientPool) sendMsg(msgs []msg) (err error) {
 			continue
 		}
 
-		if berr = client.sendMsg(bmsgs); p.shouldReset(berr) {
+		berr = client.sendMsg(bmsgs)
+		client.recordErr(berr)
+		if isNack(berr) {
+			err = berr
+		} else if p.shouldReset(berr) {
 			p.resetBeeClient(b, client)
 			err = berr
 		}
@@ -147,6 +171,7 @@ func (p *rpcClientPool) sendCmd(cmd cmd) (res interface{}, err error) {
 	if res, err = client.sendCmd(cmd); p.shouldReset(err) {
 		p.resetHiveClient(cmd.Hive, client)
 	}
+	client.recordErr(err)
 	return
 }
 
@@ -204,6 +229,9 @@ func (p *rpcClientPool) resetHiveClient(hive uint64, prev *rpcClient) (
 	}
 
 	p.deleteHive(hive)
+	if prev != nil && prev.stat != nil {
+		prev.stat.setState(ConnReconnecting)
+	}
 	if client, err = p.newClient(hive); err != nil {
 		return
 	}
@@ -224,7 +252,7 @@ func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
 		return client, nil
 	}
 
-	now := time.Now()
+	now := p.hive.config.Clock.Now()
 	if !now.After(t.next) {
 		return nil, &rpcBackoffError{Until: t.next}
 	}
@@ -234,7 +262,21 @@ func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
 		return nil, err
 	}
 
-	if client, err = newRPCClient(i.Addr); err != nil {
+	cfg := p.hive.cfg()
+	st := p.hive.conns.outgoing(hive, i.Addr)
+	var dl dialer = cfg.dialer()
+	if cfg.WriteTimeout > 0 {
+		dl = deadlineDialer{dialer: dl, write: cfg.WriteTimeout}
+	}
+	d := countingDialer{dialer: dl, stat: st}
+	if p.hive.config.MuxConns {
+		client, err = newMuxRPCClient(i.Addr, d)
+	} else {
+		client, err = newRPCClient(i.Addr, d)
+	}
+	if err != nil {
+		st.setState(ConnReconnecting)
+		st.setErr(err)
 		// contention here.
 		t.tries++
 		t.wait *= 2
@@ -246,6 +288,11 @@ func (p *rpcClientPool) newClient(hive uint64) (client *rpcClient, err error) {
 		return nil, err
 	}
 
+	client.stat = st
+	st.setState(ConnConnected)
+	client.negotiateCompression(cfg.CompressThreshold)
+	client.maxSize = cfg.MaxMsgSize
+
 	t.wait = 1 * time.Second
 	t.next = now
 	p.setRetry(hive, t)
@@ -280,51 +327,198 @@ type rpcClient struct {
 	msg  *rpc.Client
 	raft *rpc.Client
 	prio *rpc.Client
+
+	conns int       // the number of connections to the hive.
+	stat  *connStat // the statistics of the connections. nil if not counted.
+
+	// compress is the minimum size of message batches that are compressed. 0
+	// means the connection is not compressed.
+	compress uint64
+	// maxSize is the maximum size of message batches. 0 means no limit.
+	maxSize uint64
 }
 
 func (c rpcClient) String() string {
 	return fmt.Sprintf("rpc client to %s", c.addr)
 }
 
-func newRPCClient(addr string) (client *rpcClient, err error) {
+func newRPCClient(addr string, d dialer) (client *rpcClient,
+	err error) {
+
 	client = &rpcClient{
 		addr: addr,
 	}
+	network, addr := splitAddr(addr)
 
-	cmdConn, err := net.DialTimeout("tcp", addr, maxWait)
+	cmdConn, err := d.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 	client.cmd = rpc.NewClient(cmdConn)
+	client.conns++
 
-	raftConn, err := net.DialTimeout("tcp", addr, maxWait)
+	raftConn, err := d.Dial(network, addr)
 	if err != nil {
 		client.raft = client.cmd
 	} else {
 		client.raft = rpc.NewClient(raftConn)
+		client.conns++
 	}
 
-	prioConn, err := net.DialTimeout("tcp", addr, maxWait)
+	prioConn, err := d.Dial(network, addr)
 	if err != nil {
 		client.prio = client.raft
 	} else {
 		client.prio = rpc.NewClient(prioConn)
+		client.conns++
 	}
 
-	msgConn, err := net.DialTimeout("tcp", addr, maxWait)
+	msgConn, err := d.Dial(network, addr)
 	if err != nil {
 		client.msg = client.cmd
 	} else {
 		client.msg = rpc.NewClient(msgConn)
+		client.conns++
 	}
 
 	return client, nil
 }
 
+// newMuxRPCClient creates an rpc client that multiplexes all its rpcs on a
+// single connection. Messages carry their destination bee, and concurrent
+// calls are matched with their responses by the rpc client.
+func newMuxRPCClient(addr string, d dialer) (client *rpcClient,
+	err error) {
+
+	network, a := splitAddr(addr)
+	conn, err := d.Dial(network, a)
+	if err != nil {
+		return nil, err
+	}
+
+	c := rpc.NewClient(conn)
+	return &rpcClient{
+		addr:  addr,
+		cmd:   c,
+		msg:   c,
+		raft:  c,
+		prio:  c,
+		conns: 1,
+	}, nil
+}
+
+// gzipCompression is the name of the gzip compression algorithm, announced by
+// rpc servers.
+const gzipCompression = "gzip"
+
+// negotiateCompression enables compression for batches larger than threshold
+// if the server supports gzip. Servers that do not support compression return
+// an error and the connection remains uncompressed.
+func (c *rpcClient) negotiateCompression(threshold uint64) {
+	if threshold == 0 {
+		return
+	}
+
+	var algs []string
+	if err := c.cmd.Call("rpcServer.Compressions", struct{}{}, &algs); err != nil {
+		glog.V(2).Infof("%v cannot negotiate compression: %v", c, err)
+		return
+	}
+	for _, a := range algs {
+		if a == gzipCompression {
+			c.compress = threshold
+			return
+		}
+	}
+}
+
 func (c *rpcClient) sendMsg(msgs []msg) error {
 	var f struct{}
 	glog.V(3).Infof("%v sends %v messages", c, len(msgs))
-	return c.msg.Call("rpcServer.EnqueMsg", msgs, &f)
+	z, ok, err := c.encodeMsgs(msgs)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = c.msg.Call("rpcServer.EnqueCompressedMsg", z, &f)
+	} else {
+		err = c.msg.Call("rpcServer.EnqueMsg", msgs, &f)
+	}
+	if t, ok := unregisteredType(err); ok {
+		glog.Errorf("%v cannot send messages: type %v is not registered on both "+
+			"hives (see Hive.RegisterMsgs)", c, t)
+	}
+	if err == nil && c.stat != nil {
+		c.stat.addMsgsSent(len(msgs))
+	}
+	return err
+}
+
+// recordErr records err as the last error of the connections of the client.
+func (c *rpcClient) recordErr(err error) {
+	if err != nil && c.stat != nil {
+		c.stat.setErr(err)
+	}
+}
+
+// encodeMsgs encodes msgs if compression or the maximum message size is
+// enabled. It returns ErrMsgTooLarge if the encoded messages are larger than
+// the maximum message size, and returns the compressed messages if they are
+// larger than the compression threshold.
+func (c *rpcClient) encodeMsgs(msgs []msg) (z []byte, compressed bool,
+	err error) {
+
+	if c.compress == 0 && c.maxSize == 0 {
+		return nil, false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msgs); err != nil {
+		// Let the rpc client report the error.
+		return nil, false, nil
+	}
+	if c.maxSize != 0 && uint64(buf.Len()) > c.maxSize {
+		return nil, false, ErrMsgTooLarge
+	}
+	if c.compress == 0 || uint64(buf.Len()) < c.compress {
+		return nil, false, nil
+	}
+
+	var zbuf bytes.Buffer
+	w := gzip.NewWriter(&zbuf)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, false, nil
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, nil
+	}
+	glog.V(3).Infof("%v compresses %v bytes to %v", c, buf.Len(), zbuf.Len())
+	return zbuf.Bytes(), true, nil
+}
+
+// nackPrefix prefixes the errors returned for messages that are rejected by
+// the receiving hive. Rejected messages must not be retried.
+const nackPrefix = "beehive: nack: "
+
+// isNack returns whether err is a negative acknowledgement of the receiving
+// hive.
+func isNack(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), nackPrefix)
+}
+
+// unregisteredType returns the name of the type that gob could not encode or
+// decode because it was not registered.
+func unregisteredType(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	const notReg = "not registered for interface: "
+	s := err.Error()
+	i := strings.Index(s, notReg)
+	if i < 0 {
+		return "", false
+	}
+	return strings.Trim(s[i+len(notReg):], "\""), true
 }
 
 func (c *rpcClient) sendCmd(cm cmd) (res interface{}, err error) {
@@ -381,8 +575,16 @@ func (c *rpcClient) hiveState() (state HiveState, err error) {
 	return
 }
 
-func getHiveState(addr string) (state HiveState, err error) {
-	client, err := newRPCClient(addr)
+// gossip sends the hives known to this hive, and returns the call that
+// receives the hives known to the server.
+func (c *rpcClient) gossip(hives []HiveInfo) chan *rpc.Call {
+	var reply []HiveInfo
+	done := make(chan *rpc.Call, 1)
+	return c.cmd.Go("rpcServer.Gossip", hives, &reply, done).Done
+}
+
+func getHiveState(addr string, d *net.Dialer) (state HiveState, err error) {
+	client, err := newRPCClient(addr, d)
 	if err != nil {
 		return
 	}
@@ -398,12 +600,14 @@ func (c *rpcClient) stop() {
 }
 
 type rpcServer struct {
-	h *hive
+	h    *hive
+	stat *connStat // the statistics of the connection served by the server.
 }
 
-func newRPCServer(h *hive) *rpcServer {
+func newRPCServer(h *hive, stat *connStat) *rpcServer {
 	return &rpcServer{
-		h: h,
+		h:    h,
+		stat: stat,
 	}
 }
 
@@ -416,6 +620,13 @@ func (s *rpcServer) HiveState(dummy struct{}, state *HiveState) error {
 	return nil
 }
 
+// Gossip merges the hives known to another hive with the members of this
+// hive, and replies with the hives known to this hive.
+func (s *rpcServer) Gossip(hives []HiveInfo, reply *[]HiveInfo) error {
+	*reply = s.h.members.gossiped(hives)
+	return nil
+}
+
 func (s *rpcServer) ProcessCmd(cmds []cmd, res *[]cmdResult) error {
 	if len(cmds) == 0 {
 		return nil
@@ -495,6 +706,7 @@ func (s *rpcServer) ProcessRaft(batch raft.Batch, dummy *bool) (err error) {
 	}
 
 	glog.V(3).Infof("%v handles a batch from %v", s.h, batch.From)
+	s.stat.setHive(batch.From)
 	ctx, cnl := context.WithTimeout(context.Background(),
 		s.h.config.RaftHBTimeout())
 	err = s.h.node.StepBatch(ctx, batch, 2*s.h.config.RaftHBTimeout())
@@ -502,9 +714,209 @@ func (s *rpcServer) ProcessRaft(batch raft.Batch, dummy *bool) (err error) {
 	return
 }
 
+// EnqueMsg enqueues the messages received from another hive. Messages that
+// cannot be handled on this hive are rejected, and a NACK error is returned to
+// the sender. If the hive is overloaded, all the messages are rejected and the
+// sender retries them later.
 func (s *rpcServer) EnqueMsg(msgs []msg, dummy *struct{}) error {
+	s.stat.addMsgsRcvd(len(msgs))
+	if len(msgs) != 0 && msgs[0].From() != Nil && !s.stat.knowsHive() {
+		if b, err := s.h.bee(msgs[0].From()); err == nil {
+			s.stat.setHive(b.Hive)
+		}
+	}
+
+	if s.h.overloaded() {
+		glog.Warningf("%v rejects %v messages: overloaded", s.h, len(msgs))
+		return errors.New(overloadedNack)
+	}
+
+	var nacks []string
 	for i := range msgs {
+		if r := s.h.rejectReason(&msgs[i]); r != "" {
+			glog.Errorf("%v rejects %v: %v", s.h, &msgs[i], r)
+			nacks = append(nacks, r)
+			continue
+		}
 		s.h.enqueMsg(&msgs[i])
 	}
+	if len(nacks) != 0 {
+		return errors.New(nackPrefix + strings.Join(nacks, "; "))
+	}
+	return nil
+}
+
+// Compressions returns the compression algorithms supported by this server.
+func (s *rpcServer) Compressions(dummy struct{}, algs *[]string) error {
+	*algs = []string{gzipCompression}
+	return nil
+}
+
+// EnqueCompressedMsg decompresses a batch of messages compressed by
+// rpcClient.encodeMsgs and enqueues them. The batch is rejected if it is
+// larger than the maximum message size of the hive once decompressed.
+func (s *rpcServer) EnqueCompressedMsg(z []byte, dummy *struct{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var dr io.Reader = r
+	if max := s.h.cfg().MaxMsgSize; max != 0 {
+		// Read one more byte than the limit to detect larger batches.
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+		if err != nil {
+			return err
+		}
+		if uint64(len(b)) > max {
+			glog.Errorf("%v rejects a compressed batch larger than %v bytes", s.h,
+				max)
+			return errors.New(nackPrefix + ErrMsgTooLarge.Error())
+		}
+		dr = bytes.NewReader(b)
+	}
+
+	var msgs []msg
+	if err := gob.NewDecoder(dr).Decode(&msgs); err != nil {
+		return err
+	}
+	return s.EnqueMsg(msgs, dummy)
+}
+
+// maxSizeConn wraps a connection that carries a gob stream, and rejects the
+// gob messages that are larger than max. gob prefixes each message with its
+// length, which is checked before the message is read from the connection.
+type maxSizeConn struct {
+	net.Conn
+	r      *bufio.Reader
+	max    uint64
+	prefix []byte // the length prefix of the current message not yet read.
+	left   uint64 // the bytes of the current message not yet read.
+	err    error  // the error of reading the last length prefix.
+}
+
+func newMaxSizeConn(conn net.Conn, max uint64) *maxSizeConn {
+	return &maxSizeConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+		max:  max,
+	}
+}
+
+func (c *maxSizeConn) Read(p []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if len(c.prefix) == 0 && c.left == 0 {
+		if c.err = c.readPrefix(); c.err != nil {
+			return 0, c.err
+		}
+	}
+
+	if len(c.prefix) != 0 {
+		n = copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+
+	if uint64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err = c.r.Read(p)
+	c.left -= uint64(n)
+	return n, err
+}
+
+// readPrefix reads the length prefix of the next gob message, and returns
+// ErrMsgTooLarge if the message is larger than max.
+func (c *maxSizeConn) readPrefix() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	c.prefix = []byte{b}
+	if b < 0x80 {
+		c.left = uint64(b)
+	} else {
+		// Larger lengths are encoded as the negated byte count followed by the
+		// big-endian bytes of the length.
+		l := -int(int8(b))
+		if l > 8 {
+			return errors.New("rpc-server: invalid message length")
+		}
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return err
+		}
+		c.prefix = append(c.prefix, buf...)
+		c.left = 0
+		for _, b := range buf {
+			c.left = c.left<<8 | uint64(b)
+		}
+	}
+
+	if c.left > c.max {
+		glog.Errorf("rpc-server: %v sent a message of %v bytes larger than %v",
+			c.RemoteAddr(), c.left, c.max)
+		return ErrMsgTooLarge
+	}
 	return nil
 }
+
+// deadlineConn sets a deadline before each read and write on a connection. A
+// read deadline bounds the time waiting for the peer, and is refreshed on each
+// read. A connection whose write times out is closed, since the stream may be
+// left with a partial message.
+type deadlineConn struct {
+	net.Conn
+	read  time.Duration // 0 means no read deadline.
+	write time.Duration // 0 means no write deadline.
+}
+
+func newDeadlineConn(conn net.Conn, read, write time.Duration) *deadlineConn {
+	return &deadlineConn{
+		Conn:  conn,
+		read:  read,
+		write: write,
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (n int, err error) {
+	if c.read > 0 {
+		if err = c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (n int, err error) {
+	if c.write > 0 {
+		if err = c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	n, err = c.Conn.Write(p)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		glog.Errorf("rpc: write to %v timed out", c.RemoteAddr())
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// deadlineDialer dials connections with write deadlines.
+type deadlineDialer struct {
+	dialer
+	write time.Duration
+}
+
+func (d deadlineDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newDeadlineConn(conn, 0, d.write), nil
+}
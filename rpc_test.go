@@ -0,0 +1,373 @@
+package beehive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRPCClientDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	cfg := hiveConfig(DialTimeout(time.Second), KeepAlive(time.Second))
+	d := cfg.dialer()
+	if d.KeepAlive != time.Second {
+		t.Errorf("invalid keep-alive: actual=%v want=%v", d.KeepAlive, time.Second)
+	}
+	c, err := newRPCClient(l.Addr().String(), d)
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	c.stop()
+
+	// A timeout shorter than any handshake makes the dial give up, as it would
+	// for a black-holed peer.
+	cfg = hiveConfig(DialTimeout(time.Nanosecond))
+	start := time.Now()
+	_, err = newRPCClient(l.Addr().String(), cfg.dialer())
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("invalid dial error: actual=%v want=timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial did not time out: actual=%v want<=%v", elapsed, time.Second)
+	}
+}
+
+type nackTestMsg struct{}
+type nackTestUnhandled struct{}
+
+func TestRPCServerNackUnhandled(t *testing.T) {
+	h := newHiveForTest()
+	h.RegisterMsg(nackTestUnhandled{})
+	ch := make(chan uint64)
+	h.NewApp("nack").HandleFunc(nackTestMsg{},
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			ch <- c.ID()
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(nackTestMsg{})
+	id := <-ch
+
+	c, err := newRPCClient(h.Config().Addr, h.Config().dialer())
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer c.stop()
+
+	err = c.sendMsg([]msg{{MsgData: nackTestUnhandled{}, MsgTo: id}})
+	if !isNack(err) {
+		t.Fatalf("invalid error for an unhandled message: actual=%v want=nack",
+			err)
+	}
+	want := "no handler for type " + MsgType(nackTestUnhandled{}) + " on app nack"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("invalid nack reason: actual=%v want=%v", err, want)
+	}
+
+	if err := c.sendMsg([]msg{{MsgData: nackTestMsg{}, MsgTo: id}}); err != nil {
+		t.Errorf("invalid error for a handled message: actual=%v want=nil", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Error("handled message is not delivered")
+	}
+}
+
+type compressTestMsg struct {
+	Data string
+}
+
+func TestRPCClientCompression(t *testing.T) {
+	h := newHiveForTest(CompressThreshold(1024))
+	ch := make(chan compressTestMsg)
+	ids := make(chan uint64, 1)
+	h.NewApp("compress").HandleFunc(compressTestMsg{},
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			select {
+			case ids <- c.ID():
+			default:
+			}
+			ch <- m.Data().(compressTestMsg)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(compressTestMsg{})
+	<-ch
+	id := <-ids
+
+	c, err := newRPCClient(h.Config().Addr, h.Config().dialer())
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer c.stop()
+
+	c.negotiateCompression(h.Config().CompressThreshold)
+	if c.compress != 1024 {
+		t.Fatalf("compression is not negotiated: actual=%v want=1024", c.compress)
+	}
+
+	large := compressTestMsg{Data: strings.Repeat("beehive", 1024)}
+	small := compressTestMsg{Data: "beehive"}
+	for _, m := range []compressTestMsg{large, small} {
+		msgs := []msg{{MsgData: m, MsgTo: id}}
+		if _, ok, _ := c.encodeMsgs(msgs); ok != (m == large) {
+			t.Errorf("invalid compression for %v bytes: actual=%v want=%v",
+				len(m.Data), ok, m == large)
+		}
+		if err := c.sendMsg(msgs); err != nil {
+			t.Fatalf("cannot send message: %v", err)
+		}
+		select {
+		case r := <-ch:
+			if r != m {
+				t.Errorf("invalid message of %v bytes: actual=%v bytes", len(m.Data),
+					len(r.Data))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message of %v bytes is not delivered", len(m.Data))
+		}
+	}
+}
+
+func TestRPCMaxMsgSize(t *testing.T) {
+	h := newHiveForTest(MaxMsgSize(1024))
+	ch := make(chan compressTestMsg, 1)
+	ids := make(chan uint64, 1)
+	h.NewApp("maxsize").HandleFunc(compressTestMsg{},
+		func(m Msg, c MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(m Msg, c RcvContext) error {
+			select {
+			case ids <- c.ID():
+			default:
+			}
+			ch <- m.Data().(compressTestMsg)
+			return nil
+		})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(compressTestMsg{})
+	<-ch
+	id := <-ids
+
+	c, err := newRPCClient(h.Config().Addr, h.Config().dialer())
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	defer c.stop()
+
+	large := []msg{{
+		MsgData: compressTestMsg{Data: strings.Repeat("beehive", 1024)},
+		MsgTo:   id,
+	}}
+	c.maxSize = h.Config().MaxMsgSize
+	if err := c.sendMsg(large); err != ErrMsgTooLarge {
+		t.Errorf("invalid error for a large message: actual=%v want=%v", err,
+			ErrMsgTooLarge)
+	}
+
+	// The hive must reject the message even if the client does not check its
+	// size.
+	c.maxSize = 0
+	if err := c.sendMsg(large); err == nil {
+		t.Errorf("the hive accepted a message larger than %v bytes",
+			h.Config().MaxMsgSize)
+	}
+	select {
+	case m := <-ch:
+		t.Errorf("the hive delivered a message of %v bytes", len(m.Data))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRPCMaxMsgSizeCompressed(t *testing.T) {
+	h := newHiveForTest(MaxMsgSize(1024))
+
+	// The batch is compressed to fewer bytes than the limit, but is larger than
+	// the limit once decompressed.
+	msgs := []msg{{
+		MsgData: compressTestMsg{Data: strings.Repeat("b", 256*1024)},
+	}}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(w).Encode(msgs); err != nil {
+		t.Fatalf("cannot encode messages: %v", err)
+	}
+	w.Close()
+	if buf.Len() >= 1024 {
+		t.Fatalf("the batch is not compressed enough: actual=%v want<1024",
+			buf.Len())
+	}
+
+	s := newRPCServer(h.(*hive), nil)
+	err := s.EnqueCompressedMsg(buf.Bytes(), nil)
+	if !isNack(err) || !strings.Contains(err.Error(), ErrMsgTooLarge.Error()) {
+		t.Errorf("invalid error for a large compressed batch: actual=%v want=%v",
+			err, ErrMsgTooLarge)
+	}
+}
+
+func TestMaxSizeConnRejectsBeforeRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newMaxSizeConn(server, 1024)
+	defer conn.Close()
+
+	// The length prefix of a 1GB gob message, without the message itself.
+	go client.Write([]byte{0xFC, 0x40, 0x00, 0x00, 0x00})
+
+	buf := make([]byte, 16)
+	if _, err := conn.Read(buf); err != ErrMsgTooLarge {
+		t.Errorf("invalid error for a large message: actual=%v want=%v", err,
+			ErrMsgTooLarge)
+	}
+}
+
+type muxTestMsg struct {
+	Key string
+}
+
+func TestRPCMuxConns(t *testing.T) {
+	type rcv struct {
+		Hive uint64
+		Bee  uint64
+	}
+	ch := make(chan rcv, 16)
+	register := func(h Hive) {
+		h.NewApp("mux").HandleFunc(muxTestMsg{},
+			func(m Msg, c MapContext) MappedCells {
+				return MappedCells{{"D", m.Data().(muxTestMsg).Key}}
+			}, func(m Msg, c RcvContext) error {
+				ch <- rcv{Hive: c.Hive().ID(), Bee: c.ID()}
+				return nil
+			})
+	}
+
+	h1 := newHiveForTest()
+	register(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr), MuxConns(true))
+	register(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	keys := []string{"a", "b", "c", "d"}
+	bees := make(map[uint64]bool)
+	for _, k := range keys {
+		h1.Emit(muxTestMsg{Key: k})
+		bees[(<-ch).Bee] = true
+	}
+	if len(bees) != len(keys) {
+		t.Fatalf("invalid number of bees: actual=%v want=%v", len(bees), len(keys))
+	}
+
+	// h2 sends the messages of all keys to the bees on h1.
+	for i := 0; i < 2; i++ {
+		for _, k := range keys {
+			h2.Emit(muxTestMsg{Key: k})
+			select {
+			case r := <-ch:
+				if r.Hive != h1.ID() || !bees[r.Bee] {
+					t.Errorf("message received by an invalid bee: actual=%+v", r)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message for %v is not received", k)
+			}
+		}
+	}
+
+	// The connections are counted on h1, as accepted by its listener. Incoming
+	// connections that are not identified yet are counted as well.
+	conns := 0
+	for _, s := range h1.ConnStats() {
+		if !s.Outgoing && (s.Hive == h2.ID() || s.Hive == Nil) {
+			conns++
+		}
+	}
+	if conns != 1 {
+		t.Errorf("invalid number of connections accepted from %v: actual=%v "+
+			"want=1", h2, conns)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	h := newHiveForTest(ReadTimeout(200 * time.Millisecond))
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	network, addr := splitAddr(h.Config().Addr)
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send the length prefix of a gob message, and stop sending.
+	if _, err := conn.Write([]byte{0x05}); err != nil {
+		t.Fatal(err)
+	}
+
+	incoming := func() bool {
+		for _, s := range h.ConnStats() {
+			if !s.Outgoing && s.Addr == conn.LocalAddr().String() {
+				return true
+			}
+		}
+		return false
+	}
+	start := time.Now()
+	for !incoming() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the connection is not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for incoming() {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the idle connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the connection is not closed by the hive: %v", err)
+	}
+}
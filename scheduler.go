@@ -0,0 +1,95 @@
+package beehive
+
+import (
+	"runtime"
+	"sync"
+)
+
+// scheduler runs the message handlers of the bees of an app on a bounded set
+// of worker goroutines. Bees with the same shard index share a worker, which
+// trades parallelism for cache locality.
+type scheduler struct {
+	sync.Mutex
+	shard   func(bee uint64) int
+	pin     bool
+	workers map[int]*worker
+	bees    int        // the number of running bees that use the workers.
+	exited  *sync.Cond // signaled when a bee exits.
+}
+
+func newScheduler(shard func(bee uint64) int, pin bool) *scheduler {
+	s := &scheduler{
+		shard:   shard,
+		pin:     pin,
+		workers: make(map[int]*worker),
+	}
+	s.exited = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// worker returns the worker of bee, and starts the worker if it is not
+// already running. The bee must call release when it exits.
+func (s *scheduler) worker(bee uint64) *worker {
+	i := s.shard(bee)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.bees++
+	w, ok := s.workers[i]
+	if !ok {
+		w = &worker{ch: make(chan func())}
+		go w.run(s.pin)
+		s.workers[i] = w
+	}
+	return w
+}
+
+// release is called when a bee that has acquired a worker exits.
+func (s *scheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.bees--
+	s.exited.Broadcast()
+}
+
+// stop stops all the workers, once every bee using them has exited. Workers
+// are restarted on the next call to worker.
+func (s *scheduler) stop() {
+	s.Lock()
+	defer s.Unlock()
+
+	for s.bees > 0 {
+		s.exited.Wait()
+	}
+	for i, w := range s.workers {
+		close(w.ch)
+		delete(s.workers, i)
+	}
+}
+
+type worker struct {
+	ch chan func()
+}
+
+func (w *worker) run(pin bool) {
+	if pin {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	for f := range w.ch {
+		f()
+	}
+}
+
+// do runs f on the worker and waits until f returns.
+func (w *worker) do(f func()) {
+	done := make(chan struct{})
+	w.ch <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
@@ -0,0 +1,109 @@
+package beehive
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// goroutineID returns the ID of the current goroutine.
+func goroutineID() uint64 {
+	b := make([]byte, 64)
+	b = b[:runtime.Stack(b, false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	b = b[:bytes.IndexByte(b, ' ')]
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+type schedTestMsg int
+
+func TestSchedulerHint(t *testing.T) {
+	const n = 8
+	type result struct {
+		Bee       uint64
+		Goroutine uint64
+	}
+	ch := make(chan result, n)
+
+	h := newHiveForTest()
+	a := h.NewApp("sched", PinWorkers())
+	shard := func(bee uint64) int { return int(bee % 2) }
+	a.SetSchedulerHint(shard)
+	a.HandleFunc(schedTestMsg(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", fmt.Sprintf("%v", msg.Data())}}
+	}, func(msg Msg, ctx RcvContext) error {
+		ch <- result{Bee: ctx.ID(), Goroutine: goroutineID()}
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 0; i < n; i++ {
+		h.Emit(schedTestMsg(i))
+	}
+
+	bees := make(map[uint64]bool)
+	workers := make(map[int]uint64)
+	for i := 0; i < n; i++ {
+		var r result
+		select {
+		case r = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v messages: want=%v", i, n)
+		}
+		bees[r.Bee] = true
+		s := shard(r.Bee)
+		w, ok := workers[s]
+		if !ok {
+			workers[s] = r.Goroutine
+			continue
+		}
+		if w != r.Goroutine {
+			t.Errorf("bee %v is not serviced by the worker of shard %v: actual=%v "+
+				"want=%v", r.Bee, s, r.Goroutine, w)
+		}
+	}
+
+	if len(bees) != n {
+		t.Errorf("invalid number of bees: actual=%v want=%v", len(bees), n)
+	}
+	if len(workers) == 2 && workers[0] == workers[1] {
+		t.Errorf("shards are serviced by the same worker: %v", workers[0])
+	}
+}
+
+func TestSchedulerStopWaitsForBees(t *testing.T) {
+	s := newScheduler(func(bee uint64) int { return 0 }, false)
+	w := s.worker(1)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("the scheduler stopped before the bee exited")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	done := false
+	w.do(func() { done = true })
+	if !done {
+		t.Error("the worker did not run the function")
+	}
+
+	s.release()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scheduler did not stop after the bee exited")
+	}
+}
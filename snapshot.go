@@ -0,0 +1,135 @@
+package beehive
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	bhgob "github.com/kandoo/beehive/gob"
+)
+
+// appSnapshotVersion is the version of the app snapshot format. It must be
+// incremented whenever appSnapshot or beeSnapshot change.
+const appSnapshotVersion = 1
+
+// ErrAppStarted is returned when an app is restored after it is started.
+var ErrAppStarted = errors.New("app is already started")
+
+// appSnapshot is the serialized form of an app's state.
+type appSnapshot struct {
+	Version int
+	App     string
+	Bees    []beeSnapshot
+}
+
+// beeSnapshot is the state of a bee along with the cells it owns.
+type beeSnapshot struct {
+	Cells MappedCells
+	State []byte
+}
+
+func (a *app) Snapshot() ([]byte, error) {
+	s := appSnapshot{
+		Version: appSnapshotVersion,
+		App:     a.Name(),
+	}
+
+	a.qee.RLock()
+	bees := make([]*bee, 0, len(a.qee.bees))
+	for _, b := range a.qee.bees {
+		if b.detached || b.proxy || !b.isLeader() {
+			continue
+		}
+		bees = append(bees, b)
+	}
+	a.qee.RUnlock()
+
+	for _, b := range bees {
+		res, err := b.processCmd(cmdSnapshot{})
+		if err != nil {
+			return nil, err
+		}
+		s.Bees = append(s.Bees, res.(beeSnapshot))
+	}
+	return bhgob.Encode(s)
+}
+
+func (a *app) Restore(b []byte) error {
+	if a.qee.isStarted() {
+		return ErrAppStarted
+	}
+
+	var s appSnapshot
+	if err := bhgob.Decode(&s, b); err != nil {
+		return err
+	}
+	if s.Version != appSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %v (want %v)", s.Version,
+			appSnapshotVersion)
+	}
+
+	a.qee.snapshot = &s
+	return nil
+}
+
+func (b *bee) snapshot() (beeSnapshot, error) {
+	b.Lock()
+	s, err := b.stateL1.Save()
+	b.Unlock()
+	if err != nil {
+		return beeSnapshot{}, err
+	}
+	return beeSnapshot{
+		Cells: b.mappedCells(),
+		State: s,
+	}, nil
+}
+
+// restoreSnapshot creates a local bee for each bee in the snapshot of the app,
+// locks the cells of that bee, and restores its state.
+func (q *qee) restoreSnapshot() {
+	s := q.snapshot
+	q.snapshot = nil
+	for _, bs := range s.Bees {
+		if len(bs.Cells) == 0 {
+			continue
+		}
+
+		id, err := q.newBeeID()
+		if err != nil {
+			glog.Errorf("%v cannot allocate a bee ID: %v", q, err)
+			return
+		}
+
+		var batch batchReq
+		batch.addReq(addBee(q.defaultBeeInfo(id, false, true)))
+		batch.addReq(lockMappedCell{
+			Colony: q.defaultColony(id),
+			App:    q.app.Name(),
+			Cells:  bs.Cells,
+		})
+		res, err := q.hive.node.ProposeRetry(hiveGroup, batch,
+			2*q.hive.config.RaftElectTimeout(), -1)
+		if err != nil {
+			glog.Errorf("%v cannot lock cells %v: %v", q, bs.Cells, err)
+			continue
+		}
+		lres := res.(batchRes)[1]
+		if !lres.Err.IsNil() || lres.Res.(Colony).Leader != id {
+			glog.Errorf("%v cannot restore %v: cells are owned by another bee", q,
+				bs.Cells)
+			go q.hive.delBeeFromRegistry(id)
+			continue
+		}
+
+		b, err := q.newLocalBeeWithID(id, true)
+		if err != nil {
+			glog.Errorf("%v cannot create bee: %v", q, err)
+			continue
+		}
+		b.processCmd(cmdAddMappedCells{Cells: bs.Cells})
+		if _, err := b.processCmd(cmdRestoreState{State: bs.State}); err != nil {
+			glog.Errorf("%v cannot restore the state of %v: %v", q, b, err)
+		}
+	}
+}
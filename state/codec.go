@@ -0,0 +1,157 @@
+package state
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Codec encodes and decodes the values of a dictionary.
+type Codec interface {
+	Encode(val interface{}) ([]byte, error)
+	Decode(b []byte) (interface{}, error)
+}
+
+// GobCodec encodes values using gob. The types of the values must be
+// registered using gob.Register.
+type GobCodec struct{}
+
+func (c GobCodec) Encode(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&val); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GobCodec) Decode(b []byte) (interface{}, error) {
+	var val interface{}
+	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// Migration upgrades a decoded value to the next schema version.
+type Migration func(val interface{}) (interface{}, error)
+
+// Migrations maps a schema version to the migration that upgrades the values
+// of that version to the next version.
+type Migrations map[int]Migration
+
+// ErrNoMigration is returned when a value cannot be upgraded to the current
+// schema version of its dictionary.
+var ErrNoMigration = errors.New("state: no migration for the value")
+
+// Encoded is a value encoded by a codec, stored along with its schema version.
+type Encoded struct {
+	Version int
+	Data    []byte
+}
+
+// WithCodec wraps d and stores its values encoded by c with the given schema
+// version. Values of older versions are upgraded on read using migrations.
+// Values that are not stored using a codec are returned as is.
+func WithCodec(d Dict, c Codec, version int, migrations Migrations) Dict {
+	return &CodecDict{
+		Dict:       d,
+		Codec:      c,
+		Version:    version,
+		Migrations: migrations,
+	}
+}
+
+// CodecDict implements the Dict interface, and wraps any dictionary to store
+// its values encoded with a codec.
+type CodecDict struct {
+	Dict       Dict
+	Codec      Codec
+	Version    int
+	Migrations Migrations
+}
+
+func (d *CodecDict) Name() string {
+	return d.Dict.Name()
+}
+
+func (d *CodecDict) Put(k string, v interface{}) error {
+	b, err := d.Codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return d.Dict.Put(k, Encoded{Version: d.Version, Data: b})
+}
+
+func (d *CodecDict) Get(k string) (interface{}, error) {
+	v, err := d.Dict.Get(k)
+	if err != nil {
+		return v, err
+	}
+	return d.decode(v)
+}
+
+func (d *CodecDict) Del(k string) error {
+	return d.Dict.Del(k)
+}
+
+func (d *CodecDict) SetMaxEntries(n int, p EvictionPolicy) {
+	d.Dict.SetMaxEntries(n, p)
+}
+
+func (d *CodecDict) maxEntries() (int, EvictionPolicy, int) {
+	return maxEntries(d.Dict)
+}
+
+func (d *CodecDict) forEachLRU(f func(k string) bool) {
+	forEachLRU(d.Dict, f)
+}
+
+func (d *CodecDict) has(k string) bool {
+	return has(d.Dict, k)
+}
+
+func (d *CodecDict) ForEach(f IterFn) {
+	d.Dict.ForEach(func(k string, v interface{}) (next bool) {
+		dv, err := d.decode(v)
+		if err != nil {
+			glog.Errorf("cannot decode %v in %v: %v", k, d.Name(), err)
+			return true
+		}
+		return f(k, dv)
+	})
+}
+
+func (d *CodecDict) decode(v interface{}) (interface{}, error) {
+	e, ok := v.(Encoded)
+	if !ok {
+		return v, nil
+	}
+
+	if d.Version < e.Version {
+		return nil, fmt.Errorf("state: value has a newer version %v > %v",
+			e.Version, d.Version)
+	}
+
+	dv, err := d.Codec.Decode(e.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	for ver := e.Version; ver < d.Version; ver++ {
+		m, ok := d.Migrations[ver]
+		if !ok {
+			return nil, ErrNoMigration
+		}
+		if dv, err = m(dv); err != nil {
+			return nil, err
+		}
+	}
+	return dv, nil
+}
+
+func init() {
+	gob.Register(Encoded{})
+}
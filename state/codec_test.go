@@ -0,0 +1,59 @@
+package state
+
+import (
+	"encoding/gob"
+	"testing"
+)
+
+type codecTestV1 struct {
+	Name string
+}
+
+type codecTestV2 struct {
+	First string
+	Last  string
+}
+
+func init() {
+	gob.Register(codecTestV1{})
+	gob.Register(codecTestV2{})
+}
+
+func TestCodecMigration(t *testing.T) {
+	s := NewInMem()
+	d1 := WithCodec(s.Dict("d"), GobCodec{}, 1, nil)
+	if err := d1.Put("k", codecTestV1{Name: "John Doe"}); err != nil {
+		t.Fatalf("cannot put v1: %v", err)
+	}
+
+	// Upgrade the dictionary through a snapshot, as in a rolling upgrade.
+	b, err := s.Save()
+	if err != nil {
+		t.Fatalf("cannot save the state: %v", err)
+	}
+	s = NewInMem()
+	if err := s.Restore(b); err != nil {
+		t.Fatalf("cannot restore the state: %v", err)
+	}
+
+	d2 := WithCodec(s.Dict("d"), GobCodec{}, 2, Migrations{
+		1: func(v interface{}) (interface{}, error) {
+			v1 := v.(codecTestV1)
+			return codecTestV2{First: v1.Name[:4], Last: v1.Name[5:]}, nil
+		},
+	})
+	v, err := d2.Get("k")
+	if err != nil {
+		t.Fatalf("cannot get v2: %v", err)
+	}
+	want := codecTestV2{First: "John", Last: "Doe"}
+	if v != want {
+		t.Errorf("invalid migrated value: actual=%#v want=%#v", v, want)
+	}
+
+	d3 := WithCodec(s.Dict("d"), GobCodec{}, 3, nil)
+	if _, err := d3.Get("k"); err != ErrNoMigration {
+		t.Errorf("invalid error for a missing migration: actual=%v want=%v", err,
+			ErrNoMigration)
+	}
+}
@@ -18,4 +18,62 @@ type Dict interface {
 	// ForEach iterates over all entries in the dictionary, and invokes f for
 	// each entry.
 	ForEach(f IterFn)
+	// SetMaxEntries limits the number of entries in the dictionary to n, and
+	// sets the policy applied when a new key is put in a full dictionary. n <= 0
+	// removes the limit. In a transaction, the limit is set when the transaction
+	// commits, and is part of the operations of the transaction (see SetLimit).
+	SetMaxEntries(n int, p EvictionPolicy)
+}
+
+// EvictionPolicy is the policy of a dictionary when a new key is put while the
+// dictionary has its maximum number of entries.
+type EvictionPolicy int
+
+// Valid values for EvictionPolicy.
+const (
+	// EvictLRU evicts the least recently accessed entry. In a transaction, the
+	// eviction is recorded as a delete in the transaction, and the entry is
+	// evicted when the transaction commits.
+	EvictLRU EvictionPolicy = iota
+	// RejectNew rejects the new key and returns ErrDictFull from Put.
+	RejectNew
+)
+
+// limitedDict is implemented by the dictionaries that enforce SetMaxEntries.
+type limitedDict interface {
+	// maxEntries returns the limit and the policy of the dictionary, and its
+	// number of entries.
+	maxEntries() (n int, p EvictionPolicy, size int)
+	// forEachLRU calls f for the keys of the dictionary from the least recently
+	// accessed one, until f returns false.
+	forEachLRU(f func(k string) bool)
+	// has returns whether the dictionary has k. Unlike Get, it does not mark k
+	// as accessed, nor records k as read in a transaction.
+	has(k string) bool
+}
+
+// maxEntries returns the limit, the policy, and the number of entries of d. The
+// limit is 0 if d does not enforce limits.
+func maxEntries(d Dict) (n int, p EvictionPolicy, size int) {
+	if l, ok := d.(limitedDict); ok {
+		return l.maxEntries()
+	}
+	return 0, EvictLRU, 0
+}
+
+// has returns whether d has k, without accessing k if d enforces limits.
+func has(d Dict, k string) bool {
+	if l, ok := d.(limitedDict); ok {
+		return l.has(k)
+	}
+	_, err := d.Get(k)
+	return err == nil
+}
+
+// forEachLRU calls f for the keys of d from the least recently accessed one,
+// until f returns false. It does nothing if d does not enforce limits.
+func forEachLRU(d Dict, f func(k string) bool) {
+	if l, ok := d.(limitedDict); ok {
+		l.forEachLRU(f)
+	}
 }
@@ -2,6 +2,7 @@ package state
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/gob"
 )
 
@@ -57,8 +58,16 @@ func (s *InMem) inMemDict(name string) *inMemDict {
 }
 
 type inMemDict struct {
-	DictName string
-	Dict     map[string]interface{}
+	DictName   string
+	Dict       map[string]interface{}
+	MaxEntries int
+	Policy     EvictionPolicy
+
+	// The keys in the order of their last access, the most recent at the front.
+	// It is only maintained for EvictLRU, and is rebuilt in an arbitrary order
+	// after the dictionary is restored.
+	lru   *list.List
+	elems map[string]*list.Element
 }
 
 func (d inMemDict) Name() string {
@@ -70,11 +79,19 @@ func (d *inMemDict) Get(k string) (interface{}, error) {
 	if !ok {
 		return v, ErrNoSuchKey
 	}
+	d.touch(k)
 	return v, nil
 }
 
 func (d *inMemDict) Put(k string, v interface{}) error {
+	if _, ok := d.Dict[k]; !ok && d.full() {
+		if d.Policy == RejectNew {
+			return ErrDictFull
+		}
+		d.evict(len(d.Dict) - d.MaxEntries + 1)
+	}
 	d.Dict[k] = v
+	d.touch(k)
 	return nil
 }
 
@@ -84,9 +101,82 @@ func (d *inMemDict) Del(k string) error {
 	}
 
 	delete(d.Dict, k)
+	if e, ok := d.elems[k]; ok {
+		d.lru.Remove(e)
+		delete(d.elems, k)
+	}
 	return nil
 }
 
+func (d *inMemDict) SetMaxEntries(n int, p EvictionPolicy) {
+	d.MaxEntries = n
+	d.Policy = p
+	if n <= 0 || p != EvictLRU {
+		d.lru = nil
+		d.elems = nil
+		return
+	}
+	if len(d.Dict) > n {
+		d.evict(len(d.Dict) - n)
+	}
+}
+
+func (d *inMemDict) maxEntries() (int, EvictionPolicy, int) {
+	return d.MaxEntries, d.Policy, len(d.Dict)
+}
+
+func (d *inMemDict) has(k string) bool {
+	_, ok := d.Dict[k]
+	return ok
+}
+
+func (d *inMemDict) full() bool {
+	return d.MaxEntries > 0 && len(d.Dict) >= d.MaxEntries
+}
+
+// touch marks k as the most recently accessed key.
+func (d *inMemDict) touch(k string) {
+	if d.MaxEntries <= 0 || d.Policy != EvictLRU {
+		return
+	}
+	d.maybeInitLRU()
+	if e, ok := d.elems[k]; ok {
+		d.lru.MoveToFront(e)
+		return
+	}
+	d.elems[k] = d.lru.PushFront(k)
+}
+
+func (d *inMemDict) maybeInitLRU() {
+	if d.lru != nil {
+		return
+	}
+	d.lru = list.New()
+	d.elems = make(map[string]*list.Element, len(d.Dict))
+	for k := range d.Dict {
+		d.elems[k] = d.lru.PushBack(k)
+	}
+}
+
+// evict removes the n least recently accessed keys.
+func (d *inMemDict) evict(n int) {
+	d.maybeInitLRU()
+	for ; n > 0 && d.lru.Len() > 0; n-- {
+		k := d.lru.Remove(d.lru.Back()).(string)
+		delete(d.elems, k)
+		delete(d.Dict, k)
+	}
+}
+
+func (d *inMemDict) forEachLRU(f func(k string) bool) {
+	d.maybeInitLRU()
+	for e := d.lru.Back(); e != nil; e = e.Prev() {
+		if !f(e.Value.(string)) {
+			return
+		}
+	}
+}
+
 func (d *inMemDict) ForEach(f IterFn) {
 	for k, v := range d.Dict {
 		if !f(k, v) {
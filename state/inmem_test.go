@@ -1,6 +1,10 @@
 package state
 
-import "testing"
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
 
 func testInMemTx(t *testing.T, abort bool) {
 	state := NewTransactional(NewInMem())
@@ -171,3 +175,162 @@ func TestInMemNoTx(t *testing.T) {
 		t.Error("value fount for deleted key")
 	}
 }
+
+func dictKeys(d Dict) map[string]bool {
+	keys := make(map[string]bool)
+	d.ForEach(func(k string, v interface{}) bool {
+		keys[k] = true
+		return true
+	})
+	return keys
+}
+
+func TestMaxEntriesLRU(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	d := state.Dict("d")
+	d.SetMaxEntries(2, EvictLRU)
+	d.Put("k1", 1)
+	d.Put("k2", 2)
+	// Access k1 so that k2 is the least recently accessed entry.
+	d.Get("k1")
+	if err := d.Put("k3", 3); err != nil {
+		t.Errorf("error in put at the limit: %v", err)
+	}
+	want := map[string]bool{"k1": true, "k3": true}
+	if keys := dictKeys(d); len(keys) != len(want) || !keys["k1"] || !keys["k3"] {
+		t.Errorf("invalid keys after eviction: actual=%v want=%v", keys, want)
+	}
+
+	// In a transaction, the eviction is recorded as a delete in the transaction,
+	// and the entry is evicted when the transaction commits.
+	state.BeginTx()
+	d.Put("k4", 4)
+	var dels []string
+	for _, op := range state.TxOps() {
+		if op.T == Del {
+			dels = append(dels, op.K)
+		}
+	}
+	if len(dels) != 1 || dels[0] != "k1" {
+		t.Errorf("invalid deletes in the transaction: actual=%v want=[k1]", dels)
+	}
+	if _, err := state.State.Dict("d").Get("k1"); err != nil {
+		t.Errorf("entry is evicted before commit: %v", err)
+	}
+	state.CommitTx()
+	want = map[string]bool{"k3": true, "k4": true}
+	if keys := dictKeys(d); len(keys) != len(want) || !keys["k3"] || !keys["k4"] {
+		t.Errorf("invalid keys after commit: actual=%v want=%v", keys, want)
+	}
+}
+
+func TestMaxEntriesRejectNew(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	d := state.Dict("d")
+	d.SetMaxEntries(2, RejectNew)
+	d.Put("k1", 1)
+	if err := d.Put("k2", 2); err != nil {
+		t.Errorf("error in put below the limit: %v", err)
+	}
+	if err := d.Put("k3", 3); err != ErrDictFull {
+		t.Errorf("invalid error for a new key at the limit: actual=%v want=%v",
+			err, ErrDictFull)
+	}
+	if err := d.Put("k1", 10); err != nil {
+		t.Errorf("error in updating a key at the limit: %v", err)
+	}
+
+	state.BeginTx()
+	if err := d.Put("k3", 3); err != ErrDictFull {
+		t.Errorf("invalid error for a new key in tx: actual=%v want=%v", err,
+			ErrDictFull)
+	}
+	d.Del("k2")
+	if err := d.Put("k3", 3); err != nil {
+		t.Errorf("error in put after a delete in tx: %v", err)
+	}
+	if err := d.Put("k4", 4); err != ErrDictFull {
+		t.Errorf("invalid error for a new key in tx: actual=%v want=%v", err,
+			ErrDictFull)
+	}
+	state.CommitTx()
+	want := map[string]bool{"k1": true, "k3": true}
+	if keys := dictKeys(d); len(keys) != len(want) || !keys["k1"] || !keys["k3"] {
+		t.Errorf("invalid keys after commit: actual=%v want=%v", keys, want)
+	}
+}
+
+func TestMaxEntriesInTx(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	d := state.Dict("d")
+	for i := 0; i < 4; i++ {
+		d.Put(strconv.Itoa(i), i)
+	}
+
+	// The limit is set when the transaction commits, and the evicted entries are
+	// deleted in the transaction.
+	state.BeginTx()
+	d.SetMaxEntries(2, EvictLRU)
+	if n, _, _ := maxEntries(state.State.Dict("d")); n != 0 {
+		t.Errorf("limit is set before commit: %v", n)
+	}
+	ops := state.TxOps()
+	state.CommitTx()
+	// Two deletes and the limit.
+	if len(ops) != 3 {
+		t.Fatalf("invalid number of ops in the transaction: actual=%v want=3",
+			len(ops))
+	}
+
+	// A replica that applies the transaction has the same entries and limit.
+	replica := NewTransactional(NewInMem())
+	for i := 0; i < 4; i++ {
+		replica.Dict("d").Put(strconv.Itoa(i), i)
+	}
+	replica.Apply(ops)
+	want := dictKeys(d)
+	if keys := dictKeys(replica.Dict("d")); len(keys) != 2 ||
+		len(want) != 2 || !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid keys on the replica: actual=%v want=%v", keys, want)
+	}
+	if n, p, _ := maxEntries(replica.State.Dict("d")); n != 2 || p != EvictLRU {
+		t.Errorf("invalid limit on the replica: actual=%v,%v want=2,%v", n, p,
+			EvictLRU)
+	}
+
+	// An aborted transaction does not change the limit.
+	state.BeginTx()
+	d.SetMaxEntries(1, EvictLRU)
+	state.AbortTx()
+	if n, _, _ := maxEntries(state.State.Dict("d")); n != 2 {
+		t.Errorf("invalid limit after abort: actual=%v want=2", n)
+	}
+	if keys := dictKeys(d); len(keys) != 2 {
+		t.Errorf("entries are evicted by an aborted transaction: %v", keys)
+	}
+}
+
+func TestMaxEntriesInTxDoesNotRead(t *testing.T) {
+	state := NewTransactional(NewInMem())
+	d := state.Dict("d")
+	d.SetMaxEntries(2, EvictLRU)
+	d.Put("k1", 1)
+	d.Put("k2", 2)
+
+	// Putting keys in a transaction does not read the keys, and does not access
+	// them in the underlying dictionary.
+	state.BeginTx()
+	d.Put("k1", 11)
+	d.Put("k3", 3)
+	for k := range state.stage["d"].reads {
+		t.Errorf("%v is read by a put", k)
+	}
+	state.AbortTx()
+
+	// k1 is still the least recently accessed key.
+	d.Put("k3", 3)
+	want := map[string]bool{"k2": true, "k3": true}
+	if keys := dictKeys(d); !reflect.DeepEqual(keys, want) {
+		t.Errorf("invalid keys: actual=%v want=%v", keys, want)
+	}
+}
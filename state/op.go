@@ -1,5 +1,7 @@
 package state
 
+import "encoding/gob"
+
 // OpType is the type of an operation in a transaction.
 type OpType int
 
@@ -8,8 +10,17 @@ const (
 	Unknown OpType = iota
 	Put
 	Del
+	// SetLimit sets the maximum number of entries of the dictionary and its
+	// eviction policy, which are given as a Limit in the value of the operation.
+	SetLimit
 )
 
+// Limit is the value of a SetLimit operation.
+type Limit struct {
+	N int            // The maximum number of entries. N <= 0 means no limit.
+	P EvictionPolicy // The policy applied when a new key is put.
+}
+
 // Op is a state operation in a transaction.
 type Op struct {
 	T OpType
@@ -17,3 +28,7 @@ type Op struct {
 	K string      // Key.
 	V interface{} // Value.
 }
+
+func init() {
+	gob.Register(Limit{})
+}
@@ -4,6 +4,7 @@ import "errors"
 
 var (
 	ErrNoSuchKey error = errors.New("state: no such key")
+	ErrDictFull  error = errors.New("state: dictionary is full")
 )
 
 // State is a collection of dictionaries.
@@ -63,8 +63,9 @@ func NewTransactional(s State) *Transactional {
 // Transactional wraps any state dictionary and makes it transactional.
 type Transactional struct {
 	State
-	stage  map[string]*TxDict
-	status TxStatus
+	stage   map[string]*TxDict
+	handles map[string]*txHandle
+	status  TxStatus
 }
 
 func (t *Transactional) TxStatus() TxStatus {
@@ -108,10 +109,30 @@ func (t *Transactional) TxOps() []Op {
 		for _, op := range dict.Ops {
 			ops = append(ops, op)
 		}
+		if dict.limit != nil {
+			ops = append(ops, Op{T: SetLimit, D: dict.Name(), V: *dict.limit})
+		}
 	}
 	return ops
 }
 
+// ForEachTxKey calls f for each key read or written in the open transaction.
+func (t *Transactional) ForEachTxKey(f func(dict, key string)) {
+	for n, d := range t.stage {
+		if d.Status != TxOpen {
+			continue
+		}
+		for k := range d.reads {
+			f(n, k)
+		}
+		for k := range d.Ops {
+			if !d.reads[k] {
+				f(n, k)
+			}
+		}
+	}
+}
+
 func (t *Transactional) CommitTx() error {
 	if t.status != TxOpen {
 		return ErrNoTx
@@ -151,14 +172,23 @@ func (t *Transactional) Apply(ops []Op) error {
 	if t.status == TxOpen {
 		return ErrOpenTx
 	}
+	// Deletes are applied first, as in TxDict.CommitTx.
 	for _, o := range ops {
-		switch o.T {
-		case Put:
-			t.Dict(o.D).Put(o.K, o.V)
-		case Del:
+		if o.T == Del {
 			t.Dict(o.D).Del(o.K)
 		}
 	}
+	for _, o := range ops {
+		if o.T == SetLimit {
+			l := o.V.(Limit)
+			t.Dict(o.D).SetMaxEntries(l.N, l.P)
+		}
+	}
+	for _, o := range ops {
+		if o.T == Put {
+			t.Dict(o.D).Put(o.K, o.V)
+		}
+	}
 	return nil
 }
 
@@ -174,7 +204,25 @@ func (t *Transactional) Restore(b []byte) error {
 	return t.State.Restore(b)
 }
 
+// Dict returns the dictionary of the given name. The dictionary follows the
+// transactions of t: the changes made while a transaction is open are visible
+// to all the dictionaries of t, and are discarded when the transaction is
+// aborted, even if the dictionary is retrieved before the transaction begins.
 func (t *Transactional) Dict(name string) Dict {
+	h, ok := t.handles[name]
+	if !ok {
+		if t.handles == nil {
+			t.handles = make(map[string]*txHandle)
+		}
+		h = &txHandle{t: t, name: name}
+		t.handles[name] = h
+	}
+	return h
+}
+
+// dict returns the staged dictionary of name if there is an open transaction,
+// and the dictionary of the underlying state otherwise.
+func (t *Transactional) dict(name string) Dict {
 	if t.status != TxOpen {
 		return t.State.Dict(name)
 	}
@@ -194,12 +242,58 @@ func (t *Transactional) Dict(name string) Dict {
 	return d
 }
 
+// txHandle is the dictionary returned by Transactional.Dict.
+type txHandle struct {
+	t    *Transactional
+	name string
+}
+
+func (h *txHandle) Name() string {
+	return h.name
+}
+
+func (h *txHandle) Put(k string, v interface{}) error {
+	return h.t.dict(h.name).Put(k, v)
+}
+
+func (h *txHandle) Get(k string) (interface{}, error) {
+	return h.t.dict(h.name).Get(k)
+}
+
+func (h *txHandle) Del(k string) error {
+	return h.t.dict(h.name).Del(k)
+}
+
+func (h *txHandle) ForEach(f IterFn) {
+	h.t.dict(h.name).ForEach(f)
+}
+
+func (h *txHandle) SetMaxEntries(n int, p EvictionPolicy) {
+	h.t.dict(h.name).SetMaxEntries(n, p)
+}
+
+func (h *txHandle) maxEntries() (int, EvictionPolicy, int) {
+	return maxEntries(h.t.dict(h.name))
+}
+
+func (h *txHandle) forEachLRU(f func(k string) bool) {
+	forEachLRU(h.t.dict(h.name), f)
+}
+
+func (h *txHandle) has(k string) bool {
+	return has(h.t.dict(h.name), k)
+}
+
 // TxDict implements the Dict interface, and wraps any dictionary and make it
 // transactional. All modifications will fail if there is no open tx.
 type TxDict struct {
 	Dict   Dict
 	Status TxStatus
 	Ops    map[string]Op
+
+	reads map[string]bool // keys read in the transaction.
+	limit *Limit          // the limit set in the transaction, if any.
+	delta int             // the change in the number of entries in the tx.
 }
 
 func (d *TxDict) Name() string {
@@ -207,23 +301,37 @@ func (d *TxDict) Name() string {
 }
 
 func (d *TxDict) Put(k string, v interface{}) error {
-	d.Ops[k] = Op{
+	if n, p, size := d.maxEntries(); n > 0 && !d.has(k) {
+		switch {
+		case p == RejectNew && size >= n:
+			return ErrDictFull
+		case p == EvictLRU:
+			d.evict(size - n + 1)
+		}
+	}
+	d.setOp(Op{
 		T: Put,
 		D: d.Dict.Name(),
 		K: k,
 		V: v,
-	}
+	})
 	return nil
 }
 
 func (d *TxDict) Get(k string) (interface{}, error) {
+	if d.Status == TxOpen {
+		if d.reads == nil {
+			d.reads = make(map[string]bool)
+		}
+		d.reads[k] = true
+	}
 	op, ok := d.Ops[k]
 	if ok {
 		switch op.T {
 		case Put:
 			return op.V, nil
 		case Del:
-			return nil, errors.New("No such key")
+			return nil, ErrNoSuchKey
 		}
 	}
 	return d.Dict.Get(k)
@@ -234,27 +342,118 @@ func (d *TxDict) Del(k string) error {
 		return ErrNoSuchKey
 	}
 
-	d.Ops[k] = Op{
+	d.setOp(Op{
 		T: Del,
 		D: d.Dict.Name(),
 		K: k,
-	}
+	})
 	return nil
 }
 
+// setOp records op in the transaction, and keeps track of the change in the
+// number of entries.
+func (d *TxDict) setOp(op Op) {
+	if d.has(op.K) {
+		d.delta--
+	}
+	if op.T == Put {
+		d.delta++
+	}
+	d.Ops[op.K] = op
+}
+
+// has returns whether k is in the dictionary in the transaction, without
+// recording a read nor accessing k in the underlying dictionary.
+func (d *TxDict) has(k string) bool {
+	if op, ok := d.Ops[k]; ok {
+		return op.T == Put
+	}
+	return has(d.Dict, k)
+}
+
 func (d *TxDict) ForEach(f IterFn) {
-	d.Dict.ForEach(func(k string, v interface{}) (next bool) {
+	next := true
+	d.Dict.ForEach(func(k string, v interface{}) bool {
 		op, ok := d.Ops[k]
 		if ok {
 			switch op.T {
 			case Put:
-				return f(op.K, op.V)
+				next = f(op.K, op.V)
+				return next
 			case Del:
 				return true
 			}
 		}
 
-		return f(k, v)
+		next = f(k, v)
+		return next
+	})
+	if !next {
+		return
+	}
+
+	// Keys that are added in this transaction.
+	for k, op := range d.Ops {
+		if op.T != Put {
+			continue
+		}
+		if has(d.Dict, k) {
+			continue
+		}
+		if !f(op.K, op.V) {
+			return
+		}
+	}
+}
+
+// SetMaxEntries sets the limit of the underlying dictionary when the
+// transaction commits. The entries evicted to respect the limit are deleted in
+// the transaction.
+func (d *TxDict) SetMaxEntries(n int, p EvictionPolicy) {
+	if d.Status != TxOpen {
+		d.Dict.SetMaxEntries(n, p)
+		return
+	}
+
+	d.limit = &Limit{N: n, P: p}
+	if _, _, size := d.maxEntries(); n > 0 && p == EvictLRU {
+		d.evict(size - n)
+	}
+}
+
+// maxEntries returns the limits of the dictionary, and its number of entries as
+// if the transaction was committed.
+func (d *TxDict) maxEntries() (int, EvictionPolicy, int) {
+	n, p, size := maxEntries(d.Dict)
+	if d.limit != nil {
+		n, p = d.limit.N, d.limit.P
+	}
+	return n, p, size + d.delta
+}
+
+func (d *TxDict) forEachLRU(f func(k string) bool) {
+	forEachLRU(d.Dict, f)
+}
+
+// evict deletes the n least recently accessed keys of the underlying
+// dictionary in the transaction, so that the evictions are part of the
+// transaction. The keys written in the transaction are not evicted.
+func (d *TxDict) evict(n int) {
+	if n <= 0 {
+		return
+	}
+
+	forEachLRU(d.Dict, func(k string) bool {
+		if _, ok := d.Ops[k]; ok {
+			return true
+		}
+		d.setOp(Op{
+			T: Del,
+			D: d.Dict.Name(),
+			K: k,
+		})
+		n--
+		return n > 0
 	})
 }
 
@@ -270,14 +469,21 @@ func (d *TxDict) CommitTx() error {
 	if d.Status == TxNone {
 		return ErrNoTx
 	}
+	// Deletes are applied first to make room for the puts, if the dictionary is
+	// size-limited.
 	for _, o := range d.Ops {
-		switch o.T {
-		case Put:
-			d.Dict.Put(o.K, o.V)
-		case Del:
+		if o.T == Del {
 			d.Dict.Del(o.K)
 		}
 	}
+	if d.limit != nil {
+		d.Dict.SetMaxEntries(d.limit.N, d.limit.P)
+	}
+	for _, o := range d.Ops {
+		if o.T == Put {
+			d.Dict.Put(o.K, o.V)
+		}
+	}
 	d.reset()
 	return nil
 }
@@ -292,6 +498,9 @@ func (d *TxDict) AbortTx() error {
 
 func (d *TxDict) reset() {
 	d.Status = TxNone
+	d.reads = nil
+	d.limit = nil
+	d.delta = 0
 	if len(d.Ops) == 0 {
 		return
 	}
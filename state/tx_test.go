@@ -54,6 +54,83 @@ func TestLayeredTxCommit(t *testing.T) {
 	testTx(t, inm, tx1, true)
 }
 
+func TestTxMultipleDicts(t *testing.T) {
+	inm := NewInMem()
+	tx := NewTransactional(inm)
+
+	// a is retrieved before the tx begins.
+	a := tx.Dict("a")
+	if err := tx.BeginTx(); err != nil {
+		t.Fatalf("error in begin tx: %v", err)
+	}
+	a.Put("k", "va")
+	tx.Dict("b").Put("k", "vb")
+
+	for d, want := range map[string]string{"a": "va", "b": "vb"} {
+		if v, err := tx.Dict(d).Get("k"); err != nil || v != want {
+			t.Errorf("tx cannot read its write in %v: actual=%v,%v want=%v", d, v,
+				err, want)
+		}
+		n := 0
+		tx.Dict(d).ForEach(func(k string, v interface{}) bool {
+			n++
+			return true
+		})
+		if n != 1 {
+			t.Errorf("invalid number of keys in %v: actual=%v want=1", d, n)
+		}
+		if _, err := inm.Dict(d).Get("k"); err == nil {
+			t.Errorf("write in %v is in the state before commit", d)
+		}
+	}
+
+	if err := tx.AbortTx(); err != nil {
+		t.Fatalf("error in abort tx: %v", err)
+	}
+	for _, d := range []string{"a", "b"} {
+		if _, err := tx.Dict(d).Get("k"); err != ErrNoSuchKey {
+			t.Errorf("write in %v is not discarded on abort: actual=%v want=%v", d,
+				err, ErrNoSuchKey)
+		}
+		if _, err := inm.Dict(d).Get("k"); err == nil {
+			t.Errorf("write in %v is in the state after abort", d)
+		}
+	}
+}
+
+func TestTxKeys(t *testing.T) {
+	inm := NewInMem()
+	inm.Dict("a").Put("r", "v")
+	tx := NewTransactional(inm)
+	if err := tx.BeginTx(); err != nil {
+		t.Fatalf("error in begin tx: %v", err)
+	}
+	tx.Dict("a").Get("r")
+	tx.Dict("a").Put("w", "v")
+	tx.Dict("b").Get("w")
+	tx.Dict("b").Put("w", "v")
+
+	keys := make(map[string]int)
+	tx.ForEachTxKey(func(d, k string) {
+		keys[d+"/"+k]++
+	})
+	want := map[string]int{"a/r": 1, "a/w": 1, "b/w": 1}
+	if len(keys) != len(want) {
+		t.Errorf("invalid keys: actual=%v want=%v", keys, want)
+	}
+	for k, n := range want {
+		if keys[k] != n {
+			t.Errorf("invalid keys: actual=%v want=%v", keys, want)
+		}
+	}
+
+	tx.CommitTx()
+	tx.BeginTx()
+	tx.ForEachTxKey(func(d, k string) {
+		t.Errorf("key of the committed tx: %v/%v", d, k)
+	})
+}
+
 func BenchmarkTransactions(b *testing.B) {
 	inm := NewInMem()
 	tx := NewTransactional(inm)
@@ -0,0 +1,61 @@
+package beehive
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// ErrStateless is the panic of the handlers of stateless apps that access the
+// state of their bee.
+var ErrStateless = errors.New("stateless apps cannot access state")
+
+// handleMsgStateless handles the messages of a stateless app concurrently on
+// at most GOMAXPROCS goroutines, and returns once all of them are handled.
+func (b *bee) handleMsgStateless(mhs []msgAndHandler) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i := range mhs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(mh msgAndHandler) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := b.hive.config.Clock.Now()
+			b.callRcvStateless(mh)
+			b.app.latency.record(mh.msg.Type(), b.hive.config.Clock.Now().Sub(start))
+		}(mhs[i])
+	}
+	wg.Wait()
+}
+
+// callRcvStateless is callRcv for the handlers of stateless apps. Since it
+// runs concurrently with other handlers of the bee, it does not track the
+// trace, the vector clock, and the provenance of the bee.
+func (b *bee) callRcvStateless(mh msgAndHandler) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.recoverFromError(mh, r, r != ErrStateless)
+		}
+	}()
+
+	if v := b.app.validator; v != nil {
+		if err := v(mh.msg); err != nil {
+			glog.Errorf("%v drops invalid message %v: %v", b, mh.msg, err)
+			b.deadLetter(mh, err)
+			return
+		}
+	}
+
+	start := b.hive.config.Clock.Now()
+	defer b.hive.recordSpan(spanRcv, b.app.Name(), b.beeID, mh.msg, start)
+
+	if err := b.rcvWithTimeout(mh); err != nil {
+		b.recoverFromError(mh, err, false)
+		b.retry(mh, err)
+	}
+}
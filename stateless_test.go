@@ -0,0 +1,86 @@
+package beehive
+
+import (
+	"testing"
+	"time"
+)
+
+type statelessTestMsg int
+
+func TestStatelessStateAccess(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("stateless")
+	if err := a.SetStateless(true); err != nil {
+		t.Fatalf("cannot make the app stateless: %v", err)
+	}
+	ch := make(chan interface{}, 1)
+	a.HandleFunc(statelessTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		defer func() {
+			ch <- recover()
+		}()
+		c.Dict("D").Put("k", m.Data())
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(statelessTestMsg(0))
+	select {
+	case r := <-ch:
+		if r != ErrStateless {
+			t.Errorf("invalid panic on state access: actual=%v want=%v", r,
+				ErrStateless)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+}
+
+func TestStatelessPersistent(t *testing.T) {
+	h := newHiveForTest()
+	a := h.NewApp("persistent", Persistent(1))
+	if err := a.SetStateless(true); err == nil {
+		t.Error("persistent app is stateless")
+	}
+}
+
+func benchmarkStateless(b *testing.B, stateless bool) {
+	b.StopTimer()
+	h := newHiveForTest()
+	a := h.NewApp("stateless", NonTransactional())
+	if err := a.SetStateless(stateless); err != nil {
+		b.Fatalf("cannot set stateless: %v", err)
+	}
+	done := make(chan struct{}, b.N)
+	a.HandleFunc(statelessTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		// Simulates a blocking call, e.g., to an external service.
+		time.Sleep(100 * time.Microsecond)
+		done <- struct{}{}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		h.Emit(statelessTestMsg(i))
+	}
+	for i := 0; i < b.N; i++ {
+		<-done
+	}
+	b.StopTimer()
+}
+
+func BenchmarkStatelessApp(b *testing.B) {
+	benchmarkStateless(b, true)
+}
+
+func BenchmarkStatefulApp(b *testing.B) {
+	benchmarkStateless(b, false)
+}
@@ -0,0 +1,359 @@
+package beehive
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	"github.com/kandoo/beehive/state"
+)
+
+// setSticky sets whether the app is sticky. When a sticky app is distributed,
+// the cells that its local bees own because of the sticky split are spread
+// among new local bees, and the state of each cell moves with it.
+func (q *qee) setSticky(sticky bool) error {
+	if sticky {
+		q.app.flags |= appFlagSticky
+		return nil
+	}
+
+	if !q.app.sticky() {
+		return nil
+	}
+	if q.app.persistent() {
+		return fmt.Errorf("%v cannot distribute a persistent sticky app", q)
+	}
+	q.app.flags &^= appFlagSticky
+	q.split = stickySplit{}
+
+	q.RLock()
+	bees := make([]*bee, 0, len(q.bees))
+	for _, b := range q.bees {
+		if !b.detached && !b.proxy && b.colony().Leader == b.ID() {
+			bees = append(bees, b)
+		}
+	}
+	q.RUnlock()
+
+	for _, b := range bees {
+		if err := q.distribute(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// distributionGroup returns the group of c when a sticky app is distributed.
+// Cells with the same key, or with the same affinity group if the app has
+// affinity groups, are kept on the same bee.
+func (q *qee) distributionGroup(c CellKey) string {
+	switch {
+	case c.Dict == affinityDict:
+		return c.Key
+	case q.app.stickyBy != nil:
+		return q.app.stickyBy(c)
+	}
+	return c.Key
+}
+
+// distribute releases the sticky split group of b, and moves each group of
+// cells owned by b, except the first one, to a new local bee.
+func (q *qee) distribute(b *bee) error {
+	var split MappedCells
+	groups := make(map[string]MappedCells)
+	for _, c := range q.hive.registry.cellsOf(b.ID()) {
+		if c.Dict == stickySplitDict {
+			split = append(split, c)
+			continue
+		}
+		g := q.distributionGroup(c)
+		groups[g] = append(groups[g], c)
+	}
+	if len(split) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	for i := 1; i < len(names); i++ {
+		nb, err := q.newLocalBee(true)
+		if err != nil {
+			return err
+		}
+		if err := q.moveCells(b, nb, groups[names[i]]); err != nil {
+			q.stopNewBee(nb)
+			return err
+		}
+	}
+
+	unlock := unlockMappedCell{
+		Colony: b.colony(),
+		App:    q.app.Name(),
+		Cells:  split,
+	}
+	if _, err := q.hive.node.ProposeRetry(hiveGroup, unlock,
+		q.hive.config.RaftElectTimeout(), 10); err != nil {
+
+		return err
+	}
+	b.delMappedCells(split)
+	glog.V(2).Infof("%v distributes the cells of %v into %v groups", q, b,
+		len(groups))
+	return nil
+}
+
+// moveCells transfers cells and their state from b to the local bee nb.
+func (q *qee) moveCells(b, nb *bee, cells MappedCells) error {
+	t := transferCells{
+		From:  b.colony(),
+		To:    nb.colony(),
+		Cells: cells,
+	}
+	if _, err := q.hive.node.ProposeRetry(hiveGroup, t,
+		q.hive.config.RaftElectTimeout(), 10); err != nil {
+
+		return err
+	}
+
+	s, err := b.processCmd(cmdSplitCells{Cells: cells})
+	if err != nil {
+		return err
+	}
+	if _, err := nb.processCmd(cmdMergeState{State: s.([]byte)}); err != nil {
+		return err
+	}
+	nb.processCmd(cmdAddMappedCells{Cells: cells})
+	glog.V(2).Infof("%v moves %v from %v to %v", q, cells, b, nb)
+	return nil
+}
+
+// stopNewBee stops a local bee that is created but not used, and removes it
+// from the qee.
+func (q *qee) stopNewBee(b *bee) {
+	b.processCmd(cmdStop{})
+	q.removeBee(b.ID())
+	go q.hive.delBeeFromRegistry(b.ID())
+}
+
+// rebalanceSplit adjusts the number of split groups of a sticky app to the
+// message rate of the last window: a window with a rate higher than the split
+// threshold adds a group, and a window with less than half of the threshold
+// removes one. The cells of the local bees are then re-mapped to their new
+// groups.
+func (q *qee) rebalanceSplit() {
+	msgs := q.split.msgs
+	q.split.msgs = 0
+	if !q.app.sticky() || q.app.persistent() {
+		return
+	}
+
+	groups := q.split.groups
+	if groups == 0 {
+		groups = 1
+	}
+	rate := float64(msgs) / stickySplitWindow.Seconds()
+	switch thresh := float64(q.app.stickySplit); {
+	case rate > thresh:
+		groups++
+		glog.V(2).Infof("%v splits into %v groups", q, groups)
+	case rate < thresh/2 && groups > 1:
+		groups--
+		glog.V(2).Infof("%v consolidates into %v groups", q, groups)
+	default:
+		return
+	}
+
+	q.split.groups = groups
+	if err := q.resplit(); err != nil {
+		glog.Errorf("%v cannot re-map the cells of its split groups: %v", q, err)
+	}
+}
+
+// splitBee is a local bee of a sticky app with its split groups.
+type splitBee struct {
+	bee    *bee
+	groups map[int]bool
+	cells  MappedCells // the cells of the bee, other than its split groups.
+}
+
+// splitBees returns the local bees of the app that own split groups.
+func (q *qee) splitBees() []splitBee {
+	q.RLock()
+	bees := make([]*bee, 0, len(q.bees))
+	for _, b := range q.bees {
+		if !b.detached && !b.proxy && b.colony().Leader == b.ID() {
+			bees = append(bees, b)
+		}
+	}
+	q.RUnlock()
+
+	var sbs []splitBee
+	for _, b := range bees {
+		sb := splitBee{bee: b, groups: make(map[int]bool)}
+		for _, c := range q.hive.registry.cellsOf(b.ID()) {
+			switch c.Dict {
+			case stickySplitDict:
+				if g, err := strconv.Atoi(c.Key); err == nil {
+					sb.groups[g] = true
+				}
+			case beeNameDict:
+			default:
+				sb.cells = append(sb.cells, c)
+			}
+		}
+		if len(sb.groups) != 0 {
+			sbs = append(sbs, sb)
+		}
+	}
+	sort.Sort(splitBeesByID(sbs))
+	return sbs
+}
+
+type splitBeesByID []splitBee
+
+func (s splitBeesByID) Len() int      { return len(s) }
+func (s splitBeesByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s splitBeesByID) Less(i, j int) bool {
+	return s[i].bee.ID() < s[j].bee.ID()
+}
+
+// resplit moves the cells of the local bees of a sticky app to the bees of
+// their current split groups, creating the bees of new groups. The bees of the
+// groups that are removed release their groups, and are left without cells.
+func (q *qee) resplit() error {
+	sbs := q.splitBees()
+	byGroup := make(map[int]*bee)
+	for _, sb := range sbs {
+		for g := range sb.groups {
+			byGroup[g] = sb.bee
+		}
+	}
+
+	for _, sb := range sbs {
+		moves := make(map[int]MappedCells)
+		for _, c := range sb.cells {
+			if g := q.splitGroup(c); !sb.groups[g] {
+				moves[g] = append(moves[g], c)
+			}
+		}
+
+		groups := make([]int, 0, len(moves))
+		for g := range moves {
+			groups = append(groups, g)
+		}
+		sort.Ints(groups)
+		for _, g := range groups {
+			nb, ok := byGroup[g]
+			if !ok {
+				var err error
+				if nb, err = q.newSplitBee(g); err != nil {
+					return err
+				}
+				byGroup[g] = nb
+			}
+			if err := q.moveCells(sb.bee, nb, moves[g]); err != nil {
+				return err
+			}
+		}
+
+		var removed MappedCells
+		for g := range sb.groups {
+			if g >= q.split.groups {
+				removed = append(removed, q.splitKey(g))
+				delete(byGroup, g)
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		unlock := unlockMappedCell{
+			Colony: sb.bee.colony(),
+			App:    q.app.Name(),
+			Cells:  removed,
+		}
+		if _, err := q.hive.node.ProposeRetry(hiveGroup, unlock,
+			q.hive.config.RaftElectTimeout(), 10); err != nil {
+
+			return err
+		}
+		sb.bee.delMappedCells(removed)
+	}
+	return nil
+}
+
+// newSplitBee creates a local bee for split group g.
+func (q *qee) newSplitBee(g int) (*bee, error) {
+	b, err := q.newLocalBee(true)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := lockMappedCell{
+		Colony: b.colony(),
+		App:    q.app.Name(),
+		Cells:  MappedCells{q.splitKey(g)},
+	}
+	res, err := q.hive.node.ProposeRetry(hiveGroup, lock,
+		q.hive.config.RaftElectTimeout(), 10)
+	if err == nil && res.(Colony).Leader != b.ID() {
+		err = fmt.Errorf("split group %v is locked by %v", g, res)
+	}
+	if err != nil {
+		q.stopNewBee(b)
+		return nil, err
+	}
+	b.processCmd(cmdAddMappedCells{Cells: lock.Cells})
+	return b, nil
+}
+
+// splitCells removes cells and their state from the bee, and returns the
+// state of the cells, saved as an in-memory state.
+func (b *bee) splitCells(cells MappedCells) ([]byte, error) {
+	s := state.NewInMem()
+	for _, c := range cells {
+		v, err := b.stateL1.Dict(c.Dict).Get(c.Key)
+		if err != nil {
+			continue
+		}
+		if err := s.Dict(c.Dict).Put(c.Key, v); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := s.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cells {
+		b.stateL1.Dict(c.Dict).Del(c.Key)
+	}
+	b.delMappedCells(cells)
+	return data, nil
+}
+
+// mergeState puts the entries of a state saved as an in-memory state into the
+// state of the bee.
+func (b *bee) mergeState(data []byte) error {
+	s := state.NewInMem()
+	if err := s.Restore(data); err != nil {
+		return err
+	}
+
+	var err error
+	for _, d := range s.Dicts() {
+		bd := b.stateL1.Dict(d.Name())
+		d.ForEach(func(k string, v interface{}) bool {
+			err = bd.Put(k, v)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
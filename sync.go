@@ -3,6 +3,7 @@ package beehive
 import (
 	"encoding/gob"
 	"sync"
+	"time"
 
 	bhgob "github.com/kandoo/beehive/gob"
 )
@@ -51,6 +52,7 @@ func (r syncRes) Type() string {
 type syncReqAndChan struct {
 	req syncReq
 	ch  chan syncRes
+	to  uint64 // The bee to send the request to. If Nil, req is emitted.
 }
 
 // syncDetached is a generic DetachedHandler for sync request processing, and
@@ -84,6 +86,10 @@ func (s *syncDetached) Start(ctx RcvContext) {
 			ch <- struct{}{}
 		case rnc := <-s.reqch:
 			s.enque(rnc.req.ID, rnc.ch)
+			if rnc.to != Nil {
+				ctx.SendToBee(rnc.req, rnc.to)
+				continue
+			}
 			ctx.Emit(rnc.req)
 		}
 	}
@@ -172,12 +178,32 @@ type syncHandler struct {
 	handler Handler
 }
 
+// Rcv calls the handler and replies with its error, if any. Errors are sent as
+// gob.Error, so that the requester receives the same error message on any
+// hive. Panics, other than snoozes, are also replied as errors before being
+// propagated.
 func (h syncHandler) Rcv(m Msg, ctx RcvContext) error {
 	req := m.Data().(syncReq)
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, ok := r.(time.Duration); !ok {
+			ctx.AbortTx()
+			ctx.Reply(m, syncRes{
+				ID:  req.ID,
+				Err: bhgob.Errorf("%v", r),
+			})
+		}
+		panic(r)
+	}()
+
 	sm := msg{
 		MsgData: req.Data,
 		MsgFrom: m.From(),
 		MsgTo:   m.To(),
+		MsgTime: m.Time(),
 	}
 	sc := syncRcvContext{
 		RcvContext: ctx,
@@ -208,6 +234,7 @@ func (h syncHandler) Map(m Msg, ctx MapContext) MappedCells {
 		MsgData: m.Data().(syncReq).Data,
 		MsgFrom: m.From(),
 		MsgTo:   m.To(),
+		MsgTime: m.Time(),
 	}
 	return h.handler.Map(s, ctx)
 }
@@ -1,10 +1,13 @@
 package beehive
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
 )
@@ -101,6 +104,47 @@ func TestSyncDeferReply(t *testing.T) {
 	}
 }
 
+type syncWrite int
+
+func TestSyncSideEffect(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("syncSideEffect")
+	var m sync.Mutex
+	var writes []syncWrite
+	app.HandleFunc(syncWrite(0), func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(msg Msg, ctx RcvContext) error {
+		w := msg.Data().(syncWrite)
+		if w < 0 {
+			return errors.New("negative write")
+		}
+		m.Lock()
+		writes = append(writes, w)
+		m.Unlock()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	for i := 1; i <= 3; i++ {
+		if _, err := h.Sync(context.Background(), syncWrite(i)); err != nil {
+			t.Fatalf("error in sync: %v", err)
+		}
+		m.Lock()
+		l := len(writes)
+		m.Unlock()
+		if l != i {
+			t.Errorf("side effect is not visible: actual=%v want=%v", l, i)
+		}
+	}
+
+	if _, err := h.Sync(context.Background(), syncWrite(-1)); err == nil {
+		t.Error("handler error is not returned by sync")
+	}
+}
+
 type benchSyncHandler struct{}
 
 func (h benchSyncHandler) Rcv(msg Msg, ctx RcvContext) error {
@@ -154,3 +198,157 @@ func ExampleSyncInstall() {
 	}
 	fmt.Println(result)
 }
+
+type syncErrReq struct {
+	Panic bool
+}
+
+func registerSyncErrApp(h Hive) {
+	h.NewApp("syncErr").HandleFunc(syncErrReq{},
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			if msg.Data().(syncErrReq).Panic {
+				panic("handler panics")
+			}
+			return errors.New("handler fails")
+		})
+}
+
+func TestSyncHandlerError(t *testing.T) {
+	h1 := newHiveForTest()
+	registerSyncErrApp(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerSyncErrApp(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// The bee is created on h1, and the errors of h2's requests are sent back
+	// from h1.
+	for _, h := range []Hive{h1, h2} {
+		ctx, cnl := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := h.Sync(ctx, syncErrReq{})
+		if err == nil || err.Error() != "handler fails" {
+			t.Errorf("invalid error on %v: actual=%v want=handler fails", h, err)
+		}
+		_, err = h.Sync(ctx, syncErrReq{Panic: true})
+		if err == nil || err.Error() != "handler panics" {
+			t.Errorf("invalid error on %v: actual=%v want=handler panics", h, err)
+		}
+		cnl()
+	}
+}
+
+type deliverSyncAppend int
+type deliverSyncGet struct{}
+
+func TestDeliverSync(t *testing.T) {
+	h := newHiveForTest()
+	app := h.NewApp("deliversync")
+	mapf := func(msg Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}
+	app.HandleFunc(deliverSyncAppend(0), mapf,
+		func(msg Msg, ctx RcvContext) error {
+			n := msg.Data().(deliverSyncAppend)
+			if n < 0 {
+				return errors.New("negative value")
+			}
+			v, err := ctx.Dict("D").Get("log")
+			if err != nil {
+				v = ""
+			}
+			ctx.Dict("D").Put("log", fmt.Sprintf("%v%d", v, n))
+			return nil
+		})
+	app.HandleFunc(deliverSyncGet{}, mapf, func(msg Msg, ctx RcvContext) error {
+		v, _ := ctx.Dict("D").Get("log")
+		return ctx.Reply(msg, v)
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cnl()
+	if _, err := h.Sync(ctx, deliverSyncGet{}); err != nil {
+		t.Fatalf("cannot create the bee: %v", err)
+	}
+	b := findBee(app.Name(), h)
+
+	err := h.DeliverSync(b, deliverSyncAppend(1), deliverSyncAppend(2),
+		deliverSyncAppend(3))
+	if err != nil {
+		t.Fatalf("cannot deliver messages: %v", err)
+	}
+	v, err := h.Sync(ctx, deliverSyncGet{})
+	if err != nil {
+		t.Fatalf("cannot get the state: %v", err)
+	}
+	if v != "123" {
+		t.Errorf("invalid state: actual=%v want=123", v)
+	}
+
+	err = h.DeliverSync(b, deliverSyncAppend(-1), deliverSyncAppend(4))
+	if err == nil || err.Error() != "negative value" {
+		t.Errorf("invalid error: actual=%v want=negative value", err)
+	}
+	if v, _ = h.Sync(ctx, deliverSyncGet{}); v != "1234" {
+		t.Errorf("invalid state: actual=%v want=1234", v)
+	}
+}
+
+type syncRemote int
+
+func registerSyncRemoteApp(h Hive) {
+	h.NewApp("syncRemote").HandleFunc(syncRemote(0),
+		func(msg Msg, ctx MapContext) MappedCells {
+			return MappedCells{{"D", "0"}}
+		}, func(msg Msg, ctx RcvContext) error {
+			if msg.Data().(syncRemote) < 0 {
+				return errors.New("negative request")
+			}
+			return ctx.Reply(msg, ctx.Hive().ID())
+		})
+}
+
+func TestSyncRemoteBee(t *testing.T) {
+	h1 := newHiveForTest()
+	registerSyncRemoteApp(h1)
+	go h1.Start()
+	defer h1.Stop()
+	waitTilStareted(h1)
+
+	h2 := newHiveForTest(PeerAddrs(h1.Config().Addr))
+	registerSyncRemoteApp(h2)
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	// The bee is created on h1, and h2 syncs with the bee on h1.
+	for _, h := range []Hive{h1, h2} {
+		ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+		res, err := h.Sync(ctx, syncRemote(1))
+		cnl()
+		if err != nil {
+			t.Fatalf("error in sync on %v: %v", h.ID(), err)
+		}
+		if res != h1.ID() {
+			t.Errorf("invalid hive of the bee: actual=%v want=%v", res, h1.ID())
+		}
+	}
+
+	// The error of the remote handler is returned when it does not reply.
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	_, err := h2.Sync(ctx, syncRemote(-1))
+	if err == nil || err.Error() != "negative request" {
+		t.Errorf("invalid error of the remote handler: actual=%v want=%v", err,
+			"negative request")
+	}
+}
@@ -0,0 +1,396 @@
+package beehive
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+// timedRcvContext is the RcvContext passed to the handlers of the apps with a
+// handler timeout. Once the handler times out, the bee abandons the context
+// and moves on: the context of the handler is cancelled, methods returning an
+// error return ErrHandlerTimeout, and other methods panic with
+// ErrHandlerTimeout. The calls on the state of the bee that are in progress
+// when the handler times out are finished before the bee moves on, so that an
+// abandoned handler never races with the bee. The calls that block on other
+// bees or hives (e.g., Sync, LockCells and RunOnBee) do not touch the state of
+// the bee. They finish detached, and return ErrHandlerTimeout.
+type timedRcvContext struct {
+	b      *bee
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	done      *sync.Cond
+	calls     int  // the number of non-detached calls in progress.
+	abandoned bool // whether the handler is timed out.
+}
+
+func newTimedRcvContext(b *bee) *timedRcvContext {
+	c := &timedRcvContext{b: b}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.done = sync.NewCond(&c.mu)
+	return c
+}
+
+// abandon cancels the context, and waits for the calls in progress, except the
+// detached ones (see doDetached). The calls made afterwards fail.
+func (c *timedRcvContext) abandon() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.abandoned = true
+	c.cancel()
+	for c.calls != 0 {
+		c.done.Wait()
+	}
+}
+
+// enter registers a call on the bee, and returns false if the context is
+// abandoned.
+func (c *timedRcvContext) enter() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.abandoned {
+		return false
+	}
+	c.calls++
+	return true
+}
+
+func (c *timedRcvContext) exit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls--
+	if c.calls == 0 {
+		c.done.Broadcast()
+	}
+}
+
+// do runs f unless the context is abandoned, and panics otherwise.
+func (c *timedRcvContext) do(f func()) {
+	if !c.enter() {
+		panic(ErrHandlerTimeout)
+	}
+	defer c.exit()
+	f()
+}
+
+// doErr runs f unless the context is abandoned, and returns ErrHandlerTimeout
+// otherwise.
+func (c *timedRcvContext) doErr(f func() error) error {
+	if !c.enter() {
+		return ErrHandlerTimeout
+	}
+	defer c.exit()
+	return f()
+}
+
+// doDetached runs f unless the context is abandoned, and returns
+// ErrHandlerTimeout otherwise. f must be safe to run concurrently with the bee,
+// since abandoning the context does not wait for f. If the context is abandoned
+// while f is running, f finishes detached and ErrHandlerTimeout is returned.
+func (c *timedRcvContext) doDetached(f func() error) error {
+	if c.isAbandoned() {
+		return ErrHandlerTimeout
+	}
+	err := f()
+	if c.isAbandoned() {
+		return ErrHandlerTimeout
+	}
+	return err
+}
+
+func (c *timedRcvContext) isAbandoned() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.abandoned
+}
+
+func (c *timedRcvContext) String() string {
+	return c.b.String()
+}
+
+func (c *timedRcvContext) Context() context.Context {
+	return c.ctx
+}
+
+func (c *timedRcvContext) Hive() Hive {
+	return c.b.Hive()
+}
+
+func (c *timedRcvContext) App() string {
+	return c.b.App()
+}
+
+func (c *timedRcvContext) Dict(name string) (d state.Dict) {
+	c.do(func() { d = timedDict{c: c, d: c.b.Dict(name)} })
+	return
+}
+
+func (c *timedRcvContext) Sync(ctx context.Context, req interface{}) (
+	res interface{}, err error) {
+
+	err = c.doDetached(func() error {
+		res, err = c.b.Sync(ctx, req)
+		return err
+	})
+	if err == ErrHandlerTimeout {
+		res = nil
+	}
+	return
+}
+
+func (c *timedRcvContext) Printf(format string, a ...interface{}) {
+	c.b.Printf(format, a...)
+}
+
+func (c *timedRcvContext) ID() uint64 {
+	return c.b.ID()
+}
+
+func (c *timedRcvContext) BeeName() (n string) {
+	c.do(func() { n = c.b.BeeName() })
+	return
+}
+
+func (c *timedRcvContext) Colony() (col Colony) {
+	c.do(func() { col = c.b.Colony() })
+	return
+}
+
+func (c *timedRcvContext) Generation() (g uint64) {
+	c.do(func() { g = c.b.Generation() })
+	return
+}
+
+func (c *timedRcvContext) Emit(msgData interface{}) {
+	c.do(func() { c.b.Emit(msgData) })
+}
+
+func (c *timedRcvContext) EmitBatch(msgData []interface{}) {
+	c.do(func() { c.b.EmitBatch(msgData) })
+}
+
+func (c *timedRcvContext) EmitWithPriority(msgData interface{}, prio int) {
+	c.do(func() { c.b.EmitWithPriority(msgData, prio) })
+}
+
+func (c *timedRcvContext) EmitBestEffort(msgData interface{}) {
+	c.do(func() { c.b.EmitBestEffort(msgData) })
+}
+
+func (c *timedRcvContext) EmitCoalesced(msgData interface{}, key string,
+	window time.Duration) {
+
+	c.do(func() { c.b.EmitCoalesced(msgData, key, window) })
+}
+
+func (c *timedRcvContext) EmitWithReceipt(msgData interface{},
+	onResult func(DeliveryResult)) {
+
+	c.do(func() { c.b.EmitWithReceipt(msgData, onResult) })
+}
+
+func (c *timedRcvContext) SendToCell(msgData interface{}, app string,
+	cell CellKey) {
+
+	c.do(func() { c.b.SendToCell(msgData, app, cell) })
+}
+
+func (c *timedRcvContext) SendToBee(msgData interface{}, to uint64) {
+	c.do(func() { c.b.SendToBee(msgData, to) })
+}
+
+func (c *timedRcvContext) EmitToSelf(msgData interface{}) {
+	c.do(func() { c.b.EmitToSelf(msgData) })
+}
+
+func (c *timedRcvContext) SendToBeeErr(msgData interface{}, to uint64) error {
+	return c.doErr(func() error { return c.b.SendToBeeErr(msgData, to) })
+}
+
+func (c *timedRcvContext) Reply(msg Msg, replyData interface{}) error {
+	return c.doErr(func() error { return c.b.Reply(msg, replyData) })
+}
+
+func (c *timedRcvContext) DeferReply(msg Msg) Repliable {
+	return c.b.DeferReply(msg)
+}
+
+func (c *timedRcvContext) StartDetached(h DetachedHandler) (id uint64) {
+	c.do(func() { id = c.b.StartDetached(h) })
+	return
+}
+
+func (c *timedRcvContext) StartDetachedFunc(start StartFunc, stop StopFunc,
+	rcv RcvFunc) (id uint64) {
+
+	c.do(func() { id = c.b.StartDetachedFunc(start, stop, rcv) })
+	return
+}
+
+func (c *timedRcvContext) StopDetached(id uint64) error {
+	return c.doErr(func() error { return c.b.StopDetached(id) })
+}
+
+func (c *timedRcvContext) SubscribeDetached(msgType interface{}) {
+	c.do(func() { c.b.SubscribeDetached(msgType) })
+}
+
+func (c *timedRcvContext) RunOnBee(f func(ctx RcvContext)) {
+	err := c.doDetached(func() error {
+		c.b.RunOnBee(f)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *timedRcvContext) LockCells(keys []CellKey) error {
+	return c.doDetached(func() error { return c.b.LockCells(keys) })
+}
+
+func (c *timedRcvContext) LockWithTimeout(keys []CellKey,
+	d time.Duration) error {
+
+	return c.doDetached(func() error { return c.b.LockWithTimeout(keys, d) })
+}
+
+func (c *timedRcvContext) UnlockCells(keys []CellKey) error {
+	return c.doDetached(func() error { return c.b.UnlockCells(keys) })
+}
+
+func (c *timedRcvContext) ReadFromReplica(app string, cell CellKey, dict,
+	key string, rc ReadConsistency) (v ReplicaValue, err error) {
+
+	err = c.doErr(func() error {
+		v, err = c.b.ReadFromReplica(app, cell, dict, key, rc)
+		return err
+	})
+	return
+}
+
+func (c *timedRcvContext) QueryApp(app string, cell CellKey, dict,
+	key string) (v interface{}, err error) {
+
+	err = c.doErr(func() error {
+		v, err = c.b.QueryApp(app, cell, dict, key)
+		return err
+	})
+	return
+}
+
+func (c *timedRcvContext) Snooze(d time.Duration) {
+	c.do(func() { c.b.Snooze(d) })
+}
+
+func (c *timedRcvContext) BeeLocal() (d interface{}) {
+	c.do(func() { d = c.b.BeeLocal() })
+	return
+}
+
+func (c *timedRcvContext) SetBeeLocal(d interface{}) {
+	c.do(func() { c.b.SetBeeLocal(d) })
+}
+
+func (c *timedRcvContext) BeeLocalGet(key string) (v interface{}, ok bool) {
+	c.do(func() { v, ok = c.b.BeeLocalGet(key) })
+	return
+}
+
+func (c *timedRcvContext) BeeLocalSet(key string, v interface{}) {
+	c.do(func() { c.b.BeeLocalSet(key, v) })
+}
+
+func (c *timedRcvContext) BeeLocalGetOrInit(key string,
+	init func() interface{}) (v interface{}) {
+
+	c.do(func() { v = c.b.BeeLocalGetOrInit(key, init) })
+	return
+}
+
+func (c *timedRcvContext) Rand() (r *rand.Rand) {
+	c.do(func() { r = c.b.Rand() })
+	return
+}
+
+func (c *timedRcvContext) BeginTx() error {
+	return c.doErr(c.b.BeginTx)
+}
+
+func (c *timedRcvContext) CommitTx() error {
+	return c.doErr(c.b.CommitTx)
+}
+
+func (c *timedRcvContext) AbortTx() error {
+	return c.doErr(c.b.AbortTx)
+}
+
+func (c *timedRcvContext) InTx() (in bool) {
+	c.do(func() { in = c.b.InTx() })
+	return
+}
+
+func (c *timedRcvContext) TxSeq() (seq uint64) {
+	c.do(func() { seq = c.b.TxSeq() })
+	return
+}
+
+func (c *timedRcvContext) TxBufferedMsgs() (msgs []Msg) {
+	c.do(func() { msgs = c.b.TxBufferedMsgs() })
+	return
+}
+
+func (c *timedRcvContext) TxBufferedOps() (ops []state.Op) {
+	c.do(func() { ops = c.b.TxBufferedOps() })
+	return
+}
+
+func (c *timedRcvContext) OnPreCommit(f func() error) {
+	c.do(func() { c.b.OnPreCommit(f) })
+}
+
+func (c *timedRcvContext) OnPostCommit(f func()) {
+	c.do(func() { c.b.OnPostCommit(f) })
+}
+
+// timedDict is a dictionary returned by a timedRcvContext, and fails once the
+// context is abandoned.
+type timedDict struct {
+	c *timedRcvContext
+	d state.Dict
+}
+
+func (d timedDict) Name() string {
+	return d.d.Name()
+}
+
+func (d timedDict) Get(k string) (v interface{}, err error) {
+	err = d.c.doErr(func() error {
+		v, err = d.d.Get(k)
+		return err
+	})
+	return
+}
+
+func (d timedDict) Put(k string, v interface{}) error {
+	return d.c.doErr(func() error { return d.d.Put(k, v) })
+}
+
+func (d timedDict) Del(k string) error {
+	return d.c.doErr(func() error { return d.d.Del(k) })
+}
+
+func (d timedDict) ForEach(f state.IterFn) {
+	d.c.do(func() { d.d.ForEach(f) })
+}
+
+func (d timedDict) SetMaxEntries(n int, p state.EvictionPolicy) {
+	d.c.do(func() { d.d.SetMaxEntries(n, p) })
+}
+
+var _ RcvContext = &timedRcvContext{}
@@ -20,7 +20,7 @@ type timer struct {
 func (t timer) Start(ctx RcvContext) {
 	for {
 		select {
-		case <-time.Tick(t.tick):
+		case <-ctx.Hive().Config().Clock.After(t.tick):
 			t.fn()
 		case <-t.done:
 			return
@@ -0,0 +1,137 @@
+package beehive
+
+import (
+	"sort"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+)
+
+// Topology is a consistent snapshot of the hives and the bees of a cluster.
+type Topology struct {
+	Hives []HiveInfo    `json:"hives"` // Hives in the cluster.
+	Bees  []BeeTopology `json:"bees"`  // Bees in the cluster.
+}
+
+// BeeTopology represents a bee, its colony, and its mapped cells.
+type BeeTopology struct {
+	BeeInfo
+	Generation uint64      `json:"generation"` // Generation (term) of the colony.
+	Cells      MappedCells `json:"cells"`      // Cells owned by the bee.
+}
+
+// TopologyEventType is the type of a topology event.
+type TopologyEventType int
+
+// Valid values for TopologyEventType.
+const (
+	HiveJoined TopologyEventType = iota
+	HiveLeft
+	BeeAdded
+	BeeRemoved
+	BeeMoved
+	ColonyUpdated
+)
+
+func (t TopologyEventType) String() string {
+	switch t {
+	case HiveJoined:
+		return "hive-joined"
+	case HiveLeft:
+		return "hive-left"
+	case BeeAdded:
+		return "bee-added"
+	case BeeRemoved:
+		return "bee-removed"
+	case BeeMoved:
+		return "bee-moved"
+	case ColonyUpdated:
+		return "colony-updated"
+	}
+	return "unknown"
+}
+
+// TopologyEvent represents a change in the topology of the cluster. Depending
+// on the event type, either Hive or Bee is set.
+type TopologyEvent struct {
+	Type TopologyEventType
+	Hive HiveInfo
+	Bee  BeeInfo
+}
+
+// topologyWatchChSize is the buffer size of topology watch channels. Events
+// are dropped for slow watchers.
+const topologyWatchChSize = 1024
+
+func (r *registry) topology() Topology {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	var t Topology
+	for _, h := range r.Hives {
+		t.Hives = append(t.Hives, h)
+	}
+	sort.Sort(hiveInfos(t.Hives))
+
+	for _, b := range r.Bees {
+		bt := BeeTopology{
+			BeeInfo:    b,
+			Generation: r.Store.Colonies[b.Colony.ID],
+		}
+		if b.Colony.Leader == b.ID {
+			bt.Cells = r.Store.cells(b.ID)
+			sort.Sort(bt.Cells)
+		}
+		t.Bees = append(t.Bees, bt)
+	}
+	sort.Sort(beeTopologies(t.Bees))
+	return t
+}
+
+// watch returns a channel of topology events and a function that stops the
+// events and closes the channel.
+func (r *registry) watch() (<-chan TopologyEvent, func()) {
+	ch := make(chan TopologyEvent, topologyWatchChSize)
+	r.m.Lock()
+	r.watchers = append(r.watchers, ch)
+	r.m.Unlock()
+	return ch, func() { r.unwatch(ch) }
+}
+
+// unwatch removes the watcher ch and closes it. It is a no-op if ch is already
+// removed.
+func (r *registry) unwatch(ch chan TopologyEvent) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for i, w := range r.watchers {
+		if w == ch {
+			r.watchers = append(r.watchers[:i:i], r.watchers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// notify sends the event to the watchers. It must be called while r.m is
+// locked.
+func (r *registry) notify(e TopologyEvent) {
+	for _, ch := range r.watchers {
+		select {
+		case ch <- e:
+		default:
+			glog.Warningf("%v drops topology event %v for a slow watcher", r,
+				e.Type)
+		}
+	}
+}
+
+type hiveInfos []HiveInfo
+
+func (h hiveInfos) Len() int           { return len(h) }
+func (h hiveInfos) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hiveInfos) Less(i, j int) bool { return h[i].ID < h[j].ID }
+
+type beeTopologies []BeeTopology
+
+func (b beeTopologies) Len() int           { return len(b) }
+func (b beeTopologies) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b beeTopologies) Less(i, j int) bool { return b[i].ID < b[j].ID }
@@ -0,0 +1,95 @@
+package beehive
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTopology(t *testing.T) {
+	h := newHiveForTest()
+	ch := make(chan uint64)
+	a := h.NewApp("topology")
+	a.HandleFunc("", func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(string)}}
+	}, func(m Msg, c RcvContext) error {
+		ch <- c.ID()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	w, cancel := h.WatchTopology()
+	defer cancel()
+
+	n := 3
+	for i := 0; i < n; i++ {
+		h.Emit(fmt.Sprintf("k%d", i))
+	}
+	bees := make(map[uint64]bool)
+	for i := 0; i < n; i++ {
+		bees[<-ch] = true
+	}
+
+	added := 0
+	for added < n {
+		select {
+		case e := <-w:
+			if e.Type == BeeAdded && e.Bee.App == "topology" {
+				added++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing topology events: actual=%v want=%v", added, n)
+		}
+	}
+
+	topo := h.Topology()
+	if len(topo.Hives) != 1 || topo.Hives[0].ID != h.ID() {
+		t.Errorf("invalid hives: actual=%v want=[%v]", topo.Hives, h.ID())
+	}
+
+	reg := h.(*hive).registry
+	found := 0
+	for _, b := range topo.Bees {
+		if b.App != "topology" {
+			continue
+		}
+		found++
+		if !bees[b.ID] {
+			t.Errorf("unexpected bee %v in topology", b.ID)
+		}
+		for _, c := range b.Cells {
+			info, _, err := reg.beeForCells("topology", MappedCells{c})
+			if err != nil || info.ID != b.ID {
+				t.Errorf("invalid owner of %v: actual=%v want=%v", c, b.ID, info.ID)
+			}
+		}
+		if len(b.Cells) != 1 {
+			t.Errorf("invalid cells for bee %v: actual=%v want=1 cell", b.ID,
+				b.Cells)
+		}
+	}
+	if found != n {
+		t.Errorf("invalid number of bees: actual=%v want=%v", found, n)
+	}
+}
+
+func TestWatchTopologyCancel(t *testing.T) {
+	h := newHiveForTest()
+	reg := h.(*hive).registry
+
+	w, cancel := h.WatchTopology()
+	cancel()
+	cancel()
+	if _, ok := <-w; ok {
+		t.Error("the channel is not closed when the watch is canceled")
+	}
+	reg.m.RLock()
+	n := len(reg.watchers)
+	reg.m.RUnlock()
+	if n != 0 {
+		t.Errorf("invalid number of watchers: actual=%v want=0", n)
+	}
+}
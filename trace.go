@@ -0,0 +1,62 @@
+package beehive
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Span represents a phase (i.e., map or rcv) of handling a traced message.
+type Span struct {
+	TraceID  uint64        // The trace ID of the message.
+	Name     string        // Name of the phase: "map" or "rcv".
+	App      string        // The app handling the message.
+	Bee      uint64        // The bee handling the message, 0 for map.
+	MsgType  string        // Type of the message.
+	Start    time.Time     // When the phase started.
+	Duration time.Duration // How long the phase took.
+}
+
+// MsgTracer records the spans of traced messages. It can be used as an
+// adapter to export spans to a tracing system. Record is called concurrently
+// from different bees and must be thread-safe.
+type MsgTracer interface {
+	Record(s Span)
+}
+
+// Names of spans.
+const (
+	spanMap = "map"
+	spanRcv = "rcv"
+)
+
+// newTraceID returns a new trace ID if tracing is enabled on the hive.
+func (h *hive) newTraceID() uint64 {
+	if h.cfg().Tracer == nil {
+		return 0
+	}
+	for {
+		if id := uint64(rand.Int63()); id != 0 {
+			return id
+		}
+	}
+}
+
+// recordSpan records a span for m, if tracing is enabled and m is traced.
+func (h *hive) recordSpan(name string, app string, bee uint64, m *msg,
+	start time.Time) {
+
+	t := h.cfg().Tracer
+	if t == nil || m.MsgTrace == 0 {
+		return
+	}
+
+	t.Record(Span{
+		TraceID:  m.MsgTrace,
+		Name:     name,
+		App:      app,
+		Bee:      bee,
+		MsgType:  m.Type(),
+		Start:    start,
+		Duration: h.config.Clock.Now().Sub(start),
+	})
+}
@@ -0,0 +1,72 @@
+package beehive
+
+import (
+	"sync"
+	"testing"
+)
+
+type traceTestParent struct{}
+type traceTestChild struct{}
+
+type testTracer struct {
+	sync.Mutex
+	spans []Span
+}
+
+func (t *testTracer) Record(s Span) {
+	t.Lock()
+	t.spans = append(t.spans, s)
+	t.Unlock()
+}
+
+func (t *testTracer) hasSpan(trace uint64, name, msgType string) bool {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range t.spans {
+		if s.TraceID == trace && s.Name == name && s.MsgType == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTraceIDPropagation(t *testing.T) {
+	tr := &testTracer{}
+	h := newHiveForTest(Tracer(tr))
+	pch := make(chan uint64, 1)
+	cch := make(chan uint64, 1)
+
+	a := h.NewApp("trace")
+	a.HandleFunc(traceTestParent{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"P", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		pch <- m.TraceID()
+		c.Emit(traceTestChild{})
+		return nil
+	})
+	a.HandleFunc(traceTestChild{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"C", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		cch <- m.TraceID()
+		return nil
+	})
+
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(traceTestParent{})
+	parent := <-pch
+	child := <-cch
+	if parent == 0 {
+		t.Fatal("message emitted from the hive is not traced")
+	}
+	if child != parent {
+		t.Errorf("invalid trace ID of the child: actual=%v want=%v", child, parent)
+	}
+
+	pt := MsgType(traceTestParent{})
+	if !tr.hasSpan(parent, spanMap, pt) || !tr.hasSpan(parent, spanRcv, pt) {
+		t.Errorf("no span is recorded for the parent message")
+	}
+}
@@ -0,0 +1,72 @@
+package beehive
+
+import "github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+
+// txHooks are the commit hooks registered in a transaction.
+type txHooks struct {
+	pre  []func() error
+	post []func()
+}
+
+func (h *txHooks) empty() bool {
+	return len(h.pre) == 0 && len(h.post) == 0
+}
+
+func (h *txHooks) reset() {
+	h.pre = nil
+	h.post = nil
+}
+
+// runPre runs and removes the pre-commit hooks. It stops at the first hook
+// that returns an error.
+func (h *txHooks) runPre() error {
+	pre := h.pre
+	h.pre = nil
+	for _, f := range pre {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentHooks returns the hooks of the current transaction, which is the L2
+// transaction of the message when the bee handles a batch.
+func (b *bee) currentHooks() *txHooks {
+	if b.stateL2 != nil {
+		return &b.hooksL2
+	}
+	return &b.hooksL1
+}
+
+func (b *bee) OnPreCommit(f func() error) {
+	if !b.InTx() {
+		glog.Errorf("%v cannot add a pre-commit hook: no open transaction", b)
+		return
+	}
+	h := b.currentHooks()
+	h.pre = append(h.pre, f)
+}
+
+func (b *bee) OnPostCommit(f func()) {
+	if !b.InTx() {
+		glog.Errorf("%v cannot add a post-commit hook: no open transaction", b)
+		return
+	}
+	h := b.currentHooks()
+	h.post = append(h.post, f)
+}
+
+// runPostCommit runs the post-commit hooks, recovering from their panics.
+func (b *bee) runPostCommit(post []func()) {
+	for _, f := range post {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					glog.Errorf("%v recovers from a post-commit hook: %v", b, r)
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -0,0 +1,147 @@
+package beehive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type txHookTestMsg struct {
+	Op  string // commit, veto, fail, or read.
+	Key string
+}
+
+type txHookTestPost struct {
+	Key  string
+	InTx bool
+}
+
+func TestTxHooks(t *testing.T) {
+	post := make(chan txHookTestPost, 10)
+	read := make(chan []string)
+	h := newHiveForTest()
+	a := h.NewApp("txhooks", Transactional())
+	a.HandleFunc(txHookTestMsg{}, func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		tm := m.Data().(txHookTestMsg)
+		d := ctx.Dict("D")
+		if tm.Op == "read" {
+			var keys []string
+			for _, k := range []string{"commit", "veto", "fail"} {
+				if _, err := d.Get(k); err == nil {
+					keys = append(keys, k)
+				}
+			}
+			read <- keys
+			return nil
+		}
+
+		d.Put(tm.Key, tm.Key)
+		ctx.OnPostCommit(func() {
+			post <- txHookTestPost{Key: tm.Key, InTx: ctx.InTx()}
+		})
+		switch tm.Op {
+		case "veto":
+			ctx.OnPreCommit(func() error { return errors.New("vetoed") })
+		case "fail":
+			return errors.New("handler error")
+		}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// The messages are likely handled in the same batch, and each one in its
+	// own nested transaction.
+	h.EmitBatch([]interface{}{
+		txHookTestMsg{Op: "veto", Key: "veto"},
+		txHookTestMsg{Op: "commit", Key: "commit"},
+		txHookTestMsg{Op: "fail", Key: "fail"},
+	})
+	h.Emit(txHookTestMsg{Op: "read"})
+
+	keys := <-read
+	if len(keys) != 1 || keys[0] != "commit" {
+		t.Errorf("invalid keys: actual=%v want=[commit]", keys)
+	}
+
+	select {
+	case p := <-post:
+		if p.Key != "commit" {
+			t.Errorf("post-commit hook of an aborted tx: %v", p.Key)
+		}
+		if p.InTx {
+			t.Error("post-commit hook runs before the commit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("post-commit hook is not called")
+	}
+	select {
+	case p := <-post:
+		t.Errorf("post-commit hook of an aborted tx: %v", p.Key)
+	default:
+	}
+}
+
+func TestTxHooksVetoWithoutBatch(t *testing.T) {
+	post := make(chan string, 10)
+	h := newHiveForTest(BatchSize(1))
+	a := h.NewApp("txhooks", Transactional())
+	a.HandleFunc(txHookTestMsg{}, func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		tm := m.Data().(txHookTestMsg)
+		ctx.Dict("D").Put(tm.Key, tm.Key)
+		ctx.OnPostCommit(func() { post <- tm.Key })
+		if tm.Op == "veto" {
+			ctx.OnPreCommit(func() error { return errors.New("vetoed") })
+		}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(txHookTestMsg{Op: "veto", Key: "veto"})
+	h.Emit(txHookTestMsg{Op: "commit", Key: "commit"})
+	if k := <-post; k != "commit" {
+		t.Errorf("invalid post-commit hook: actual=%v want=commit", k)
+	}
+}
+
+func TestTxHooksFailedCommit(t *testing.T) {
+	post := make(chan struct{}, 1)
+	ch := make(chan error)
+	h := newHiveForTest()
+	a := h.NewApp("txhooks")
+	a.HandleFunc(txHookTestMsg{}, func(m Msg, ctx MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, ctx RcvContext) error {
+		b := ctx.(*bee)
+		b.BeginTx()
+		b.Dict("D").Put("k", "v")
+		b.OnPostCommit(func() { post <- struct{}{} })
+		// Close the transaction of the state behind the bee, so that committing
+		// the in-memory transaction fails.
+		b.stateL1.AbortTx()
+		ch <- b.CommitTx()
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	h.Emit(txHookTestMsg{Op: "commit", Key: "k"})
+	if err := <-ch; err != state.ErrNoTx {
+		t.Errorf("invalid commit error: actual=%v want=%v", err, state.ErrNoTx)
+	}
+	select {
+	case <-post:
+		t.Error("post-commit hook is called for a failed commit")
+	default:
+	}
+}
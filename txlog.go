@@ -0,0 +1,287 @@
+package beehive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/github.com/golang/glog"
+	bhgob "github.com/kandoo/beehive/gob"
+	"github.com/kandoo/beehive/state"
+)
+
+// TxRecord is a durably committed transaction of a bee.
+type TxRecord struct {
+	App        string        // The app of the bee.
+	Bee        uint64        // The bee that committed the transaction.
+	Colony     uint64        // The ID of the bee's colony.
+	Seq        uint64        // The sequence of the transaction in the colony.
+	Generation uint64        // The generation of the colony.
+	Keys       []CellKey     // The keys written in the transaction.
+	Msgs       []interface{} // The data of the messages emitted in the tx.
+	Cells      MappedCells   // The cells owned by the colony.
+	Ops        []TxOp        // The state operations of the transaction.
+	// MsgsErr is the error in encoding Msgs by the logger, if any. The record
+	// is then logged without the messages.
+	MsgsErr string `json:",omitempty"`
+}
+
+// TxOp is a state operation of a logged transaction.
+type TxOp struct {
+	Del   bool // Whether the key is deleted. Otherwise, Value is put.
+	Dict  string
+	Key   string
+	Value []byte // The value encoded using gob. Empty for deletes.
+	// Limit is the limit set on the dictionary, if the operation sets the
+	// maximum number of entries of the dictionary instead of a key.
+	Limit *state.Limit `json:",omitempty"`
+	// Err is the error in encoding the value, if any. The value is then empty,
+	// and the transaction cannot be replayed.
+	Err string `json:",omitempty"`
+}
+
+func newTxOp(op state.Op) (TxOp, error) {
+	o := TxOp{Dict: op.D, Key: op.K}
+	if op.T == state.SetLimit {
+		l := op.V.(state.Limit)
+		o.Limit = &l
+		return o, nil
+	}
+	if op.T == state.Del {
+		o.Del = true
+		return o, nil
+	}
+	v, err := bhgob.Encode(&op.V)
+	if err != nil {
+		o.Err = err.Error()
+		return o, err
+	}
+	o.Value = v
+	return o, nil
+}
+
+func (o TxOp) stateOp() (state.Op, error) {
+	op := state.Op{D: o.Dict, K: o.Key}
+	if o.Err != "" {
+		return op, fmt.Errorf("value is not logged: %v", o.Err)
+	}
+	if o.Limit != nil {
+		op.T = state.SetLimit
+		op.V = *o.Limit
+		return op, nil
+	}
+	if o.Del {
+		op.T = state.Del
+		return op, nil
+	}
+	op.T = state.Put
+	err := bhgob.Decode(&op.V, o.Value)
+	return op, err
+}
+
+// TxLogger records the transactions of persistent apps once they are durably
+// committed. Aborted transactions and the in-memory transactions of other
+// apps are not recorded. Log is called concurrently from different bees and
+// must be thread-safe.
+type TxLogger interface {
+	Log(r TxRecord)
+}
+
+// NewTxLogWriter returns a TxLogger that appends the records to w, one JSON
+// object per line. If the data of the messages of a record cannot be encoded
+// in JSON, the record is logged without them and its MsgsErr is set.
+func NewTxLogWriter(w io.Writer) TxLogger {
+	return &txLogWriter{enc: json.NewEncoder(w)}
+}
+
+type txLogWriter struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func (l *txLogWriter) Log(r TxRecord) {
+	l.Lock()
+	defer l.Unlock()
+	err := l.enc.Encode(r)
+	if err == nil {
+		return
+	}
+	if _, merr := json.Marshal(r.Msgs); merr != nil {
+		glog.Errorf("cannot encode the messages of transaction %v of %v: %v",
+			r.Seq, r.Bee, merr)
+		r.Msgs = nil
+		r.MsgsErr = merr.Error()
+		err = l.enc.Encode(r)
+	}
+	if err != nil {
+		glog.Errorf("cannot write transaction %v of %v: %v", r.Seq, r.Bee, err)
+	}
+}
+
+// logTx records the committed transaction in the transaction log of the hive.
+func (b *bee) logTx(commit commitTx) {
+	l := b.hive.cfg().TxLog
+	if l == nil {
+		return
+	}
+
+	b.Lock()
+	seq := b.txGen
+	b.Unlock()
+	r := TxRecord{
+		App:        b.app.Name(),
+		Bee:        b.ID(),
+		Colony:     b.colony().ID,
+		Seq:        seq,
+		Generation: commit.Term,
+		Keys:       make([]CellKey, 0, len(commit.Tx.Ops)),
+		Msgs:       make([]interface{}, 0, len(commit.Tx.Msgs)),
+		Cells:      b.mappedCells(),
+		Ops:        make([]TxOp, 0, len(commit.Tx.Ops)),
+	}
+	sort.Sort(r.Cells)
+	for _, op := range commit.Tx.Ops {
+		if op.T != state.SetLimit {
+			r.Keys = append(r.Keys, CellKey{Dict: op.D, Key: op.K})
+		}
+		o, err := newTxOp(op)
+		if err != nil {
+			glog.Errorf("%v cannot encode the value of %v in transaction %v: %v",
+				b, op.K, seq, err)
+		}
+		r.Ops = append(r.Ops, o)
+	}
+	for _, m := range commit.Tx.Msgs {
+		r.Msgs = append(r.Msgs, m.Data())
+	}
+	l.Log(r)
+}
+
+// replayedColony is the state of a colony reconstructed from a transaction log.
+type replayedColony struct {
+	seq   uint64
+	gen   uint64
+	cells map[CellKey]bool
+	state *state.Transactional
+	base  int // The index of the bee of the colony in the snapshot, or -1.
+}
+
+func (a *app) ReplayLog(r io.Reader) error {
+	if a.qee.isStarted() {
+		return ErrAppStarted
+	}
+
+	s := a.qee.snapshot
+	if s == nil {
+		s = &appSnapshot{Version: appSnapshotVersion, App: a.Name()}
+	}
+
+	var colonies []*replayedColony
+	byID := make(map[uint64]*replayedColony)
+	dec := json.NewDecoder(r)
+	for {
+		var rec TxRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if rec.App != a.Name() {
+			continue
+		}
+
+		c, ok := byID[rec.Colony]
+		switch {
+		case !ok:
+			var err error
+			if c, err = a.newReplayedColony(s, rec.Cells); err != nil {
+				return err
+			}
+			byID[rec.Colony] = c
+			colonies = append(colonies, c)
+		case rec.Seq != c.seq+1:
+			return fmt.Errorf("transaction %v of colony %v follows %v", rec.Seq,
+				rec.Colony, c.seq)
+		case rec.Generation < c.gen:
+			return fmt.Errorf("transaction %v of colony %v is of generation %v "+
+				"older than %v", rec.Seq, rec.Colony, rec.Generation, c.gen)
+		}
+
+		ops := make([]state.Op, 0, len(rec.Ops))
+		for _, o := range rec.Ops {
+			op, err := o.stateOp()
+			if err != nil {
+				return fmt.Errorf("cannot decode %v in transaction %v of colony %v: "+
+					"%v", o.Key, rec.Seq, rec.Colony, err)
+			}
+			ops = append(ops, op)
+		}
+		if err := c.state.Apply(ops); err != nil {
+			return err
+		}
+		for _, k := range rec.Cells {
+			c.cells[k] = true
+		}
+		c.seq = rec.Seq
+		c.gen = rec.Generation
+	}
+
+	for _, c := range colonies {
+		b, err := c.state.Save()
+		if err != nil {
+			return err
+		}
+		bs := beeSnapshot{State: b}
+		for k := range c.cells {
+			bs.Cells = append(bs.Cells, k)
+		}
+		sort.Sort(bs.Cells)
+		if c.base < 0 {
+			s.Bees = append(s.Bees, bs)
+		} else {
+			s.Bees[c.base] = bs
+		}
+	}
+	a.qee.snapshot = s
+	return nil
+}
+
+// newReplayedColony returns a colony that owns cells. If a bee in the
+// snapshot owns any of the cells, the colony starts from the state of that
+// bee.
+func (a *app) newReplayedColony(s *appSnapshot, cells MappedCells) (
+	*replayedColony, error) {
+
+	c := &replayedColony{
+		cells: make(map[CellKey]bool),
+		state: state.NewTransactional(a.newState()),
+		base:  -1,
+	}
+	for i, bs := range s.Bees {
+		if !cellsIntersect(bs.Cells, cells) {
+			continue
+		}
+		if err := c.state.Restore(bs.State); err != nil {
+			return nil, err
+		}
+		for _, k := range bs.Cells {
+			c.cells[k] = true
+		}
+		c.base = i
+		break
+	}
+	return c, nil
+}
+
+func cellsIntersect(a, b MappedCells) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
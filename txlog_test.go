@@ -0,0 +1,237 @@
+package beehive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kandoo/beehive/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/kandoo/beehive/state"
+)
+
+type testTxLogger chan TxRecord
+
+func (l testTxLogger) Log(r TxRecord) {
+	l <- r
+}
+
+type txLogTestMsg int
+
+func TestTxLog(t *testing.T) {
+	l := make(testTxLogger, 10)
+	h := newHiveForTest(TxLog(l))
+	a := h.NewApp("txlog", Persistent(1))
+	a.HandleFunc(txLogTestMsg(0), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", "0"}}
+	}, func(m Msg, c RcvContext) error {
+		n := m.Data().(txLogTestMsg)
+		c.Dict("D").Put(fmt.Sprintf("k%v", n), int(n))
+		c.Emit(fmt.Sprintf("m%v", n))
+		if n == 2 {
+			return errors.New("aborted")
+		}
+		return nil
+	})
+	go h.Start()
+	defer h.Stop()
+	waitTilStareted(h)
+
+	// Messages are emitted one by one, since the transactions of a batch are
+	// committed together.
+	var seq uint64
+	for n := 1; n <= 4; n++ {
+		h.Emit(txLogTestMsg(n))
+		if n == 2 {
+			continue
+		}
+
+		select {
+		case r := <-l:
+			if r.App != "txlog" || r.Seq <= seq {
+				t.Errorf("invalid record: %#v", r)
+			}
+			seq = r.Seq
+			k := CellKey{Dict: "D", Key: fmt.Sprintf("k%v", n)}
+			if len(r.Keys) != 1 || r.Keys[0] != k {
+				t.Errorf("invalid keys: actual=%v want=%v", r.Keys, k)
+			}
+			m := fmt.Sprintf("m%v", n)
+			if len(r.Msgs) != 1 || r.Msgs[0] != m {
+				t.Errorf("invalid messages: actual=%v want=%v", r.Msgs, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no record for transaction %v", n)
+		}
+	}
+	select {
+	case r := <-l:
+		t.Errorf("unexpected record: %#v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTxLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewTxLogWriter(&buf)
+	for i := uint64(1); i <= 2; i++ {
+		l.Log(TxRecord{App: "a", Seq: i, Keys: []CellKey{{"D", "k"}}})
+	}
+
+	dec := json.NewDecoder(&buf)
+	for i := uint64(1); i <= 2; i++ {
+		var r TxRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("cannot decode record %v: %v", i, err)
+		}
+		if r.App != "a" || r.Seq != i || len(r.Keys) != 1 {
+			t.Errorf("invalid record: %#v", r)
+		}
+	}
+}
+
+func TestTxLogWriterMsgsErr(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewTxLogWriter(&buf)
+	l.Log(TxRecord{App: "a", Seq: 1, Msgs: []interface{}{make(chan int)}})
+	l.Log(TxRecord{App: "a", Seq: 2, Msgs: []interface{}{"m"}})
+
+	dec := json.NewDecoder(&buf)
+	for i := uint64(1); i <= 2; i++ {
+		var r TxRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("cannot decode record %v: %v", i, err)
+		}
+		if r.Seq != i {
+			t.Errorf("invalid sequence: actual=%v want=%v", r.Seq, i)
+		}
+		if (r.MsgsErr != "") != (i == 1) || (len(r.Msgs) != 0) != (i == 2) {
+			t.Errorf("invalid messages of record %v: %#v", i, r)
+		}
+	}
+}
+
+type replayTestPut struct {
+	K string
+	V int // The key is deleted if V is negative.
+}
+
+type replayTestGet string
+
+func registerReplayApp(h Hive) App {
+	a := h.NewApp("replay", Persistent(1))
+	a.HandleFunc(replayTestPut{}, func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", m.Data().(replayTestPut).K}}
+	}, func(m Msg, c RcvContext) error {
+		p := m.Data().(replayTestPut)
+		if p.V < 0 {
+			return c.Dict("D").Del(p.K)
+		}
+		return c.Dict("D").Put(p.K, p.V)
+	})
+	a.HandleFunc(replayTestGet(""), func(m Msg, c MapContext) MappedCells {
+		return MappedCells{{"D", string(m.Data().(replayTestGet))}}
+	}, func(m Msg, c RcvContext) error {
+		v, err := c.Dict("D").Get(string(m.Data().(replayTestGet)))
+		if err != nil {
+			return err
+		}
+		return c.Reply(m, v)
+	})
+	return a
+}
+
+func TestReplayLog(t *testing.T) {
+	var buf bytes.Buffer
+	h1 := newHiveForTest(TxLog(NewTxLogWriter(&buf)))
+	registerReplayApp(h1)
+	go h1.Start()
+	waitTilStareted(h1)
+
+	ctx, cnl := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cnl()
+	puts := []replayTestPut{{"a", 1}, {"a", 2}, {"b", 3}, {"a", 4}, {"c", 5},
+		{"c", -1}}
+	for _, p := range puts {
+		if _, err := h1.Sync(ctx, p); err != nil {
+			t.Fatalf("cannot put %v: %v", p, err)
+		}
+	}
+	h1.Stop()
+
+	h2 := newHiveForTest()
+	a := registerReplayApp(h2)
+	if err := a.ReplayLog(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("cannot replay the log: %v", err)
+	}
+	go h2.Start()
+	defer h2.Stop()
+	waitTilStareted(h2)
+
+	for k, want := range map[string]int{"a": 4, "b": 3} {
+		v, err := h2.Sync(ctx, replayTestGet(k))
+		if err != nil {
+			t.Errorf("cannot get %v: %v", k, err)
+			continue
+		}
+		if v != want {
+			t.Errorf("invalid value for %v: actual=%v want=%v", k, v, want)
+		}
+	}
+	if _, err := h2.Sync(ctx, replayTestGet("c")); err == nil {
+		t.Error("deleted key is replayed")
+	}
+	if n := len(h2.(*hive).registry.bees()); n == 0 {
+		t.Error("no bee is created for the replayed state")
+	}
+}
+
+func TestReplayLogGap(t *testing.T) {
+	var recs []TxRecord
+	for i := uint64(1); i <= 3; i++ {
+		op, err := newTxOp(state.Op{T: state.Put, D: "D", K: "k", V: int(i)})
+		if err != nil {
+			t.Fatalf("cannot encode op: %v", err)
+		}
+		recs = append(recs, TxRecord{
+			App:        "replay",
+			Colony:     10,
+			Seq:        i,
+			Generation: 1,
+			Cells:      MappedCells{{"D", "k"}},
+			Ops:        []TxOp{op},
+		})
+	}
+
+	for _, test := range []struct {
+		recs []TxRecord
+		ok   bool
+	}{
+		{recs: recs, ok: true},
+		// The log can start from any transaction of a colony.
+		{recs: recs[1:], ok: true},
+		{recs: []TxRecord{recs[0], recs[2]}},
+		{recs: []TxRecord{recs[0], recs[1], {App: "replay", Colony: 10, Seq: 3}}},
+		// The value of an op that cannot be encoded is not replayed as empty.
+		{recs: []TxRecord{recs[0], {
+			App:        "replay",
+			Colony:     10,
+			Seq:        2,
+			Generation: 1,
+			Ops:        []TxOp{{Dict: "D", Key: "k", Err: "cannot encode"}},
+		}}},
+	} {
+		var buf bytes.Buffer
+		l := NewTxLogWriter(&buf)
+		for _, r := range test.recs {
+			l.Log(r)
+		}
+		h := newHiveForTest()
+		a := registerReplayApp(h)
+		if err := a.ReplayLog(&buf); (err == nil) != test.ok {
+			t.Errorf("invalid error for %v records: %v", len(test.recs), err)
+		}
+	}
+}
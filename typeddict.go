@@ -0,0 +1,90 @@
+//go:build go1.18
+// +build go1.18
+
+package beehive
+
+import (
+	"fmt"
+
+	"github.com/kandoo/beehive/state"
+)
+
+// TypeMismatchError is returned by TypedDict when a value in the dictionary
+// is not of the type of the TypedDict.
+type TypeMismatchError struct {
+	Dict   string
+	Key    string
+	Want   string // the type of the TypedDict.
+	Actual string // the type of the value.
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("value of %v/%v is of type %v not %v", e.Dict, e.Key,
+		e.Actual, e.Want)
+}
+
+// TypedDict is a view of a dictionary whose values are all of type T. Values
+// are asserted to T once, in TypedDict, and a value of another type results in
+// a TypeMismatchError instead of a panic in the handler.
+type TypedDict[T any] struct {
+	dict state.Dict
+}
+
+// NewTypedDict returns a typed view of d.
+func NewTypedDict[T any](d state.Dict) TypedDict[T] {
+	return TypedDict[T]{dict: d}
+}
+
+// Dict returns the underlying dictionary.
+func (d TypedDict[T]) Dict() state.Dict {
+	return d.dict
+}
+
+// Get returns the value of key. It returns state.ErrNoSuchKey if there is no
+// such key, and a TypeMismatchError if the value is not of type T.
+func (d TypedDict[T]) Get(key string) (T, error) {
+	var zero T
+	v, err := d.dict.Get(key)
+	if err != nil {
+		return zero, err
+	}
+	return d.assert(key, v)
+}
+
+// Put associates val with key.
+func (d TypedDict[T]) Put(key string, val T) error {
+	return d.dict.Put(key, val)
+}
+
+// Del deletes key from the dictionary.
+func (d TypedDict[T]) Del(key string) error {
+	return d.dict.Del(key)
+}
+
+// ForEach invokes f for each entry of the dictionary, until f returns false. It
+// stops and returns a TypeMismatchError at the first value that is not of type
+// T.
+func (d TypedDict[T]) ForEach(f func(k CellKey, v T) bool) error {
+	var err error
+	d.dict.ForEach(func(key string, val interface{}) bool {
+		var v T
+		if v, err = d.assert(key, val); err != nil {
+			return false
+		}
+		return f(CellKey{Dict: d.dict.Name(), Key: key}, v)
+	})
+	return err
+}
+
+func (d TypedDict[T]) assert(key string, val interface{}) (T, error) {
+	v, ok := val.(T)
+	if !ok {
+		return v, &TypeMismatchError{
+			Dict:   d.dict.Name(),
+			Key:    key,
+			Want:   fmt.Sprintf("%T", (*T)(nil))[1:],
+			Actual: fmt.Sprintf("%T", val),
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,59 @@
+//go:build go1.18
+// +build go1.18
+
+package beehive
+
+import (
+	"testing"
+
+	"github.com/kandoo/beehive/state"
+)
+
+type typedDictTestStats map[string]uint64
+
+func TestTypedDict(t *testing.T) {
+	d := state.NewInMem().Dict("stats")
+	td := NewTypedDict[typedDictTestStats](d)
+
+	if _, err := td.Get("s1"); err != state.ErrNoSuchKey {
+		t.Errorf("invalid error for a missing key: actual=%v want=%v", err,
+			state.ErrNoSuchKey)
+	}
+
+	td.Put("s1", typedDictTestStats{"f1": 1})
+	td.Put("s2", typedDictTestStats{"f2": 2})
+	s, err := td.Get("s1")
+	if err != nil {
+		t.Fatalf("cannot get s1: %v", err)
+	}
+	if s["f1"] != 1 {
+		t.Errorf("invalid value: actual=%v want=1", s["f1"])
+	}
+
+	sum := uint64(0)
+	if err := td.ForEach(func(k CellKey, s typedDictTestStats) bool {
+		if k.Dict != "stats" {
+			t.Errorf("invalid dict: actual=%v want=stats", k.Dict)
+		}
+		for _, v := range s {
+			sum += v
+		}
+		return true
+	}); err != nil {
+		t.Errorf("cannot iterate the dict: %v", err)
+	}
+	if sum != 3 {
+		t.Errorf("invalid sum: actual=%v want=3", sum)
+	}
+
+	d.Put("s3", "not stats")
+	_, err = td.Get("s3")
+	if _, ok := err.(*TypeMismatchError); !ok {
+		t.Errorf("invalid error for a mismatched type: %v", err)
+	}
+	if err := td.ForEach(func(k CellKey, s typedDictTestStats) bool {
+		return true
+	}); err == nil {
+		t.Error("no error when iterating over a mismatched type")
+	}
+}